@@ -0,0 +1,201 @@
+package main
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	sessionCookieName = "session"
+	sessionTTL        = 7 * 24 * time.Hour
+	maxSessions       = 1000
+)
+
+// sessions backs the optional password login: logging in hands out a
+// random session id kept here until it expires or the user logs out.
+// Sessions only live in memory, so a restart logs everyone out.
+type sessions struct {
+	mu       sync.Mutex
+	ttl      time.Duration
+	max      int
+	password [sha256.Size]byte
+	expires  map[string]time.Time
+}
+
+func newSessions(password string, ttl time.Duration, max int) *sessions {
+	return &sessions{
+		ttl:      ttl,
+		max:      max,
+		password: sha256.Sum256([]byte(password)),
+		expires:  make(map[string]time.Time),
+	}
+}
+
+// checkPassword compares in constant time, hashing first so the length of
+// the password doesn't show either.
+func (s *sessions) checkPassword(password string) bool {
+	sum := sha256.Sum256([]byte(password))
+	return subtle.ConstantTimeCompare(sum[:], s.password[:]) == 1
+}
+
+func (s *sessions) start(now time.Time) string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.evict(now)
+	if len(s.expires) >= s.max {
+		// make room by dropping the session closest to expiring
+		var oldest string
+		for id, exp := range s.expires {
+			if oldest == "" || exp.Before(s.expires[oldest]) {
+				oldest = id
+			}
+		}
+		delete(s.expires, oldest)
+	}
+	id := randomToken()
+	s.expires[id] = now.Add(s.ttl)
+	return id
+}
+
+func (s *sessions) valid(id string, now time.Time) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	exp, ok := s.expires[id]
+	return ok && now.Before(exp)
+}
+
+func (s *sessions) end(id string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.expires, id)
+}
+
+func (s *sessions) evict(now time.Time) {
+	for id, exp := range s.expires {
+		if !now.Before(exp) {
+			delete(s.expires, id)
+		}
+	}
+}
+
+// loggedIn reports whether r carries a live session. It is always false
+// when login is turned off.
+func (s *server) loggedIn(r *http.Request) bool {
+	if s.sessions == nil {
+		return false
+	}
+	c, err := r.Cookie(sessionCookieName)
+	return err == nil && s.sessions.valid(c.Value, s.clock.Now())
+}
+
+func (s *server) setSessionCookie(w http.ResponseWriter, value string, maxAge int) {
+	http.SetCookie(w, &http.Cookie{
+		Name:     sessionCookieName,
+		Value:    value,
+		Path:     s.url("/"),
+		Domain:   s.cookieDomain,
+		MaxAge:   maxAge,
+		SameSite: s.cookieSameSite,
+		HttpOnly: true,
+		Secure:   s.secureCookies,
+	})
+}
+
+// withLogin keeps the todos and the admin pages behind the login page when
+// a password is set.
+// Browsers are redirected to it, htmx requests get an HX-Redirect to it
+// and API clients a plain 401.
+func (s *server) withLogin(h http.Handler) http.Handler {
+	if s.sessions == nil {
+		return h
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		private := strings.HasPrefix(r.URL.Path, "/todos") || strings.HasPrefix(r.URL.Path, "/admin/")
+		if !private || s.loggedIn(r) {
+			h.ServeHTTP(w, r)
+			return
+		}
+		next := "/todos/"
+		if r.Method == "GET" && r.Header.Get("HX-Request") == "" {
+			next = r.URL.Path
+			if r.URL.RawQuery != "" {
+				next += "?" + r.URL.RawQuery
+			}
+		}
+		login := s.url("/login?" + url.Values{"next": {next}}.Encode())
+		switch negotiate(r) {
+		case formatHTML:
+			http.Redirect(w, r, login, 303)
+		case formatHTMLFragment:
+			w.Header().Set("HX-Redirect", login)
+			respondError(w, r, 401)
+		default:
+			respondError(w, r, 401)
+		}
+	})
+}
+
+type loginPage struct {
+	Request *http.Request
+	Next    string
+	Failed  bool
+}
+
+// safeNext keeps the page to go back to after logging in on this site.
+func safeNext(next string) string {
+	if !strings.HasPrefix(next, "/") || strings.HasPrefix(next, "//") || strings.HasPrefix(next, "/\\") {
+		return "/todos/"
+	}
+	return next
+}
+
+func (s *server) loginHandler(w http.ResponseWriter, r *http.Request) {
+	if s.sessions == nil {
+		respondError(w, r, 404)
+		return
+	}
+	if r.Method != "GET" && r.Method != "POST" {
+		respondError(w, r, 405)
+		return
+	}
+	if !parseForm(w, r) {
+		return
+	}
+	next := safeNext(r.FormValue("next"))
+	if r.Method == "GET" {
+		if s.loggedIn(r) {
+			http.Redirect(w, r, s.url(next), 303)
+			return
+		}
+		handlePage(s.templates, "login.html", w, loginPage{Request: r, Next: next})
+		return
+	}
+	if !s.sessions.checkPassword(r.PostFormValue("password")) {
+		logf(r.Context(), "failed login from %s", clientIP(r))
+		handlePageStatus(s.templates, "login.html", w, 401, loginPage{Request: r, Next: next, Failed: true})
+		return
+	}
+	s.setSessionCookie(w, s.sessions.start(s.clock.Now()), int(sessionTTL.Seconds()))
+	http.Redirect(w, r, s.url(next), 303)
+}
+
+func (s *server) logoutHandler(w http.ResponseWriter, r *http.Request) {
+	if s.sessions == nil {
+		respondError(w, r, 404)
+		return
+	}
+	if r.Method != "POST" {
+		respondError(w, r, 405)
+		return
+	}
+	if c, err := r.Cookie(sessionCookieName); err == nil {
+		s.sessions.end(c.Value)
+	}
+	s.setSessionCookie(w, "", -1)
+	http.Redirect(w, r, s.url("/login"), 303)
+}
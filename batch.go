@@ -0,0 +1,184 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"strings"
+	"time"
+)
+
+type batchOp struct {
+	Op         string  `json:"op"`
+	Id         uint64  `json:"id"`
+	Text       *string `json:"text"`
+	Done       *bool   `json:"done"`
+	Due        string  `json:"due"`
+	Recurrence *string `json:"recurrence"`
+}
+
+type batchError struct {
+	Code    string `json:"code"`
+	Message string `json:"message"`
+}
+
+type batchResult struct {
+	Ok    bool        `json:"ok"`
+	Todo  *todoDTO    `json:"todo,omitempty"`
+	Error *batchError `json:"error,omitempty"`
+}
+
+// todoBatchHandler applies a JSON array of create, update and delete
+// operations in order and reports a result for each one. By default a
+// failed operation doesn't stop the ones after it.
+//
+// With ?atomic=true every operation is checked before any is applied, and
+// nothing is applied if one of them would fail. The in-memory store has no
+// transactions, so this is a best effort: an operation that passes the
+// checks but still fails, e.g. because the list filled up in the meantime,
+// stops the batch and leaves the operations before it applied.
+func (s *server) todoBatchHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		respondError(w, r, 405)
+		return
+	}
+	var ops []batchOp
+	if err := json.NewDecoder(r.Body).Decode(&ops); err != nil {
+		logf(r.Context(), "decoding batch: %v", err)
+		respondError(w, r, 400)
+		return
+	}
+	atomic := r.URL.Query().Get("atomic") == "true"
+
+	results := make([]batchResult, len(ops))
+	if atomic {
+		failed := false
+		for i, op := range ops {
+			if err := s.checkBatchOp(r.Context(), op); err != nil {
+				results[i].Error = newBatchError(r, err)
+				failed = true
+			}
+		}
+		if failed {
+			markNotApplied(r, results, 0)
+			handleJSON(w, 422, results)
+			return
+		}
+	}
+
+	for i, op := range ops {
+		todo, err := s.applyBatchOp(r.Context(), op)
+		if err != nil {
+			logf(r.Context(), "applying batch op %d: %v", i, err)
+			results[i].Error = newBatchError(r, err)
+			if atomic {
+				markNotApplied(r, results, i+1)
+				break
+			}
+			continue
+		}
+		results[i] = batchResult{Ok: true, Todo: todoJSON(todo)}
+	}
+	handleJSON(w, 200, results)
+}
+
+func (s *server) applyBatchOp(ctx context.Context, op batchOp) (*todo, error) {
+	switch op.Op {
+	case "create":
+		t := todo{}
+		if op.Text != nil {
+			t.Text = *op.Text
+		}
+		if op.Due != "" {
+			due, err := parseDue(op.Due, timeLocation(ctx))
+			if err != nil {
+				return nil, err
+			}
+			t.DueAt = due
+		}
+		if op.Recurrence != nil {
+			recur, err := parseRecurrence(*op.Recurrence)
+			if err != nil {
+				return nil, err
+			}
+			t.Recurrence = recur
+		}
+		if err := s.todoService.createTodo(ctx, &t); err != nil {
+			return nil, err
+		}
+		return &t, nil
+	case "update":
+		update := todoUpdate{text: op.Text, done: op.Done}
+		if op.Recurrence != nil {
+			recur, err := parseRecurrence(*op.Recurrence)
+			if err != nil {
+				return nil, err
+			}
+			update.recurrence = &recur
+		}
+		return s.todoService.updateTodo(ctx, op.Id, update)
+	case "delete":
+		return nil, s.todoService.deleteTodo(ctx, op.Id)
+	default:
+		return nil, &validationError{key: "Unknown operation %q.", args: []interface{}{op.Op}}
+	}
+}
+
+// checkBatchOp reports whether op is likely to succeed without applying it.
+func (s *server) checkBatchOp(ctx context.Context, op batchOp) error {
+	switch op.Op {
+	case "create":
+		if op.Text == nil || strings.TrimSpace(*op.Text) == "" {
+			return &validationError{key: "Todo text is required."}
+		}
+		if op.Due != "" {
+			if _, err := parseDue(op.Due, timeLocation(ctx)); err != nil {
+				return err
+			}
+		}
+	case "update", "delete":
+		t, err := s.todoService.getTodoById(ctx, op.Id)
+		if err != nil {
+			return err
+		}
+		if t.Deleted {
+			return errTodoNotFound
+		}
+		if op.Text != nil && strings.TrimSpace(*op.Text) == "" {
+			return &validationError{key: "Todo text is required."}
+		}
+	default:
+		return &validationError{key: "Unknown operation %q.", args: []interface{}{op.Op}}
+	}
+	if op.Recurrence != nil {
+		if _, err := parseRecurrence(*op.Recurrence); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func parseDue(v string, loc *time.Location) (time.Time, error) {
+	due, err := time.ParseInLocation("2006-01-02", v, loc)
+	if err != nil {
+		return time.Time{}, &validationError{key: "Invalid due date %q.", args: []interface{}{v}}
+	}
+	return due, nil
+}
+
+func newBatchError(r *http.Request, err error) *batchError {
+	status, key, args := serviceErrorMessage(err)
+	return &batchError{Code: errorCodes[status], Message: printer(r).Sprintf(key, args...)}
+}
+
+// markNotApplied flags every result from start on that has no error yet.
+func markNotApplied(r *http.Request, results []batchResult, start int) {
+	for i := start; i < len(results); i++ {
+		if results[i].Error == nil && !results[i].Ok {
+			results[i].Error = &batchError{
+				Code:    "not_applied",
+				Message: printer(r).Sprintf("Not applied because another operation failed."),
+			}
+		}
+	}
+}
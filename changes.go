@@ -0,0 +1,136 @@
+package main
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// changeBroker fans out notifications of todo changes to live connections.
+// Subscribers get a signal rather than the change itself and re-render what
+// they show, so a slow subscriber just misses signals it would have merged
+// anyway.
+type changeBroker struct {
+	mu   sync.Mutex
+	subs map[chan struct{}]bool
+}
+
+func newChangeBroker() *changeBroker {
+	return &changeBroker{subs: make(map[chan struct{}]bool)}
+}
+
+func (b *changeBroker) subscribe() chan struct{} {
+	ch := make(chan struct{}, 1)
+	b.mu.Lock()
+	b.subs[ch] = true
+	b.mu.Unlock()
+	return ch
+}
+
+func (b *changeBroker) unsubscribe(ch chan struct{}) {
+	b.mu.Lock()
+	delete(b.subs, ch)
+	b.mu.Unlock()
+}
+
+func (b *changeBroker) publish() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for ch := range b.subs {
+		select {
+		case ch <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// notifyingTodoService publishes to a broker after every successful change
+// made through the wrapped service.
+type notifyingTodoService struct {
+	todoService
+	broker *changeBroker
+}
+
+func (s notifyingTodoService) notify(err error) error {
+	if err == nil {
+		s.broker.publish()
+	}
+	return err
+}
+
+func (s notifyingTodoService) createTodo(ctx context.Context, todo *todo) error {
+	return s.notify(s.todoService.createTodo(ctx, todo))
+}
+
+func (s notifyingTodoService) updateTodo(ctx context.Context, id uint64, update todoUpdate) (*todo, error) {
+	t, err := s.todoService.updateTodo(ctx, id, update)
+	return t, s.notify(err)
+}
+
+func (s notifyingTodoService) deleteTodo(ctx context.Context, id uint64) error {
+	return s.notify(s.todoService.deleteTodo(ctx, id))
+}
+
+func (s notifyingTodoService) deleteTodos(ctx context.Context, ids []uint64) error {
+	return s.notify(s.todoService.deleteTodos(ctx, ids))
+}
+
+func (s notifyingTodoService) setTodosDone(ctx context.Context, ids []uint64, done bool) error {
+	return s.notify(s.todoService.setTodosDone(ctx, ids, done))
+}
+
+func (s notifyingTodoService) restoreAll(ctx context.Context) (int, error) {
+	n, err := s.todoService.restoreAll(ctx)
+	if n > 0 {
+		err = s.notify(err)
+	}
+	return n, err
+}
+
+func (s notifyingTodoService) emptyTrash(ctx context.Context) (int, error) {
+	n, err := s.todoService.emptyTrash(ctx)
+	if n > 0 {
+		err = s.notify(err)
+	}
+	return n, err
+}
+
+func (s notifyingTodoService) snoozeTodo(ctx context.Context, id uint64, until time.Time) (*todo, error) {
+	t, err := s.todoService.snoozeTodo(ctx, id, until)
+	return t, s.notify(err)
+}
+
+func (s notifyingTodoService) restoreTodo(ctx context.Context, id uint64) (*todo, error) {
+	t, err := s.todoService.restoreTodo(ctx, id)
+	return t, s.notify(err)
+}
+
+func (s notifyingTodoService) moveTodo(ctx context.Context, id uint64, toTop bool) (*todo, error) {
+	t, err := s.todoService.moveTodo(ctx, id, toTop)
+	return t, s.notify(err)
+}
+
+func (s notifyingTodoService) putTodo(ctx context.Context, id uint64, update todoUpdate) (*todo, bool, error) {
+	t, created, err := s.todoService.putTodo(ctx, id, update)
+	return t, created, s.notify(err)
+}
+
+func (s notifyingTodoService) expireTodos(ctx context.Context) (int, error) {
+	n, err := s.todoService.expireTodos(ctx)
+	if n > 0 {
+		err = s.notify(err)
+	}
+	return n, err
+}
+
+func (s notifyingTodoService) purgeTodo(ctx context.Context, id uint64) error {
+	return s.notify(s.todoService.purgeTodo(ctx, id))
+}
+
+func (s notifyingTodoService) purgeExpired(ctx context.Context, before time.Time) (int, error) {
+	n, err := s.todoService.purgeExpired(ctx, before)
+	if n > 0 {
+		err = s.notify(err)
+	}
+	return n, err
+}
@@ -0,0 +1,54 @@
+package main
+
+import (
+	"net/http"
+	"unicode/utf8"
+)
+
+// charCountWarnAt is the fraction of the maximum length from which the
+// character counter turns red.
+const charCountWarnAt = 0.9
+
+// todoTextLength is the length of a todo's text as its limit counts it, in
+// characters rather than bytes.
+func todoTextLength(text string) int {
+	return utf8.RuneCountInString(text)
+}
+
+type charCount struct {
+	Request *http.Request
+	Count   int
+	// Max is 0 when there is no limit
+	Max int
+	// Warn is set near the limit, Over past it
+	Warn bool
+	Over bool
+}
+
+// todoCharCountHandler renders the character counter of the new-todo input
+// for the text it is given, counted the way creating the todo would.
+func (s *server) todoCharCountHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		respondError(w, r, 405)
+		return
+	}
+	text := r.FormValue("text")
+	if _, ok := r.Form["text"]; !ok {
+		// the input sends its own value under its name
+		text = r.FormValue("new-todo")
+	}
+	data := charCount{
+		Request: r,
+		Count:   todoTextLength(normalizeTodoText(text, s.collapseWhitespace)),
+		Max:     s.maxTodoLength,
+	}
+	if data.Max > 0 {
+		data.Over = data.Count > data.Max
+		data.Warn = float64(data.Count) >= charCountWarnAt*float64(data.Max)
+	}
+	if negotiate(r) == formatJSON {
+		handleJSON(w, 200, map[string]interface{}{"count": data.Count, "max": data.Max, "over": data.Over})
+		return
+	}
+	handlePage(s.templates, "char-count.html", w, data)
+}
@@ -0,0 +1,69 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"golang.org/x/sync/singleflight"
+)
+
+// coalescingTodoService shares one countTodos call between the concurrent
+// requests for the same count, such as many tabs polling the same list.
+// The shared call keeps the values of the request that started it but not
+// its cancellation, so that request going away doesn't fail the others;
+// each request still stops waiting when its own context is done.
+type coalescingTodoService struct {
+	todoService
+	counts *singleflight.Group
+}
+
+func newCoalescingTodoService(svc todoService) coalescingTodoService {
+	return coalescingTodoService{svc, new(singleflight.Group)}
+}
+
+func (s coalescingTodoService) countTodos(ctx context.Context, filter todoFilter) (int, error) {
+	filter = filter.forOwner(ctx)
+	ch := s.counts.DoChan(filter.key(), func() (interface{}, error) {
+		return s.todoService.countTodos(detachedContext{ctx}, filter)
+	})
+	select {
+	case <-ctx.Done():
+		return 0, ctx.Err()
+	case res := <-ch:
+		if res.Err != nil {
+			return 0, res.Err
+		}
+		return res.Val.(int), nil
+	}
+}
+
+// key is a canonical string for the filter, equal for filters that select
+// the same todos.
+func (filter todoFilter) key() string {
+	var b strings.Builder
+	if filter.done != nil {
+		fmt.Fprintf(&b, "done=%t;", *filter.done)
+	}
+	for _, t := range []struct {
+		name string
+		t    *time.Time
+	}{
+		{"doneAfter", filter.doneAfter},
+		{"doneBefore", filter.doneBefore},
+		{"modifiedSince", filter.modifiedSince},
+	} {
+		if t.t != nil {
+			fmt.Fprintf(&b, "%s=%d;", t.name, t.t.UnixNano())
+		}
+	}
+	fmt.Fprintf(&b, "snoozed=%t;overdue=%t;pinned=%t;deleted=%t;",
+		filter.includeSnoozed, filter.overdue, filter.pinnedOnly, filter.deletedOnly)
+	// the excluded ids come from a map, in no particular order
+	exclude := append([]uint64(nil), filter.excludeIds...)
+	sort.Slice(exclude, func(i, j int) bool { return exclude[i] < exclude[j] })
+	fmt.Fprintf(&b, "exclude=%v;owner=%q;allOwners=%t;query=%q;lang=%s", exclude, filter.owner, filter.allOwners, filter.query, filter.lang)
+	return b.String()
+}
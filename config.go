@@ -0,0 +1,304 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Config holds every server option. Options come from the defaults, then
+// an optional JSON file given with -config, then flags set on the command
+// line.
+type Config struct {
+	Host             string `json:"host"`
+	Port             int    `json:"port"`
+	Socket           string `json:"socket"`
+	TLSCert          string `json:"tls_cert"`
+	TLSKey           string `json:"tls_key"`
+	HTTPRedirectPort int    `json:"http_redirect_port"`
+	CSRFAuthKey      string `json:"csrf"`
+	Templates        string `json:"templates"`
+	Skin             string `json:"skin"`
+	Timezone         string `json:"timezone"`
+	LogLevel         string `json:"log_level"`
+	BasePath         string `json:"base_path"`
+	AppName          string `json:"app_name"`
+	Favicon          string `json:"favicon"`
+	RobotsTxt        string `json:"robots_txt"`
+	NoIndex          bool   `json:"noindex"`
+	TrustedProxies   string `json:"trusted_proxies"`
+	OwnerHeader      string `json:"owner_header"`
+	CORSOrigins      string `json:"cors_origins"`
+	WebhookURL       string `json:"webhook_url"`
+	AuthPassword     string `json:"auth_password"`
+
+	Store     string `json:"store"`
+	StorePath string `json:"store_path"`
+	SeedCount int    `json:"seed_count"`
+
+	MaxTodoLength      int  `json:"max_todo_length"`
+	CollapseWhitespace bool `json:"collapse_whitespace"`
+	MaxTodos           int  `json:"max_todos"`
+	EvictDone          bool `json:"evict_done"`
+	ParseDueDates      bool `json:"parse_due_dates"`
+	UpdateSlugs        bool `json:"update_slugs"`
+
+	ReadOnly          bool     `json:"read_only"`
+	Maintenance       string   `json:"maintenance"`
+	Metrics           bool     `json:"metrics"`
+	DebugBodies       bool     `json:"debug_bodies"`
+	PprofAddr         string   `json:"pprof_addr"`
+	WebSocket         bool     `json:"websocket"`
+	ConfirmDeletes    bool     `json:"confirm_deletes"`
+	UndoWindow        duration `json:"undo_window"`
+	DefaultFilter     string   `json:"default_filter"`
+	DoneDisplay       string   `json:"done_display"`
+	ReminderWindow    duration `json:"reminder_window"`
+	TrashRetention    duration `json:"trash_retention"`
+	TrashPurgeEvery   duration `json:"trash_purge_interval"`
+	TodoTTL           duration `json:"todo_ttl"`
+	TodoTTLKeepDone   bool     `json:"todo_ttl_keep_done"`
+	MaxBodyBytes      int64    `json:"max_body_bytes"`
+	IndexCacheControl string   `json:"index_cache_control"`
+	CacheControl      string   `json:"cache_control"`
+
+	RequestTimeout    duration `json:"request_timeout"`
+	ReadHeaderTimeout duration `json:"read_header_timeout"`
+	ReadTimeout       duration `json:"read_timeout"`
+	// the write timeout is longer than the default request timeout so a
+	// handler whose context expired can still send its error response
+	WriteTimeout duration `json:"write_timeout"`
+	IdleTimeout  duration `json:"idle_timeout"`
+
+	CookieDomain   string   `json:"cookie_domain"`
+	CookieMaxAge   duration `json:"cookie_max_age"`
+	CookieSameSite string   `json:"cookie_same_site"`
+}
+
+// duration reads a time.Duration from a JSON string such as "30s".
+type duration struct {
+	time.Duration
+}
+
+func (d *duration) UnmarshalJSON(b []byte) error {
+	var s string
+	if err := json.Unmarshal(b, &s); err != nil {
+		return fmt.Errorf("duration must be a string like \"30s\": %w", err)
+	}
+	v, err := time.ParseDuration(s)
+	if err != nil {
+		return err
+	}
+	d.Duration = v
+	return nil
+}
+
+func (d duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(d.String())
+}
+
+func defaultConfig() Config {
+	return Config{
+		Host:              "0.0.0.0",
+		Port:              8080,
+		BasePath:          "/",
+		AppName:           defaultAppName,
+		Skin:              defaultSkin,
+		LogLevel:          "info",
+		Store:             "memory",
+		StorePath:         "todos.json",
+		MaxTodoLength:     1000,
+		DefaultFilter:     "all",
+		DoneDisplay:       doneStrike,
+		ReminderWindow:    duration{24 * time.Hour},
+		TrashRetention:    duration{30 * 24 * time.Hour},
+		TrashPurgeEvery:   duration{time.Hour},
+		MaxBodyBytes:      1 << 20,
+		IndexCacheControl: "private, max-age=300",
+		CacheControl:      "no-store",
+		RequestTimeout:    duration{30 * time.Second},
+		ReadHeaderTimeout: duration{5 * time.Second},
+		ReadTimeout:       duration{15 * time.Second},
+		WriteTimeout:      duration{45 * time.Second},
+		IdleTimeout:       duration{2 * time.Minute},
+		CookieMaxAge:      duration{365 * 24 * time.Hour},
+		CookieSameSite:    "lax",
+	}
+}
+
+func (c *Config) registerFlags(fs *flag.FlagSet) {
+	fs.StringVar(&c.Host, "host", c.Host, "hostname or IP address")
+	fs.IntVar(&c.Port, "port", c.Port, "port")
+	fs.StringVar(&c.Socket, "socket", c.Socket, "listen on this Unix domain socket instead of host and port")
+	fs.StringVar(&c.TLSCert, "tls-cert", c.TLSCert, "TLS certificate file, serve HTTPS when set with -tls-key")
+	fs.StringVar(&c.TLSKey, "tls-key", c.TLSKey, "TLS private key file")
+	fs.IntVar(&c.HTTPRedirectPort, "http-redirect-port", c.HTTPRedirectPort, "with TLS, also listen for plain HTTP on this port and redirect to HTTPS (0 to disable)")
+	fs.StringVar(&c.CSRFAuthKey, "csrf", c.CSRFAuthKey, "CSRF auth key (32 bytes)")
+	fs.StringVar(&c.Templates, "templates", c.Templates, "directory to load templates from instead of the embedded ones")
+	fs.StringVar(&c.Skin, "skin", c.Skin, "layout to present, from the skins directory of the templates (\"default\" for the templates themselves)")
+	fs.StringVar(&c.LogLevel, "log-level", c.LogLevel, "least important log lines to write: debug, info, warn or error")
+	fs.StringVar(&c.Timezone, "timezone", c.Timezone, "IANA time zone, such as Europe/Paris, that days start in unless users choose theirs (default the server's)")
+	fs.StringVar(&c.BasePath, "base-path", c.BasePath, "URL path prefix the app is served under")
+	fs.StringVar(&c.AppName, "app-name", c.AppName, "name shown in the page titles and header")
+	fs.StringVar(&c.Favicon, "favicon", c.Favicon, "icon file to serve at /favicon.ico instead of the built-in one")
+	fs.StringVar(&c.RobotsTxt, "robots-txt", c.RobotsTxt, "file to serve at /robots.txt instead of the built-in one that disallows everything")
+	fs.BoolVar(&c.NoIndex, "noindex", c.NoIndex, "send X-Robots-Tag: noindex with every response to keep search engines from indexing the site")
+	fs.StringVar(&c.TrustedProxies, "trusted-proxies", c.TrustedProxies, "comma separated CIDR ranges of reverse proxies whose X-Forwarded-For and X-Real-IP headers are believed")
+	fs.StringVar(&c.CORSOrigins, "cors-origins", c.CORSOrigins, "comma separated origins, such as https://app.example.com, whose scripts may call the JSON API")
+	fs.StringVar(&c.OwnerHeader, "owner-header", c.OwnerHeader, "request header, such as X-Remote-User, naming the user a trusted proxy authenticated, whose todos are then kept apart from others'")
+	fs.StringVar(&c.WebhookURL, "webhook-url", c.WebhookURL, "URL to POST a JSON event to whenever a todo is created or completed")
+	fs.StringVar(&c.AuthPassword, "auth-password", c.AuthPassword, "require logging in with this password to see the todos (better set in the config file than on the command line)")
+	fs.StringVar(&c.Store, "store", c.Store, "where to keep the todos: memory, or file to also save them to -store-path")
+	fs.StringVar(&c.StorePath, "store-path", c.StorePath, "JSON file the todos are saved to with -store=file")
+	fs.IntVar(&c.SeedCount, "seed-count", c.SeedCount, "start an empty store with this many made up todos instead of the three examples, for load testing")
+	fs.IntVar(&c.MaxTodoLength, "max-todo-length", c.MaxTodoLength, "maximum length of a todo's text in characters (0 for no limit)")
+	fs.BoolVar(&c.CollapseWhitespace, "collapse-whitespace", c.CollapseWhitespace, "collapse runs of whitespace in todo text into a single space")
+	fs.IntVar(&c.MaxTodos, "max-todos", c.MaxTodos, "maximum number of todos each owner may have (0 for no limit)")
+	fs.BoolVar(&c.EvictDone, "evict-done", c.EvictDone, "when an owner's todo list is full, delete their oldest done todo instead of rejecting new ones")
+	fs.BoolVar(&c.ParseDueDates, "parse-due-dates", c.ParseDueDates, "take due dates like \"tomorrow\" or \"friday\" from the end of new todos' text")
+	fs.BoolVar(&c.UpdateSlugs, "update-slugs", c.UpdateSlugs, "change a todo's permalink slug when its text is edited, old links redirect to the new one")
+	fs.BoolVar(&c.ReadOnly, "read-only", c.ReadOnly, "serve the todo list without allowing changes")
+	fs.StringVar(&c.Maintenance, "maintenance", c.Maintenance, "start in maintenance mode, answering 503 to changes (writes) or to everything (all); logged in users can switch it with POST /maintenance")
+	fs.BoolVar(&c.Metrics, "metrics", c.Metrics, "expose request and todo metrics at /metrics")
+	fs.BoolVar(&c.DebugBodies, "debug-bodies", c.DebugBodies, "log the start of request bodies, with passwords and tokens redacted, and the size of responses")
+	fs.StringVar(&c.PprofAddr, "pprof", c.PprofAddr, "serve profiles at /debug/pprof/ on this address, such as localhost:6060 (only expose it to trusted networks)")
+	fs.BoolVar(&c.WebSocket, "websocket", c.WebSocket, "push live todo list updates over a websocket at /todos/ws")
+	fs.BoolVar(&c.ConfirmDeletes, "confirm-deletes", c.ConfirmDeletes, "require a confirmation round trip with a short-lived token before deleting a todo")
+	fs.DurationVar(&c.UndoWindow.Duration, "undo-window", c.UndoWindow.Duration, "how long a todo deleted from the list can be brought back before it goes to the trash, such as 5s (0 to delete right away)")
+	fs.StringVar(&c.DefaultFilter, "default-filter", c.DefaultFilter, "filter applied to the todo list when none is chosen: all, notdone, done, donetoday or deleted")
+	fs.StringVar(&c.DoneDisplay, "done-display", c.DoneDisplay, "how done todos show in the todo list unless users choose: strike to strike them through, or hide to leave them to the Done filter")
+	fs.DurationVar(&c.ReminderWindow.Duration, "reminder-window", c.ReminderWindow.Duration, "how far ahead /todos/reminders looks for due todos")
+	fs.DurationVar(&c.TrashRetention.Duration, "trash-retention", c.TrashRetention.Duration, "how long deleted todos stay in the trash before they are removed for good (0 to keep them forever)")
+	fs.DurationVar(&c.TrashPurgeEvery.Duration, "trash-purge-interval", c.TrashPurgeEvery.Duration, "how often to look for todos past the trash retention")
+	fs.DurationVar(&c.TodoTTL.Duration, "todo-ttl", c.TodoTTL.Duration, "how long todos live before they expire: they drop out of the list and go to the trash, such as 24h (0 to keep them)")
+	fs.BoolVar(&c.TodoTTLKeepDone, "todo-ttl-keep-done", c.TodoTTLKeepDone, "don't expire done todos")
+	fs.Int64Var(&c.MaxBodyBytes, "max-body-bytes", c.MaxBodyBytes, "maximum size of a request body in bytes (0 for no limit)")
+	fs.StringVar(&c.IndexCacheControl, "index-cache-control", c.IndexCacheControl, "Cache-Control header for the index page")
+	fs.StringVar(&c.CacheControl, "cache-control", c.CacheControl, "Cache-Control header for all other responses")
+	fs.DurationVar(&c.RequestTimeout.Duration, "request-timeout", c.RequestTimeout.Duration, "maximum time to spend handling a request (0 to disable)")
+	fs.DurationVar(&c.ReadHeaderTimeout.Duration, "read-header-timeout", c.ReadHeaderTimeout.Duration, "maximum time to read request headers")
+	fs.DurationVar(&c.ReadTimeout.Duration, "read-timeout", c.ReadTimeout.Duration, "maximum time to read a whole request, including the body")
+	fs.DurationVar(&c.WriteTimeout.Duration, "write-timeout", c.WriteTimeout.Duration, "maximum time from the end of the request headers to the end of the response")
+	fs.DurationVar(&c.IdleTimeout.Duration, "idle-timeout", c.IdleTimeout.Duration, "maximum time to keep an idle keep-alive connection open")
+	fs.StringVar(&c.CookieDomain, "cookie-domain", c.CookieDomain, "domain for the preference cookies, to share them across subdomains")
+	fs.DurationVar(&c.CookieMaxAge.Duration, "cookie-max-age", c.CookieMaxAge.Duration, "how long the browser keeps the preference cookies (0 for session cookies)")
+	fs.StringVar(&c.CookieSameSite, "cookie-same-site", c.CookieSameSite, "SameSite policy for the preference cookies: lax, strict or none")
+}
+
+// loadConfig reads a JSON config file over the defaults. Unknown keys are
+// an error so typos don't go unnoticed.
+func loadConfig(r io.Reader) (Config, error) {
+	c := defaultConfig()
+	dec := json.NewDecoder(r)
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&c); err != nil {
+		return Config{}, fmt.Errorf("decoding config: %w", err)
+	}
+	return c, nil
+}
+
+// parseConfig resolves the config from the command line arguments, letting
+// flags that were set explicitly win over the config file.
+func parseConfig(name string, args []string) (Config, error) {
+	c := defaultConfig()
+	fs := flag.NewFlagSet(name, flag.ExitOnError)
+	configPath := fs.String("config", "", "JSON file to read options from, flags given on the command line take precedence")
+	c.registerFlags(fs)
+	if err := fs.Parse(args); err != nil {
+		return Config{}, err
+	}
+
+	if *configPath != "" {
+		b, err := os.ReadFile(*configPath)
+		if err != nil {
+			return Config{}, fmt.Errorf("reading config: %w", err)
+		}
+		fileConfig, err := loadConfig(bytes.NewReader(b))
+		if err != nil {
+			return Config{}, fmt.Errorf("%s: %w", *configPath, err)
+		}
+		overrides := flag.NewFlagSet(name, flag.ContinueOnError)
+		fileConfig.registerFlags(overrides)
+		var setErr error
+		fs.Visit(func(f *flag.Flag) {
+			if f.Name == "config" || setErr != nil {
+				return
+			}
+			setErr = overrides.Set(f.Name, f.Value.String())
+		})
+		if setErr != nil {
+			return Config{}, setErr
+		}
+		c = fileConfig
+	}
+
+	if c.CSRFAuthKey == "" {
+		c.CSRFAuthKey = os.Getenv("CSRF_AUTH_KEY")
+	}
+	return c, c.validate()
+}
+
+func (c Config) validate() error {
+	var errs []string
+	check := func(ok bool, format string, a ...interface{}) {
+		if !ok {
+			errs = append(errs, fmt.Sprintf(format, a...))
+		}
+	}
+	check(len(c.CSRFAuthKey) == 32, "CSRF auth key (32 bytes) required, please provide -csrf option or set CSRF_AUTH_KEY env var")
+	check(c.Socket != "" || (c.Port > 0 && c.Port < 65536), "port %d out of range", c.Port)
+	check(c.HTTPRedirectPort >= 0 && c.HTTPRedirectPort < 65536, "http redirect port %d out of range", c.HTTPRedirectPort)
+	check((c.TLSCert == "") == (c.TLSKey == ""), "tls cert and key must be given together")
+	check(c.MaxTodoLength >= 0, "max todo length must not be negative")
+	check(c.MaxTodos >= 0, "max todos must not be negative")
+	check(c.SeedCount >= 0, "seed count must not be negative")
+	check(c.MaxBodyBytes >= 0, "max body bytes must not be negative")
+	check(c.TrashRetention.Duration == 0 || c.TrashPurgeEvery.Duration > 0, "trash purge interval must be positive")
+	check(isStateFilter(c.DefaultFilter), "unknown default filter %q", c.DefaultFilter)
+	check(isDoneDisplay(c.DoneDisplay), "unknown done display %q", c.DoneDisplay)
+	check(isSkinName(c.Skin), "invalid skin name %q", c.Skin)
+	_, ok := parseLogLevel(c.LogLevel)
+	check(ok, "unknown log level %q", c.LogLevel)
+	_, err := loadLocation(c.Timezone)
+	check(err == nil, "timezone: %v", err)
+	check(c.Store == "memory" || c.Store == "file", "unknown store %q", c.Store)
+	check(c.Store != "file" || c.StorePath != "", "file store needs a store path")
+	_, err = parseCIDRs(c.TrustedProxies)
+	check(err == nil, "trusted proxies: %v", err)
+	check(c.OwnerHeader == "" || c.TrustedProxies != "", "owner header needs trusted proxies to come from")
+	_, err = parseOrigins(c.CORSOrigins)
+	check(err == nil, "cors origins: %v", err)
+	check(c.WebhookURL == "" || isWebhookURL(c.WebhookURL), "invalid webhook url %q", c.WebhookURL)
+	sameSite, ok := parseSameSite(c.CookieSameSite)
+	check(ok, "unknown cookie SameSite policy %q", c.CookieSameSite)
+	check(sameSite != http.SameSiteNoneMode || c.TLSCert != "", "cookie SameSite policy none needs TLS")
+	_, ok = parseMaintenanceMode(c.Maintenance)
+	check(ok, "unknown maintenance mode %q", c.Maintenance)
+	for name, d := range map[string]duration{
+		"reminder window":     c.ReminderWindow,
+		"trash retention":     c.TrashRetention,
+		"todo ttl":            c.TodoTTL,
+		"undo window":         c.UndoWindow,
+		"request timeout":     c.RequestTimeout,
+		"read header timeout": c.ReadHeaderTimeout,
+		"read timeout":        c.ReadTimeout,
+		"write timeout":       c.WriteTimeout,
+		"idle timeout":        c.IdleTimeout,
+		"cookie max age":      c.CookieMaxAge,
+	} {
+		check(d.Duration >= 0, "%s must not be negative", name)
+	}
+	if len(errs) > 0 {
+		sort.Strings(errs)
+		return errors.New("invalid config: " + strings.Join(errs, "; "))
+	}
+	return nil
+}
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"sync"
+	"time"
+)
+
+const (
+	deleteTokenTTL  = 2 * time.Minute
+	maxDeleteTokens = 1000
+)
+
+type deleteToken struct {
+	todoId  uint64
+	expires time.Time
+}
+
+// deleteTokens backs the optional two-step delete: a DELETE without a
+// valid token only gets a confirmation, and the token it hands out allows
+// one delete of that todo before it expires. Past max live tokens the one
+// closest to expiring goes first.
+type deleteTokens struct {
+	mu     sync.Mutex
+	ttl    time.Duration
+	max    int
+	tokens map[string]deleteToken
+}
+
+func newDeleteTokens(ttl time.Duration, max int) *deleteTokens {
+	return &deleteTokens{ttl: ttl, max: max, tokens: make(map[string]deleteToken)}
+}
+
+func (d *deleteTokens) issue(id uint64, now time.Time) string {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.evict(now)
+	if len(d.tokens) >= d.max {
+		d.evictOldest()
+	}
+	token := randomToken()
+	d.tokens[token] = deleteToken{todoId: id, expires: now.Add(d.ttl)}
+	return token
+}
+
+// consume reports whether token is a live token for id, using it up.
+func (d *deleteTokens) consume(token string, id uint64, now time.Time) bool {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.evict(now)
+	t, ok := d.tokens[token]
+	if !ok || t.todoId != id {
+		return false
+	}
+	delete(d.tokens, token)
+	return true
+}
+
+func (d *deleteTokens) evict(now time.Time) {
+	for token, t := range d.tokens {
+		if !now.Before(t.expires) {
+			delete(d.tokens, token)
+		}
+	}
+}
+
+func (d *deleteTokens) evictOldest() {
+	var oldest string
+	var oldestExpires time.Time
+	for token, t := range d.tokens {
+		if oldest == "" || t.expires.Before(oldestExpires) {
+			oldest, oldestExpires = token, t.expires
+		}
+	}
+	delete(d.tokens, oldest)
+}
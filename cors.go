@@ -0,0 +1,86 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/gorilla/csrf"
+)
+
+const (
+	corsAllowMethods = "GET, POST, PUT, PATCH, DELETE"
+	corsAllowHeaders = "Accept, Content-Type, Idempotency-Key"
+	corsMaxAge       = "600"
+)
+
+// withCORS lets scripts on the allowed origins call the JSON API, which
+// answers under /todos/ next to the pages, and fetch the calendar feed.
+// The pages and htmx fragments get no CORS headers, so browsers keep them,
+// and the CSRF token in them, from the script, as they do the responses to
+// any other origin. Preflights carry no Accept header to tell the two
+// apart, but they grant nothing by themselves.
+//
+// Scripts on the allowed origins can't read the CSRF token, so their API
+// calls skip the check instead. Browsers set Origin themselves, so a page
+// elsewhere can't pass for one of them, and a client that can doesn't hold
+// the user's cookies. withCORS must wrap the CSRF middleware for that.
+// Since the API relies on cookies, the origin is echoed back rather than
+// answered with "*", which browsers don't accept along with credentials.
+func withCORS(h http.Handler, origins []string) http.Handler {
+	if len(origins) == 0 {
+		return h
+	}
+	allowed := make(map[string]bool, len(origins))
+	for _, o := range origins {
+		allowed[o] = true
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !strings.HasPrefix(r.URL.Path, "/todos/") && r.URL.Path != "/todos.ics" {
+			h.ServeHTTP(w, r)
+			return
+		}
+		w.Header().Add("Vary", "Origin")
+		w.Header().Add("Vary", "Accept")
+		origin := r.Header.Get("Origin")
+		if origin == "" || !allowed[origin] {
+			h.ServeHTTP(w, r)
+			return
+		}
+		preflight := r.Method == "OPTIONS" && r.Header.Get("Access-Control-Request-Method") != ""
+		if !preflight && r.URL.Path != "/todos.ics" && negotiate(r) != formatJSON {
+			h.ServeHTTP(w, r)
+			return
+		}
+		w.Header().Set("Access-Control-Allow-Origin", origin)
+		w.Header().Set("Access-Control-Allow-Credentials", "true")
+		if preflight {
+			w.Header().Set("Access-Control-Allow-Methods", corsAllowMethods)
+			w.Header().Set("Access-Control-Allow-Headers", corsAllowHeaders)
+			w.Header().Set("Access-Control-Max-Age", corsMaxAge)
+			w.WriteHeader(204)
+			return
+		}
+		w.Header().Set("Access-Control-Expose-Headers", "Location, Retry-After")
+		h.ServeHTTP(w, csrf.UnsafeSkipCheck(r))
+	})
+}
+
+// parseOrigins parses a comma separated list of origins such as
+// https://example.com or http://localhost:3000.
+func parseOrigins(list string) ([]string, error) {
+	var origins []string
+	for _, s := range strings.Split(list, ",") {
+		s = strings.TrimSpace(s)
+		if s == "" {
+			continue
+		}
+		u, err := url.Parse(s)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" || (u.Path != "" && u.Path != "/") || u.RawQuery != "" {
+			return nil, fmt.Errorf("invalid origin %q", s)
+		}
+		origins = append(origins, u.Scheme+"://"+u.Host)
+	}
+	return origins, nil
+}
@@ -0,0 +1,46 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"net/http"
+	"regexp"
+)
+
+// maxLoggedBody caps how much of a request body -debug-bodies logs.
+const maxLoggedBody = 1024
+
+var (
+	sensitiveFormField = regexp.MustCompile(`(?i)((?:^|&)[^=&]*(?:password|token|secret|csrf)[^=&]*=)[^&]*`)
+	sensitiveJSONField = regexp.MustCompile(`(?i)("[^"]*(?:password|token|secret|csrf)[^"]*"\s*:\s*)"[^"]*"`)
+)
+
+// logRequestBody logs the start of the request body with passwords and
+// tokens blanked out. It only reads what it logs, putting it back in front
+// of the rest of the body for the handlers.
+func logRequestBody(r *http.Request) {
+	if r.Body == nil || r.Body == http.NoBody {
+		return
+	}
+	head := make([]byte, maxLoggedBody+1)
+	n, err := io.ReadFull(r.Body, head)
+	if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+		logf(r.Context(), "reading request body: %v", err)
+	}
+	head = head[:n]
+	r.Body = struct {
+		io.Reader
+		io.Closer
+	}{io.MultiReader(bytes.NewReader(head), r.Body), r.Body}
+
+	logged, truncated := head, ""
+	if len(logged) > maxLoggedBody {
+		logged, truncated = logged[:maxLoggedBody], " (truncated)"
+	}
+	logf(r.Context(), "request body: %s%s", redactBody(logged), truncated)
+}
+
+func redactBody(b []byte) []byte {
+	b = sensitiveFormField.ReplaceAll(b, []byte("${1}[redacted]"))
+	return sensitiveJSONField.ReplaceAll(b, []byte(`${1}"[redacted]"`))
+}
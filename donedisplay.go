@@ -0,0 +1,78 @@
+package main
+
+import (
+	"context"
+	"net/http"
+)
+
+// DoneDisplay is how completed todos show in the default todo list: struck
+// through in place, or left out so only the Done filter shows them.
+type DoneDisplay struct {
+	Name  string
+	Label string
+}
+
+var doneDisplays = []DoneDisplay{
+	{"strike", "Strike through"},
+	{"hide", "Hide"},
+}
+
+const (
+	doneDisplayKey        contextKey = 9
+	doneDisplayCookieName            = "done_display"
+	doneStrike                       = "strike"
+	doneHide                         = "hide"
+)
+
+func isDoneDisplay(name string) bool {
+	for _, d := range doneDisplays {
+		if d.Name == name {
+			return true
+		}
+	}
+	return false
+}
+
+// withDoneDisplay records the done display chosen with its cookie, or else
+// def.
+func withDoneDisplay(h http.Handler, def string) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		display := def
+		if c, err := r.Cookie(doneDisplayCookieName); err == nil && isDoneDisplay(c.Value) {
+			display = c.Value
+		}
+		ctx := context.WithValue(r.Context(), doneDisplayKey, display)
+		h.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
+
+func doneDisplay(ctx context.Context) string {
+	if d, ok := ctx.Value(doneDisplayKey).(string); ok {
+		return d
+	}
+	return doneStrike
+}
+
+func (s *server) doneDisplayHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(w, http.StatusText(405), 405)
+		return
+	}
+	if !parseForm(w, r) {
+		return
+	}
+	if display := r.FormValue("done_display"); display != "" {
+		if !isDoneDisplay(display) {
+			warnf(r.Context(), "unknown done display %q", display)
+			respondError(w, r, 400)
+			return
+		}
+
+		s.setCookie(w, doneDisplayCookieName, display)
+		respondOrRedirect(w, r, s.url("/"), func() {
+			w.Header().Set("HX-Refresh", "true")
+		})
+	} else {
+		http.Error(w, http.StatusText(400), 400)
+	}
+}
@@ -0,0 +1,59 @@
+package main
+
+import "time"
+
+// todoDTO is how a todo looks in JSON responses. It keeps the wire format
+// stable whatever the store keeps, and leaves out the bookkeeping fields.
+type todoDTO struct {
+	Id           uint64     `json:"id"`
+	Text         string     `json:"text"`
+	Slug         string     `json:"slug"`
+	Done         bool       `json:"done"`
+	Pinned       bool       `json:"pinned"`
+	Recurrence   string     `json:"recurrence,omitempty"`
+	CreatedAt    time.Time  `json:"created_at"`
+	UpdatedAt    time.Time  `json:"updated_at"`
+	DoneAt       *time.Time `json:"done_at,omitempty"`
+	DueAt        *time.Time `json:"due_at,omitempty"`
+	SnoozedUntil *time.Time `json:"snoozed_until,omitempty"`
+	// DeletedAt is only there for todos in the trash
+	DeletedAt *time.Time `json:"deleted_at,omitempty"`
+}
+
+// todoJSON converts a todo for a JSON response, nil staying nil.
+func todoJSON(t *todo) *todoDTO {
+	if t == nil {
+		return nil
+	}
+	return &todoDTO{
+		Id:           t.Id,
+		Text:         t.Text,
+		Slug:         t.Slug,
+		Done:         t.Done,
+		Pinned:       t.Pinned,
+		Recurrence:   string(t.Recurrence),
+		CreatedAt:    t.CreatedAt,
+		UpdatedAt:    t.UpdatedAt,
+		DoneAt:       optionalTime(t.DoneAt),
+		DueAt:        optionalTime(t.DueAt),
+		SnoozedUntil: optionalTime(t.SnoozedUntil),
+		DeletedAt:    optionalTime(t.DeletedAt),
+	}
+}
+
+// todosJSON converts a list of todos for a JSON response, which is an
+// empty array rather than null when there are none.
+func todosJSON(todos []*todo) []*todoDTO {
+	list := make([]*todoDTO, len(todos))
+	for i, t := range todos {
+		list[i] = todoJSON(t)
+	}
+	return list
+}
+
+func optionalTime(t time.Time) *time.Time {
+	if t.IsZero() {
+		return nil
+	}
+	return &t
+}
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"strings"
+	"time"
+
+	"golang.org/x/text/language"
+)
+
+type duePhrase struct {
+	phrase string
+	// days from today, or -1 when weekday is used
+	days    int
+	weekday time.Weekday
+}
+
+var duePhrases = map[string][]duePhrase{
+	"en": {
+		{phrase: "today", days: 0},
+		{phrase: "tomorrow", days: 1},
+		{phrase: "next week", days: 7},
+		{phrase: "monday", days: -1, weekday: time.Monday},
+		{phrase: "tuesday", days: -1, weekday: time.Tuesday},
+		{phrase: "wednesday", days: -1, weekday: time.Wednesday},
+		{phrase: "thursday", days: -1, weekday: time.Thursday},
+		{phrase: "friday", days: -1, weekday: time.Friday},
+		{phrase: "saturday", days: -1, weekday: time.Saturday},
+		{phrase: "sunday", days: -1, weekday: time.Sunday},
+	},
+	"fr": {
+		{phrase: "aujourd'hui", days: 0},
+		{phrase: "demain", days: 1},
+		{phrase: "la semaine prochaine", days: 7},
+		{phrase: "semaine prochaine", days: 7},
+		{phrase: "lundi", days: -1, weekday: time.Monday},
+		{phrase: "mardi", days: -1, weekday: time.Tuesday},
+		{phrase: "mercredi", days: -1, weekday: time.Wednesday},
+		{phrase: "jeudi", days: -1, weekday: time.Thursday},
+		{phrase: "vendredi", days: -1, weekday: time.Friday},
+		{phrase: "samedi", days: -1, weekday: time.Saturday},
+		{phrase: "dimanche", days: -1, weekday: time.Sunday},
+	},
+}
+
+// extractDue looks for a date phrase in lang at the end of text, like "buy
+// milk tomorrow", and returns the text without it and the day it names. A
+// weekday means the next one after today. Only whole trailing words are
+// recognized, and never the whole text.
+func extractDue(text string, lang language.Tag, now time.Time) (string, time.Time, bool) {
+	base, _ := lang.Base()
+	phrases, ok := duePhrases[base.String()]
+	if !ok {
+		phrases = duePhrases["en"]
+	}
+	for _, p := range phrases {
+		i := len(text) - len(p.phrase)
+		if i < 1 || text[i-1] != ' ' || !strings.EqualFold(text[i:], p.phrase) {
+			continue
+		}
+		rest := strings.TrimSpace(text[:i])
+		if rest == "" {
+			continue
+		}
+		today := startOfDay(now)
+		days := p.days
+		if days < 0 {
+			days = (int(p.weekday) - int(today.Weekday()) + 7) % 7
+			if days == 0 {
+				days = 7
+			}
+		}
+		return rest, today.AddDate(0, 0, days), true
+	}
+	return text, time.Time{}, false
+}
@@ -0,0 +1,44 @@
+package main
+
+import (
+	_ "embed"
+	"mime"
+	"net/http"
+	"os"
+	"path/filepath"
+)
+
+//go:embed static/favicon.ico
+var defaultFavicon []byte
+
+const defaultAppName = "htmx + Go"
+
+const faviconCacheControl = "public, max-age=86400"
+
+// loadFavicon reads a favicon file, giving its content type by extension.
+func loadFavicon(path string) ([]byte, string, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, "", err
+	}
+	ctype := mime.TypeByExtension(filepath.Ext(path))
+	if ctype == "" {
+		ctype = http.DetectContentType(b)
+	}
+	return b, ctype, nil
+}
+
+func (s *server) faviconHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" && r.Method != "HEAD" {
+		respondError(w, r, 405)
+		return
+	}
+	w.Header().Set("Content-Type", s.faviconType)
+	w.Header().Set("Cache-Control", faviconCacheControl)
+	if r.Method == "HEAD" {
+		return
+	}
+	if _, err := w.Write(s.favicon); err != nil {
+		logf(r.Context(), "writing favicon: %v", err)
+	}
+}
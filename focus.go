@@ -0,0 +1,136 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+)
+
+// actionableBefore orders todos for focus mode: pinned todos first, then
+// those with the soonest due date, then the oldest.
+func actionableBefore(a, b *todo) bool {
+	if a.Pinned != b.Pinned {
+		return a.Pinned
+	}
+	if a.DueAt.IsZero() != b.DueAt.IsZero() {
+		return !a.DueAt.IsZero()
+	}
+	if !a.DueAt.Equal(b.DueAt) {
+		return a.DueAt.Before(b.DueAt)
+	}
+	return a.CreatedAt.Before(b.CreatedAt)
+}
+
+// nextActionable returns the todo that should be worked on next among
+// those the filter selects, or nil when there are none.
+func (s *inMemTodoService) nextActionable(ctx context.Context, filter todoFilter) (*todo, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	filter = filter.forOwner(ctx)
+	now := s.clock.Now()
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	var next *todo
+	for _, t := range s.todos {
+		if filter.matches(t, now) && !s.expired(t, now) && (next == nil || actionableBefore(t, next)) {
+			next = t
+		}
+	}
+	if next == nil {
+		return nil, nil
+	}
+	return next.clone(), nil
+}
+
+type focusPage struct {
+	Request *http.Request
+	Todo    *todo
+	// Skip holds the todos passed over with "next", NextHref passes over
+	// the current one as well
+	Skip     []uint64
+	NextHref string
+}
+
+// todoFocusHandler shows just the next todo to work on. Posting an action
+// for it (done or snooze) moves on to the one after.
+func (s *server) todoFocusHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" && r.Method != "POST" {
+		respondError(w, r, 405)
+		return
+	}
+	if !parseForm(w, r) {
+		return
+	}
+	var skip []uint64
+	for _, v := range r.Form["skip"] {
+		id, err := strconv.ParseUint(v, 10, 64)
+		if err != nil {
+			respondError(w, r, 400)
+			return
+		}
+		skip = append(skip, id)
+	}
+
+	if r.Method == "POST" {
+		id, err := strconv.ParseUint(r.PostForm.Get("id"), 10, 64)
+		if err != nil {
+			respondError(w, r, 400)
+			return
+		}
+		switch r.PostForm.Get("action") {
+		case "done":
+			done := true
+			_, err = s.todoService.updateTodo(r.Context(), id, todoUpdate{done: &done})
+		case "snooze":
+			_, err = s.todoService.snoozeTodo(r.Context(), id, startOfDay(s.now(r)).AddDate(0, 0, 1))
+		default:
+			respondError(w, r, 400)
+			return
+		}
+		if err != nil {
+			logf(r.Context(), "updating focused todo: %v", err)
+			respondServiceError(w, r, err)
+			return
+		}
+	}
+
+	done := false
+	todo, err := s.todoService.nextActionable(r.Context(), todoFilter{done: &done, excludeIds: skip})
+	if err != nil {
+		logf(r.Context(), "finding next todo: %v", err)
+		respondError(w, r, 500)
+		return
+	}
+	data := focusPage{Request: r, Todo: todo, Skip: skip}
+	if todo != nil {
+		data.NextHref = s.focusURL(append(skip, todo.Id))
+	}
+	switch negotiate(r) {
+	case formatHTMLFragment:
+		handlePage(s.templates, "todo-focus.html", w, data)
+	case formatJSON:
+		handleJSON(w, 200, todoJSON(todo))
+	default:
+		if r.Method == "POST" {
+			// the todos passed over stay passed over
+			http.Redirect(w, r, s.focusURL(skip), 303)
+			return
+		}
+		handlePage(s.templates, "todos_focus.html", w, data)
+	}
+}
+
+// focusURL is the focus page passing over the skip todos.
+func (s *server) focusURL(skip []uint64) string {
+	if len(skip) == 0 {
+		return s.url("/todos/focus/")
+	}
+	query := url.Values{}
+	for _, id := range skip {
+		query.Add("skip", strconv.FormatUint(id, 10))
+	}
+	return s.url(fmt.Sprintf("/todos/focus/?%s", query.Encode()))
+}
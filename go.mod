@@ -4,7 +4,9 @@ go 1.16
 
 require (
 	github.com/gorilla/csrf v1.7.1
+	github.com/gorilla/websocket v1.5.0
 	golang.org/x/mod v0.5.0 // indirect
+	golang.org/x/sync v0.1.0
 	golang.org/x/sys v0.0.0-20210831042530-f4d43177bf5e // indirect
 	golang.org/x/text v0.3.7
 	golang.org/x/tools v0.1.5 // indirect
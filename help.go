@@ -0,0 +1,39 @@
+package main
+
+import "net/http"
+
+// shortcut is a key the pages respond to; the key bindings themselves are
+// in the script of base.html.
+type shortcut struct {
+	Key         string
+	Description string
+}
+
+var shortcuts = []shortcut{
+	{"n", "Write a new todo"},
+	{"f", "Open focus mode"},
+	{"Enter", "Edit the selected todo"},
+	{"?", "Show the keyboard shortcuts"},
+	{"Esc", "Close this help"},
+}
+
+// shortcutsHelpHandler renders the keyboard shortcuts, localized, for the
+// help overlay.
+func (s *server) shortcutsHelpHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		respondError(w, r, 405)
+		return
+	}
+	if negotiate(r) == formatJSON {
+		list := make([]map[string]string, len(shortcuts))
+		for i, sc := range shortcuts {
+			list[i] = map[string]string{"key": sc.Key, "description": printer(r).Sprintf(sc.Description)}
+		}
+		handleJSON(w, 200, list)
+		return
+	}
+	handlePage(s.templates, "help-shortcuts.html", w, map[string]interface{}{
+		"Request":   r,
+		"Shortcuts": shortcuts,
+	})
+}
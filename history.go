@@ -0,0 +1,100 @@
+package main
+
+import (
+	"net/http"
+	"time"
+)
+
+// maxTodoEvents is how many events a todo's history keeps, the oldest ones
+// being dropped first.
+const maxTodoEvents = 50
+
+type todoEventKind string
+
+const (
+	eventCreated  todoEventKind = "created"
+	eventDone     todoEventKind = "done"
+	eventUndone   todoEventKind = "undone"
+	eventEdited   todoEventKind = "edited"
+	eventDeleted  todoEventKind = "deleted"
+	eventRestored todoEventKind = "restored"
+	eventExpired  todoEventKind = "expired"
+)
+
+// todoEvent is one entry of a todo's history.
+type todoEvent struct {
+	Kind todoEventKind
+	At   time.Time
+}
+
+// Label is the message key describing the event in the timeline.
+func (e todoEvent) Label() string {
+	switch e.Kind {
+	case eventCreated:
+		return "Created"
+	case eventDone:
+		return "Marked done"
+	case eventUndone:
+		return "Marked not done"
+	case eventEdited:
+		return "Edited"
+	case eventDeleted:
+		return "Deleted"
+	case eventRestored:
+		return "Restored"
+	case eventExpired:
+		return "Expired"
+	}
+	return string(e.Kind)
+}
+
+// record adds an event to a stored todo's history; the service's lock must
+// be held for writing.
+func (t *todo) record(kind todoEventKind, at time.Time) {
+	t.History = append(t.History, todoEvent{kind, at})
+	if n := len(t.History) - maxTodoEvents; n > 0 {
+		t.History = append(t.History[:0], t.History[n:]...)
+	}
+}
+
+type todoEventDTO struct {
+	Kind todoEventKind `json:"kind"`
+	At   time.Time     `json:"at"`
+}
+
+// todoHistoryHandler serves the history of a todo, oldest event first. It
+// is kept for todos in the trash as well.
+func (s *server) todoHistoryHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		respondError(w, r, 405)
+		return
+	}
+	id, err := extractTodoId(r.URL.Path)
+	if err != nil {
+		logf(r.Context(), "extracting todo id: %v", err)
+		respondError(w, r, 500)
+		return
+	}
+	todo, err := s.todoService.getTodoById(r.Context(), id)
+	if err != nil {
+		logf(r.Context(), "getting todo by id: %v", err)
+		respondServiceError(w, r, err)
+		return
+	}
+	data := todoListItem{
+		Request: r,
+		Todo:    todo,
+	}
+	switch negotiate(r) {
+	case formatHTMLFragment:
+		handlePage(s.templates, "todo-history.html", w, data)
+	case formatJSON:
+		events := make([]todoEventDTO, len(todo.History))
+		for i, e := range todo.History {
+			events[i] = todoEventDTO{e.Kind, e.At}
+		}
+		handleJSON(w, 200, events)
+	default:
+		handlePage(s.templates, "todo_detail.html", w, data)
+	}
+}
@@ -0,0 +1,81 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+const icalTimeFormat = "20060102T150405Z"
+
+var icalEscaper = strings.NewReplacer(`\`, `\\`, ";", `\;`, ",", `\,`, "\r\n", `\n`, "\n", `\n`)
+
+// icalWriter writes iCalendar content lines, folding them at 75 octets
+// and ending them with CRLF as RFC 5545 requires.
+type icalWriter struct {
+	b bytes.Buffer
+}
+
+func (w *icalWriter) line(format string, a ...interface{}) {
+	s := fmt.Sprintf(format, a...)
+	// continuation lines start with a space, which counts toward the limit
+	max := 75
+	for len(s) > max {
+		// don't split a UTF-8 sequence
+		n := max
+		for n > 0 && s[n]&0xC0 == 0x80 {
+			n--
+		}
+		w.b.WriteString(s[:n])
+		w.b.WriteString("\r\n ")
+		s = s[n:]
+		max = 74
+	}
+	w.b.WriteString(s)
+	w.b.WriteString("\r\n")
+}
+
+// todoCalendarHandler serves the undone todos with a due date as an
+// iCalendar feed of VTODOs that calendar apps can subscribe to. The usual
+// list filters narrow it down.
+func (s *server) todoCalendarHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		respondError(w, r, 405)
+		return
+	}
+	items, _, err := s.getFilteredTodoListItems(r, false)
+	if err != nil {
+		logf(r.Context(), "finding todos: %v", err)
+		respondError(w, r, 500)
+		return
+	}
+	now := s.clock.Now().UTC()
+	var cal icalWriter
+	cal.line("BEGIN:VCALENDAR")
+	cal.line("VERSION:2.0")
+	cal.line("PRODID:-//htmx-go-example//todos//EN")
+	cal.line("X-WR-CALNAME:%s", icalEscaper.Replace(s.appName))
+	for _, item := range items {
+		t := item.Todo
+		if t.Done || t.DueAt.IsZero() {
+			continue
+		}
+		cal.line("BEGIN:VTODO")
+		cal.line("UID:todo-%d@%s", t.Id, r.Host)
+		cal.line("DTSTAMP:%s", now.Format(icalTimeFormat))
+		cal.line("CREATED:%s", t.CreatedAt.UTC().Format(icalTimeFormat))
+		cal.line("LAST-MODIFIED:%s", t.UpdatedAt.UTC().Format(icalTimeFormat))
+		cal.line("DUE:%s", t.DueAt.UTC().Format(icalTimeFormat))
+		cal.line("SUMMARY:%s", icalEscaper.Replace(t.Text))
+		cal.line("STATUS:NEEDS-ACTION")
+		cal.line("END:VTODO")
+	}
+	cal.line("END:VCALENDAR")
+
+	w.Header().Set("Content-Type", "text/calendar; charset=utf-8")
+	w.Header().Set("Content-Disposition", `inline; filename="todos.ics"`)
+	if _, err := cal.b.WriteTo(w); err != nil {
+		logf(r.Context(), "writing calendar: %v", err)
+	}
+}
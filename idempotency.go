@@ -0,0 +1,130 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"net/http"
+	"sync"
+	"time"
+)
+
+const (
+	idempotencyKeyTTL  = 10 * time.Minute
+	maxIdempotencyKeys = 1000
+)
+
+// idempotencyEntry is the todos created for a key, or the create still in
+// progress: done is closed once todoIds or err is set.
+type idempotencyEntry struct {
+	todoIds []uint64
+	err     error
+	done    chan struct{}
+	expires time.Time
+}
+
+// ownedKey scopes a client-supplied key to its owner, so clients picking
+// the same key never get each other's todos.
+type ownedKey struct {
+	owner string
+	key   string
+}
+
+// idempotencyStore remembers which todo was created for a client-supplied
+// key, so a retried create returns the original todo instead of a copy.
+type idempotencyStore struct {
+	mu      sync.Mutex
+	ttl     time.Duration
+	max     int
+	entries map[ownedKey]*idempotencyEntry
+}
+
+func newIdempotencyStore(ttl time.Duration, max int) *idempotencyStore {
+	return &idempotencyStore{
+		ttl:     ttl,
+		max:     max,
+		entries: make(map[ownedKey]*idempotencyEntry),
+	}
+}
+
+// do returns the todo id recorded for owner's key, or calls create and
+// records the id it returns. A concurrent retry with the same key waits for
+// that create rather than making a todo of its own, and gets its error if
+// it fails; other keys don't wait for it.
+func (s *idempotencyStore) do(owner, key string, now time.Time, create func() (uint64, error)) (id uint64, created bool, err error) {
+	ids, created, err := s.doMany(owner, key, now, func() ([]uint64, error) {
+		id, err := create()
+		return []uint64{id}, err
+	})
+	if err != nil || len(ids) == 0 {
+		// no ids when the key was first used to add no todos
+		return 0, created, err
+	}
+	return ids[0], created, nil
+}
+
+// doMany is do for a create that may add several todos.
+func (s *idempotencyStore) doMany(owner, key string, now time.Time, create func() ([]uint64, error)) (ids []uint64, created bool, err error) {
+	k := ownedKey{owner, key}
+	s.mu.Lock()
+	s.evict(now)
+	if e, ok := s.entries[k]; ok {
+		s.mu.Unlock()
+		<-e.done
+		return e.todoIds, false, e.err
+	}
+	if len(s.entries) >= s.max {
+		s.evictOldest()
+	}
+	e := &idempotencyEntry{done: make(chan struct{}), expires: now.Add(s.ttl)}
+	s.entries[k] = e
+	s.mu.Unlock()
+
+	e.todoIds, e.err = create()
+	close(e.done)
+	if e.err != nil {
+		// nothing was created, so a later retry may try again
+		s.mu.Lock()
+		if s.entries[k] == e {
+			delete(s.entries, k)
+		}
+		s.mu.Unlock()
+		return nil, false, e.err
+	}
+	return e.todoIds, true, nil
+}
+
+func (s *idempotencyStore) evict(now time.Time) {
+	for k, e := range s.entries {
+		if !now.Before(e.expires) {
+			delete(s.entries, k)
+		}
+	}
+}
+
+func (s *idempotencyStore) evictOldest() {
+	var oldest ownedKey
+	var oldestExpires time.Time
+	for k, e := range s.entries {
+		if oldest == (ownedKey{}) || e.expires.Before(oldestExpires) {
+			oldest, oldestExpires = k, e.expires
+		}
+	}
+	delete(s.entries, oldest)
+}
+
+// idempotencyKey reads the client-supplied key from the Idempotency-Key
+// header, falling back to the hidden form field rendered with the form.
+func idempotencyKey(r *http.Request) string {
+	if key := r.Header.Get("Idempotency-Key"); key != "" {
+		return key
+	}
+	return r.FormValue("idempotency-key")
+}
+
+func randomToken() string {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		panic(err)
+	}
+	return hex.EncodeToString(b)
+}
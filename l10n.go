@@ -2,9 +2,12 @@ package main
 
 import (
 	"context"
-	"log"
 	"net/http"
+	"strconv"
+	"strings"
+	"time"
 
+	"golang.org/x/text/cases"
 	"golang.org/x/text/feature/plural"
 	"golang.org/x/text/language"
 	"golang.org/x/text/message"
@@ -44,6 +47,11 @@ var entries = [...]entry{
 	{"fr", "new todo entry", "nouvelle entrée à faire"},
 	{"fr", "list of todos", "liste de tâches"},
 	{"fr", "Filter todos:", "Filtrer les tâches:"},
+	{"en", "Theme", "Theme"},
+	{"fr", "Theme", "Thème"},
+	{"fr", "Auto", "Auto"},
+	{"fr", "Light", "Clair"},
+	{"fr", "Dark", "Sombre"},
 	{"en", "Select language", "Select language"},
 	{"fr", "Select language", "Choisir la langue"},
 	{"en", "Todo list", "Todo list"},
@@ -59,9 +67,108 @@ var entries = [...]entry{
 	{"fr", "All", "Tout"},
 	{"fr", "Done", "Complété"},
 	{"fr", "Remaining", "Restant"},
+	{"fr", "Completed today", "Complété aujourd'hui"},
+	{"fr", "Overdue", "En retard"},
+	{"fr", "Pinned", "Épinglées"},
+	{"fr", "Pin", "Épingler"},
+	{"fr", "Unpin", "Désépingler"},
 	{"fr", "Mark done", "Marquer complété"},
 	{"fr", "Mark undone", "Marquer inachevé"},
 	{"fr", "Delete", "Supprimer"},
+	{"fr", "Cancel", "Annuler"},
+	{"fr", "Trash", "Corbeille"},
+	{"fr", "Restore", "Restaurer"},
+	{"fr", "Delete forever", "Supprimer définitivement"},
+	{"fr", "Restore all", "Tout restaurer"},
+	{"fr", "Empty trash", "Vider la corbeille"},
+	{"en", "Restored %d todo(s).", plural.Selectf(1, "",
+		"=1", "Restored 1 todo.",
+		"other", "Restored %d todos.",
+	)},
+	{"fr", "Restored %d todo(s).", plural.Selectf(1, "",
+		"one", "%d tâche restaurée.",
+		"other", "%d tâches restaurées.",
+	)},
+	{"en", "Deleted %d todo(s) forever.", plural.Selectf(1, "",
+		"=1", "Deleted 1 todo forever.",
+		"other", "Deleted %d todos forever.",
+	)},
+	{"fr", "Deleted %d todo(s) forever.", plural.Selectf(1, "",
+		"one", "%d tâche supprimée définitivement.",
+		"other", "%d tâches supprimées définitivement.",
+	)},
+	{"fr", "Deleted %s", "Supprimée le %s"},
+	{"fr", "Rename", "Renommer"},
+	{"fr", "Focus", "Concentration"},
+	{"fr", "Subscribe in a calendar", "S'abonner dans un agenda"},
+	{"fr", "Saving…", "Enregistrement…"},
+	{"fr", "Saved", "Enregistré"},
+	{"fr", "Log in", "Se connecter"},
+	{"fr", "Log out", "Se déconnecter"},
+	{"fr", "Password", "Mot de passe"},
+	{"fr", "Wrong password.", "Mot de passe incorrect."},
+	{"fr", "Move to top", "Monter en haut"},
+	{"fr", "Move to bottom", "Descendre en bas"},
+	{"fr", "Unknown position %q.", "Position %q inconnue."},
+	{"fr", "Statistics", "Statistiques"},
+	{"fr", "Deleted “%s”.", "« %s » supprimé."},
+	{"fr", "Undo", "Annuler"},
+	{"en", "%d/%d character(s)", plural.Selectf(1, "",
+		"=1", "1/%[2]d character",
+		"other", "%d/%d characters",
+	)},
+	{"fr", "%d/%d character(s)", plural.Selectf(1, "",
+		"one", "%d/%d caractère",
+		"other", "%d/%d caractères",
+	)},
+	{"en", "%d character(s)", plural.Selectf(1, "",
+		"=1", "1 character",
+		"other", "%d characters",
+	)},
+	{"fr", "%d character(s)", plural.Selectf(1, "",
+		"one", "%d caractère",
+		"other", "%d caractères",
+	)},
+	{"fr", "History", "Historique"},
+	{"fr", "Marked done", "Marquée complétée"},
+	{"fr", "Marked not done", "Marquée inachevée"},
+	{"fr", "Edited", "Modifiée"},
+	{"fr", "Deleted", "Supprimée"},
+	{"fr", "Restored", "Restaurée"},
+	{"fr", "Time zone", "Fuseau horaire"},
+	{"fr", "Keyboard shortcuts", "Raccourcis clavier"},
+	{"fr", "Write a new todo", "Écrire une nouvelle tâche"},
+	{"fr", "Open focus mode", "Ouvrir le mode concentration"},
+	{"fr", "Edit the selected todo", "Modifier la tâche sélectionnée"},
+	{"fr", "Show the keyboard shortcuts", "Afficher les raccourcis clavier"},
+	{"fr", "Close this help", "Fermer cette aide"},
+	{"fr", "Close", "Fermer"},
+	{"fr", "Several, one per line", "Plusieurs, une par ligne"},
+	{"fr", "Line %d: %s", "Ligne %d : %s"},
+	{"fr", "At most %d todos can be added at once.", "Au plus %d tâches peuvent être ajoutées à la fois."},
+	{"en", "Added %d todo(s).", plural.Selectf(1, "",
+		"=1", "Added 1 todo.",
+		"other", "Added %d todos.",
+	)},
+	{"fr", "created %s", "créée %s"},
+	{"fr", "Done todos", "Tâches terminées"},
+	{"fr", "Strike through", "Barrer"},
+	{"fr", "Hide", "Masquer"},
+	{"fr", "Link to this view", "Lien vers cette vue"},
+	{"fr", "Clear filters", "Effacer les filtres"},
+	{"fr", "Expired", "Expirée"},
+	{"fr", "Added %d todo(s).", plural.Selectf(1, "",
+		"one", "%d tâche ajoutée.",
+		"other", "%d tâches ajoutées.",
+	)},
+	{"fr", "Created today", "Créés aujourd'hui"},
+	{"fr", "Average time to complete", "Temps moyen pour compléter"},
+	{"fr", "The site is under maintenance, please try again in a few minutes.", "Le site est en maintenance, veuillez réessayer dans quelques minutes."},
+	{"fr", "Next", "Suivante"},
+	{"fr", "Start over", "Recommencer"},
+	{"fr", "Snooze until tomorrow", "Reporter à demain"},
+	{"fr", "All done — nothing left to do! 🎉", "Tout est fait, plus rien à faire ! 🎉"},
+	{"fr", "New text for this todo", "Nouveau texte pour cette tâche"},
 	{"en", "Showing %d todo item(s).", plural.Selectf(1, "",
 		"=1", "Showing 1 todo item.",
 		"=2", "Showing 2 todo items.",
@@ -72,6 +179,44 @@ var entries = [...]entry{
 		"=2", "Affichage de 2 éléments à faire.",
 		"other", "Affichage de %d éléments à faire.",
 	)},
+	{"en", "Deleted %d todo(s).", plural.Selectf(1, "",
+		"=1", "Deleted 1 todo.",
+		"other", "Deleted %d todos.",
+	)},
+	{"fr", "Deleted %d todo(s).", plural.Selectf(1, "",
+		"=1", "1 tâche supprimée.",
+		"other", "%d tâches supprimées.",
+	)},
+	{"fr", "Delete selected", "Supprimer la sélection"},
+	{"en", "Marked %d todo(s) done.", plural.Selectf(1, "",
+		"=1", "Marked 1 todo done.",
+		"other", "Marked %d todos done.",
+	)},
+	{"fr", "Marked %d todo(s) done.", plural.Selectf(1, "",
+		"one", "%d tâche marquée terminée.",
+		"other", "%d tâches marquées terminées.",
+	)},
+	{"en", "Marked %d todo(s) not done.", plural.Selectf(1, "",
+		"=1", "Marked 1 todo not done.",
+		"other", "Marked %d todos not done.",
+	)},
+	{"fr", "Marked %d todo(s) not done.", plural.Selectf(1, "",
+		"one", "%d tâche marquée inachevée.",
+		"other", "%d tâches marquées inachevées.",
+	)},
+	{"fr", "Mark selected done", "Marquer la sélection complétée"},
+	{"fr", "Mark selected undone", "Marquer la sélection inachevée"},
+	{"fr", "Select", "Sélectionner"},
+	{"en", "%d of %d done (%d%%)", "%d of %d done (%d%%)"},
+	{"fr", "%d of %d done (%d%%)", plural.Selectf(1, "",
+		"one", "%d sur %d terminée (%d %%)",
+		"other", "%d sur %d terminées (%d %%)",
+	)},
+	{"en", "%d remaining", "%d remaining"},
+	{"fr", "%d remaining", plural.Selectf(1, "",
+		"one", "%d restante",
+		"other", "%d restantes",
+	)},
 	{"en", "intro(part)1", `This simple todo app demonstrates the effective use of `},
 	{"en", "intro(part)2", `a way to enhance interactivity and responsiveness to basic HTML, with Go's html/template package.`},
 	{"fr", "intro(part)1", "Cette application simple à faire montre l'utilisation efficace de "},
@@ -80,6 +225,123 @@ var entries = [...]entry{
 	{"fr", "Add", "Ajouter"},
 	{"fr", "Copyright", "Droits d'auteur"},
 	{"fr", "Are you sure?", "Es-tu sûr?"},
+	{"fr", "Due", "Échéance"},
+	{"fr", "Due %s", "Échéance %s"},
+	{"fr", "Repeat", "Répéter"},
+	{"fr", "Never", "Jamais"},
+	{"fr", "Daily", "Quotidien"},
+	{"fr", "Weekly", "Hebdomadaire"},
+	{"fr", "Monthly", "Mensuel"},
+	{"fr", "Unknown recurrence %q.", "Récurrence inconnue %q."},
+	{"fr", "Snooze:", "Reporter :"},
+	{"fr", "1 hour", "1 heure"},
+	{"fr", "Tomorrow", "Demain"},
+	{"fr", "Next week", "La semaine prochaine"},
+	{"fr", "Snoozed until %s", "Reporté jusqu'au %s"},
+	{"fr", "Details", "Détails"},
+	{"fr", "Created", "Créé"},
+	{"fr", "Updated", "Modifié"},
+	{"fr", "Back to the list", "Retour à la liste"},
+	{"fr", "Todo text is required.", "Le texte de la tâche est obligatoire."},
+	{"fr", "Todo text must be at most %d characters.", "Le texte de la tâche ne doit pas dépasser %d caractères."},
+	{"fr", "The todo list is full (%d todos).", "La liste est pleine (%d tâches)."},
+	{"fr", "Unknown operation %q.", "Opération inconnue %q."},
+	{"fr", "Invalid due date %q.", "Date d'échéance invalide %q."},
+	{"fr", "Not applied because another operation failed.", "Non appliqué car une autre opération a échoué."},
+	{"fr", "Bad Request", "Requête incorrecte"},
+	{"fr", "Forbidden", "Interdit"},
+	{"fr", "Not Found", "Introuvable"},
+	{"fr", "Method Not Allowed", "Méthode non autorisée"},
+	{"fr", "Conflict", "Conflit"},
+	{"fr", "Request Entity Too Large", "Requête trop volumineuse"},
+	{"fr", "Internal Server Error", "Erreur interne du serveur"},
+	{"fr", "Sunday", "dimanche"},
+	{"fr", "Monday", "lundi"},
+	{"fr", "Tuesday", "mardi"},
+	{"fr", "Wednesday", "mercredi"},
+	{"fr", "Thursday", "jeudi"},
+	{"fr", "Friday", "vendredi"},
+	{"fr", "Saturday", "samedi"},
+	{"fr", "January", "janvier"},
+	{"fr", "February", "février"},
+	{"fr", "March", "mars"},
+	{"fr", "April", "avril"},
+	{"fr", "May", "mai"},
+	{"fr", "June", "juin"},
+	{"fr", "July", "juillet"},
+	{"fr", "August", "août"},
+	{"fr", "September", "septembre"},
+	{"fr", "October", "octobre"},
+	{"fr", "November", "novembre"},
+	{"fr", "December", "décembre"},
+	{"fr", "%[1]s, %[2]s %[3]d, %[4]s", "%[1]s %[3]d %[2]s %[4]s"},
+	{"fr", "No due date", "Sans échéance"},
+	{"fr", "Todos by day", "Tâches par jour"},
+	{"fr", "Group by day", "Grouper par jour"},
+	{"fr", "Flat view", "Vue simple"},
+	{"fr", "By creation date", "Par date de création"},
+	{"fr", "By due date", "Par échéance"},
+	{"fr", "No todos", "Aucune tâche"},
+	{"fr", "No todos yet.", "Aucune tâche pour l'instant."},
+	{"fr", "No todos yet — add one below.", "Aucune tâche pour l'instant — ajoutez-en une ci-dessous."},
+	{"fr", "No todos match your filter.", "Aucune tâche ne correspond à votre filtre."},
+	{"fr", "%[1]s %[2]d, %[3]s", "%[2]d %[1]s %[3]s"},
+	{"fr", "just now", "à l'instant"},
+	{"en", "%d minute(s) ago", plural.Selectf(1, "",
+		"=1", "1 minute ago",
+		"other", "%d minutes ago",
+	)},
+	{"fr", "%d minute(s) ago", plural.Selectf(1, "",
+		"one", "il y a %d minute",
+		"other", "il y a %d minutes",
+	)},
+	{"en", "in %d minute(s)", plural.Selectf(1, "",
+		"=1", "in 1 minute",
+		"other", "in %d minutes",
+	)},
+	{"fr", "in %d minute(s)", plural.Selectf(1, "",
+		"one", "dans %d minute",
+		"other", "dans %d minutes",
+	)},
+	{"en", "%d hour(s) ago", plural.Selectf(1, "",
+		"=1", "1 hour ago",
+		"other", "%d hours ago",
+	)},
+	{"fr", "%d hour(s) ago", plural.Selectf(1, "",
+		"one", "il y a %d heure",
+		"other", "il y a %d heures",
+	)},
+	{"en", "in %d hour(s)", plural.Selectf(1, "",
+		"=1", "in 1 hour",
+		"other", "in %d hours",
+	)},
+	{"fr", "in %d hour(s)", plural.Selectf(1, "",
+		"one", "dans %d heure",
+		"other", "dans %d heures",
+	)},
+	{"en", "%d day(s) ago", plural.Selectf(1, "",
+		"=1", "1 day ago",
+		"other", "%d days ago",
+	)},
+	{"fr", "%d day(s) ago", plural.Selectf(1, "",
+		"one", "il y a %d jour",
+		"other", "il y a %d jours",
+	)},
+	{"en", "in %d day(s)", plural.Selectf(1, "",
+		"=1", "in 1 day",
+		"other", "in %d days",
+	)},
+	{"fr", "in %d day(s)", plural.Selectf(1, "",
+		"one", "dans %d jour",
+		"other", "dans %d jours",
+	)},
+	{"fr", "Todo added", "Tâche ajoutée"},
+	{"fr", "Todo completed", "Tâche terminée"},
+	{"fr", "Todo reopened", "Tâche rouverte"},
+	{"fr", "Todo updated", "Tâche modifiée"},
+	{"fr", "Todo deleted", "Tâche supprimée"},
+	{"fr", "Todo restored", "Tâche restaurée"},
+	{"fr", "Todo deleted forever", "Tâche supprimée définitivement"},
 }
 
 func init() {
@@ -111,6 +373,93 @@ const (
 	langCookieName               = "lang"
 )
 
+func isSupportedLanguage(tag string) bool {
+	for _, l := range supportedLanguages {
+		if l.Tag == tag {
+			return true
+		}
+	}
+	return false
+}
+
+func printer(r *http.Request) *message.Printer {
+	return r.Context().Value(messagePrinterKey).(*message.Printer)
+}
+
+// foldCase prepares text for case-insensitive comparison following the
+// casing rules of lang, so the Turkish İ matches i and ß matches ss.
+func foldCase(lang language.Tag, s string) string {
+	return cases.Fold().String(cases.Lower(lang).String(s))
+}
+
+// containsFolded reports whether substr is within s, ignoring case the way
+// lang does.
+func containsFolded(lang language.Tag, s, substr string) bool {
+	return strings.Contains(foldCase(lang, s), foldCase(lang, substr))
+}
+
+// formatDay renders a long-form date such as "Monday, January 2, 2006" in
+// the printer's language.
+func formatDay(p *message.Printer, t time.Time) string {
+	return p.Sprintf("%[1]s, %[2]s %[3]d, %[4]s",
+		p.Sprintf(t.Weekday().String()), p.Sprintf(t.Month().String()), t.Day(), strconv.Itoa(t.Year()))
+}
+
+// formatDate renders a date such as "January 2, 2006" in the printer's
+// language.
+func formatDate(p *message.Printer, t time.Time) string {
+	return p.Sprintf("%[1]s %[2]d, %[3]s", p.Sprintf(t.Month().String()), t.Day(), strconv.Itoa(t.Year()))
+}
+
+// relativeTimeLimit is how far from now relativeTime gives up on relative
+// descriptions for the date.
+const relativeTimeLimit = 7 * 24 * time.Hour
+
+// relativeTime describes t as seen from now in the printer's language,
+// using the largest unit that fits, or gives its date when it is more than
+// a week away.
+func relativeTime(p *message.Printer, t, now time.Time) string {
+	d := now.Sub(t)
+	past := d >= 0
+	if !past {
+		d = -d
+	}
+	var n int
+	var ago, in string
+	switch {
+	case d >= relativeTimeLimit:
+		return formatDate(p, t)
+	case d < time.Minute:
+		return p.Sprintf("just now")
+	case d < time.Hour:
+		n, ago, in = int(d/time.Minute), "%d minute(s) ago", "in %d minute(s)"
+	case d < 24*time.Hour:
+		n, ago, in = int(d/time.Hour), "%d hour(s) ago", "in %d hour(s)"
+	default:
+		n, ago, in = int(d/(24*time.Hour)), "%d day(s) ago", "in %d day(s)"
+	}
+	if past {
+		return p.Sprintf(ago, n)
+	}
+	return p.Sprintf(in, n)
+}
+
+// relativeTimeRefresh is how often a description by relativeTime of t is
+// worth refreshing, or 0 once it has become a date that won't change.
+func relativeTimeRefresh(t, now time.Time) time.Duration {
+	d := now.Sub(t)
+	if d < 0 {
+		d = -d
+	}
+	switch {
+	case d < time.Hour:
+		return time.Minute
+	case d < relativeTimeLimit:
+		return time.Hour
+	}
+	return 0
+}
+
 func withMessagePrinter(h http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		lang, err := r.Cookie(langCookieName)
@@ -118,11 +467,18 @@ func withMessagePrinter(h http.Handler) http.Handler {
 			lang = &http.Cookie{Name: langCookieName, Value: ""}
 		}
 		accept := r.Header.Get("Accept-Language")
-		log.Printf("\x1b[1;35mcookie: %q\taccept: %q\x1b[0m", lang, accept)
-		tag, _ := language.MatchStrings(matcher, lang.Value, accept)
-		log.Printf("\x1b[1;36muser language: %s\x1b[0m", tag)
+		debugf(r.Context(), "\x1b[1;35mcookie: %q\taccept: %q\x1b[0m", lang, accept)
+		var tag language.Tag
+		if override := r.URL.Query().Get("lang"); isSupportedLanguage(override) {
+			// a one-off choice for this request, handy for sharing links
+			// and for testing; the cookie is left as it is
+			tag, _ = language.MatchStrings(matcher, override)
+		} else {
+			tag, _ = language.MatchStrings(matcher, lang.Value, accept)
+		}
+		debugf(r.Context(), "\x1b[1;36muser language: %s\x1b[0m", tag)
 		p := message.NewPrinter(tag)
-		ctx := context.WithValue(context.Background(), messagePrinterKey, p)
+		ctx := context.WithValue(r.Context(), messagePrinterKey, p)
 		ctx = context.WithValue(ctx, languageTagKey, tag)
 		h.ServeHTTP(w, r.WithContext(ctx))
 	})
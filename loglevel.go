@@ -0,0 +1,62 @@
+package main
+
+import (
+	"context"
+	"strings"
+	"sync/atomic"
+)
+
+// logLevel is how important a log line is. Lines logged with logf are
+// errors, or otherwise always worth seeing.
+type logLevel int32
+
+const (
+	levelDebug logLevel = iota
+	levelInfo
+	levelWarn
+	levelError
+)
+
+var logLevelNames = map[string]logLevel{
+	"debug": levelDebug,
+	"info":  levelInfo,
+	"warn":  levelWarn,
+	"error": levelError,
+}
+
+// minLogLevel is the least important logLevel that gets logged.
+var minLogLevel = int32(levelInfo)
+
+func parseLogLevel(name string) (logLevel, bool) {
+	level, ok := logLevelNames[strings.ToLower(name)]
+	return level, ok
+}
+
+func setLogLevel(level logLevel) {
+	atomic.StoreInt32(&minLogLevel, int32(level))
+}
+
+func logEnabled(level logLevel) bool {
+	return int32(level) >= atomic.LoadInt32(&minLogLevel)
+}
+
+// debugf is logf for details only wanted while investigating something.
+func debugf(ctx context.Context, format string, a ...interface{}) {
+	if logEnabled(levelDebug) {
+		logf(ctx, "\x1b[1;32m[DEBUG]\x1b[0m "+format, a...)
+	}
+}
+
+// infof is logf for the routine comings and goings.
+func infof(ctx context.Context, format string, a ...interface{}) {
+	if logEnabled(levelInfo) {
+		logf(ctx, format, a...)
+	}
+}
+
+// warnf is logf for things that look wrong but were dealt with.
+func warnf(ctx context.Context, format string, a ...interface{}) {
+	if logEnabled(levelWarn) {
+		logf(ctx, "[WARN] "+format, a...)
+	}
+}
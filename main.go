@@ -1,21 +1,31 @@
 package main
 
 import (
+	"bufio"
 	"bytes"
+	"context"
 	embed "embed"
-	"flag"
+	"encoding/json"
+	"errors"
 	"fmt"
 	"html/template"
 	"io"
 	"io/fs"
 	"log"
+	"net"
 	"net/http"
+	"net/url"
 	"os"
-	"path/filepath"
+	"os/signal"
+	"path"
 	"regexp"
+	"runtime/debug"
+	"sort"
 	"strconv"
 	"strings"
+	"sync"
 	"sync/atomic"
+	"syscall"
 	"time"
 
 	"golang.org/x/text/language"
@@ -27,130 +37,848 @@ import (
 //go:embed template
 var f embed.FS
 
-func logger(h http.Handler) http.Handler {
+// logger logs each request, and with debugBodies the start of the body of
+// requests that can have one and the status and size of every response.
+func logger(h http.Handler, m *metrics, debugBodies bool) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		log.Printf("%s %s %s", r.Method, r.URL, r.RemoteAddr)
+		infof(r.Context(), "%s %s %s", r.Method, r.URL, clientIP(r))
+		if debugBodies && r.Method != "GET" && r.Method != "HEAD" {
+			logRequestBody(r)
+		}
+		if m == nil && !debugBodies {
+			h.ServeHTTP(w, r)
+			return
+		}
+		start := time.Now()
+		rec := &statusRecorder{ResponseWriter: w}
+		h.ServeHTTP(rec, r)
+		if rec.status == 0 {
+			rec.status = http.StatusOK
+		}
+		if m != nil {
+			m.observe(r.Method, rec.status, time.Since(start))
+		}
+		if debugBodies {
+			infof(r.Context(), "responded %d with %d bytes", rec.status, rec.size)
+		}
+	})
+}
+
+func withRecover(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		defer func() {
+			if err := recover(); err != nil {
+				if err == http.ErrAbortHandler {
+					panic(err)
+				}
+				logf(r.Context(), "panic serving %s %s: %v\n%s", r.Method, r.URL, err, debug.Stack())
+				http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+			}
+		}()
+		h.ServeHTTP(w, r)
+	})
+}
+
+func withBasePath(h http.Handler, basePath string) http.Handler {
+	if basePath == "" {
+		return h
+	}
+	stripped := http.StripPrefix(basePath, h)
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == basePath {
+			http.Redirect(w, r, basePath+"/", 301)
+			return
+		}
+		stripped.ServeHTTP(w, r)
+	})
+}
+
+func normalizeBasePath(path string) string {
+	path = strings.Trim(path, "/")
+	if path == "" {
+		return ""
+	}
+	return "/" + path
+}
+
+func withMaxBodyBytes(h http.Handler, n int64) http.Handler {
+	if n <= 0 {
+		return h
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		r.Body = http.MaxBytesReader(w, r.Body, n)
+		h.ServeHTTP(w, r)
+	})
+}
+
+// withHead serves HEAD requests with the GET handlers. The server drops
+// the body of a response to HEAD, leaving the same headers GET would send.
+func withHead(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == "HEAD" {
+			get := r.Clone(r.Context())
+			get.Method = "GET"
+			r = get
+		}
+		h.ServeHTTP(w, r)
+	})
+}
+
+// overridableMethods are the methods a POST may ask to be treated as, for
+// clients and proxies that can only send GET and POST.
+var overridableMethods = map[string]bool{"PUT": true, "PATCH": true, "DELETE": true}
+
+// withMethodOverride turns a POST into the method named by its
+// X-HTTP-Method-Override header or _method form field.
+func withMethodOverride(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method == "POST" {
+			method := r.Header.Get("X-HTTP-Method-Override")
+			if method == "" {
+				if !parseForm(w, r) {
+					return
+				}
+				method = r.PostForm.Get("_method")
+			}
+			if method = strings.ToUpper(method); overridableMethods[method] {
+				r.Method = method
+			}
+		}
+		h.ServeHTTP(w, r)
+	})
+}
+
+// withCacheControl lets browsers briefly cache the mostly static index page,
+// and keeps everything else, in particular the htmx fragments, from being
+// cached so swaps never see stale content. The pages also depend on the
+// language, theme and done display cookies, which the CSRF middleware
+// already adds to Vary.
+func withCacheControl(h http.Handler, indexPolicy, defaultPolicy string) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		policy := defaultPolicy
+		if r.URL.Path == "/" && (r.Method == "GET" || r.Method == "HEAD") && r.Header.Get("HX-Request") == "" {
+			policy = indexPolicy
+		}
+		if policy != "" {
+			w.Header().Set("Cache-Control", policy)
+		}
+		w.Header().Add("Vary", "Accept-Language")
 		h.ServeHTTP(w, r)
 	})
 }
 
+func parseForm(w http.ResponseWriter, r *http.Request) bool {
+	if err := r.ParseForm(); err != nil {
+		logf(r.Context(), "parsing form: %v", err)
+		if isBodyTooLarge(err) {
+			respondError(w, r, 413)
+		} else {
+			respondError(w, r, 400)
+		}
+		return false
+	}
+	return true
+}
+
+// isBodyTooLarge reports whether err comes from reading past the limit set
+// by withMaxBodyBytes. Go 1.19 gives the error a type, http.MaxBytesError,
+// but this module supports 1.16, where it can only be told by its message.
+func isBodyTooLarge(err error) bool {
+	return strings.HasSuffix(err.Error(), "http: request body too large")
+}
+
+func withRequestTimeout(h http.Handler, timeout time.Duration) http.Handler {
+	if timeout <= 0 {
+		return h
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ctx, cancel := context.WithTimeout(r.Context(), timeout)
+		defer cancel()
+		h.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
+
+type Clock interface {
+	Now() time.Time
+}
+
+type realClock struct{}
+
+func (realClock) Now() time.Time {
+	return time.Now()
+}
+
 var latestTodoId uint64
 
 type todo struct {
-	Id        uint64
-	Text      string
-	CreatedAt time.Time
-	Done      bool
-	DoneAt    time.Time
-	Deleted   bool
-	DeletedAt time.Time
+	Id           uint64
+	Text         string
+	CreatedAt    time.Time
+	Done         bool
+	DoneAt       time.Time
+	Deleted      bool
+	DeletedAt    time.Time
+	UpdatedAt    time.Time
+	DueAt        time.Time
+	Recurrence   recurrence
+	SnoozedUntil time.Time
+	// Pinned todos are listed before the others
+	Pinned bool
+	// Slug makes the todo's permalink readable, see slugify
+	Slug string
+	// Owner is who created the todo, see withOwner
+	Owner string
+	// Position orders the todos in the list, pinned ones aside
+	Position int
+	// History lists what happened to the todo, see todoEvent
+	History []todoEvent
+}
+
+// clone returns a copy of t that shares no memory with it, so the store's
+// todos can only be changed through the service.
+func (t *todo) clone() *todo {
+	c := *t
+	c.History = append([]todoEvent(nil), t.History...)
+	return &c
 }
 
 type todoService interface {
-	getTodoById(id uint64) (*todo, error)
-	findTodos(filter todoFilter) ([]*todo, error)
-	createTodo(todo *todo) error
-	updateTodo(id uint64, update todoUpdate) (*todo, error)
-	deleteTodo(id uint64) error
-	deleteTodos(ids []uint64) error
+	getTodoById(ctx context.Context, id uint64) (*todo, error)
+	findTodos(ctx context.Context, filter todoFilter) ([]*todo, error)
+	findTodosFunc(ctx context.Context, filter todoFilter, fn func(*todo) error) error
+	countTodos(ctx context.Context, filter todoFilter) (int, error)
+	createTodo(ctx context.Context, todo *todo) error
+	updateTodo(ctx context.Context, id uint64, update todoUpdate) (*todo, error)
+	deleteTodo(ctx context.Context, id uint64) error
+	deleteTodos(ctx context.Context, ids []uint64) error
+	setTodosDone(ctx context.Context, ids []uint64, done bool) error
+	snoozeTodo(ctx context.Context, id uint64, until time.Time) (*todo, error)
+	restoreTodo(ctx context.Context, id uint64) (*todo, error)
+	purgeTodo(ctx context.Context, id uint64) error
+	purgeExpired(ctx context.Context, before time.Time) (int, error)
+	expireTodos(ctx context.Context) (int, error)
+	restoreAll(ctx context.Context) (int, error)
+	emptyTrash(ctx context.Context) (int, error)
+	nextActionable(ctx context.Context, filter todoFilter) (*todo, error)
+	moveTodo(ctx context.Context, id uint64, toTop bool) (*todo, error)
+	putTodo(ctx context.Context, id uint64, update todoUpdate) (t *todo, created bool, err error)
+	stats(ctx context.Context) (todoStats, error)
 }
 
 type todoFilter struct {
-	done *bool
+	done           *bool
+	doneAfter      *time.Time
+	doneBefore     *time.Time
+	modifiedSince  *time.Time
+	includeSnoozed bool
+	overdue        bool
+	pinnedOnly     bool
+	query          string
+	// lang sets the casing rules for matching the query
+	lang language.Tag
+	// deletedOnly selects the trash instead of the live todos
+	deletedOnly bool
+	excludeIds  []uint64
+	// owner defaults to the owner of the request's context
+	owner string
+	// allOwners selects every owner's todos, for operators
+	allOwners bool
 }
 
 type todoUpdate struct {
-	text *string
-	done *bool
+	text       *string
+	done       *bool
+	recurrence *recurrence
+	pinned     *bool
+	// due is only set by PUT /todos/{id}/, the zero time clears it
+	due *time.Time
 }
 
 type inMemTodoService struct {
-	todos []*todo
+	mu                 sync.RWMutex
+	todos              []*todo
+	clock              Clock
+	maxTextLength      int
+	collapseWhitespace bool
+	// maxTodos caps the number of todos each owner has that aren't deleted
+	// or expired, 0 means no limit. When an owner's list is full, evictDone
+	// makes room by deleting their oldest done todo instead of rejecting
+	// the new one.
+	maxTodos  int
+	evictDone bool
+	// parseDueDates takes a trailing date phrase like "tomorrow" off new
+	// todos' text and uses it as the due date, see extractDue
+	parseDueDates bool
+	// updateSlugs regenerates a todo's slug when its text changes, which
+	// moves its permalink; the old one still redirects
+	updateSlugs bool
+	// ttl, unless 0, is how long todos live before they are left out of
+	// the list and then moved to the trash; ttlKeepDone spares done ones
+	ttl         time.Duration
+	ttlKeepDone bool
+}
+
+func newInMemTodoService(clock Clock) *inMemTodoService {
+	return &inMemTodoService{clock: clock}
+}
+
+var errTodoNotFound = errors.New("todo not found")
+
+type validationError struct {
+	key  string
+	args []interface{}
+}
+
+func (e *validationError) Error() string {
+	return fmt.Sprintf(e.key, e.args...)
+}
+
+var whitespaceRun = regexp.MustCompile(`\s+`)
+
+// normalizeTodoText trims text the way it is stored, collapsing runs of
+// whitespace too if asked.
+func normalizeTodoText(text string, collapse bool) string {
+	text = strings.TrimSpace(text)
+	if collapse {
+		text = whitespaceRun.ReplaceAllString(text, " ")
+	}
+	return text
+}
+
+func (s *inMemTodoService) cleanText(text string) (string, error) {
+	text = normalizeTodoText(text, s.collapseWhitespace)
+	if text == "" {
+		return "", &validationError{key: "Todo text is required."}
+	}
+	if s.maxTextLength > 0 && todoTextLength(text) > s.maxTextLength {
+		return "", &validationError{key: "Todo text must be at most %d characters.", args: []interface{}{s.maxTextLength}}
+	}
+	return text, nil
 }
 
-func (s *inMemTodoService) getTodoById(id uint64) (*todo, error) {
+func (s *inMemTodoService) getTodoById(ctx context.Context, id uint64) (*todo, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	owner := ownerFromContext(ctx)
+	s.mu.RLock()
+	defer s.mu.RUnlock()
 	for i := range s.todos {
-		if s.todos[i].Id == id {
-			return s.todos[i], nil
+		if s.todos[i].Id == id && s.todos[i].Owner == owner {
+			return s.todos[i].clone(), nil
 		}
 	}
-	return nil, fmt.Errorf("todo %d not found", id)
+	return nil, fmt.Errorf("todo %d: %w", id, errTodoNotFound)
 }
 
-func (s *inMemTodoService) findTodos(filter todoFilter) ([]*todo, error) {
+func (s *inMemTodoService) findTodos(ctx context.Context, filter todoFilter) ([]*todo, error) {
 	var todos []*todo
+	err := s.findTodosFunc(ctx, filter, func(t *todo) error {
+		todos = append(todos, t)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return todos, nil
+}
+
+// findTodosFunc calls fn with each todo the filter selects, in list order,
+// stopping at the first error fn returns, which it returns too. Unlike
+// findTodos it hands out one copy at a time, and a backend reading from a
+// database can stream its rows. fn must not call the service.
+func (s *inMemTodoService) findTodosFunc(ctx context.Context, filter todoFilter, fn func(*todo) error) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	filter = filter.forOwner(ctx)
+	now := s.clock.Now()
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	var found []*todo
 	for _, t := range s.todos {
-		if t.Deleted {
-			continue
+		if filter.matches(t, now) && !s.expired(t, now) {
+			found = append(found, t)
 		}
-		if filter.done != nil {
-			if t.Done == *filter.done {
-				todos = append(todos, t)
-			}
-		} else {
-			todos = append(todos, t)
+	}
+	sort.SliceStable(found, func(i, j int) bool {
+		if found[i].Pinned != found[j].Pinned {
+			return found[i].Pinned
+		}
+		return found[i].Position < found[j].Position
+	})
+	for _, t := range found {
+		if err := fn(t.clone()); err != nil {
+			return err
 		}
 	}
-	return todos, nil
+	return nil
+}
+
+// countTodos is findTodos for when only the number of todos is needed.
+func (s *inMemTodoService) countTodos(ctx context.Context, filter todoFilter) (int, error) {
+	if err := ctx.Err(); err != nil {
+		return 0, err
+	}
+	filter = filter.forOwner(ctx)
+	now := s.clock.Now()
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	n := 0
+	for _, t := range s.todos {
+		if filter.matches(t, now) && !s.expired(t, now) {
+			n++
+		}
+	}
+	return n, nil
+}
+
+// forOwner fills in the filter's owner from ctx unless it names one.
+func (filter todoFilter) forOwner(ctx context.Context) todoFilter {
+	if filter.owner == "" && !filter.allOwners {
+		filter.owner = ownerFromContext(ctx)
+	}
+	return filter
+}
+
+func (filter todoFilter) matches(t *todo, now time.Time) bool {
+	if filter.owner != "" && t.Owner != filter.owner {
+		return false
+	}
+	if !filter.includeSnoozed && t.SnoozedUntil.After(now) {
+		return false
+	}
+	if filter.modifiedSince != nil {
+		if t.UpdatedAt.Before(*filter.modifiedSince) {
+			return false
+		}
+	} else if t.Deleted != filter.deletedOnly {
+		return false
+	}
+	if filter.doneAfter != nil || filter.doneBefore != nil {
+		if !t.Done {
+			return false
+		}
+		if filter.doneAfter != nil && t.DoneAt.Before(*filter.doneAfter) {
+			return false
+		}
+		if filter.doneBefore != nil && !t.DoneAt.Before(*filter.doneBefore) {
+			return false
+		}
+	}
+	if filter.done != nil && t.Done != *filter.done {
+		return false
+	}
+	if filter.overdue && (t.Done || t.DueAt.IsZero() || !t.DueAt.Before(now)) {
+		return false
+	}
+	if filter.pinnedOnly && !t.Pinned {
+		return false
+	}
+	for _, id := range filter.excludeIds {
+		if t.Id == id {
+			return false
+		}
+	}
+	if filter.query != "" && !containsFolded(filter.lang, t.Text, filter.query) {
+		return false
+	}
+	return true
+}
+
+func (s *inMemTodoService) createTodo(ctx context.Context, todo *todo) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	text, err := s.cleanText(todo.Text)
+	if err != nil {
+		return err
+	}
+	todo.Text = text
+	todo.Owner = ownerFromContext(ctx)
+	if s.parseDueDates && todo.DueAt.IsZero() {
+		lang, ok := ctx.Value(languageTagKey).(language.Tag)
+		if !ok {
+			lang = language.English
+		}
+		if rest, due, ok := extractDue(todo.Text, lang, s.clock.Now().In(timeLocation(ctx))); ok {
+			todo.Text = rest
+			todo.DueAt = due
+		}
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if err := s.makeRoom(todo.Owner); err != nil {
+		return err
+	}
+	s.insertTodo(todo)
+	return nil
 }
 
-func (s *inMemTodoService) createTodo(todo *todo) error {
-	todo.Text = strings.TrimSpace(todo.Text)
-	if todo.Text == "" {
-		return fmt.Errorf("todo text is required")
+// makeRoom checks owner's todo limit before an insert for them, evicting
+// their oldest done todo if that policy is enabled; s.mu must be held for
+// writing. Other owners' todos neither count nor go.
+func (s *inMemTodoService) makeRoom(owner string) error {
+	if s.maxTodos <= 0 {
+		return nil
+	}
+	now := s.clock.Now()
+	active := 0
+	var oldestDone *todo
+	for _, t := range s.todos {
+		if t.Owner != owner || t.Deleted || s.expired(t, now) {
+			continue
+		}
+		active++
+		if t.Done && (oldestDone == nil || t.DoneAt.Before(oldestDone.DoneAt)) {
+			oldestDone = t
+		}
+	}
+	if active < s.maxTodos {
+		return nil
 	}
+	if s.evictDone && oldestDone != nil {
+		oldestDone.Deleted = true
+		oldestDone.DeletedAt = now
+		oldestDone.UpdatedAt = oldestDone.DeletedAt
+		oldestDone.record(eventDeleted, oldestDone.DeletedAt)
+		return nil
+	}
+	return &validationError{key: "The todo list is full (%d todos).", args: []interface{}{s.maxTodos}}
+}
+
+// insertTodo stores a copy of a new todo, filling in its id and
+// timestamps; s.mu must be held for writing.
+func (s *inMemTodoService) insertTodo(todo *todo) {
 	todo.Id = atomic.AddUint64(&latestTodoId, 1)
+	s.addTodo(todo)
+}
+
+// addTodo is insertTodo for a todo that already has its id.
+func (s *inMemTodoService) addTodo(todo *todo) {
 	todo.Done = false
-	todo.CreatedAt = time.Now()
+	todo.CreatedAt = s.clock.Now()
+	todo.UpdatedAt = todo.CreatedAt
 	todo.DoneAt = time.Time{}
 	todo.Deleted = false
 	todo.DeletedAt = time.Time{}
-	s.todos = append(s.todos, todo)
+	todo.Slug = slugify(todo.Text)
+	_, max := s.positionRange()
+	todo.Position = max + 1
+	todo.History = nil
+	todo.record(eventCreated, todo.CreatedAt)
+	s.todos = append(s.todos, todo.clone())
+}
+
+func (s *inMemTodoService) updateTodo(ctx context.Context, id uint64, update todoUpdate) (*todo, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	if update.text != nil {
+		text, err := s.cleanText(*update.text)
+		if err != nil {
+			return nil, err
+		}
+		update.text = &text
+	}
+	owner := ownerFromContext(ctx)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, t := range s.todos {
+		if t.Id == id && t.Owner == owner && !t.Deleted {
+			s.applyUpdate(t, update)
+			return t.clone(), nil
+		}
+	}
+	return nil, fmt.Errorf("todo %d: %w", id, errTodoNotFound)
+}
+
+// applyUpdate changes a stored todo, scheduling the next occurrence when a
+// recurring todo gets done; s.mu must be held for writing.
+func (s *inMemTodoService) applyUpdate(t *todo, update todoUpdate) {
+	now := s.clock.Now()
+	if update.text != nil && *update.text != t.Text {
+		t.record(eventEdited, now)
+	}
+	if update.text != nil {
+		t.Text = *update.text
+		if s.updateSlugs {
+			t.Slug = slugify(t.Text)
+		}
+	}
+	if update.recurrence != nil {
+		t.Recurrence = *update.recurrence
+	}
+	if update.pinned != nil {
+		t.Pinned = *update.pinned
+	}
+	if update.due != nil {
+		t.DueAt = *update.due
+	}
+	var completed bool
+	if update.done != nil {
+		completed = *update.done && !t.Done
+		if completed {
+			t.DoneAt = now
+			t.record(eventDone, now)
+		} else if !*update.done {
+			if t.Done {
+				t.record(eventUndone, now)
+			}
+			t.DoneAt = time.Time{}
+		}
+		t.Done = *update.done
+	}
+	t.UpdatedAt = now
+	if completed && t.Recurrence != recurNone {
+		due := t.DueAt
+		if due.IsZero() {
+			due = t.DoneAt
+		}
+		next := &todo{
+			Text:       t.Text,
+			DueAt:      t.Recurrence.next(due),
+			Recurrence: t.Recurrence,
+			Owner:      t.Owner,
+		}
+		s.insertTodo(next)
+	}
+}
+
+// setTodosDone marks several todos done or not done. Like deleteTodos it
+// is all or nothing.
+func (s *inMemTodoService) setTodosDone(ctx context.Context, ids []uint64, done bool) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	want := make(map[uint64]bool, len(ids))
+	for _, id := range ids {
+		want[id] = true
+	}
+	owner := ownerFromContext(ctx)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var found []*todo
+	for _, t := range s.todos {
+		if want[t.Id] && t.Owner == owner && !t.Deleted {
+			found = append(found, t)
+		}
+	}
+	if len(found) != len(want) {
+		return fmt.Errorf("could not update all todos (%d of %d): %w", len(found), len(want), errTodoNotFound)
+	}
+	for _, t := range found {
+		s.applyUpdate(t, todoUpdate{done: &done})
+	}
 	return nil
 }
 
-func (s *inMemTodoService) updateTodo(id uint64, update todoUpdate) (*todo, error) {
+// positionRange returns the lowest and highest position of the todos; s.mu
+// must be held.
+func (s *inMemTodoService) positionRange() (min, max int) {
 	for i, t := range s.todos {
-		if t.Id == id {
-			if update.text != nil {
-				s.todos[i].Text = *update.text
-			}
-			if update.done != nil {
-				s.todos[i].Done = *update.done
-				if *update.done {
-					s.todos[i].DoneAt = time.Now()
-				}
+		if i == 0 || t.Position < min {
+			min = t.Position
+		}
+		if i == 0 || t.Position > max {
+			max = t.Position
+		}
+	}
+	return min, max
+}
+
+// moveTodo puts a todo before all the others, or after them.
+func (s *inMemTodoService) moveTodo(ctx context.Context, id uint64, toTop bool) (*todo, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	owner := ownerFromContext(ctx)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, t := range s.todos {
+		if t.Id == id && t.Owner == owner && !t.Deleted {
+			min, max := s.positionRange()
+			if toTop {
+				t.Position = min - 1
+			} else {
+				t.Position = max + 1
 			}
-			return s.todos[i], nil
+			t.UpdatedAt = s.clock.Now()
+			return t.clone(), nil
 		}
 	}
-	return nil, fmt.Errorf("todo %d not found", id)
+	return nil, fmt.Errorf("todo %d: %w", id, errTodoNotFound)
 }
 
-func (s *inMemTodoService) deleteTodo(id uint64) error {
+func (s *inMemTodoService) snoozeTodo(ctx context.Context, id uint64, until time.Time) (*todo, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	owner := ownerFromContext(ctx)
+	s.mu.Lock()
+	defer s.mu.Unlock()
 	for i, t := range s.todos {
-		if t.Id == id {
+		if t.Id == id && t.Owner == owner && !t.Deleted {
+			s.todos[i].SnoozedUntil = until
+			s.todos[i].UpdatedAt = s.clock.Now()
+			return s.todos[i].clone(), nil
+		}
+	}
+	return nil, fmt.Errorf("todo %d: %w", id, errTodoNotFound)
+}
+
+func (s *inMemTodoService) deleteTodo(ctx context.Context, id uint64) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	owner := ownerFromContext(ctx)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for i, t := range s.todos {
+		if t.Id == id && t.Owner == owner {
 			s.todos[i].Deleted = true
-			s.todos[i].DeletedAt = time.Now()
+			s.todos[i].DeletedAt = s.clock.Now()
+			s.todos[i].UpdatedAt = s.todos[i].DeletedAt
+			s.todos[i].record(eventDeleted, s.todos[i].DeletedAt)
 			return nil
 		}
 	}
-	return fmt.Errorf("todo %d not found", id)
+	return fmt.Errorf("todo %d: %w", id, errTodoNotFound)
+}
+
+func (s *inMemTodoService) restoreTodo(ctx context.Context, id uint64) (*todo, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	owner := ownerFromContext(ctx)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, t := range s.todos {
+		if t.Id == id && t.Owner == owner && t.Deleted {
+			t.Deleted = false
+			t.DeletedAt = time.Time{}
+			t.UpdatedAt = s.clock.Now()
+			t.record(eventRestored, t.UpdatedAt)
+			return t.clone(), nil
+		}
+	}
+	return nil, fmt.Errorf("deleted todo %d: %w", id, errTodoNotFound)
+}
+
+// restoreAll takes every todo of the context's owner out of the trash and
+// reports how many there were.
+func (s *inMemTodoService) restoreAll(ctx context.Context) (int, error) {
+	if err := ctx.Err(); err != nil {
+		return 0, err
+	}
+	owner := ownerFromContext(ctx)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	n := 0
+	now := s.clock.Now()
+	for _, t := range s.todos {
+		if t.Deleted && t.Owner == owner {
+			t.Deleted = false
+			t.DeletedAt = time.Time{}
+			t.UpdatedAt = now
+			t.record(eventRestored, now)
+			n++
+		}
+	}
+	return n, nil
+}
+
+// emptyTrash removes every todo in the context owner's trash for good and
+// reports how many there were.
+func (s *inMemTodoService) emptyTrash(ctx context.Context) (int, error) {
+	if err := ctx.Err(); err != nil {
+		return 0, err
+	}
+	owner := ownerFromContext(ctx)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	kept := s.todos[:0]
+	for _, t := range s.todos {
+		if !t.Deleted || t.Owner != owner {
+			kept = append(kept, t)
+		}
+	}
+	n := len(s.todos) - len(kept)
+	for i := len(kept); i < len(s.todos); i++ {
+		s.todos[i] = nil
+	}
+	s.todos = kept
+	return n, nil
 }
 
-func (s *inMemTodoService) deleteTodos(ids []uint64) error {
-	var deleted int
+// purgeTodo removes a todo that is already in the trash for good.
+func (s *inMemTodoService) purgeTodo(ctx context.Context, id uint64) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	owner := ownerFromContext(ctx)
+	s.mu.Lock()
+	defer s.mu.Unlock()
 	for i, t := range s.todos {
-		for _, id := range ids {
-			if t.Id == id {
-				s.todos[i].Deleted = true
-				s.todos[i].DeletedAt = time.Now()
-			}
-			deleted++
+		if t.Id == id && t.Owner == owner && t.Deleted {
+			s.todos = append(s.todos[:i], s.todos[i+1:]...)
+			return nil
+		}
+	}
+	return fmt.Errorf("deleted todo %d: %w", id, errTodoNotFound)
+}
+
+// purgeExpired removes for good the todos that went into the trash before
+// the given time, and reports how many there were. Unlike the other changes
+// it applies to every owner's todos, for the background sweep.
+func (s *inMemTodoService) purgeExpired(ctx context.Context, before time.Time) (int, error) {
+	if err := ctx.Err(); err != nil {
+		return 0, err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	kept := s.todos[:0]
+	for _, t := range s.todos {
+		if t.Deleted && t.DeletedAt.Before(before) {
+			continue
+		}
+		kept = append(kept, t)
+	}
+	n := len(s.todos) - len(kept)
+	for i := len(kept); i < len(s.todos); i++ {
+		s.todos[i] = nil
+	}
+	s.todos = kept
+	return n, nil
+}
+
+func (s *inMemTodoService) deleteTodos(ctx context.Context, ids []uint64) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	want := make(map[uint64]bool, len(ids))
+	for _, id := range ids {
+		want[id] = true
+	}
+	owner := ownerFromContext(ctx)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var found []*todo
+	for _, t := range s.todos {
+		if want[t.Id] && t.Owner == owner && !t.Deleted {
+			found = append(found, t)
 		}
 	}
-	if deleted != len(ids) {
-		return fmt.Errorf("could not delete all todos (%d of %d)", deleted, len(ids))
+	// all or nothing, so a stale id doesn't leave a partial deletion behind
+	if len(found) != len(want) {
+		return fmt.Errorf("could not delete all todos (%d of %d): %w", len(found), len(want), errTodoNotFound)
+	}
+	now := s.clock.Now()
+	for _, t := range found {
+		t.Deleted = true
+		t.DeletedAt = now
+		t.UpdatedAt = now
+		t.record(eventDeleted, now)
 	}
 	return nil
 }
@@ -158,43 +886,96 @@ func (s *inMemTodoService) deleteTodos(ids []uint64) error {
 type server struct {
 	templates   map[string]*template.Template
 	todoService todoService
+	clock       Clock
+	basePath    string
+	metrics     *metrics
+	readOnly    bool
+	idempotency *idempotencyStore
+	// maxTodoLength and collapseWhitespace follow the todo service's text
+	// rules, for the character counter of the new-todo input
+	maxTodoLength      int
+	collapseWhitespace bool
+	// reminderWindow is how far ahead /todos/reminders looks by default
+	reminderWindow time.Duration
+	// defaultFilter is the state filter applied when none is chosen
+	defaultFilter string
+	// changes is set when live updates over a websocket are enabled
+	changes *changeBroker
+	// deleteTokens is set when deletes need a confirmation round trip
+	deleteTokens *deleteTokens
+	// pendingDeletes is set when deletes from the list can be undone
+	pendingDeletes *pendingDeletes
+	// sessions is set when the todos are behind a password login
+	sessions *sessions
+	// maintenance holds the current maintenanceMode
+	maintenance int32
+	// secureCookies marks cookies Secure when serving over TLS
+	secureCookies bool
+	// cookieDomain, cookieMaxAge and cookieSameSite apply to the
+	// preference cookies set by setCookie
+	cookieDomain   string
+	cookieMaxAge   time.Duration
+	cookieSameSite http.SameSite
+	// appName brands the pages, favicon is served at /favicon.ico
+	appName     string
+	favicon     []byte
+	faviconType string
+	robotsTxt   []byte
+}
+
+func (s *server) url(path string) string {
+	return s.basePath + path
 }
 
 func debugLog(fmt string, a ...interface{}) {
 	if _, ok := os.LookupEnv("DEBUG"); ok {
 		log.Printf("\x1b[1;32m[DEBUG]\x1b[0m "+fmt, a...)
+	} else {
+		debugf(context.Background(), fmt, a...)
 	}
 }
 
-func preprocessTemplates(basePath string, partialPaths, pagePaths []string, funcs template.FuncMap) map[string]*template.Template {
+func preprocessTemplates(fsys fs.FS, basePath string, partialPaths, pagePaths []string, funcs template.FuncMap) map[string]*template.Template {
 	templates := make(map[string]*template.Template)
 
-	filename := filepath.Base(basePath)
+	filename := path.Base(basePath)
 	base := template.New(filename).Funcs(funcs)
 	debugLog("parsing base %s", basePath)
-	base = template.Must(base.ParseFS(f, basePath))
+	base = template.Must(base.ParseFS(fsys, basePath))
 	templates[base.Name()] = base
 
-	for _, path := range partialPaths {
-		debugLog("parsing partial %s", path)
-		t := template.Must(base.ParseFS(f, path))
-		filename := filepath.Base(path)
+	for _, p := range partialPaths {
+		debugLog("parsing partial %s", p)
+		t := template.Must(base.ParseFS(fsys, p))
+		filename := path.Base(p)
 		templates[filename] = t
 	}
 
-	for _, path := range pagePaths {
-		debugLog("parsing page %s", path)
+	for _, p := range pagePaths {
+		debugLog("parsing page %s", p)
 		base := template.Must(templates[base.Name()].Clone())
-		t := template.Must(base.ParseFS(f, path))
-		filename := filepath.Base(path)
+		t := template.Must(base.ParseFS(fsys, p))
+		filename := path.Base(p)
 		templates[filename] = t
 	}
 
 	return templates
 }
 
-func newServer() *server {
-	s := &server{}
+func newServer(templateFS fs.FS, basePath string, svc todoService) *server {
+	s := &server{
+		basePath:       basePath,
+		todoService:    svc,
+		clock:          realClock{},
+		reminderWindow: 24 * time.Hour,
+		idempotency:    newIdempotencyStore(idempotencyKeyTTL, maxIdempotencyKeys),
+		cookieMaxAge:   365 * 24 * time.Hour,
+		cookieSameSite: http.SameSiteLaxMode,
+		appName:        defaultAppName,
+		favicon:        defaultFavicon,
+		faviconType:    "image/x-icon",
+		robotsTxt:      []byte(defaultRobotsTxt),
+	}
 
 	funcs := template.FuncMap{
 		"activeLang": func(r *http.Request) language.Tag {
@@ -206,37 +987,162 @@ func newServer() *server {
 		},
 
 		"T": func(r *http.Request, key string, a ...interface{}) string {
-			p := r.Context().Value(messagePrinterKey).(*message.Printer)
-			return p.Sprintf(key, a...)
+			return printer(r).Sprintf(key, a...)
 		},
 
 		"csrfToken": func(r *http.Request) string {
 			return csrf.Token(r)
 		},
-	}
 
-	s.templates = setupTemplates(funcs)
-	s.todoService = &inMemTodoService{}
+		"activeTheme": func(r *http.Request) string {
+			return r.Context().Value(themeKey).(string)
+		},
 
-	return s
-}
+		"day": func(r *http.Request, t time.Time) string {
+			return formatDay(printer(r), t)
+		},
 
-func setupTemplates(funcs template.FuncMap) map[string]*template.Template {
-	mustGlob := func(matches []string, err error) []string {
+		// formatDate renders a date without the weekday, such as
+		// "January 2, 2006", in the request's language.
+		"formatDate": func(r *http.Request, t time.Time) string {
+			return formatDate(printer(r), t.In(timeLocation(r.Context())))
+		},
+
+		// relativeTime describes t relative to now, such as "3 hours ago"
+		// or "in 2 days", in the request's language.
+		"relativeTime": func(r *http.Request, t time.Time) string {
+			return relativeTime(printer(r), t.In(timeLocation(r.Context())), s.clock.Now())
+		},
+
+		// refreshEvery is an hx-trigger that keeps a relativeTime of t
+		// up to date, or nothing when it no longer changes
+		"refreshEvery": func(t time.Time) string {
+			if d := relativeTimeRefresh(t, s.clock.Now()); d > 0 {
+				return fmt.Sprintf("every %ds", int(d.Seconds()))
+			}
+			return ""
+		},
+
+		// local shows t in the time zone of the user making r
+		"local": func(r *http.Request, t time.Time) time.Time {
+			return t.In(timeLocation(r.Context()))
+		},
+
+		// truncate shortens s to at most n characters, ending it with an
+		// ellipsis when anything was cut.
+		"truncate": truncate,
+
+		// checked renders the checked attribute of a checkbox when b is
+		// true.
+		"checked": func(b bool) template.HTMLAttr {
+			if b {
+				return "checked"
+			}
+			return ""
+		},
+
+		"idempotencyKey": randomToken,
+
+		"listQuery": func(r *http.Request) template.URL {
+			return template.URL(listQuery(r).Encode())
+		},
+
+		"viewState": func(r *http.Request) string {
+			return encodeViewState(listQuery(r))
+		},
+
+		"themes": func() []Theme {
+			return supportedThemes
+		},
+
+		"now": func() time.Time {
+			return s.clock.Now()
+		},
+
+		"newTodoForm": func(r *http.Request) newTodoForm {
+			return newTodoForm{Request: r}
+		},
+
+		"activeDoneDisplay": func(r *http.Request) string {
+			return doneDisplay(r.Context())
+		},
+		"doneDisplays": func() []DoneDisplay {
+			return doneDisplays
+		},
+		"activeTimezone": func(r *http.Request) string {
+			return timeLocation(r.Context()).String()
+		},
+
+		"readOnly": func() bool {
+			return s.readOnly
+		},
+
+		"liveUpdates": func() bool {
+			return s.changes != nil
+		},
+
+		"confirmDeletes": func() bool {
+			return s.deleteTokens != nil
+		},
+
+		"loggedIn": s.loggedIn,
+
+		"permalink": s.permalink,
+
+		"appName": func() string {
+			return s.appName
+		},
+
+		"basePath": func() string {
+			return s.basePath
+		},
+	}
+
+	s.templates = setupTemplates(templateFS, funcs)
+
+	return s
+}
+
+// embeddedTemplates returns the templates compiled into the binary, rooted
+// at the template directory.
+func embeddedTemplates() fs.FS {
+	sub, err := fs.Sub(f, "template")
+	if err != nil {
+		panic(err)
+	}
+	return sub
+}
+
+// templatesFS returns a filesystem rooted at dir if it exists, so
+// templates can be edited without rebuilding, falling back to the
+// embedded templates otherwise.
+func templatesFS(dir string) fs.FS {
+	if dir != "" {
+		if info, err := os.Stat(dir); err == nil && info.IsDir() {
+			log.Printf("loading templates from %s", dir)
+			return os.DirFS(dir)
+		}
+		warnf(context.Background(), "template directory %q not found, using embedded templates", dir)
+	}
+	return embeddedTemplates()
+}
+
+func setupTemplates(fsys fs.FS, funcs template.FuncMap) map[string]*template.Template {
+	mustGlob := func(matches []string, err error) []string {
 		if err != nil {
 			panic(err)
 		}
 		return matches
 	}
 
-	basePath := filepath.Join("template", "base.html")
-	partialPaths := mustGlob(fs.Glob(f, filepath.Join("template", "partial", "*.html")))
-	pagePaths := mustGlob(fs.Glob(f, filepath.Join("template", "page", "*.html")))
+	basePath := "base.html"
+	partialPaths := mustGlob(fs.Glob(fsys, path.Join("partial", "*.html")))
+	pagePaths := mustGlob(fs.Glob(fsys, path.Join("page", "*.html")))
 
-	return preprocessTemplates(basePath, partialPaths, pagePaths, funcs)
+	return preprocessTemplates(fsys, basePath, partialPaths, pagePaths, funcs)
 }
 
-func renderPage(templates map[string]*template.Template, name string, w http.ResponseWriter, data interface{}) error {
+func renderPage(templates map[string]*template.Template, name string, w http.ResponseWriter, status int, data interface{}) error {
 	w.Header().Set("Content-Type", "text/html")
 	t, ok := templates[name]
 	if !ok {
@@ -247,14 +1153,232 @@ func renderPage(templates map[string]*template.Template, name string, w http.Res
 	if err = t.ExecuteTemplate(&b, name, data); err != nil {
 		return fmt.Errorf("executing template %q: %w", name, err)
 	}
+	w.Header().Set("Content-Length", strconv.Itoa(b.Len()))
+	w.WriteHeader(status)
 	if _, err = io.Copy(w, &b); err != nil {
 		return fmt.Errorf("copying rendered template to response: %w", err)
 	}
 	return nil
 }
 
+// streamThreshold is the number of todos above which the list page is
+// streamed to the client rather than rendered into a buffer first.
+const streamThreshold = 500
+
+// streamChunkSize is how much rendered output is held before it's written
+// and flushed to the client.
+const streamChunkSize = 32 << 10
+
+// flushWriter flushes the response after every write.
+type flushWriter struct {
+	w http.ResponseWriter
+}
+
+func (fw flushWriter) Write(b []byte) (int, error) {
+	n, err := fw.w.Write(b)
+	if f, ok := fw.w.(http.Flusher); ok {
+		f.Flush()
+	}
+	return n, err
+}
+
+// streamPage is like renderPage but writes the output in chunks as it is
+// rendered, so a large page is never held in memory whole. The status has
+// been sent by the time an error happens, so errors can only be logged.
+func streamPage(templates map[string]*template.Template, name string, w http.ResponseWriter, data interface{}) error {
+	t, ok := templates[name]
+	if !ok {
+		return fmt.Errorf("unknown template %q", name)
+	}
+	w.Header().Set("Content-Type", "text/html")
+	bw := bufio.NewWriterSize(flushWriter{w}, streamChunkSize)
+	if err := t.ExecuteTemplate(bw, name, data); err != nil {
+		return fmt.Errorf("executing template %q: %w", name, err)
+	}
+	if err := bw.Flush(); err != nil {
+		return fmt.Errorf("flushing rendered template to response: %w", err)
+	}
+	return nil
+}
+
+func truncate(s string, n int) string {
+	r := []rune(s)
+	if len(r) <= n {
+		return s
+	}
+	if n < 1 {
+		return ""
+	}
+	return string(r[:n-1]) + "…"
+}
+
+type fragment struct {
+	name string
+	data interface{}
+}
+
+func renderOOB(templates map[string]*template.Template, w http.ResponseWriter, fragments ...fragment) error {
+	w.Header().Set("Content-Type", "text/html")
+	var b bytes.Buffer
+	for _, frag := range fragments {
+		t, ok := templates[frag.name]
+		if !ok {
+			return fmt.Errorf("unknown template %q", frag.name)
+		}
+		if err := t.ExecuteTemplate(&b, frag.name, frag.data); err != nil {
+			return fmt.Errorf("executing template %q: %w", frag.name, err)
+		}
+	}
+	if _, err := io.Copy(w, &b); err != nil {
+		return fmt.Errorf("copying rendered fragments to response: %w", err)
+	}
+	return nil
+}
+
+func handleOOB(templates map[string]*template.Template, w http.ResponseWriter, fragments ...fragment) error {
+	if err := renderOOB(templates, w, fragments...); err != nil {
+		log.Printf("rendering fragments: %v", err)
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return err
+	}
+	return nil
+}
+
+// liveMessage is an announcement for the page's aria-live region. Row is set
+// when the response is made of table rows, since htmx drops anything else
+// when it parses those.
+type liveMessage struct {
+	Message string
+	Row     bool
+}
+
+func announce(r *http.Request, row bool, key string) fragment {
+	return fragment{"live-region.html", liveMessage{printer(r).Sprintf(key), row}}
+}
+
+func countFragments(data todoListItem) []fragment {
+	return []fragment{
+		{"todo-progress.html", data},
+		{"todo-list-number.html", data},
+	}
+}
+
+var errorCodes = map[int]string{
+	400: "bad_request",
+	403: "forbidden",
+	404: "not_found",
+	405: "method_not_allowed",
+	409: "conflict",
+	413: "request_too_large",
+	422: "validation_failed",
+	500: "internal",
+	503: "unavailable",
+}
+
+func writeJSONError(w http.ResponseWriter, status int, code, message string) {
+	var body struct {
+		Error struct {
+			Code    string `json:"code"`
+			Message string `json:"message"`
+		} `json:"error"`
+	}
+	body.Error.Code = code
+	body.Error.Message = message
+	if err := renderJSON(w, status, body); err != nil {
+		log.Printf("rendering json error: %v", err)
+	}
+}
+
+// respondErrorMessage writes an error with a localized message, as JSON for
+// API clients, as an error page for browsers and as plain text for htmx.
+func respondErrorMessage(w http.ResponseWriter, r *http.Request, status int, key string, a ...interface{}) {
+	message := printer(r).Sprintf(key, a...)
+	switch negotiate(r) {
+	case formatJSON:
+		code, ok := errorCodes[status]
+		if !ok {
+			code = "error"
+		}
+		writeJSONError(w, status, code, message)
+		return
+	case formatHTML:
+		if renderErrorPage(w, r, status, message) {
+			return
+		}
+	}
+	http.Error(w, message, status)
+}
+
+// templatesKey holds the server's templates in the request context, for
+// rendering error pages from outside the server's methods.
+const templatesKey contextKey = 5
+
+type errorPage struct {
+	Request    *http.Request
+	Status     int
+	StatusText string
+	Message    string
+}
+
+// renderErrorPage writes the error page, reporting false without writing
+// anything when it can't be rendered so the caller can fall back to plain
+// text.
+func renderErrorPage(w http.ResponseWriter, r *http.Request, status int, message string) bool {
+	templates, ok := r.Context().Value(templatesKey).(map[string]*template.Template)
+	if !ok {
+		return false
+	}
+	t, ok := templates["error.html"]
+	if !ok {
+		return false
+	}
+	var b bytes.Buffer
+	data := errorPage{r, status, http.StatusText(status), message}
+	if err := t.ExecuteTemplate(&b, "error.html", data); err != nil {
+		logf(r.Context(), "rendering error page: %v", err)
+		return false
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.WriteHeader(status)
+	if _, err := b.WriteTo(w); err != nil {
+		logf(r.Context(), "writing error page: %v", err)
+	}
+	return true
+}
+
+func respondError(w http.ResponseWriter, r *http.Request, status int) {
+	respondErrorMessage(w, r, status, http.StatusText(status))
+}
+
+// respondServiceError maps an error returned by the todo service to a
+// response: 422 for invalid input, 404 for missing todos, 500 otherwise.
+func respondServiceError(w http.ResponseWriter, r *http.Request, err error) {
+	status, key, args := serviceErrorMessage(err)
+	respondErrorMessage(w, r, status, key, args...)
+}
+
+func serviceErrorMessage(err error) (status int, key string, args []interface{}) {
+	var verr *validationError
+	switch {
+	case errors.As(err, &verr):
+		return 422, verr.key, verr.args
+	case errors.Is(err, errTodoNotFound):
+		return 404, http.StatusText(404), nil
+	default:
+		return 500, http.StatusText(500), nil
+	}
+}
+
 func handlePage(templates map[string]*template.Template, name string, w http.ResponseWriter, data interface{}) error {
-	if err := renderPage(templates, name, w, data); err != nil {
+	return handlePageStatus(templates, name, w, 200, data)
+}
+
+// handlePageStatus is handlePage for a page sent with another status. The
+// status goes out with the headers once the page has rendered, so a failure
+// still turns into a clean 500.
+func handlePageStatus(templates map[string]*template.Template, name string, w http.ResponseWriter, status int, data interface{}) error {
+	if err := renderPage(templates, name, w, status, data); err != nil {
 		log.Printf("rendering page: %v", err)
 		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
 		return err
@@ -262,6 +1386,96 @@ func handlePage(templates map[string]*template.Template, name string, w http.Res
 	return nil
 }
 
+type responseFormat int
+
+const (
+	formatHTML responseFormat = iota
+	formatHTMLFragment
+	formatJSON
+)
+
+func negotiate(r *http.Request) responseFormat {
+	if r.Header.Get("HX-Request") == "true" {
+		return formatHTMLFragment
+	}
+	accept := r.Header.Get("Accept")
+	jsonIdx := strings.Index(accept, "application/json")
+	htmlIdx := strings.Index(accept, "text/html")
+	if jsonIdx >= 0 && (htmlIdx < 0 || jsonIdx < htmlIdx) {
+		return formatJSON
+	}
+	return formatHTML
+}
+
+// Events sent to the browser in the HX-Trigger response header, which
+// htmx dispatches on the body:
+//
+//	newTodo      (no payload) the todo list should be reloaded
+//	todoCreated  {"id": N} a todo was created; the new-todo input is reset
+//	             and refocused
+//	todoUpdated  {"id": N} a todo's text or state changed; focus returns to
+//	             its row
+//	todoDeleted  {"id": N} a todo was deleted; focus moves to the new-todo
+//	             input
+//	showToast    {"message": "..."} a short notice is shown to the user
+const (
+	eventNewTodo     = "newTodo"
+	eventTodoCreated = "todoCreated"
+	eventTodoUpdated = "todoUpdated"
+	eventTodoDeleted = "todoDeleted"
+	eventShowToast   = "showToast"
+)
+
+type todoEventPayload struct {
+	Id uint64 `json:"id"`
+}
+
+type toastPayload struct {
+	Message string `json:"message"`
+}
+
+// setHxTrigger adds an event to the HX-Trigger response header, keeping any
+// events already set on it.
+func setHxTrigger(w http.ResponseWriter, event string, payload interface{}) {
+	events := make(map[string]interface{})
+	if v := w.Header().Get("HX-Trigger"); v != "" {
+		if err := json.Unmarshal([]byte(v), &events); err != nil {
+			for _, name := range strings.Split(v, ",") {
+				events[strings.TrimSpace(name)] = nil
+			}
+		}
+	}
+	events[event] = payload
+	b, err := json.Marshal(events)
+	if err != nil {
+		log.Printf("encoding HX-Trigger events: %v", err)
+		return
+	}
+	w.Header().Set("HX-Trigger", string(b))
+}
+
+func renderJSON(w http.ResponseWriter, status int, data interface{}) error {
+	var b bytes.Buffer
+	if err := json.NewEncoder(&b).Encode(data); err != nil {
+		return fmt.Errorf("encoding json: %w", err)
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if _, err := io.Copy(w, &b); err != nil {
+		return fmt.Errorf("copying encoded json to response: %w", err)
+	}
+	return nil
+}
+
+func handleJSON(w http.ResponseWriter, status int, data interface{}) error {
+	if err := renderJSON(w, status, data); err != nil {
+		log.Printf("rendering json: %v", err)
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return err
+	}
+	return nil
+}
+
 func (s *server) indexHandler(w http.ResponseWriter, r *http.Request) {
 	handlePage(s.templates, "index.html", w, struct {
 		Request *http.Request
@@ -270,50 +1484,217 @@ func (s *server) indexHandler(w http.ResponseWriter, r *http.Request) {
 	})
 }
 
+// paramFilter is a link in the list footer. Filters sharing a Param are
+// mutually exclusive; a filter with its own Param toggles independently, so
+// the links combine with AND semantics.
 type paramFilter struct {
 	Label  string
+	Param  string
 	Value  string
 	Active bool
+	Href   string
 }
 
-func getParamFilters() []paramFilter {
+func getParamFilters(p *message.Printer) []paramFilter {
 	paramFilters := []paramFilter{
-		{Label: "All", Value: "", Active: true},
-		{Label: "Remaining", Value: "notdone"},
-		{Label: "Done", Value: "done"},
+		{Label: p.Sprintf("All"), Param: "filter", Value: "all", Active: true},
+		{Label: p.Sprintf("Remaining"), Param: "filter", Value: "notdone"},
+		{Label: p.Sprintf("Done"), Param: "filter", Value: "done"},
+		{Label: p.Sprintf("Completed today"), Param: "filter", Value: "donetoday"},
+		{Label: p.Sprintf("Trash"), Param: "filter", Value: "deleted"},
+		{Label: p.Sprintf("Overdue"), Param: "overdue", Value: "1"},
+		{Label: p.Sprintf("Pinned"), Param: "pinned", Value: "1"},
 	}
 	return paramFilters
 }
 
-func applyFilter(filter *todoFilter, filters []paramFilter, r *http.Request) {
-	if v := r.FormValue("filter"); v != "" {
-		for i, f := range filters {
-			if f.Value == v {
-				filters[i].Active = true
-			} else {
-				filters[i].Active = false
+var listQueryKeys = []string{"filter", "overdue", "pinned", "q", "done_after", "done_before", "snoozed"}
+
+// listQuery returns the query parameters that select the current todo list,
+// so links and reloads can preserve the full filter combination. Parameters
+// given on their own win over those packed in the state parameter.
+func listQuery(r *http.Request) url.Values {
+	query := viewState(r)
+	for _, key := range listQueryKeys {
+		if v := r.FormValue(key); v != "" {
+			query.Set(key, v)
+		}
+	}
+	return query
+}
+
+func filterHref(r *http.Request, f paramFilter) string {
+	query := listQuery(r)
+	switch {
+	case f.Param == "filter":
+		query.Set(f.Param, f.Value)
+	case f.Active:
+		query.Del(f.Param)
+	default:
+		query.Set(f.Param, f.Value)
+	}
+	if query.Get("filter") == "" {
+		query.Del("filter")
+	}
+	if len(query) == 0 {
+		return "./"
+	}
+	return "./?" + query.Encode()
+}
+
+func parseFilterTime(v string, loc *time.Location) (time.Time, error) {
+	if t, err := time.Parse(time.RFC3339, v); err == nil {
+		return t, nil
+	}
+	return time.ParseInLocation("2006-01-02", v, loc)
+}
+
+func startOfDay(t time.Time) time.Time {
+	y, m, d := t.Date()
+	return time.Date(y, m, d, 0, 0, 0, 0, t.Location())
+}
+
+const filterCookieName = "filter"
+
+func isStateFilter(v string) bool {
+	for _, f := range getParamFilters(message.NewPrinter(language.English)) {
+		if f.Param == "filter" && f.Value == v {
+			return true
+		}
+	}
+	return false
+}
+
+// defaultFilterValue is the state filter used when the request doesn't pick
+// one: the one the user last chose, else the configured default.
+func (s *server) defaultFilterValue(r *http.Request) string {
+	if c, err := r.Cookie(filterCookieName); err == nil && isStateFilter(c.Value) {
+		return c.Value
+	}
+	return s.defaultFilter
+}
+
+func (s *server) rememberFilter(w http.ResponseWriter, r *http.Request) {
+	v := r.URL.Query().Get("filter")
+	if !isStateFilter(v) {
+		return
+	}
+	s.setCookie(w, filterCookieName, v)
+}
+
+// setCookie sets one of the cookies that remember a user's preferences.
+func (s *server) setCookie(w http.ResponseWriter, name, value string) {
+	http.SetCookie(w, &http.Cookie{
+		Name:     name,
+		Value:    value,
+		Path:     s.url("/"),
+		Domain:   s.cookieDomain,
+		MaxAge:   int(s.cookieMaxAge.Seconds()),
+		SameSite: s.cookieSameSite,
+		HttpOnly: true,
+		Secure:   s.secureCookies,
+	})
+}
+
+// clearCookie removes a cookie set by setCookie.
+func (s *server) clearCookie(w http.ResponseWriter, name string) {
+	http.SetCookie(w, &http.Cookie{
+		Name:     name,
+		Path:     s.url("/"),
+		Domain:   s.cookieDomain,
+		MaxAge:   -1,
+		SameSite: s.cookieSameSite,
+		HttpOnly: true,
+		Secure:   s.secureCookies,
+	})
+}
+
+func parseSameSite(v string) (http.SameSite, bool) {
+	switch strings.ToLower(v) {
+	case "lax":
+		return http.SameSiteLaxMode, true
+	case "strict":
+		return http.SameSiteStrictMode, true
+	case "none":
+		return http.SameSiteNoneMode, true
+	}
+	return http.SameSiteDefaultMode, false
+}
+
+func applyFilter(filter *todoFilter, filters []paramFilter, r *http.Request, now time.Time, defaultFilter string) {
+	query := listQuery(r)
+	filter.includeSnoozed = query.Get("snoozed") == "include"
+	filter.overdue = query.Get("overdue") != ""
+	filter.pinnedOnly = query.Get("pinned") != ""
+	filter.query = strings.TrimSpace(query.Get("q"))
+	filter.lang, _ = r.Context().Value(languageTagKey).(language.Tag)
+	for _, param := range []struct {
+		key string
+		dst **time.Time
+	}{
+		{"done_after", &filter.doneAfter},
+		{"done_before", &filter.doneBefore},
+	} {
+		if v := query.Get(param.key); v != "" {
+			t, err := parseFilterTime(v, now.Location())
+			if err != nil {
+				warnf(r.Context(), "invalid %s value %q", param.key, v)
+				continue
 			}
+			*param.dst = &t
+		}
+	}
+
+	state := query.Get("filter")
+	// the default view leaves done todos to the Done filter when they are
+	// hidden, but choosing All explicitly still shows them
+	hideDone := state == "" && doneDisplay(r.Context()) == doneHide
+	if state == "" {
+		state = defaultFilter
+	}
+	for i, f := range filters {
+		if f.Param != "filter" {
+			filters[i].Active = query.Get(f.Param) == f.Value
+		} else if state != "" {
+			filters[i].Active = f.Value == state
 		}
+	}
+	for i := range filters {
+		filters[i].Href = filterHref(r, filters[i])
+	}
 
+	if state != "" {
 		var done bool
-		switch v {
+		switch state {
+		case "all":
+			if hideDone {
+				filter.done = &done
+			}
 		case "done":
 			done = true
 			filter.done = &done
 		case "notdone":
 			done = false
 			filter.done = &done
+		case "donetoday":
+			done = true
+			filter.done = &done
+			today := startOfDay(now)
+			filter.doneAfter = &today
+		case "deleted":
+			filter.deletedOnly = true
 		default:
-			log.Printf("[WARN] unknown filter value %q", v)
+			warnf(r.Context(), "unknown filter value %q", state)
 		}
 	}
 }
 
 func (s *server) getFilteredTodoListItems(r *http.Request, updateNumber bool) ([]todoListItem, []paramFilter, error) {
-	paramFilters := getParamFilters()
+	paramFilters := getParamFilters(printer(r))
 	var filter todoFilter
-	applyFilter(&filter, paramFilters, r)
-	todos, err := s.todoService.findTodos(filter)
+	applyFilter(&filter, paramFilters, r, s.now(r), s.defaultFilterValue(r))
+	filter.excludeIds = s.pendingDeleteIds()
+	todos, err := s.todoService.findTodos(r.Context(), filter)
 	if err != nil {
 		return nil, nil, fmt.Errorf("finding todos: %w", err)
 	}
@@ -329,75 +1710,298 @@ func (s *server) getFilteredTodoListItems(r *http.Request, updateNumber bool) ([
 	return items, paramFilters, nil
 }
 
+// countFilteredTodos counts the todos getFilteredTodoListItems would list.
+func (s *server) countFilteredTodos(r *http.Request) (int, error) {
+	var filter todoFilter
+	applyFilter(&filter, getParamFilters(printer(r)), r, s.now(r), s.defaultFilterValue(r))
+	filter.excludeIds = s.pendingDeleteIds()
+	n, err := s.todoService.countTodos(r.Context(), filter)
+	if err != nil {
+		return 0, fmt.Errorf("counting todos: %w", err)
+	}
+	return n, nil
+}
+
 type todoListItem struct {
 	Request             *http.Request
 	Todo                *todo
 	UpdateNumber        bool
 	FilteredTodosNumber int
+	Progress            todoProgress
+}
+
+type todoProgress struct {
+	Total     int
+	Done      int
+	Remaining int
+	Percent   int
+}
+
+func (s *server) getProgress(r *http.Request) (todoProgress, error) {
+	pending := s.pendingDeleteIds()
+	total, err := s.todoService.countTodos(r.Context(), todoFilter{includeSnoozed: true, excludeIds: pending})
+	if err != nil {
+		return todoProgress{}, fmt.Errorf("counting todos: %w", err)
+	}
+	done := true
+	doneCount, err := s.todoService.countTodos(r.Context(), todoFilter{includeSnoozed: true, done: &done, excludeIds: pending})
+	if err != nil {
+		return todoProgress{}, fmt.Errorf("counting done todos: %w", err)
+	}
+	progress := todoProgress{Total: total, Done: doneCount}
+	progress.Remaining = progress.Total - progress.Done
+	if progress.Total > 0 {
+		progress.Percent = progress.Done * 100 / progress.Total
+	}
+	return progress, nil
 }
 
 func (s *server) todosIndexHandler(w http.ResponseWriter, r *http.Request) {
 	if r.Method == "POST" {
+		if !parseForm(w, r) {
+			return
+		}
 		newTodo := r.FormValue("new-todo")
 		newTodo = strings.TrimSpace(newTodo)
 		if newTodo == "" {
-			log.Printf("invalid todo form")
+			logf(r.Context(), "invalid todo form")
+			if negotiate(r) == formatJSON {
+				respondServiceError(w, r, &validationError{key: "Todo text is required."})
+				return
+			}
 			// invalid form, render page with errors
 		} else {
 			todo := todo{Text: newTodo}
-			err := s.todoService.createTodo(&todo)
+			recur, err := parseRecurrence(r.FormValue("recurrence"))
 			if err != nil {
-				log.Printf("creating todo: %v", err)
-				http.Error(w, http.StatusText(500), 500)
+				logf(r.Context(), "parsing recurrence: %v", err)
+				respondServiceError(w, r, err)
 				return
 			}
-			if r.Header.Get("HX-Request") == "true" {
-				w.Header().Set("HX-Trigger", "newTodo")
-				handlePage(s.templates, "new-todo-form.html", w, map[string]interface{}{
-					"Request": r,
-				})
-			} else {
-				http.Redirect(w, r, "/todos/", 302)
+			todo.Recurrence = recur
+			if v := r.FormValue("due"); v != "" {
+				due, err := time.ParseInLocation("2006-01-02", v, timeLocation(r.Context()))
+				if err != nil {
+					logf(r.Context(), "parsing due date: %v", err)
+					respondError(w, r, 400)
+					return
+				}
+				todo.DueAt = due
+			}
+			if r.FormValue("multi") != "" {
+				s.createTodoLines(w, r, newTodo, todo)
+				return
+			}
+			create := func() (uint64, error) {
+				err := s.todoService.createTodo(r.Context(), &todo)
+				return todo.Id, err
+			}
+			if key := idempotencyKey(r); key != "" {
+				id, created, err := s.idempotency.do(ownerFromContext(r.Context()), key, s.clock.Now(), create)
+				if err != nil {
+					logf(r.Context(), "creating todo: %v", err)
+					respondServiceError(w, r, err)
+					return
+				}
+				if !created {
+					// a retry of a create that already succeeded
+					existing, err := s.todoService.getTodoById(r.Context(), id)
+					if err != nil {
+						logf(r.Context(), "getting todo by id: %v", err)
+						respondServiceError(w, r, err)
+						return
+					}
+					todo = *existing
+				}
+			} else if _, err := create(); err != nil {
+				logf(r.Context(), "creating todo: %v", err)
+				respondServiceError(w, r, err)
+				return
+			}
+			switch negotiate(r) {
+			case formatHTMLFragment:
+				setHxTrigger(w, eventNewTodo, nil)
+				setHxTrigger(w, eventTodoCreated, todoEventPayload{todo.Id})
+				handleOOB(s.templates, w,
+					fragment{"new-todo-form.html", newTodoForm{Request: r}},
+					announce(r, false, "Todo added"))
+			case formatJSON:
+				handleJSON(w, 201, todoJSON(&todo))
+			default:
+				http.Redirect(w, r, s.url("/todos/"), 302)
 			}
 			return
 		}
 	}
 
-	todos, paramFilters, err := s.getFilteredTodoListItems(r, false)
-	if err != nil {
-		log.Printf("finding todos: %v", err)
-		http.Error(w, http.StatusText(500), 500)
+	if r.FormValue("reset") != "" {
+		s.resetFilters(w, r)
 		return
 	}
-
-	data := struct {
-		Request             *http.Request
-		Todos               []todoListItem
-		UpdateNumber        bool
-		FilteredTodosNumber int
-		Filters             []paramFilter
-		Errors              []string
-		CSRFTemplateTag     template.HTML
-	}{
-		r,
-		todos,
-		false,
-		len(todos),
-		paramFilters,
-		nil,
-		csrf.TemplateField(r),
+	data, err := s.getTodoListPage(r)
+	if err != nil {
+		logf(r.Context(), "getting todo list: %v", err)
+		respondError(w, r, 500)
+		return
 	}
+	s.rememberFilter(w, r)
 
-	if r.Header.Get("HX-Request") == "true" {
+	switch negotiate(r) {
+	case formatHTMLFragment:
+		w.Header().Set("HX-Push-Url", s.listPushURL(r))
 		handlePage(s.templates, "todo-list.html", w, data)
-	} else {
-		handlePage(s.templates, "todos_index.html", w, data)
+	case formatJSON:
+		list := make([]*todo, len(data.Todos))
+		for i, item := range data.Todos {
+			list[i] = item.Todo
+		}
+		handleJSON(w, 200, todosJSON(list))
+	default:
+		if r.FormValue("view") == "grouped" {
+			data.Groups = groupTodosByDay(data.Todos, r.FormValue("group") == "due", timeLocation(r.Context()))
+			handlePage(s.templates, "todos_grouped.html", w, data)
+			return
+		}
+		if len(data.Todos) > streamThreshold {
+			if err := streamPage(s.templates, "todos_index.html", w, data); err != nil {
+				logf(r.Context(), "streaming page: %v", err)
+			}
+			return
+		}
+		handlePage(s.templates, "todos_index.html", w, data)
+	}
+}
+
+type todoListPage struct {
+	Request             *http.Request
+	Todos               []todoListItem
+	UpdateNumber        bool
+	FilteredTodosNumber int
+	Progress            todoProgress
+	Filters             []paramFilter
+	Groups              []todoGroup
+	// Trash is set when the list shows the deleted todos
+	Trash bool
+	// FiltersActive is set when the list is filtered down from its default
+	FiltersActive   bool
+	Errors          []string
+	CSRFTemplateTag template.HTML
+}
+
+type todoGroup struct {
+	Day   time.Time
+	Todos []todoListItem
+}
+
+// groupTodosByDay buckets todos by the local day they were created, or are
+// due when byDue is set. Todos without a due date end up in a final group
+// with a zero Day.
+func groupTodosByDay(items []todoListItem, byDue bool, loc *time.Location) []todoGroup {
+	var groups []todoGroup
+	index := make(map[time.Time]int)
+	for _, item := range items {
+		t := item.Todo.CreatedAt
+		if byDue {
+			t = item.Todo.DueAt
+		}
+		var day time.Time
+		if !t.IsZero() {
+			day = startOfDay(t.In(loc))
+		}
+		i, ok := index[day]
+		if !ok {
+			i = len(groups)
+			index[day] = i
+			groups = append(groups, todoGroup{Day: day})
+		}
+		groups[i].Todos = append(groups[i].Todos, item)
+	}
+	sort.SliceStable(groups, func(i, j int) bool {
+		if groups[i].Day.IsZero() || groups[j].Day.IsZero() {
+			return !groups[i].Day.IsZero()
+		}
+		return groups[i].Day.Before(groups[j].Day)
+	})
+	return groups
+}
+
+func (s *server) getTodoListPage(r *http.Request) (todoListPage, error) {
+	todos, paramFilters, err := s.getFilteredTodoListItems(r, false)
+	if err != nil {
+		return todoListPage{}, fmt.Errorf("finding todos: %w", err)
+	}
+	progress, err := s.getProgress(r)
+	if err != nil {
+		return todoListPage{}, fmt.Errorf("getting progress: %w", err)
+	}
+	return todoListPage{
+		Request:             r,
+		Todos:               todos,
+		UpdateNumber:        false,
+		FilteredTodosNumber: len(todos),
+		Progress:            progress,
+		Filters:             paramFilters,
+		Trash:               isTrash(paramFilters),
+		FiltersActive:       s.filtersActive(r),
+		Errors:              nil,
+		CSRFTemplateTag:     csrf.TemplateField(r),
+	}, nil
+}
+
+func isTrash(filters []paramFilter) bool {
+	for _, f := range filters {
+		if f.Param == "filter" && f.Value == "deleted" {
+			return f.Active
+		}
+	}
+	return false
+}
+
+func (s *server) todosURL(r *http.Request) string {
+	query := listQuery(r)
+	u := s.url("/todos/")
+	if len(query) > 0 {
+		u += "?" + query.Encode()
+	}
+	return u
+}
+
+// listPushURL is the address to show in the location bar for the todo list
+// r selects. Query parameters of the list page htmx is on that don't select
+// the list are kept, so the filters don't wipe them out.
+func (s *server) listPushURL(r *http.Request) string {
+	query := url.Values{}
+	if current, err := url.Parse(r.Header.Get("HX-Current-URL")); err == nil && current.Path == s.url("/todos/") {
+		query = current.Query()
+	}
+	query.Del(viewStateParam)
+	list := listQuery(r)
+	for _, key := range listQueryKeys {
+		query.Del(key)
+		if v := list.Get(key); v != "" {
+			query.Set(key, v)
+		}
+	}
+	u := s.url("/todos/")
+	if len(query) > 0 {
+		u += "?" + query.Encode()
 	}
+	return u
+}
+
+var todoRowIdRe = regexp.MustCompile(`^todo-\d+$`)
+
+// wantsCounts reports whether the element an htmx request targets sits in
+// the todo list next to the counts, so they can be updated out of band.
+// Requests that don't name their target, such as from API clients, get them.
+func wantsCounts(r *http.Request) bool {
+	target := r.Header.Get("HX-Target")
+	return target == "" || target == "todo-list" || todoRowIdRe.MatchString(target)
 }
 
 func isTodoInList(todo *todo, list []todoListItem) bool {
 	for _, item := range list {
-		if todo == item.Todo {
+		if todo.Id == item.Todo.Id {
 			return true
 		}
 	}
@@ -407,15 +2011,19 @@ func isTodoInList(todo *todo, list []todoListItem) bool {
 func (s *server) todoHandler(w http.ResponseWriter, r *http.Request) {
 	id, err := extractTodoId(r.URL.Path)
 	if err != nil {
-		log.Printf("extracting todo id: %v", err)
-		http.Error(w, http.StatusText(500), 500)
+		logf(r.Context(), "extracting todo id: %v", err)
+		respondError(w, r, 500)
 		return
 	}
 	if r.Method == "GET" {
-		todo, err := s.todoService.getTodoById(id)
+		todo, err := s.todoService.getTodoById(r.Context(), id)
 		if err != nil {
-			log.Printf("getting todo by id: %v", err)
-			http.Error(w, http.StatusText(500), 500)
+			logf(r.Context(), "getting todo by id: %v", err)
+			respondServiceError(w, r, err)
+			return
+		}
+		if negotiate(r) == formatJSON {
+			handleJSON(w, 200, todoJSON(todo))
 			return
 		}
 		data := todoListItem{
@@ -425,72 +2033,639 @@ func (s *server) todoHandler(w http.ResponseWriter, r *http.Request) {
 		}
 		handlePage(s.templates, "todo-list-item.html", w, data)
 	} else if r.Method == "DELETE" {
-		if err := s.todoService.deleteTodo(id); err != nil {
-			log.Printf("getting todo by id: %v", err)
-			http.Error(w, http.StatusText(500), 500)
+		if !parseForm(w, r) {
 			return
 		}
-		if r.Header.Get("HX-Request") == "true" {
-			todos, _, err := s.getFilteredTodoListItems(r, true)
-			if err != nil {
-				log.Printf("finding todos: %v", err)
-				http.Error(w, http.StatusText(500), 500)
-				return
-			}
-			data := todoListItem{
-				Request:             r,
-				Todo:                nil,
-				UpdateNumber:        true,
-				FilteredTodosNumber: len(todos),
-			}
-			handlePage(s.templates, "todo-list-number.html", w, data)
+		if s.deleteTokens != nil && !s.deleteTokens.consume(r.FormValue("confirm"), id, s.clock.Now()) {
+			s.confirmDelete(w, r, id)
+			return
+		}
+		if s.pendingDeletes != nil && negotiate(r) == formatHTMLFragment {
+			s.deleteWithUndo(w, r, id)
+			return
+		}
+		if err := s.todoService.deleteTodo(r.Context(), id); err != nil {
+			logf(r.Context(), "deleting todo: %v", err)
+			respondServiceError(w, r, err)
+			return
+		}
+		if negotiate(r) == formatJSON {
+			w.WriteHeader(204)
+			return
 		}
+		respondOrRedirect(w, r, s.url("/todos/"), func() {
+			setHxTrigger(w, eventTodoDeleted, todoEventPayload{id})
+			s.respondRowRemoved(w, r, "Todo deleted")
+		})
 	} else if r.Method == "PUT" {
+		if !parseForm(w, r) {
+			return
+		}
 		update := todoUpdate{}
 		if strings.HasSuffix(r.URL.Path, "_done/") {
 			done := r.FormValue("done") == "done"
 			update.done = &done
 		} else if strings.HasSuffix(r.URL.Path, "_text/") {
 			text := r.FormValue("text")
+			// hx-prompt sends the entered text in a header instead of
+			// the form body
+			if _, ok := r.Header["Hx-Prompt"]; ok {
+				text = r.Header.Get("HX-Prompt")
+			}
 			update.text = &text
+			if r.FormValue("inline") != "" && negotiate(r) == formatHTMLFragment {
+				s.saveTodoInline(w, r, id, update)
+				return
+			}
+		} else if strings.HasSuffix(r.URL.Path, "_recurrence/") {
+			recur, err := parseRecurrence(r.FormValue("recurrence"))
+			if err != nil {
+				logf(r.Context(), "parsing recurrence: %v", err)
+				respondServiceError(w, r, err)
+				return
+			}
+			update.recurrence = &recur
+		} else {
+			s.todoPutHandler(w, r, id)
+			return
 		}
-		todo, err := s.todoService.updateTodo(id, update)
+		s.applyTodoUpdate(w, r, id, update)
+	} else {
+		respondError(w, r, 405)
+		return
+	}
+}
+
+// saveTodoInline updates a todo while its edit form stays open, as the
+// form's auto-save does, and responds with just the save indicator.
+func (s *server) saveTodoInline(w http.ResponseWriter, r *http.Request, id uint64, update todoUpdate) {
+	todo, err := s.todoService.updateTodo(r.Context(), id, update)
+	if err != nil {
+		logf(r.Context(), "updating todo: %v", err)
+		respondServiceError(w, r, err)
+		return
+	}
+	data := todoListItem{
+		Request: r,
+		Todo:    todo,
+	}
+	handlePage(s.templates, "save-indicator.html", w, data)
+}
+
+// applyTodoUpdate updates a todo and responds with the todo itself, or
+// with its row for htmx.
+func (s *server) applyTodoUpdate(w http.ResponseWriter, r *http.Request, id uint64, update todoUpdate) {
+	todo, err := s.todoService.updateTodo(r.Context(), id, update)
+	if err != nil {
+		logf(r.Context(), "updating todo: %v", err)
+		respondServiceError(w, r, err)
+		return
+	}
+	if negotiate(r) == formatJSON {
+		handleJSON(w, 200, todoJSON(todo))
+		return
+	}
+	respondOrRedirect(w, r, s.url("/todos/"), func() { s.respondTodoUpdated(w, r, todo, update) })
+}
+
+// respondTodoUpdated answers htmx with the updated todo's row, see
+// respondTodoRow.
+func (s *server) respondTodoUpdated(w http.ResponseWriter, r *http.Request, todo *todo, update todoUpdate) {
+	if update.done != nil && *update.done && todo.Recurrence != recurNone {
+		// completing a recurring todo schedules its next occurrence,
+		// so have the list reload to pick it up
+		setHxTrigger(w, eventNewTodo, nil)
+	}
+	setHxTrigger(w, eventTodoUpdated, todoEventPayload{todo.Id})
+	message := "Todo updated"
+	if update.done != nil {
+		message = "Todo reopened"
+		if *update.done {
+			message = "Todo completed"
+		}
+	}
+	s.respondTodoRow(w, r, todo, message)
+}
+
+// respondTodoRow answers htmx with a todo's row and the refreshed counts.
+// If the todo no longer matches the current filter, such as one marked done
+// while viewing the remaining ones, its row is deleted instead. The counts
+// are left out when the page has none to update.
+func (s *server) respondTodoRow(w http.ResponseWriter, r *http.Request, todo *todo, message string) {
+	todos, _, err := s.getFilteredTodoListItems(r, true)
+	if err != nil {
+		logf(r.Context(), "finding todos: %v", err)
+		respondError(w, r, 500)
+		return
+	}
+	data := todoListItem{
+		Request:             r,
+		UpdateNumber:        true,
+		FilteredTodosNumber: len(todos),
+	}
+	var fragments []fragment
+	if isTodoInList(todo, todos) {
+		data.Todo = todo
+		fragments = append(fragments, fragment{"todo-list-item.html", data})
+	} else if todoRowIdRe.MatchString(r.Header.Get("HX-Target")) {
+		w.Header().Set("HX-Reswap", "delete")
+	}
+	if wantsCounts(r) {
+		data.Progress, err = s.getProgress(r)
 		if err != nil {
-			log.Printf("getting todo by id: %v", err)
-			http.Error(w, http.StatusText(500), 500)
+			logf(r.Context(), "getting progress: %v", err)
+			respondError(w, r, 500)
+			return
+		}
+		fragments = append(fragments, countFragments(data)...)
+	}
+	handleOOB(s.templates, w, append(fragments, announce(r, true, message))...)
+}
+
+func (s *server) todoToggleHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		respondError(w, r, 405)
+		return
+	}
+	id, err := extractTodoId(r.URL.Path)
+	if err != nil {
+		logf(r.Context(), "extracting todo id: %v", err)
+		respondError(w, r, 500)
+		return
+	}
+	todo, err := s.todoService.getTodoById(r.Context(), id)
+	if err != nil || todo.Deleted {
+		respondError(w, r, 404)
+		return
+	}
+	done := !todo.Done
+	s.applyTodoUpdate(w, r, id, todoUpdate{done: &done})
+}
+
+// respondOrRedirect answers an htmx request with what fragment writes and
+// sends any other browser to the page at to, so a change made from a plain
+// form without JavaScript lands back on a full page instead of a bare
+// fragment. API clients should have been answered before.
+func respondOrRedirect(w http.ResponseWriter, r *http.Request, to string, fragment func()) {
+	if negotiate(r) == formatHTMLFragment {
+		fragment()
+		return
+	}
+	http.Redirect(w, r, to, 303)
+}
+
+// respondTodoList answers with the whole todo list, for changes that can
+// reorder or reshape it.
+func (s *server) respondTodoList(w http.ResponseWriter, r *http.Request) {
+	data, err := s.getTodoListPage(r)
+	if err != nil {
+		logf(r.Context(), "getting todo list: %v", err)
+		respondError(w, r, 500)
+		return
+	}
+	handlePage(s.templates, "todo-list.html", w, data)
+}
+
+// respondRowRemoved answers an htmx request whose target row goes away with
+// the refreshed counts and an announcement for screen readers.
+func (s *server) respondRowRemoved(w http.ResponseWriter, r *http.Request, message string, rows ...fragment) {
+	if !wantsCounts(r) {
+		handleOOB(s.templates, w, append(rows, announce(r, true, message))...)
+		return
+	}
+	n, err := s.countFilteredTodos(r)
+	if err != nil {
+		logf(r.Context(), "counting todos: %v", err)
+		respondError(w, r, 500)
+		return
+	}
+	progress, err := s.getProgress(r)
+	if err != nil {
+		logf(r.Context(), "getting progress: %v", err)
+		respondError(w, r, 500)
+		return
+	}
+	data := todoListItem{
+		Request:             r,
+		Todo:                nil,
+		UpdateNumber:        true,
+		FilteredTodosNumber: n,
+		Progress:            progress,
+	}
+	fragments := append(rows, countFragments(data)...)
+	handleOOB(s.templates, w, append(fragments, announce(r, true, message))...)
+}
+
+func (s *server) todoRestoreHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		respondError(w, r, 405)
+		return
+	}
+	id, err := extractTodoId(r.URL.Path)
+	if err != nil {
+		logf(r.Context(), "extracting todo id: %v", err)
+		respondError(w, r, 500)
+		return
+	}
+	todo, err := s.todoService.restoreTodo(r.Context(), id)
+	if err != nil {
+		logf(r.Context(), "restoring todo: %v", err)
+		respondServiceError(w, r, err)
+		return
+	}
+	if negotiate(r) == formatJSON {
+		handleJSON(w, 200, todoJSON(todo))
+		return
+	}
+	respondOrRedirect(w, r, s.url("/todos/?filter=deleted"), func() {
+		s.respondRowRemoved(w, r, "Todo restored")
+	})
+}
+
+func (s *server) todoPurgeHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "DELETE" {
+		respondError(w, r, 405)
+		return
+	}
+	id, err := extractTodoId(r.URL.Path)
+	if err != nil {
+		logf(r.Context(), "extracting todo id: %v", err)
+		respondError(w, r, 500)
+		return
+	}
+	if err := s.todoService.purgeTodo(r.Context(), id); err != nil {
+		logf(r.Context(), "purging todo: %v", err)
+		respondServiceError(w, r, err)
+		return
+	}
+	if negotiate(r) == formatJSON {
+		w.WriteHeader(204)
+		return
+	}
+	respondOrRedirect(w, r, s.url("/todos/?filter=deleted"), func() {
+		s.respondRowRemoved(w, r, "Todo deleted forever")
+	})
+}
+
+// confirmDelete answers a DELETE that has no valid confirmation token with
+// a fresh token, as a confirmation row for htmx.
+func (s *server) confirmDelete(w http.ResponseWriter, r *http.Request, id uint64) {
+	t, err := s.todoService.getTodoById(r.Context(), id)
+	if err == nil && t.Deleted {
+		err = errTodoNotFound
+	}
+	if err != nil {
+		logf(r.Context(), "getting todo by id: %v", err)
+		respondServiceError(w, r, err)
+		return
+	}
+	token := s.deleteTokens.issue(id, s.clock.Now())
+	switch negotiate(r) {
+	case formatJSON:
+		handleJSON(w, 202, struct {
+			ConfirmToken string `json:"confirmToken"`
+		}{token})
+	default:
+		handlePage(s.templates, "todo-delete-confirm.html", w, struct {
+			Request *http.Request
+			Todo    *todo
+			Token   string
+		}{r, t, token})
+	}
+}
+
+func (s *server) todoChangesHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		respondError(w, r, 405)
+		return
+	}
+	since, err := time.Parse(time.RFC3339, r.FormValue("since"))
+	if err != nil {
+		logf(r.Context(), "parsing since: %v", err)
+		respondError(w, r, 400)
+		return
+	}
+	now := s.clock.Now()
+	todos, err := s.todoService.findTodos(r.Context(), todoFilter{modifiedSince: &since, includeSnoozed: true})
+	if err != nil {
+		logf(r.Context(), "finding todos: %v", err)
+		respondError(w, r, 500)
+		return
+	}
+	changes := struct {
+		Now     time.Time  `json:"now"`
+		Updated []*todoDTO `json:"updated"`
+		Deleted []uint64   `json:"deleted"`
+	}{
+		Now:     now,
+		Updated: []*todoDTO{},
+		Deleted: []uint64{},
+	}
+	for _, t := range todos {
+		if t.Deleted {
+			changes.Deleted = append(changes.Deleted, t.Id)
+		} else {
+			changes.Updated = append(changes.Updated, todoJSON(t))
+		}
+	}
+	handleJSON(w, 200, changes)
+}
+
+func (s *server) todoBatchDeleteHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		respondError(w, r, 405)
+		return
+	}
+	if !parseForm(w, r) {
+		return
+	}
+	ids, err := formIds(r)
+	if err != nil {
+		logf(r.Context(), "parsing todo ids: %v", err)
+		respondError(w, r, 400)
+		return
+	}
+	if len(ids) > 0 {
+		if err := s.todoService.deleteTodos(r.Context(), ids); err != nil {
+			logf(r.Context(), "deleting todos: %v", err)
+			respondServiceError(w, r, err)
 			return
 		}
-		todos, _, err := s.getFilteredTodoListItems(r, true)
+		setHxTrigger(w, eventShowToast, toastPayload{printer(r).Sprintf("Deleted %d todo(s).", len(ids))})
+	}
+
+	if negotiate(r) == formatJSON {
+		handleJSON(w, 200, struct {
+			Deleted int `json:"deleted"`
+		}{len(ids)})
+		return
+	}
+	respondOrRedirect(w, r, s.todosURL(r), func() { s.respondTodoList(w, r) })
+}
+
+// formIds reads the distinct todo ids from the form's id fields.
+func formIds(r *http.Request) ([]uint64, error) {
+	var ids []uint64
+	seen := make(map[uint64]bool)
+	for _, v := range r.PostForm["id"] {
+		id, err := strconv.ParseUint(v, 10, 64)
 		if err != nil {
-			log.Printf("finding todos: %v", err)
-			http.Error(w, http.StatusText(500), 500)
+			return nil, fmt.Errorf("parsing todo id %q: %w", v, err)
+		}
+		if !seen[id] {
+			seen[id] = true
+			ids = append(ids, id)
+		}
+	}
+	return ids, nil
+}
+
+// todoBatchStatusHandler marks the selected todos done or not done.
+func (s *server) todoBatchStatusHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		respondError(w, r, 405)
+		return
+	}
+	if !parseForm(w, r) {
+		return
+	}
+	ids, err := formIds(r)
+	if err != nil {
+		logf(r.Context(), "parsing todo ids: %v", err)
+		respondError(w, r, 400)
+		return
+	}
+	done, err := strconv.ParseBool(r.PostForm.Get("done"))
+	if err != nil || len(ids) == 0 {
+		respondError(w, r, 400)
+		return
+	}
+	if err := s.todoService.setTodosDone(r.Context(), ids, done); err != nil {
+		logf(r.Context(), "updating todos: %v", err)
+		respondServiceError(w, r, err)
+		return
+	}
+	key := "Marked %d todo(s) not done."
+	if done {
+		key = "Marked %d todo(s) done."
+	}
+	setHxTrigger(w, eventShowToast, toastPayload{printer(r).Sprintf(key, len(ids))})
+
+	if negotiate(r) == formatJSON {
+		handleJSON(w, 200, struct {
+			Updated int `json:"updated"`
+		}{len(ids)})
+		return
+	}
+	respondOrRedirect(w, r, s.todosURL(r), func() { s.respondTodoList(w, r) })
+}
+
+// todoTrashHandler restores or permanently deletes everything in the trash.
+func (s *server) todoTrashHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		respondError(w, r, 405)
+		return
+	}
+	var n int
+	var err error
+	var key string
+	switch strings.TrimSuffix(strings.TrimPrefix(r.URL.Path, "/todos/trash/"), "/") {
+	case "restore-all":
+		n, err = s.todoService.restoreAll(r.Context())
+		key = "Restored %d todo(s)."
+	case "empty":
+		n, err = s.todoService.emptyTrash(r.Context())
+		key = "Deleted %d todo(s) forever."
+	default:
+		respondError(w, r, 404)
+		return
+	}
+	if err != nil {
+		logf(r.Context(), "updating trash: %v", err)
+		respondServiceError(w, r, err)
+		return
+	}
+	setHxTrigger(w, eventShowToast, toastPayload{printer(r).Sprintf(key, n)})
+
+	if negotiate(r) == formatJSON {
+		handleJSON(w, 200, struct {
+			Count int `json:"count"`
+		}{n})
+		return
+	}
+	respondOrRedirect(w, r, s.url("/todos/?filter=deleted"), func() { s.respondTodoList(w, r) })
+}
+
+func (s *server) todoRemindersHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		respondError(w, r, 405)
+		return
+	}
+	within := s.reminderWindow
+	if v := r.FormValue("within"); v != "" {
+		d, err := time.ParseDuration(v)
+		if err != nil || d < 0 {
+			logf(r.Context(), "parsing within: %q", v)
+			respondError(w, r, 400)
 			return
 		}
-		if isTodoInList(todo, todos) {
-			data := todoListItem{
-				Request:             r,
-				Todo:                todo,
-				UpdateNumber:        true,
-				FilteredTodosNumber: len(todos),
-			}
-			handlePage(s.templates, "todo-list-item.html", w, data)
-		} else {
-			data := todoListItem{
-				Request:             r,
-				Todo:                nil,
-				UpdateNumber:        true,
-				FilteredTodosNumber: len(todos),
-			}
-			handlePage(s.templates, "todo-list-number.html", w, data)
+		within = d
+	}
+	now := s.clock.Now()
+	end := now.Add(within)
+	done := false
+	reminders := []*todo{}
+	err := s.todoService.findTodosFunc(r.Context(), todoFilter{done: &done}, func(t *todo) error {
+		if !t.DueAt.IsZero() && !t.DueAt.Before(now) && !t.DueAt.After(end) {
+			reminders = append(reminders, t)
 		}
-	} else {
-		http.Error(w, http.StatusText(405), 405)
+		return nil
+	})
+	if err != nil {
+		logf(r.Context(), "finding todos: %v", err)
+		respondError(w, r, 500)
 		return
 	}
+	sort.SliceStable(reminders, func(i, j int) bool {
+		return reminders[i].DueAt.Before(reminders[j].DueAt)
+	})
+	handleJSON(w, 200, todosJSON(reminders))
+}
+
+func resolveSnooze(v string, now time.Time) (time.Time, error) {
+	switch v {
+	case "hour":
+		return now.Add(time.Hour), nil
+	case "tomorrow":
+		return startOfDay(now).AddDate(0, 0, 1), nil
+	case "nextweek":
+		return startOfDay(now).AddDate(0, 0, 7), nil
+	}
+	return time.Parse(time.RFC3339, v)
+}
+
+func (s *server) todoSnoozeHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		respondError(w, r, 405)
+		return
+	}
+	id, err := extractTodoId(r.URL.Path)
+	if err != nil {
+		logf(r.Context(), "extracting todo id: %v", err)
+		respondError(w, r, 500)
+		return
+	}
+	if !parseForm(w, r) {
+		return
+	}
+	until, err := resolveSnooze(r.FormValue("until"), s.now(r))
+	if err != nil {
+		logf(r.Context(), "parsing snooze time: %v", err)
+		respondError(w, r, 400)
+		return
+	}
+	todo, err := s.todoService.snoozeTodo(r.Context(), id, until)
+	if err != nil {
+		logf(r.Context(), "snoozing todo: %v", err)
+		respondServiceError(w, r, err)
+		return
+	}
+	if negotiate(r) == formatJSON {
+		handleJSON(w, 200, todoJSON(todo))
+		return
+	}
+	respondOrRedirect(w, r, s.url("/todos/"), func() { s.respondTodoList(w, r) })
+}
+
+// todoPinHandler pins or unpins a todo. The pinned form field picks which,
+// without it the pin is toggled. The whole list is sent back since pinning
+// moves the todo.
+func (s *server) todoPinHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		respondError(w, r, 405)
+		return
+	}
+	id, err := extractTodoId(r.URL.Path)
+	if err != nil {
+		logf(r.Context(), "extracting todo id: %v", err)
+		respondError(w, r, 500)
+		return
+	}
+	if !parseForm(w, r) {
+		return
+	}
+	current, err := s.todoService.getTodoById(r.Context(), id)
+	if err != nil || current.Deleted {
+		respondError(w, r, 404)
+		return
+	}
+	pinned := !current.Pinned
+	if v := r.PostForm.Get("pinned"); v != "" {
+		if pinned, err = strconv.ParseBool(v); err != nil {
+			logf(r.Context(), "parsing pinned: %v", err)
+			respondError(w, r, 400)
+			return
+		}
+	}
+	todo, err := s.todoService.updateTodo(r.Context(), id, todoUpdate{pinned: &pinned})
+	if err != nil {
+		logf(r.Context(), "pinning todo: %v", err)
+		respondServiceError(w, r, err)
+		return
+	}
+	if negotiate(r) == formatJSON {
+		handleJSON(w, 200, todoJSON(todo))
+		return
+	}
+	respondOrRedirect(w, r, s.url("/todos/"), func() { s.respondTodoList(w, r) })
+}
+
+// todoMoveHandler moves a todo to the top or the bottom of the list, a
+// button friendly alternative to dragging it there.
+func (s *server) todoMoveHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		respondError(w, r, 405)
+		return
+	}
+	id, err := extractTodoId(r.URL.Path)
+	if err != nil {
+		logf(r.Context(), "extracting todo id: %v", err)
+		respondError(w, r, 500)
+		return
+	}
+	if !parseForm(w, r) {
+		return
+	}
+	var toTop bool
+	switch r.FormValue("to") {
+	case "top":
+		toTop = true
+	case "bottom":
+		toTop = false
+	default:
+		respondErrorMessage(w, r, 400, "Unknown position %q.", r.FormValue("to"))
+		return
+	}
+	todo, err := s.todoService.moveTodo(r.Context(), id, toTop)
+	if err != nil {
+		logf(r.Context(), "moving todo: %v", err)
+		respondServiceError(w, r, err)
+		return
+	}
+	if negotiate(r) == formatJSON {
+		handleJSON(w, 200, todoJSON(todo))
+		return
+	}
+	respondOrRedirect(w, r, s.url("/todos/"), func() { s.respondTodoList(w, r) })
+}
+
+// permalink is the canonical address of a todo's detail page.
+func (s *server) permalink(t *todo) string {
+	return s.url(fmt.Sprintf("/todos/%d-%s/", t.Id, t.Slug))
 }
 
 func extractTodoId(path string) (uint64, error) {
-	pat := regexp.MustCompile(`^/todos/(\d+)/`)
+	pat := regexp.MustCompile(`^/todos/(\d+)[/-]`)
 	matches := pat.FindStringSubmatch(path)
 	id, err := strconv.ParseUint(matches[1], 10, 64)
 	if err != nil {
@@ -502,16 +2677,102 @@ func extractTodoId(path string) (uint64, error) {
 func (s *server) todoEditHandler(w http.ResponseWriter, r *http.Request) {
 	id, err := extractTodoId(r.URL.Path)
 	if err != nil {
-		log.Printf("extracting todo id: %v", err)
-		http.Error(w, http.StatusText(500), 500)
+		logf(r.Context(), "extracting todo id: %v", err)
+		respondError(w, r, 500)
+		return
+	}
+	todo, err := s.todoService.getTodoById(r.Context(), id)
+	if err != nil {
+		respondServiceError(w, r, err)
+		return
+	}
+	if negotiate(r) == formatJSON {
+		handleJSON(w, 200, todoJSON(todo))
+		return
+	}
+	data := todoListItem{
+		Request: r,
+		Todo:    todo,
+	}
+	handlePage(s.templates, "todo-edit-item.html", w, data)
+}
+
+func (s *server) todoDetailHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		respondError(w, r, 405)
+		return
+	}
+	id, err := extractTodoId(r.URL.Path)
+	if err != nil {
+		logf(r.Context(), "extracting todo id: %v", err)
+		respondError(w, r, 500)
+		return
+	}
+	todo, err := s.todoService.getTodoById(r.Context(), id)
+	if err != nil || todo.Deleted {
+		respondError(w, r, 404)
+		return
+	}
+	if slug, ok := permalinkSlug(r.URL.Path); ok && slug != todo.Slug {
+		http.Redirect(w, r, s.permalink(todo), 301)
+		return
+	}
+	data := todoListItem{
+		Request: r,
+		Todo:    todo,
+	}
+	switch negotiate(r) {
+	case formatHTMLFragment:
+		handlePage(s.templates, "todo-detail.html", w, data)
+	case formatJSON:
+		handleJSON(w, 200, todoJSON(todo))
+	default:
+		handlePage(s.templates, "todo_detail.html", w, data)
+	}
+}
+
+// todoAgeHandler renders how long ago a todo was created, for its row to
+// keep that fresh.
+func (s *server) todoAgeHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		respondError(w, r, 405)
+		return
+	}
+	id, err := extractTodoId(r.URL.Path)
+	if err != nil {
+		logf(r.Context(), "extracting todo id: %v", err)
+		respondError(w, r, 500)
 		return
 	}
-	todo, err := s.todoService.getTodoById(id)
+	todo, err := s.todoService.getTodoById(r.Context(), id)
 	if err != nil {
-		http.NotFound(w, r)
+		logf(r.Context(), "getting todo by id: %v", err)
+		respondServiceError(w, r, err)
+		return
+	}
+	handlePage(s.templates, "todo-age.html", w, todoListItem{Request: r, Todo: todo})
+}
+
+func (s *server) todoEditCancelHandler(w http.ResponseWriter, r *http.Request) {
+	id, err := extractTodoId(r.URL.Path)
+	if err != nil {
+		logf(r.Context(), "extracting todo id: %v", err)
+		respondError(w, r, 500)
+		return
+	}
+	todo, err := s.todoService.getTodoById(r.Context(), id)
+	if err != nil || todo.Deleted {
+		// the todo went away while it was being edited, so swap the
+		// edit row out for nothing
+		w.Header().Set("Content-Type", "text/html")
 		return
 	}
-	handlePage(s.templates, "todo-edit-item.html", w, todo)
+	data := todoListItem{
+		Request:      r,
+		Todo:         todo,
+		UpdateNumber: false,
+	}
+	handlePage(s.templates, "todo-list-item.html", w, data)
 }
 
 func (s *server) languageHandler(w http.ResponseWriter, r *http.Request) {
@@ -524,87 +2785,387 @@ func (s *server) languageHandler(w http.ResponseWriter, r *http.Request) {
 			}
 		}
 		if !isSupported {
-			log.Printf("[WARN] unsupported language tag %q", tag)
-			http.NotFound(w, r)
+			warnf(r.Context(), "unsupported language tag %q", tag)
+			respondError(w, r, 404)
 			return
 		}
 
-		c := http.Cookie{
-			Name:     langCookieName,
-			Value:    tag,
-			Path:     "/",
-			SameSite: http.SameSiteLaxMode,
-			HttpOnly: true,
-		}
-		http.SetCookie(w, &c)
-		w.Header().Set("HX-Refresh", "true")
+		s.setCookie(w, langCookieName, tag)
+		respondOrRedirect(w, r, s.url("/"), func() {
+			w.Header().Set("HX-Refresh", "true")
+		})
 		return
 	} else {
-		http.Error(w, http.StatusText(400), 400)
+		respondError(w, r, 400)
 	}
 }
 
 func (s *server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	r = r.WithContext(context.WithValue(r.Context(), templatesKey, s.templates))
 	if r.URL.Path == "/" {
 		s.indexHandler(w, r)
 	} else if r.URL.Path == "/lang/" {
 		s.languageHandler(w, r)
+	} else if r.URL.Path == "/favicon.ico" {
+		s.faviconHandler(w, r)
+	} else if r.URL.Path == "/robots.txt" {
+		s.robotsHandler(w, r)
+	} else if r.URL.Path == "/metrics" {
+		s.metricsHandler(w, r)
+	} else if r.URL.Path == "/help/shortcuts" || r.URL.Path == "/help/shortcuts/" {
+		s.shortcutsHelpHandler(w, r)
+	} else if r.URL.Path == "/timezone/" {
+		s.timezoneHandler(w, r)
+	} else if r.URL.Path == "/done-display/" {
+		s.doneDisplayHandler(w, r)
+	} else if r.URL.Path == "/theme/" {
+		s.themeHandler(w, r)
+	} else if r.URL.Path == "/login" {
+		s.loginHandler(w, r)
+	} else if r.URL.Path == "/logout" {
+		s.logoutHandler(w, r)
+	} else if r.URL.Path == "/maintenance" {
+		s.maintenanceHandler(w, r)
+	} else if r.URL.Path == "/admin/stats" {
+		s.adminStatsHandler(w, r)
 	} else if strings.HasPrefix(r.URL.Path, "/todos") {
+		if s.readOnly && r.Method != "GET" && r.Method != "HEAD" {
+			respondError(w, r, 403)
+			return
+		}
 		path := strings.TrimPrefix(r.URL.Path, "/todos")
-		if path == "" {
-			http.Redirect(w, r, "/todos/", 301)
+		if path == ".ics" {
+			s.todoCalendarHandler(w, r)
+		} else if path == "" {
+			http.Redirect(w, r, s.url("/todos/"), 301)
 		} else if path == "/" {
 			s.todosIndexHandler(w, r)
-		} else if matched, err := regexp.MatchString(`^/\d+/((_done|_text)/)?$`, path); err == nil && matched {
+		} else if path == "/changes" || path == "/changes/" {
+			s.todoChangesHandler(w, r)
+		} else if path == "/ws" {
+			s.todoWebSocketHandler(w, r)
+		} else if path == "/batch-delete/" {
+			s.todoBatchDeleteHandler(w, r)
+		} else if path == "/new-form/" {
+			s.newTodoFormHandler(w, r)
+		} else if path == "/charcount" || path == "/charcount/" {
+			s.todoCharCountHandler(w, r)
+		} else if path == "/focus/" {
+			s.todoFocusHandler(w, r)
+		} else if strings.HasPrefix(path, "/trash/") {
+			s.todoTrashHandler(w, r)
+		} else if path == "/batch-status" || path == "/batch-status/" {
+			s.todoBatchStatusHandler(w, r)
+		} else if path == "/batch" || path == "/batch/" {
+			s.todoBatchHandler(w, r)
+		} else if path == "/reminders" || path == "/reminders/" {
+			s.todoRemindersHandler(w, r)
+		} else if matched, err := regexp.MatchString(`^/\d+/((_done|_text|_recurrence)/)?$`, path); err == nil && matched {
 			s.todoHandler(w, r)
+		} else if matched, err := regexp.MatchString(`^/\d+/restore/$`, path); err == nil && matched {
+			s.todoRestoreHandler(w, r)
+		} else if matched, err := regexp.MatchString(`^/\d+/purge/$`, path); err == nil && matched {
+			s.todoPurgeHandler(w, r)
+		} else if matched, err := regexp.MatchString(`^/\d+/undo/$`, path); err == nil && matched {
+			s.todoUndoHandler(w, r)
+		} else if matched, err := regexp.MatchString(`^/\d+/toggle/$`, path); err == nil && matched {
+			s.todoToggleHandler(w, r)
+		} else if matched, err := regexp.MatchString(`^/\d+/pin/$`, path); err == nil && matched {
+			s.todoPinHandler(w, r)
+		} else if matched, err := regexp.MatchString(`^/\d+/move/?$`, path); err == nil && matched {
+			s.todoMoveHandler(w, r)
+		} else if matched, err := regexp.MatchString(`^/\d+/snooze/$`, path); err == nil && matched {
+			s.todoSnoozeHandler(w, r)
+		} else if matched, err := regexp.MatchString(`^/\d+(/detail|-[^/]*)/$`, path); err == nil && matched {
+			s.todoDetailHandler(w, r)
+		} else if matched, err := regexp.MatchString(`^/\d+/age/$`, path); err == nil && matched {
+			s.todoAgeHandler(w, r)
+		} else if matched, err := regexp.MatchString(`^/\d+/history/$`, path); err == nil && matched {
+			s.todoHistoryHandler(w, r)
 		} else if matched, err := regexp.MatchString(`^/\d+/edit/$`, path); err == nil && matched {
 			s.todoEditHandler(w, r)
+		} else if matched, err := regexp.MatchString(`^/\d+/edit/cancel/$`, path); err == nil && matched {
+			s.todoEditCancelHandler(w, r)
 		} else {
-			http.Error(w, http.StatusText(http.StatusNotFound), http.StatusNotFound)
+			respondError(w, r, http.StatusNotFound)
 		}
 	} else {
-		http.Error(w, http.StatusText(http.StatusNotFound), http.StatusNotFound)
+		respondError(w, r, http.StatusNotFound)
 	}
 }
 
-func main() {
-	host := flag.String("host", "0.0.0.0", "hostname or IP address")
-	port := flag.Int("port", 8080, "port")
-	csrfAuthKey := flag.String("csrf", "", "CSRF auth key (32 bytes)")
-	flag.Parse()
-
-	if *csrfAuthKey == "" {
-		if key := os.Getenv("CSRF_AUTH_KEY"); key != "" {
-			*csrfAuthKey = key
+// newServerFromConfig sets up the todo service and the server the way cfg
+// describes. An empty store is seeded with a few example todos, or with
+// cfg.SeedCount made up ones.
+func newServerFromConfig(cfg Config) (*server, error) {
+	svc := newInMemTodoService(realClock{})
+	svc.maxTextLength = cfg.MaxTodoLength
+	svc.collapseWhitespace = cfg.CollapseWhitespace
+	svc.maxTodos = cfg.MaxTodos
+	svc.evictDone = cfg.EvictDone
+	svc.ttl = cfg.TodoTTL.Duration
+	svc.ttlKeepDone = cfg.TodoTTLKeepDone
+	svc.parseDueDates = cfg.ParseDueDates
+	svc.updateSlugs = cfg.UpdateSlugs
+	var store todoService = svc
+	if cfg.Store == "file" {
+		fileSvc, err := newFileTodoService(svc, cfg.StorePath)
+		if err != nil {
+			return nil, fmt.Errorf("loading todos: %w", err)
 		}
+		store = fileSvc
 	}
-	if *csrfAuthKey == "" || len(*csrfAuthKey) != 32 {
-		log.Fatalf("CSRF auth key (32 bytes) required, please provide -csrf option or set CSRF_AUTH_KEY env var")
+	empty := len(svc.todos) == 0
+	if empty && cfg.SeedCount > 0 {
+		if err := seedTodos(svc, cfg.SeedCount); err != nil {
+			return nil, fmt.Errorf("seeding todos: %w", err)
+		}
+		if fileSvc, ok := store.(*fileTodoService); ok {
+			if err := fileSvc.save(); err != nil {
+				return nil, fmt.Errorf("saving todos: %w", err)
+			}
+		}
+		empty = false
 	}
-
-	s := newServer()
-	examples := []string{"Do some stuff", "Make other things", "Call your mom"}
-	for _, ex := range examples {
-		todo := todo{Text: ex}
-		if err := s.todoService.createTodo(&todo); err != nil {
-			panic(err)
+	templates, err := skinFS(templatesFS(cfg.Templates), cfg.Skin)
+	if err != nil {
+		return nil, fmt.Errorf("loading templates: %w", err)
+	}
+	s := newServer(templates, normalizeBasePath(cfg.BasePath), newCoalescingTodoService(store))
+	s.readOnly = cfg.ReadOnly
+	s.maxTodoLength = cfg.MaxTodoLength
+	s.collapseWhitespace = cfg.CollapseWhitespace
+	maintenance, _ := parseMaintenanceMode(cfg.Maintenance)
+	s.setMaintenanceMode(maintenance)
+	s.secureCookies = cfg.TLSCert != ""
+	s.cookieDomain = cfg.CookieDomain
+	s.cookieMaxAge = cfg.CookieMaxAge.Duration
+	s.cookieSameSite, _ = parseSameSite(cfg.CookieSameSite)
+	s.reminderWindow = cfg.ReminderWindow.Duration
+	s.defaultFilter = cfg.DefaultFilter
+	s.appName = cfg.AppName
+	if cfg.Favicon != "" {
+		favicon, ctype, err := loadFavicon(cfg.Favicon)
+		if err != nil {
+			return nil, fmt.Errorf("loading favicon: %w", err)
 		}
+		s.favicon, s.faviconType = favicon, ctype
 	}
+	if cfg.RobotsTxt != "" {
+		robotsTxt, err := os.ReadFile(cfg.RobotsTxt)
+		if err != nil {
+			return nil, fmt.Errorf("loading robots.txt: %w", err)
+		}
+		s.robotsTxt = robotsTxt
+	}
+	if cfg.WebSocket {
+		s.changes = newChangeBroker()
+		s.todoService = notifyingTodoService{s.todoService, s.changes}
+	}
+	if cfg.ConfirmDeletes {
+		s.deleteTokens = newDeleteTokens(deleteTokenTTL, maxDeleteTokens)
+	}
+	if cfg.UndoWindow.Duration > 0 {
+		s.pendingDeletes = newPendingDeletes(cfg.UndoWindow.Duration)
+	}
+	if cfg.Metrics {
+		s.metrics = newMetrics()
+	}
+	if cfg.AuthPassword != "" {
+		s.sessions = newSessions(cfg.AuthPassword, sessionTTL, maxSessions)
+	}
+	if empty {
+		examples := []string{"Do some stuff", "Make other things", "Call your mom"}
+		for _, ex := range examples {
+			todo := todo{Text: ex}
+			if err := s.todoService.createTodo(context.Background(), &todo); err != nil {
+				return nil, fmt.Errorf("adding example todos: %w", err)
+			}
+		}
+	}
+	// installed last so the example todos don't go out as events
+	if cfg.WebhookURL != "" {
+		s.todoService = hookingTodoService{s.todoService, newWebhookNotifier(cfg.WebhookURL)}
+	}
+	return s, nil
+}
 
-	_, isDev := os.LookupEnv("DEV")
-	log.Printf("\x1b[1;32mis development environment?\x1b[0m %v", isDev)
-
+// handler wraps the server in its middleware.
+func (s *server) handler(cfg Config, isDev bool) http.Handler {
 	var h http.Handler
 	h = s
-	h = csrf.Protect([]byte(*csrfAuthKey),
-		csrf.Secure(!isDev),
-		csrf.Path("/"),
+	h = s.withLogin(h)
+	h = withHead(h)
+	h = withRequestTimeout(h, cfg.RequestTimeout.Duration)
+	h = withCacheControl(h, cfg.IndexCacheControl, cfg.CacheControl)
+	h = csrf.Protect([]byte(cfg.CSRFAuthKey),
+		csrf.Secure(!isDev || s.secureCookies),
+		csrf.Path(s.url("/")),
 	)(h)
-	h = logger(h)
+	// validated with the rest of the config
+	corsOrigins, _ := parseOrigins(cfg.CORSOrigins)
+	h = withCORS(h, corsOrigins)
+	h = withMethodOverride(h)
+	h = withMaxBodyBytes(h, cfg.MaxBodyBytes)
+	h = withBasePath(h, s.basePath)
+	h = s.withMaintenance(h)
+	if cfg.NoIndex {
+		h = withNoIndex(h)
+	}
+	h = logger(h, s.metrics, cfg.DebugBodies)
+	// validated with the rest of the config
+	trustedProxies, _ := parseCIDRs(cfg.TrustedProxies)
+	h = withOwner(h, cfg.OwnerHeader, trustedProxies)
+	h = withClientIP(h, trustedProxies)
 	h = withMessagePrinter(h)
-	http.Handle("/", h)
+	h = withTheme(h)
+	h = withDoneDisplay(h, cfg.DoneDisplay)
+	// validated with the rest of the config
+	loc, _ := loadLocation(cfg.Timezone)
+	h = withLocation(h, loc)
+	h = withRecover(h)
+	h = withTrace(h)
+	return h
+}
+
+func main() {
+	cfg, err := parseConfig(os.Args[0], os.Args[1:])
+	if err != nil {
+		log.Fatal(err)
+	}
+	useTLS := cfg.TLSCert != ""
+	// validated with the rest of the config
+	level, _ := parseLogLevel(cfg.LogLevel)
+	setLogLevel(level)
+
+	s, err := newServerFromConfig(cfg)
+	if err != nil {
+		log.Fatal(err)
+	}
 
-	addr := fmt.Sprintf("%s:%d", *host, *port)
-	log.Printf("listening on %s", addr)
-	log.Fatal(http.ListenAndServe(addr, nil))
+	_, isDev := os.LookupEnv("DEV")
+	log.Printf("\x1b[1;32mis development environment?\x1b[0m %v", isDev)
+
+	ln, err := listen(cfg.Host, cfg.Port, cfg.Socket)
+	if err != nil {
+		log.Fatal(err)
+	}
+	log.Printf("listening on %s", ln.Addr())
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	// main waits for the sweeps and the shutdown to wind down before exiting
+	var background sync.WaitGroup
+	goBackground := func(f func()) {
+		background.Add(1)
+		go func() {
+			defer background.Done()
+			f()
+		}()
+	}
+	if cfg.TrashRetention.Duration > 0 {
+		goBackground(func() { s.purgeTrash(ctx, cfg.TrashRetention.Duration, cfg.TrashPurgeEvery.Duration) })
+	}
+	if s.pendingDeletes != nil {
+		goBackground(func() { s.finalizeDeletes(ctx, undoSweepInterval) })
+	}
+	if cfg.TodoTTL.Duration > 0 {
+		goBackground(func() { s.expireTodos(ctx, expireSweepInterval) })
+	}
+	// the app gets its own handler rather than http.DefaultServeMux, which
+	// importing net/http/pprof registers the profiles on
+	srv := newHTTPServer(cfg, "", s.handler(cfg, isDev))
+	servers := []*http.Server{srv}
+	if cfg.PprofAddr != "" {
+		pprofSrv := newHTTPServer(cfg, cfg.PprofAddr, pprofHandler())
+		servers = append(servers, pprofSrv)
+		go func() {
+			log.Printf("serving pprof on %s", cfg.PprofAddr)
+			if err := pprofSrv.ListenAndServe(); err != http.ErrServerClosed {
+				log.Fatal(err)
+			}
+		}()
+	}
+	if useTLS && cfg.HTTPRedirectPort > 0 {
+		redirectAddr := fmt.Sprintf("%s:%d", cfg.Host, cfg.HTTPRedirectPort)
+		redirectSrv := newHTTPServer(cfg, redirectAddr, redirectToHTTPS(cfg.Port))
+		servers = append(servers, redirectSrv)
+		go func() {
+			log.Printf("redirecting http on %s to https", redirectAddr)
+			if err := redirectSrv.ListenAndServe(); err != http.ErrServerClosed {
+				log.Fatal(err)
+			}
+		}()
+	}
+	goBackground(func() {
+		<-ctx.Done()
+		log.Printf("shutting down")
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+		for _, srv := range servers {
+			if err := srv.Shutdown(shutdownCtx); err != nil {
+				log.Printf("shutting down: %v", err)
+			}
+		}
+	})
+	if useTLS {
+		err = srv.ServeTLS(ln, cfg.TLSCert, cfg.TLSKey)
+	} else {
+		err = srv.Serve(ln)
+	}
+	if err != http.ErrServerClosed {
+		log.Fatal(err)
+	}
+	// Serve returns as soon as the shutdown starts, without waiting for
+	// the requests in flight or the sweeps to finish
+	background.Wait()
+	if cfg.Socket != "" {
+		// the listener removes the socket file when closed, this catches
+		// the case where it was already gone
+		if err := os.Remove(cfg.Socket); err != nil && !errors.Is(err, fs.ErrNotExist) {
+			log.Printf("removing socket: %v", err)
+		}
+	}
+}
+
+// newHTTPServer serves h on addr with the timeouts from cfg, which keep
+// slow clients from holding connections open indefinitely.
+func newHTTPServer(cfg Config, addr string, h http.Handler) *http.Server {
+	return &http.Server{
+		Addr:              addr,
+		Handler:           h,
+		ReadHeaderTimeout: cfg.ReadHeaderTimeout.Duration,
+		ReadTimeout:       cfg.ReadTimeout.Duration,
+		WriteTimeout:      cfg.WriteTimeout.Duration,
+		IdleTimeout:       cfg.IdleTimeout.Duration,
+	}
+}
+
+// redirectToHTTPS permanently redirects every request to the same URL on
+// the HTTPS port.
+func redirectToHTTPS(httpsPort int) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		host := r.Host
+		if h, _, err := net.SplitHostPort(host); err == nil {
+			host = h
+		}
+		if httpsPort != 443 {
+			host = net.JoinHostPort(host, strconv.Itoa(httpsPort))
+		}
+		http.Redirect(w, r, "https://"+host+r.URL.RequestURI(), 301)
+	})
+}
+
+// listen opens a Unix domain socket when socket is set, removing a stale
+// socket file left behind by a previous run, and a TCP listener otherwise.
+func listen(host string, port int, socket string) (net.Listener, error) {
+	if socket == "" {
+		return net.Listen("tcp", fmt.Sprintf("%s:%d", host, port))
+	}
+	if fi, err := os.Stat(socket); err == nil && fi.Mode()&fs.ModeSocket != 0 {
+		if err := os.Remove(socket); err != nil {
+			return nil, fmt.Errorf("removing stale socket: %w", err)
+		}
+	}
+	return net.Listen("unix", socket)
 }
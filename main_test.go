@@ -0,0 +1,6624 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"html/template"
+	"io"
+	"io/fs"
+	"log"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"reflect"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+	"unicode/utf8"
+
+	"github.com/gorilla/websocket"
+	"golang.org/x/text/language"
+	"golang.org/x/text/message"
+)
+
+func TestMain(m *testing.M) {
+	// keep the request and error logs out of the test output
+	log.SetOutput(io.Discard)
+	os.Exit(m.Run())
+}
+
+// fakeClock is a service clock the test moves by hand.
+type fakeClock struct {
+	now time.Time
+}
+
+func (c *fakeClock) Now() time.Time {
+	return c.now
+}
+
+func (c *fakeClock) advance(d time.Duration) {
+	c.now = c.now.Add(d)
+}
+
+func newTestClock() *fakeClock {
+	return &fakeClock{now: time.Date(2024, 3, 1, 9, 0, 0, 0, time.UTC)}
+}
+
+func ownerContext(owner string) context.Context {
+	return context.WithValue(context.Background(), ownerKey, owner)
+}
+
+// newTestHandler serves svc through a server using the embedded templates
+// and the default middleware.
+func newTestHandler(svc todoService) (*server, http.Handler) {
+	s := newServer(embeddedTemplates(), "", svc)
+	cfg := defaultConfig()
+	cfg.CSRFAuthKey = strings.Repeat("k", 32)
+	return s, s.handler(cfg, true)
+}
+
+var (
+	csrfTokenRe = regexp.MustCompile(`"X-CSRF-Token"\] = "([^"]+)"`)
+	// jsUnescaper undoes the escaping html/template gives the token in the
+	// page's script
+	jsUnescaper = strings.NewReplacer(`\/`, "/", `\u002b`, "+", `\u003d`, "=")
+)
+
+// newTestRequest makes a request h accepts as coming from one of its pages:
+// with the CSRF cookie and token of a page fetched first.
+func newTestRequest(t *testing.T, h http.Handler, method, target string, form url.Values) *http.Request {
+	t.Helper()
+	return newTestRequestFrom(t, h, "/", method, target, form)
+}
+
+// newTestRequestFrom is newTestRequest taking the CSRF token from page.
+func newTestRequestFrom(t *testing.T, h http.Handler, page, method, target string, form url.Values) *http.Request {
+	t.Helper()
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest("GET", page, nil))
+	m := csrfTokenRe.FindStringSubmatch(rec.Body.String())
+	if m == nil {
+		t.Fatal("no CSRF token on the index page")
+	}
+	req := httptest.NewRequest(method, target, strings.NewReader(form.Encode()))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("X-CSRF-Token", jsUnescaper.Replace(m[1]))
+	for _, c := range rec.Result().Cookies() {
+		req.AddCookie(c)
+	}
+	return req
+}
+
+// newJSONRequest is newTestRequest for an API client sending JSON.
+func newJSONRequest(t *testing.T, h http.Handler, method, target, body string) *http.Request {
+	t.Helper()
+	req := newTestRequest(t, h, method, target, nil)
+	req.Body = io.NopCloser(strings.NewReader(body))
+	req.ContentLength = int64(len(body))
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Accept", "application/json")
+	return req
+}
+
+func mustCreate(t *testing.T, svc todoService, ctx context.Context, text string) *todo {
+	t.Helper()
+	td := &todo{Text: text}
+	if err := svc.createTodo(ctx, td); err != nil {
+		t.Fatalf("creating %q: %v", text, err)
+	}
+	return td
+}
+
+func TestCompletingRecurringTodoKeepsOwner(t *testing.T) {
+	svc := newInMemTodoService(newTestClock())
+	ctx := ownerContext("alice")
+	td := &todo{Text: "water the plants", Recurrence: recurDaily}
+	if err := svc.createTodo(ctx, td); err != nil {
+		t.Fatal(err)
+	}
+	done := true
+	if _, err := svc.updateTodo(ctx, td.Id, todoUpdate{done: &done}); err != nil {
+		t.Fatal(err)
+	}
+	notDone := false
+	todos, err := svc.findTodos(ctx, todoFilter{done: &notDone})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(todos) != 1 {
+		t.Fatalf("got %d open todos for alice, want the next occurrence", len(todos))
+	}
+	if next := todos[0]; next.Text != td.Text || next.Owner != "alice" || next.Recurrence != recurDaily {
+		t.Errorf("next occurrence = %+v", next)
+	}
+}
+
+func TestRecurrenceNext(t *testing.T) {
+	date := func(y int, m time.Month, d int) time.Time {
+		return time.Date(y, m, d, 9, 30, 0, 0, time.UTC)
+	}
+	tests := []struct {
+		name string
+		r    recurrence
+		from time.Time
+		want time.Time
+	}{
+		{"none", recurNone, date(2024, 3, 1), date(2024, 3, 1)},
+		{"daily", recurDaily, date(2024, 3, 1), date(2024, 3, 2)},
+		{"daily across a month", recurDaily, date(2024, 2, 29), date(2024, 3, 1)},
+		{"weekly", recurWeekly, date(2024, 3, 1), date(2024, 3, 8)},
+		{"weekly across a year", recurWeekly, date(2024, 12, 28), date(2025, 1, 4)},
+		{"monthly", recurMonthly, date(2024, 3, 15), date(2024, 4, 15)},
+		{"monthly across a year", recurMonthly, date(2024, 12, 15), date(2025, 1, 15)},
+		{"month end, leap year", recurMonthly, date(2024, 1, 31), date(2024, 2, 29)},
+		{"month end", recurMonthly, date(2023, 1, 31), date(2023, 2, 28)},
+		{"into a shorter month", recurMonthly, date(2024, 3, 31), date(2024, 4, 30)},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.r.next(tt.from); !got.Equal(tt.want) {
+				t.Errorf("next(%v) = %v, want %v", tt.from, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestCompletingRecurringTodoSchedulesNext(t *testing.T) {
+	clock := newTestClock()
+	tests := []struct {
+		name    string
+		due     time.Time
+		r       recurrence
+		wantDue time.Time
+	}{
+		{"weekly", time.Date(2024, 3, 4, 0, 0, 0, 0, time.UTC), recurWeekly, time.Date(2024, 3, 11, 0, 0, 0, 0, time.UTC)},
+		{"monthly from month end", time.Date(2024, 1, 31, 0, 0, 0, 0, time.UTC), recurMonthly, time.Date(2024, 2, 29, 0, 0, 0, 0, time.UTC)},
+		{"daily without a due date", time.Time{}, recurDaily, clock.Now().AddDate(0, 0, 1)},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			svc := newInMemTodoService(clock)
+			td := &todo{Text: "Call your mom", DueAt: tt.due, Recurrence: tt.r}
+			if err := svc.createTodo(context.Background(), td); err != nil {
+				t.Fatal(err)
+			}
+			done := true
+			if _, err := svc.updateTodo(context.Background(), td.Id, todoUpdate{done: &done}); err != nil {
+				t.Fatal(err)
+			}
+
+			completed, err := svc.getTodoById(context.Background(), td.Id)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !completed.Done || !completed.DueAt.Equal(tt.due) {
+				t.Errorf("completed todo = %+v, want it kept done with its due date", completed)
+			}
+			notDone := false
+			open, err := svc.findTodos(context.Background(), todoFilter{done: &notDone})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(open) != 1 {
+				t.Fatalf("got %d open todos, want the next occurrence", len(open))
+			}
+			if next := open[0]; next.Id == td.Id || next.Recurrence != tt.r || !next.DueAt.Equal(tt.wantDue) {
+				t.Errorf("next occurrence = %+v, want due %v", next, tt.wantDue)
+			}
+		})
+	}
+}
+
+func TestReopeningRecurringTodoSchedulesNothing(t *testing.T) {
+	svc := newInMemTodoService(newTestClock())
+	td := &todo{Text: "Call your mom", Recurrence: recurWeekly, Done: true}
+	if err := svc.createTodo(context.Background(), td); err != nil {
+		t.Fatal(err)
+	}
+	notDone := false
+	if _, err := svc.updateTodo(context.Background(), td.Id, todoUpdate{done: &notDone}); err != nil {
+		t.Fatal(err)
+	}
+	if n, err := svc.countTodos(context.Background(), todoFilter{}); err != nil || n != 1 {
+		t.Errorf("got %d todos (%v), want just the reopened one", n, err)
+	}
+}
+
+func TestExtractDue(t *testing.T) {
+	// the test clock's day is a Friday
+	now := newTestClock().Now()
+	day := func(d int) time.Time { return time.Date(2024, 3, d, 0, 0, 0, 0, time.UTC) }
+	tests := []struct {
+		text     string
+		lang     language.Tag
+		wantText string
+		wantDue  time.Time
+	}{
+		{"buy milk today", language.English, "buy milk", day(1)},
+		{"buy milk tomorrow", language.English, "buy milk", day(2)},
+		{"buy milk Tomorrow", language.English, "buy milk", day(2)},
+		{"plan the trip next week", language.English, "plan the trip", day(8)},
+		{"call mom monday", language.English, "call mom", day(4)},
+		{"call mom thursday", language.English, "call mom", day(7)},
+		{"call mom friday", language.English, "call mom", day(8)},
+		{"call mom saturday", language.English, "call mom", day(2)},
+		{"acheter du pain demain", language.French, "acheter du pain", day(2)},
+		{"appeler maman la semaine prochaine", language.French, "appeler maman", day(8)},
+		{"appeler maman semaine prochaine", language.French, "appeler maman", day(8)},
+		{"appeler maman vendredi", language.French, "appeler maman", day(8)},
+		{"appeler maman lundi", language.Make("fr-CA"), "appeler maman", day(4)},
+		{"buy milk tomorrow", language.German, "buy milk", day(2)},
+		// left alone
+		{"buy milk tomorrow", language.French, "buy milk tomorrow", time.Time{}},
+		{"acheter du pain demain", language.English, "acheter du pain demain", time.Time{}},
+		{"tomorrow", language.English, "tomorrow", time.Time{}},
+		{"tomorrow buy milk", language.English, "tomorrow buy milk", time.Time{}},
+		{"happy birthday", language.English, "happy birthday", time.Time{}},
+		{"buy milk nexttomorrow", language.English, "buy milk nexttomorrow", time.Time{}},
+		{"write the report", language.English, "write the report", time.Time{}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.lang.String()+"/"+tt.text, func(t *testing.T) {
+			text, due, ok := extractDue(tt.text, tt.lang, now)
+			if text != tt.wantText || !due.Equal(tt.wantDue) || ok != !tt.wantDue.IsZero() {
+				t.Errorf("got %q, %v, %v; want %q, %v", text, due, ok, tt.wantText, tt.wantDue)
+			}
+		})
+	}
+}
+
+func TestCreateTakesDueDateFromText(t *testing.T) {
+	svc := newInMemTodoService(newTestClock())
+	svc.parseDueDates = true
+	td := mustCreate(t, svc, context.Background(), "buy milk tomorrow")
+	if want := time.Date(2024, 3, 2, 0, 0, 0, 0, time.UTC); td.Text != "buy milk" || !td.DueAt.Equal(want) {
+		t.Errorf("got %q due %v, want \"buy milk\" due %v", td.Text, td.DueAt, want)
+	}
+	due := time.Date(2024, 4, 1, 0, 0, 0, 0, time.UTC)
+	td = &todo{Text: "buy milk tomorrow", DueAt: due}
+	if err := svc.createTodo(context.Background(), td); err != nil {
+		t.Fatal(err)
+	}
+	if td.Text != "buy milk tomorrow" || !td.DueAt.Equal(due) {
+		t.Errorf("a todo with a due date got %q due %v, want it unchanged", td.Text, td.DueAt)
+	}
+}
+
+func TestOwnersCannotChangeEachOthersTodos(t *testing.T) {
+	svc := newInMemTodoService(newTestClock())
+	alice, bob := ownerContext("alice"), ownerContext("bob")
+	open := mustCreate(t, svc, alice, "open")
+	trashed := mustCreate(t, svc, alice, "trashed")
+	if err := svc.deleteTodo(alice, trashed.Id); err != nil {
+		t.Fatal(err)
+	}
+
+	done := true
+	text := "hijacked"
+	changes := map[string]func() error{
+		"updateTodo": func() error {
+			_, err := svc.updateTodo(bob, open.Id, todoUpdate{text: &text, done: &done})
+			return err
+		},
+		"setTodosDone": func() error { return svc.setTodosDone(bob, []uint64{open.Id}, true) },
+		"moveTodo": func() error {
+			_, err := svc.moveTodo(bob, open.Id, true)
+			return err
+		},
+		"snoozeTodo": func() error {
+			_, err := svc.snoozeTodo(bob, open.Id, time.Now().Add(time.Hour))
+			return err
+		},
+		"putTodo": func() error {
+			_, _, err := svc.putTodo(bob, open.Id, todoUpdate{text: &text})
+			return err
+		},
+		"deleteTodo":  func() error { return svc.deleteTodo(bob, open.Id) },
+		"deleteTodos": func() error { return svc.deleteTodos(bob, []uint64{open.Id}) },
+		"restoreTodo": func() error {
+			_, err := svc.restoreTodo(bob, trashed.Id)
+			return err
+		},
+		"purgeTodo": func() error { return svc.purgeTodo(bob, trashed.Id) },
+	}
+	for name, change := range changes {
+		if err := change(); !errors.Is(err, errTodoNotFound) {
+			t.Errorf("%s on another owner's todo: got %v, want errTodoNotFound", name, err)
+		}
+	}
+	if n, err := svc.restoreAll(bob); err != nil || n != 0 {
+		t.Errorf("restoreAll for bob = %d, %v; want 0, nil", n, err)
+	}
+	if n, err := svc.emptyTrash(bob); err != nil || n != 0 {
+		t.Errorf("emptyTrash for bob = %d, %v; want 0, nil", n, err)
+	}
+
+	got, err := svc.getTodoById(alice, open.Id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.Text != "open" || got.Done || got.Deleted || !got.SnoozedUntil.IsZero() || got.Position != open.Position {
+		t.Errorf("alice's todo was changed by bob: %+v", got)
+	}
+	got, err = svc.getTodoById(alice, trashed.Id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !got.Deleted {
+		t.Errorf("alice's trashed todo was restored by bob")
+	}
+}
+
+func TestOwnersSeeOnlyTheirTodos(t *testing.T) {
+	svc := newInMemTodoService(newTestClock())
+	alice, bob := ownerContext("alice"), ownerContext("bob")
+	mustCreate(t, svc, alice, "alice's")
+	theirs := mustCreate(t, svc, bob, "bob's")
+
+	todos, err := svc.findTodos(alice, todoFilter{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(todos) != 1 || todos[0].Owner != "alice" {
+		t.Errorf("alice's list = %+v, want only her todo", todos)
+	}
+	if _, err := svc.getTodoById(alice, theirs.Id); !errors.Is(err, errTodoNotFound) {
+		t.Errorf("getting bob's todo as alice: got %v, want errTodoNotFound", err)
+	}
+	if n, err := svc.emptyTrash(alice); err != nil || n != 0 {
+		t.Fatalf("emptyTrash = %d, %v", n, err)
+	}
+	if err := svc.deleteTodo(bob, theirs.Id); err != nil {
+		t.Fatal(err)
+	}
+	if n, err := svc.emptyTrash(alice); err != nil || n != 0 {
+		t.Errorf("alice emptied bob's trash: %d, %v", n, err)
+	}
+	if n, err := svc.emptyTrash(bob); err != nil || n != 1 {
+		t.Errorf("bob's emptyTrash = %d, %v; want 1", n, err)
+	}
+}
+
+// A server can be given a pre-populated service, so handlers can be tried
+// against known todos.
+func Example_newServer() {
+	svc := newInMemTodoService(newTestClock())
+	ctx := context.Background()
+	for _, text := range []string{"Buy milk", "Walk the dog", "File taxes"} {
+		if err := svc.createTodo(ctx, &todo{Text: text}); err != nil {
+			panic(err)
+		}
+	}
+	_, h := newTestHandler(svc)
+
+	req := httptest.NewRequest("GET", "/todos/?q=the", nil)
+	req.Header.Set("Accept", "application/json")
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, req)
+
+	var todos []todoDTO
+	if err := json.Unmarshal(rec.Body.Bytes(), &todos); err != nil {
+		panic(err)
+	}
+	fmt.Println(rec.Code)
+	for _, t := range todos {
+		fmt.Println(t.Text)
+	}
+	// Output:
+	// 200
+	// Walk the dog
+}
+
+func TestTodosIndexPageListsInjectedTodos(t *testing.T) {
+	svc := newInMemTodoService(newTestClock())
+	mustCreate(t, svc, context.Background(), "Buy milk")
+	_, h := newTestHandler(svc)
+
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest("GET", "/todos/", nil))
+	if rec.Code != 200 {
+		t.Fatalf("status = %d, want 200", rec.Code)
+	}
+	if ct := rec.Header().Get("Content-Type"); !strings.HasPrefix(ct, "text/html") {
+		t.Errorf("Content-Type = %q, want HTML", ct)
+	}
+	if !strings.Contains(rec.Body.String(), "Buy milk") {
+		t.Errorf("page doesn't list the injected todo")
+	}
+}
+
+// recordingNotifier remembers the events it is told about.
+type recordingNotifier struct {
+	mu      sync.Mutex
+	created []uint64
+	done    []uint64
+}
+
+func (n *recordingNotifier) OnTodoCreated(ctx context.Context, t *todo) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	n.created = append(n.created, t.Id)
+}
+
+func (n *recordingNotifier) OnTodoDone(ctx context.Context, t *todo) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	n.done = append(n.done, t.Id)
+}
+
+// TestConcurrentChanges hammers the service and each of its decorators with
+// concurrent changes and reads; run it with -race.
+func TestConcurrentChanges(t *testing.T) {
+	services := map[string]func(t *testing.T) todoService{
+		"inMem": func(t *testing.T) todoService {
+			return newInMemTodoService(realClock{})
+		},
+		"coalescing": func(t *testing.T) todoService {
+			return newCoalescingTodoService(newInMemTodoService(realClock{}))
+		},
+		"notifying": func(t *testing.T) todoService {
+			broker := newChangeBroker()
+			ch := broker.subscribe()
+			stop := make(chan struct{})
+			t.Cleanup(func() { close(stop) })
+			go func() {
+				for {
+					select {
+					case <-ch:
+					case <-stop:
+						return
+					}
+				}
+			}()
+			return notifyingTodoService{newInMemTodoService(realClock{}), broker}
+		},
+		"hooking": func(t *testing.T) todoService {
+			return hookingTodoService{newInMemTodoService(realClock{}), &recordingNotifier{}}
+		},
+		"file": func(t *testing.T) todoService {
+			svc, err := newFileTodoService(newInMemTodoService(realClock{}), filepath.Join(t.TempDir(), "todos.json"))
+			if err != nil {
+				t.Fatal(err)
+			}
+			return svc
+		},
+	}
+	const workers = 8
+	for name, newService := range services {
+		t.Run(name, func(t *testing.T) {
+			rounds := 25
+			if name == "file" {
+				// every change rewrites the whole file
+				rounds = 4
+			}
+			svc := newService(t)
+			ctx := context.Background()
+			var wg sync.WaitGroup
+			errs := make(chan error, workers)
+			for w := 0; w < workers; w++ {
+				wg.Add(1)
+				go func(w int) {
+					defer wg.Done()
+					errs <- hammer(ctx, svc, w, rounds)
+				}(w)
+			}
+			wg.Wait()
+			close(errs)
+			for err := range errs {
+				if err != nil {
+					t.Fatal(err)
+				}
+			}
+			live, err := svc.countTodos(ctx, todoFilter{})
+			if err != nil {
+				t.Fatal(err)
+			}
+			trashed, err := svc.countTodos(ctx, todoFilter{deletedOnly: true})
+			if err != nil {
+				t.Fatal(err)
+			}
+			// each round creates two todos and deletes one of them
+			if want := workers * rounds; live != want || trashed != want {
+				t.Errorf("got %d live and %d deleted todos, want %d of each", live, trashed, want)
+			}
+		})
+	}
+}
+
+// hammer runs rounds of creating, changing, reading and deleting todos of
+// its own while other workers do the same.
+func hammer(ctx context.Context, svc todoService, worker, rounds int) error {
+	for i := 0; i < rounds; i++ {
+		keep := &todo{Text: fmt.Sprintf("keep %d-%d", worker, i)}
+		drop := &todo{Text: fmt.Sprintf("drop %d-%d", worker, i)}
+		if err := svc.createTodo(ctx, keep); err != nil {
+			return err
+		}
+		if err := svc.createTodo(ctx, drop); err != nil {
+			return err
+		}
+		text := keep.Text + " edited"
+		done := i%2 == 0
+		if _, err := svc.updateTodo(ctx, keep.Id, todoUpdate{text: &text, done: &done}); err != nil {
+			return err
+		}
+		if err := svc.setTodosDone(ctx, []uint64{drop.Id}, true); err != nil {
+			return err
+		}
+		if _, err := svc.moveTodo(ctx, keep.Id, i%3 == 0); err != nil {
+			return err
+		}
+		if _, err := svc.findTodos(ctx, todoFilter{query: "edited"}); err != nil {
+			return err
+		}
+		if _, err := svc.countTodos(ctx, todoFilter{done: &done}); err != nil {
+			return err
+		}
+		if _, err := svc.getTodoById(ctx, keep.Id); err != nil {
+			return err
+		}
+		if err := svc.deleteTodo(ctx, drop.Id); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func TestCancelledContextStopsService(t *testing.T) {
+	svc := newInMemTodoService(newTestClock())
+	existing := mustCreate(t, svc, context.Background(), "existing")
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	done := true
+	calls := map[string]func() error{
+		"getTodoById": func() error {
+			_, err := svc.getTodoById(ctx, existing.Id)
+			return err
+		},
+		"findTodos": func() error {
+			_, err := svc.findTodos(ctx, todoFilter{})
+			return err
+		},
+		"countTodos": func() error {
+			_, err := svc.countTodos(ctx, todoFilter{})
+			return err
+		},
+		"createTodo": func() error { return svc.createTodo(ctx, &todo{Text: "new"}) },
+		"updateTodo": func() error {
+			_, err := svc.updateTodo(ctx, existing.Id, todoUpdate{done: &done})
+			return err
+		},
+		"deleteTodo": func() error { return svc.deleteTodo(ctx, existing.Id) },
+		"stats": func() error {
+			_, err := svc.stats(ctx)
+			return err
+		},
+	}
+	for name, call := range calls {
+		if err := call(); !errors.Is(err, context.Canceled) {
+			t.Errorf("%s with a cancelled context: got %v, want context.Canceled", name, err)
+		}
+	}
+	got, err := svc.getTodoById(context.Background(), existing.Id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.Done || got.Deleted {
+		t.Errorf("todo changed despite the cancelled context: %+v", got)
+	}
+	if n, _ := svc.countTodos(context.Background(), todoFilter{}); n != 1 {
+		t.Errorf("got %d todos, want only the existing one", n)
+	}
+}
+
+func TestCancelledRequestFailsHandler(t *testing.T) {
+	svc := newInMemTodoService(newTestClock())
+	mustCreate(t, svc, context.Background(), "existing")
+	_, h := newTestHandler(svc)
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	for _, req := range []*http.Request{
+		newTestRequest(t, h, "GET", "/todos/", nil),
+		newTestRequest(t, h, "POST", "/todos/", url.Values{"new-todo": {"new"}}),
+	} {
+		req = req.WithContext(ctx)
+		req.Header.Set("Accept", "application/json")
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, req)
+		if rec.Code != 500 {
+			t.Errorf("%s %s with a cancelled context: status %d, want 500", req.Method, req.URL, rec.Code)
+		}
+	}
+	if n, _ := svc.countTodos(context.Background(), todoFilter{}); n != 1 {
+		t.Errorf("got %d todos, want the cancelled request to add none", n)
+	}
+}
+
+func TestNegotiate(t *testing.T) {
+	tests := []struct {
+		name       string
+		accept     string
+		htmx       bool
+		wantFormat responseFormat
+	}{
+		{"browser", "text/html,application/xhtml+xml,*/*;q=0.8", false, formatHTML},
+		{"no accept", "", false, formatHTML},
+		{"anything", "*/*", false, formatHTML},
+		{"json", "application/json", false, formatJSON},
+		{"json before html", "application/json, text/html", false, formatJSON},
+		{"html before json", "text/html, application/json", false, formatHTML},
+		{"htmx", "*/*", true, formatHTMLFragment},
+		{"htmx asking for json", "application/json", true, formatHTMLFragment},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest("GET", "/todos/", nil)
+			if tt.accept != "" {
+				r.Header.Set("Accept", tt.accept)
+			}
+			if tt.htmx {
+				r.Header.Set("HX-Request", "true")
+			}
+			if got := negotiate(r); got != tt.wantFormat {
+				t.Errorf("negotiate() = %v, want %v", got, tt.wantFormat)
+			}
+		})
+	}
+}
+
+func TestToggleResponseFormats(t *testing.T) {
+	tests := []struct {
+		name            string
+		accept          string
+		htmx            bool
+		wantStatus      int
+		wantContentType string
+		wantBody        string
+	}{
+		{"browser is redirected", "text/html", false, 303, "", ""},
+		{"json gets the todo", "application/json", false, 200, "application/json", `"text":"Walk the dog"`},
+		{"htmx gets the row", "text/html", true, 200, "text/html", `id="todo-`},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			svc := newInMemTodoService(newTestClock())
+			todo := mustCreate(t, svc, context.Background(), "Walk the dog")
+			_, h := newTestHandler(svc)
+			req := newTestRequest(t, h, "POST", fmt.Sprintf("/todos/%d/toggle/", todo.Id), url.Values{})
+			req.Header.Set("Accept", tt.accept)
+			if tt.htmx {
+				req.Header.Set("HX-Request", "true")
+			}
+			rec := httptest.NewRecorder()
+			h.ServeHTTP(rec, req)
+			if rec.Code != tt.wantStatus {
+				t.Fatalf("status %d, want %d: %s", rec.Code, tt.wantStatus, rec.Body)
+			}
+			if tt.wantStatus == 303 {
+				if loc := rec.Header().Get("Location"); loc != "/todos/" {
+					t.Errorf("redirected to %q, want /todos/", loc)
+				}
+			}
+			if ct := rec.Header().Get("Content-Type"); !strings.HasPrefix(ct, tt.wantContentType) {
+				t.Errorf("Content-Type %q, want %s", ct, tt.wantContentType)
+			}
+			body := rec.Body.String()
+			if !strings.Contains(body, tt.wantBody) {
+				t.Errorf("body doesn't contain %q:\n%s", tt.wantBody, body)
+			}
+			if strings.Contains(body, "<html") {
+				t.Errorf("got a full page, want a %s response", tt.name)
+			}
+			got, err := svc.getTodoById(context.Background(), todo.Id)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !got.Done {
+				t.Error("todo wasn't toggled")
+			}
+		})
+	}
+}
+
+func TestListResponseFormats(t *testing.T) {
+	svc := newInMemTodoService(newTestClock())
+	mustCreate(t, svc, context.Background(), "Walk the dog")
+	_, h := newTestHandler(svc)
+	tests := []struct {
+		name     string
+		accept   string
+		htmx     bool
+		fullPage bool
+		json     bool
+	}{
+		{"browser gets the page", "text/html", false, true, false},
+		{"json gets the list", "application/json", false, false, true},
+		{"htmx gets the fragment", "text/html", true, false, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest("GET", "/todos/", nil)
+			req.Header.Set("Accept", tt.accept)
+			if tt.htmx {
+				req.Header.Set("HX-Request", "true")
+			}
+			rec := httptest.NewRecorder()
+			h.ServeHTTP(rec, req)
+			if rec.Code != 200 {
+				t.Fatalf("status %d, want 200", rec.Code)
+			}
+			body := rec.Body.String()
+			if got := strings.Contains(body, "<html"); got != tt.fullPage {
+				t.Errorf("full page: got %v, want %v", got, tt.fullPage)
+			}
+			var todos []todoDTO
+			isJSON := json.Unmarshal(rec.Body.Bytes(), &todos) == nil
+			if isJSON != tt.json {
+				t.Errorf("json: got %v, want %v", isJSON, tt.json)
+			}
+			if !strings.Contains(body, "Walk the dog") {
+				t.Errorf("body doesn't list the todo:\n%s", body)
+			}
+		})
+	}
+}
+
+func TestTimestampsFollowTheClock(t *testing.T) {
+	clock := newTestClock()
+	svc := newInMemTodoService(clock)
+	ctx := context.Background()
+	created := clock.Now()
+	todo := mustCreate(t, svc, ctx, "Walk the dog")
+	if !todo.CreatedAt.Equal(created) || !todo.UpdatedAt.Equal(created) || !todo.DoneAt.IsZero() {
+		t.Fatalf("new todo: created %v, updated %v, done %v; want %v, %v and zero",
+			todo.CreatedAt, todo.UpdatedAt, todo.DoneAt, created, created)
+	}
+
+	check := func(step string, wantUpdated, wantDone time.Time) {
+		t.Helper()
+		got, err := svc.getTodoById(ctx, todo.Id)
+		if err != nil {
+			t.Fatalf("%s: %v", step, err)
+		}
+		if !got.CreatedAt.Equal(created) {
+			t.Errorf("%s: CreatedAt %v, want %v", step, got.CreatedAt, created)
+		}
+		if !got.UpdatedAt.Equal(wantUpdated) {
+			t.Errorf("%s: UpdatedAt %v, want %v", step, got.UpdatedAt, wantUpdated)
+		}
+		if !got.DoneAt.Equal(wantDone) {
+			t.Errorf("%s: DoneAt %v, want %v", step, got.DoneAt, wantDone)
+		}
+	}
+	yes, no := true, false
+
+	clock.advance(time.Hour)
+	text := "Walk the cat"
+	if _, err := svc.updateTodo(ctx, todo.Id, todoUpdate{text: &text}); err != nil {
+		t.Fatal(err)
+	}
+	check("editing", clock.Now(), time.Time{})
+
+	clock.advance(time.Hour)
+	doneAt := clock.Now()
+	if _, err := svc.updateTodo(ctx, todo.Id, todoUpdate{done: &yes}); err != nil {
+		t.Fatal(err)
+	}
+	check("completing", doneAt, doneAt)
+
+	clock.advance(time.Hour)
+	if _, err := svc.updateTodo(ctx, todo.Id, todoUpdate{done: &yes}); err != nil {
+		t.Fatal(err)
+	}
+	check("completing again", clock.Now(), doneAt)
+
+	clock.advance(time.Hour)
+	if _, err := svc.updateTodo(ctx, todo.Id, todoUpdate{done: &no}); err != nil {
+		t.Fatal(err)
+	}
+	check("un-doing", clock.Now(), time.Time{})
+
+	clock.advance(time.Hour)
+	if err := svc.setTodosDone(ctx, []uint64{todo.Id}, true); err != nil {
+		t.Fatal(err)
+	}
+	check("completing in bulk", clock.Now(), clock.Now())
+
+	clock.advance(time.Hour)
+	if err := svc.setTodosDone(ctx, []uint64{todo.Id}, false); err != nil {
+		t.Fatal(err)
+	}
+	check("un-doing in bulk", clock.Now(), time.Time{})
+}
+
+func TestReadsReturnCopies(t *testing.T) {
+	services := map[string]todoService{
+		"inMem":      newInMemTodoService(newTestClock()),
+		"coalescing": newCoalescingTodoService(newInMemTodoService(newTestClock())),
+	}
+	for name, svc := range services {
+		t.Run(name, func(t *testing.T) {
+			ctx := context.Background()
+			created := mustCreate(t, svc, ctx, "Walk the dog")
+			id := created.Id
+			mutate := func(t *todo) {
+				t.Text = "changed"
+				t.Done = true
+				t.Owner = "someone else"
+				if len(t.History) > 0 {
+					t.History[0].Kind = eventDeleted
+				}
+				t.History = append(t.History, todoEvent{Kind: eventDone})
+			}
+			check := func(step string) {
+				t.Helper()
+				got, err := svc.getTodoById(ctx, id)
+				if err != nil {
+					t.Fatalf("%s: %v", step, err)
+				}
+				if got.Text != "Walk the dog" || got.Done || got.Owner != anonymousOwner {
+					t.Errorf("%s changed the stored todo: %+v", step, got)
+				}
+				if len(got.History) != 1 || got.History[0].Kind != eventCreated {
+					t.Errorf("%s changed the stored history: %+v", step, got.History)
+				}
+			}
+
+			mutate(created)
+			check("mutating the created todo")
+
+			got, err := svc.getTodoById(ctx, id)
+			if err != nil {
+				t.Fatal(err)
+			}
+			mutate(got)
+			check("mutating getTodoById's todo")
+
+			found, err := svc.findTodos(ctx, todoFilter{})
+			if err != nil {
+				t.Fatal(err)
+			}
+			for _, t := range found {
+				mutate(t)
+			}
+			check("mutating findTodos' todos")
+
+			err = svc.findTodosFunc(ctx, todoFilter{}, func(t *todo) error {
+				mutate(t)
+				return nil
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			check("mutating findTodosFunc's todos")
+		})
+	}
+}
+
+func TestCountMatchesFind(t *testing.T) {
+	clock := newTestClock()
+	svc := newInMemTodoService(clock)
+	svc.ttl = 48 * time.Hour
+	ctx := context.Background()
+	yes := true
+
+	mustCreate(t, svc, ctx, "expired")
+	clock.advance(72 * time.Hour)
+	start := clock.Now()
+	mustCreate(t, svc, ownerContext("bob"), "someone else's")
+	mustCreate(t, svc, ctx, "Walk the dog")
+	done := mustCreate(t, svc, ctx, "Feed the cat")
+	if _, err := svc.updateTodo(ctx, done.Id, todoUpdate{done: &yes}); err != nil {
+		t.Fatal(err)
+	}
+	pinned := mustCreate(t, svc, ctx, "Water the plants")
+	if _, err := svc.updateTodo(ctx, pinned.Id, todoUpdate{pinned: &yes}); err != nil {
+		t.Fatal(err)
+	}
+	overdue := &todo{Text: "Pay the bills", DueAt: start.Add(-time.Hour)}
+	if err := svc.createTodo(ctx, overdue); err != nil {
+		t.Fatal(err)
+	}
+	snoozed := mustCreate(t, svc, ctx, "Call the dentist")
+	if _, err := svc.snoozeTodo(ctx, snoozed.Id, start.Add(time.Hour)); err != nil {
+		t.Fatal(err)
+	}
+	deleted := mustCreate(t, svc, ctx, "Walk the cat")
+	if err := svc.deleteTodo(ctx, deleted.Id); err != nil {
+		t.Fatal(err)
+	}
+	clock.advance(time.Minute)
+
+	notDone := false
+	before := start.Add(time.Second)
+	tests := []struct {
+		name   string
+		filter todoFilter
+		want   int
+	}{
+		{"all", todoFilter{}, 4},
+		{"done", todoFilter{done: &yes}, 1},
+		{"not done", todoFilter{done: &notDone}, 3},
+		{"done after", todoFilter{doneAfter: &start}, 1},
+		{"done before", todoFilter{doneBefore: &before}, 1},
+		{"modified since", todoFilter{modifiedSince: &start}, 5},
+		{"include snoozed", todoFilter{includeSnoozed: true}, 5},
+		{"overdue", todoFilter{overdue: true}, 1},
+		{"pinned", todoFilter{pinnedOnly: true}, 1},
+		{"query", todoFilter{query: "walk"}, 1},
+		{"no match", todoFilter{query: "nothing like it"}, 0},
+		{"trash", todoFilter{deletedOnly: true}, 1},
+		{"excluded", todoFilter{excludeIds: []uint64{done.Id, pinned.Id}}, 2},
+		{"other owner", todoFilter{owner: "bob"}, 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			found, err := svc.findTodos(ctx, tt.filter)
+			if err != nil {
+				t.Fatal(err)
+			}
+			n, err := svc.countTodos(ctx, tt.filter)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if n != len(found) {
+				t.Errorf("countTodos = %d, findTodos found %d", n, len(found))
+			}
+			if n != tt.want {
+				t.Errorf("countTodos = %d, want %d", n, tt.want)
+			}
+		})
+	}
+}
+
+func TestFindTodosFuncVisitsInListOrder(t *testing.T) {
+	svc := newInMemTodoService(newTestClock())
+	ctx := context.Background()
+	yes := true
+	first := mustCreate(t, svc, ctx, "first")
+	second := mustCreate(t, svc, ctx, "second")
+	third := mustCreate(t, svc, ctx, "third")
+	done := mustCreate(t, svc, ctx, "done")
+	if _, err := svc.updateTodo(ctx, done.Id, todoUpdate{done: &yes}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := svc.updateTodo(ctx, second.Id, todoUpdate{pinned: &yes}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := svc.moveTodo(ctx, third.Id, true); err != nil {
+		t.Fatal(err)
+	}
+
+	var got []uint64
+	notDone := false
+	err := svc.findTodosFunc(ctx, todoFilter{done: &notDone}, func(t *todo) error {
+		got = append(got, t.Id)
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []uint64{second.Id, third.Id, first.Id}
+	if fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Errorf("visited %v, want the pinned todo, then the moved one, then the rest: %v", got, want)
+	}
+}
+
+func TestFindTodosFuncStopsOnError(t *testing.T) {
+	svc := newInMemTodoService(newTestClock())
+	ctx := context.Background()
+	for i := 0; i < 5; i++ {
+		mustCreate(t, svc, ctx, fmt.Sprintf("todo %d", i))
+	}
+	errStop := errors.New("stop")
+	calls := 0
+	err := svc.findTodosFunc(ctx, todoFilter{}, func(t *todo) error {
+		calls++
+		if calls == 2 {
+			return errStop
+		}
+		return nil
+	})
+	if err != errStop {
+		t.Errorf("got error %v, want the one fn returned", err)
+	}
+	if calls != 2 {
+		t.Errorf("fn called %d times, want it to stop after the error at 2", calls)
+	}
+
+	// the read lock is released, so changes go through afterwards
+	if err := svc.createTodo(ctx, &todo{Text: "after"}); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// discardResponse is a flushable ResponseWriter that throws the body away,
+// so benchmarks measure rendering rather than a recorder's buffer.
+type discardResponse struct {
+	header http.Header
+	code   int
+}
+
+func (w *discardResponse) Header() http.Header {
+	if w.header == nil {
+		w.header = http.Header{}
+	}
+	return w.header
+}
+
+func (w *discardResponse) Write(b []byte) (int, error) { return len(b), nil }
+func (w *discardResponse) WriteHeader(code int)        { w.code = code }
+func (w *discardResponse) Flush()                      {}
+
+// newPageRequest returns a GET request for target carrying the context the
+// middleware gives the templates.
+func newPageRequest(s *server, target string) *http.Request {
+	var req *http.Request
+	var h http.Handler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		req = r.WithContext(context.WithValue(r.Context(), templatesKey, s.templates))
+	})
+	h = withMessagePrinter(h)
+	h = withTheme(h)
+	h = withDoneDisplay(h, defaultConfig().DoneDisplay)
+	h = withLocation(h, time.UTC)
+	h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", target, nil))
+	return req
+}
+
+func BenchmarkTodosIndexPage(b *testing.B) {
+	svc := newInMemTodoService(newTestClock())
+	if err := seedTodos(svc, 2*streamThreshold); err != nil {
+		b.Fatal(err)
+	}
+	s, _ := newTestHandler(svc)
+	r := newPageRequest(s, "/todos/?filter=all")
+	data, err := s.getTodoListPage(r)
+	if err != nil {
+		b.Fatal(err)
+	}
+	if len(data.Todos) <= streamThreshold {
+		b.Fatalf("listed %d todos, want more than the stream threshold", len(data.Todos))
+	}
+	render := map[string]func(map[string]*template.Template, string, http.ResponseWriter, interface{}) error{
+		"buffered": func(templates map[string]*template.Template, name string, w http.ResponseWriter, data interface{}) error {
+			return renderPage(templates, name, w, 200, data)
+		},
+		"streamed": streamPage,
+	}
+	for _, name := range []string{"buffered", "streamed"} {
+		b.Run(name, func(b *testing.B) {
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				if err := render[name](s.templates, "todos_index.html", &discardResponse{}, data); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+func BenchmarkSeededList(b *testing.B) {
+	svc := newInMemTodoService(newTestClock())
+	if err := seedTodos(svc, 10000); err != nil {
+		b.Fatal(err)
+	}
+	_, h := newTestHandler(svc)
+	b.Run("find", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			if _, err := svc.findTodos(context.Background(), todoFilter{}); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+	b.Run("page", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			w := &discardResponse{}
+			h.ServeHTTP(w, httptest.NewRequest("GET", "/todos/?filter=all", nil))
+			if w.code != 0 && w.code != 200 {
+				b.Fatalf("status %d, want 200", w.code)
+			}
+		}
+	})
+}
+
+func TestFinalizeDeletesOnShutdown(t *testing.T) {
+	svc := newInMemTodoService(newTestClock())
+	s, _ := newTestHandler(svc)
+	s.pendingDeletes = newPendingDeletes(time.Hour)
+	mine := mustCreate(t, svc, context.Background(), "Walk the dog")
+	theirs := mustCreate(t, svc, ownerContext("bob"), "Feed the cat")
+	s.pendingDeletes.add(mine.Id, anonymousOwner, s.clock.Now())
+	s.pendingDeletes.add(theirs.Id, "bob", s.clock.Now())
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		s.finalizeDeletes(ctx, time.Hour)
+	}()
+	cancel()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("finalizeDeletes didn't return after ctx was done")
+	}
+	for _, c := range []struct {
+		ctx context.Context
+		id  uint64
+	}{
+		{context.Background(), mine.Id},
+		{ownerContext("bob"), theirs.Id},
+	} {
+		got, err := svc.getTodoById(c.ctx, c.id)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !got.Deleted {
+			t.Errorf("todo %d still not deleted after the sweep stopped", c.id)
+		}
+	}
+	if ids := s.pendingDeletes.ids(); len(ids) != 0 {
+		t.Errorf("deletes %v still pending", ids)
+	}
+}
+
+func TestBasePath(t *testing.T) {
+	svc := newInMemTodoService(newTestClock())
+	td := mustCreate(t, svc, context.Background(), "Walk the dog")
+	s := newServer(embeddedTemplates(), normalizeBasePath("/app/"), svc)
+	cfg := defaultConfig()
+	cfg.CSRFAuthKey = strings.Repeat("k", 32)
+	h := s.handler(cfg, true)
+
+	tests := []struct {
+		target   string
+		want     int
+		location string
+	}{
+		{"/app/", 200, ""},
+		{"/app", 301, "/app/"},
+		{"/app/todos", 301, "/app/todos/"},
+		{"/app/todos/", 200, ""},
+		{fmt.Sprintf("/app/todos/%d/detail/", td.Id), 200, ""},
+		{"/todos/", 404, ""},
+		{"/", 404, ""},
+	}
+	for _, tt := range tests {
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, httptest.NewRequest("GET", tt.target, nil))
+		if loc := rec.Result().Header.Get("Location"); rec.Code != tt.want || loc != tt.location {
+			t.Errorf("GET %s: status %d to %q, want %d to %q", tt.target, rec.Code, loc, tt.want, tt.location)
+		}
+	}
+
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest("GET", "/app/todos/", nil))
+	body := rec.Body.String()
+	if !strings.Contains(body, `hx-post="/app/todos/`) || strings.Contains(body, `hx-post="/todos/`) {
+		t.Error("list page links aren't under the base path")
+	}
+
+	req := newTestRequestFrom(t, h, "/app/", "POST", "/app/todos/", url.Values{"new-todo": {"Feed the cat"}})
+	rec = httptest.NewRecorder()
+	h.ServeHTTP(rec, req)
+	if loc := rec.Result().Header.Get("Location"); rec.Code != 302 || loc != "/app/todos/" {
+		t.Errorf("create: status %d to %q, want 302 to /app/todos/", rec.Code, loc)
+	}
+	if n, _ := svc.countTodos(context.Background(), todoFilter{}); n != 2 {
+		t.Errorf("%d todos after creating one under the base path, want 2", n)
+	}
+}
+
+func TestNormalizeBasePath(t *testing.T) {
+	for in, want := range map[string]string{"": "", "/": "", "app": "/app", "/app/": "/app", "//a/b//": "/a/b"} {
+		if got := normalizeBasePath(in); got != want {
+			t.Errorf("normalizeBasePath(%q) = %q, want %q", in, got, want)
+		}
+	}
+}
+
+func TestProgressAfterToggling(t *testing.T) {
+	svc := newInMemTodoService(newTestClock())
+	ctx := context.Background()
+	var todos []*todo
+	for _, text := range []string{"Walk the dog", "Feed the cat", "Call your mom", "Pay rent"} {
+		todos = append(todos, mustCreate(t, svc, ctx, text))
+	}
+	// trashed todos don't count, snoozed ones do
+	trashed := mustCreate(t, svc, ctx, "Water the plants")
+	if err := svc.deleteTodo(ctx, trashed.Id); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := svc.snoozeTodo(ctx, todos[3].Id, svc.clock.Now().Add(time.Hour)); err != nil {
+		t.Fatal(err)
+	}
+	s, h := newTestHandler(svc)
+
+	toggle := func(td *todo) string {
+		t.Helper()
+		req := newTestRequest(t, h, "POST", fmt.Sprintf("/todos/%d/toggle/", td.Id), nil)
+		req.Header.Set("HX-Request", "true")
+		req.Header.Set("HX-Target", fmt.Sprintf("todo-%d", td.Id))
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, req)
+		if rec.Code != 200 {
+			t.Fatalf("toggling: status %d", rec.Code)
+		}
+		return rec.Body.String()
+	}
+
+	toggle(todos[0])
+	body := toggle(todos[1])
+	for _, want := range []string{`hx-swap-oob="outerHTML:#todo-progress"`, `aria-valuenow="50"`, "2 of 4 done (50%)", "2 remaining"} {
+		if !strings.Contains(body, want) {
+			t.Errorf("toggle response has no %q:\n%s", want, body)
+		}
+	}
+	body = toggle(todos[0])
+	if !strings.Contains(body, "1 of 4 done (25%)") || !strings.Contains(body, "3 remaining") {
+		t.Errorf("reopening didn't update the progress:\n%s", body)
+	}
+
+	got, err := s.getProgress(newPageRequest(s, "/todos/"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := (todoProgress{Total: 4, Done: 1, Remaining: 3, Percent: 25}); got != want {
+		t.Errorf("progress = %+v, want %+v", got, want)
+	}
+}
+
+func TestChangesUpdateCountsOutOfBand(t *testing.T) {
+	tests := []struct {
+		name    string
+		method  string
+		target  string
+		primary string
+	}{
+		{"toggle", "POST", "/todos/%d/toggle/", `<tr id="todo-%d"`},
+		{"delete", "DELETE", "/todos/%d/", "Showing 1 todo item."},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			svc := newInMemTodoService(newTestClock())
+			mustCreate(t, svc, context.Background(), "Walk the dog")
+			td := mustCreate(t, svc, context.Background(), "Feed the cat")
+			_, h := newTestHandler(svc)
+			req := newTestRequest(t, h, tt.method, fmt.Sprintf(tt.target, td.Id), nil)
+			req.Header.Set("HX-Request", "true")
+			req.Header.Set("HX-Target", fmt.Sprintf("todo-%d", td.Id))
+			rec := httptest.NewRecorder()
+			h.ServeHTTP(rec, req)
+			body := rec.Body.String()
+			primary := tt.primary
+			if strings.Contains(primary, "%d") {
+				primary = fmt.Sprintf(primary, td.Id)
+			}
+			for _, want := range []string{
+				primary,
+				`hx-swap-oob="outerHTML:#todo-number-items"`,
+				`hx-swap-oob="outerHTML:#todo-progress"`,
+			} {
+				if !strings.Contains(body, want) {
+					t.Errorf("response has no %q:\n%s", want, body)
+				}
+			}
+		})
+	}
+
+	// a create has the list reload, counts included
+	svc := newInMemTodoService(newTestClock())
+	_, h := newTestHandler(svc)
+	req := newTestRequest(t, h, "POST", "/todos/", url.Values{"new-todo": {"Walk the dog"}})
+	req.Header.Set("HX-Request", "true")
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, req)
+	if trigger := rec.Result().Header.Get("HX-Trigger"); !strings.Contains(trigger, eventNewTodo) {
+		t.Errorf("HX-Trigger %q doesn't reload the list", trigger)
+	}
+	if !strings.Contains(rec.Body.String(), `id="new-todo-form"`) {
+		t.Errorf("create response has no fresh form:\n%s", rec.Body)
+	}
+}
+
+func TestRenderOOB(t *testing.T) {
+	templates := map[string]*template.Template{
+		"a.html": template.Must(template.New("a.html").Parse(`<p id="a">{{.}}</p>`)),
+		"b.html": template.Must(template.New("b.html").Parse(`<p id="b" hx-swap-oob="true">{{.}}</p>`)),
+	}
+	rec := httptest.NewRecorder()
+	if err := renderOOB(templates, rec, fragment{"a.html", 1}, fragment{"b.html", 2}); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := rec.Body.String(), `<p id="a">1</p><p id="b" hx-swap-oob="true">2</p>`; got != want {
+		t.Errorf("got %s, want %s", got, want)
+	}
+
+	// nothing is written when a fragment fails
+	rec = httptest.NewRecorder()
+	if err := renderOOB(templates, rec, fragment{"a.html", 1}, fragment{"c.html", 2}); err == nil {
+		t.Error("unknown template rendered")
+	}
+	if rec.Body.Len() != 0 {
+		t.Errorf("partial response written: %s", rec.Body)
+	}
+}
+
+func TestFilterPushesURL(t *testing.T) {
+	tests := []struct {
+		name    string
+		target  string
+		current string
+		want    string
+	}{
+		{"done filter", "/todos/?filter=done", "", "/todos/?filter=done"},
+		{"search", "/todos/?filter=done&q=cat", "", "/todos/?filter=done&q=cat"},
+		{"no filter", "/todos/", "", "/todos/"},
+		{"keeps other params", "/todos/?filter=done", "http://example.com/todos/?filter=all&sort=due", "/todos/?filter=done&sort=due"},
+		{"ignores other pages", "/todos/?filter=done", "http://example.com/todos/focus/?sort=due", "/todos/?filter=done"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			svc := newInMemTodoService(newTestClock())
+			_, h := newTestHandler(svc)
+			req := newTestRequest(t, h, "GET", tt.target, nil)
+			req.Header.Set("HX-Request", "true")
+			if tt.current != "" {
+				req.Header.Set("HX-Current-URL", tt.current)
+			}
+			rec := httptest.NewRecorder()
+			h.ServeHTTP(rec, req)
+			if rec.Code != 200 {
+				t.Fatalf("status %d", rec.Code)
+			}
+			if got := rec.Result().Header.Get("HX-Push-Url"); got != tt.want {
+				t.Errorf("HX-Push-Url %q, want %q", got, tt.want)
+			}
+		})
+	}
+
+	// a full page load doesn't push anything
+	svc := newInMemTodoService(newTestClock())
+	_, h := newTestHandler(svc)
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, newTestRequest(t, h, "GET", "/todos/?filter=done", nil))
+	if got := rec.Result().Header.Get("HX-Push-Url"); got != "" {
+		t.Errorf("full page load pushed %q", got)
+	}
+}
+
+func TestTheme(t *testing.T) {
+	svc := newInMemTodoService(newTestClock())
+	_, h := newTestHandler(svc)
+
+	// auto until a theme is chosen
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest("GET", "/todos/", nil))
+	if !strings.Contains(rec.Body.String(), `data-theme="auto"`) {
+		t.Error("page without a theme cookie isn't auto")
+	}
+
+	req := newTestRequest(t, h, "POST", "/theme/", url.Values{"theme": {"dark"}})
+	req.Header.Set("HX-Request", "true")
+	rec = httptest.NewRecorder()
+	h.ServeHTTP(rec, req)
+	if got := rec.Result().Header.Get("HX-Refresh"); got != "true" {
+		t.Errorf("HX-Refresh %q, want true", got)
+	}
+	var cookie *http.Cookie
+	for _, c := range rec.Result().Cookies() {
+		if c.Name == themeCookieName {
+			cookie = c
+		}
+	}
+	if cookie == nil || cookie.Value != "dark" {
+		t.Fatalf("theme cookie %v, want dark", cookie)
+	}
+
+	req = httptest.NewRequest("GET", "/todos/", nil)
+	req.AddCookie(cookie)
+	rec = httptest.NewRecorder()
+	h.ServeHTTP(rec, req)
+	if !strings.Contains(rec.Body.String(), `data-theme="dark"`) {
+		t.Error("page with a dark theme cookie isn't dark")
+	}
+
+	// an unknown cookie value falls back to auto
+	req = httptest.NewRequest("GET", "/todos/", nil)
+	req.AddCookie(&http.Cookie{Name: themeCookieName, Value: "neon"})
+	rec = httptest.NewRecorder()
+	h.ServeHTTP(rec, req)
+	if !strings.Contains(rec.Body.String(), `data-theme="auto"`) {
+		t.Error("page with an unknown theme cookie isn't auto")
+	}
+
+	for theme, status := range map[string]int{"neon": 404, "": 400} {
+		rec = httptest.NewRecorder()
+		h.ServeHTTP(rec, newTestRequest(t, h, "POST", "/theme/", url.Values{"theme": {theme}}))
+		if rec.Code != status {
+			t.Errorf("theme %q: status %d, want %d", theme, rec.Code, status)
+		}
+		for _, c := range rec.Result().Cookies() {
+			if c.Name == themeCookieName {
+				t.Errorf("theme %q set the cookie to %q", theme, c.Value)
+			}
+		}
+	}
+}
+
+func TestEditCancel(t *testing.T) {
+	svc := newInMemTodoService(newTestClock())
+	td := mustCreate(t, svc, context.Background(), "Walk the dog")
+	_, h := newTestHandler(svc)
+
+	get := func(target string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("GET", target, nil)
+		req.Header.Set("HX-Request", "true")
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, req)
+		return rec
+	}
+
+	rec := get(fmt.Sprintf("/todos/%d/edit/", td.Id))
+	cancel := fmt.Sprintf(`hx-get="/todos/%d/edit/cancel/"`, td.Id)
+	if !strings.Contains(rec.Body.String(), cancel) {
+		t.Fatalf("edit form has no cancel button:\n%s", rec.Body)
+	}
+
+	for _, target := range []string{
+		fmt.Sprintf("/todos/%d/edit/cancel/", td.Id),
+		fmt.Sprintf("/todos/%d/", td.Id),
+	} {
+		rec = get(target)
+		body := rec.Body.String()
+		if rec.Code != 200 {
+			t.Errorf("GET %s: status %d", target, rec.Code)
+		}
+		if !strings.Contains(body, fmt.Sprintf(`<tr id="todo-%d"`, td.Id)) || !strings.Contains(body, "Walk the dog") {
+			t.Errorf("GET %s didn't render the todo:\n%s", target, body)
+		}
+		if strings.Contains(body, cancel) {
+			t.Errorf("GET %s rendered the edit form", target)
+		}
+	}
+
+	// a todo deleted while it was being edited leaves nothing to swap in
+	if err := svc.deleteTodo(context.Background(), td.Id); err != nil {
+		t.Fatal(err)
+	}
+	rec = get(fmt.Sprintf("/todos/%d/edit/cancel/", td.Id))
+	if rec.Code != 200 || rec.Body.Len() != 0 {
+		t.Errorf("cancelling a deleted todo's edit: status %d, body %q", rec.Code, rec.Body)
+	}
+}
+
+func TestCompletedFilters(t *testing.T) {
+	clock := newTestClock()
+	clock.now = time.Date(2024, 2, 29, 15, 0, 0, 0, time.UTC)
+	svc := newInMemTodoService(clock)
+	ctx := context.Background()
+	var ids []uint64
+	for _, text := range []string{"done yesterday", "done this morning", "done just now", "not done"} {
+		ids = append(ids, mustCreate(t, svc, ctx, text).Id)
+	}
+	for i, at := range []time.Time{
+		time.Date(2024, 2, 29, 15, 0, 0, 0, time.UTC),
+		time.Date(2024, 3, 1, 8, 0, 0, 0, time.UTC),
+		time.Date(2024, 3, 1, 10, 0, 0, 0, time.UTC),
+	} {
+		clock.now = at
+		if err := svc.setTodosDone(ctx, ids[i:i+1], true); err != nil {
+			t.Fatal(err)
+		}
+	}
+	s, h := newTestHandler(svc)
+	s.clock = clock
+
+	tests := []struct {
+		query string
+		want  []string
+	}{
+		{"filter=donetoday", []string{"done just now", "done this morning"}},
+		{"done_after=2024-02-29", []string{"done just now", "done this morning", "done yesterday"}},
+		{"done_before=2024-03-01", []string{"done yesterday"}},
+		{"done_after=2024-03-01T09:00:00Z", []string{"done just now"}},
+		{"done_after=2024-03-01&done_before=2024-03-01T09:00:00Z", []string{"done this morning"}},
+		{"filter=all&done_after=2024-02-29", []string{"done just now", "done this morning", "done yesterday"}},
+		{"done_after=2024-03-02", nil},
+	}
+	for _, tt := range tests {
+		req := httptest.NewRequest("GET", "/todos/?"+tt.query, nil)
+		req.Header.Set("Accept", "application/json")
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, req)
+		var list []todoDTO
+		if err := json.Unmarshal(rec.Body.Bytes(), &list); err != nil {
+			t.Fatalf("%s: %v", tt.query, err)
+		}
+		var got []string
+		for _, td := range list {
+			got = append(got, td.Text)
+		}
+		sort.Strings(got)
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s: got %q, want %q", tt.query, got, tt.want)
+		}
+	}
+}
+
+func TestTodoChanges(t *testing.T) {
+	clock := newTestClock()
+	svc := newInMemTodoService(clock)
+	ctx := context.Background()
+	untouched := mustCreate(t, svc, ctx, "untouched")
+	completed := mustCreate(t, svc, ctx, "completed")
+	deleted := mustCreate(t, svc, ctx, "deleted")
+	since := clock.now.Add(time.Minute)
+
+	clock.advance(time.Hour)
+	created := mustCreate(t, svc, ctx, "created")
+	if err := svc.setTodosDone(ctx, []uint64{completed.Id}, true); err != nil {
+		t.Fatal(err)
+	}
+	if err := svc.deleteTodo(ctx, deleted.Id); err != nil {
+		t.Fatal(err)
+	}
+	s, h := newTestHandler(svc)
+	s.clock = clock
+
+	type changes struct {
+		Now     time.Time `json:"now"`
+		Updated []todoDTO `json:"updated"`
+		Deleted []uint64  `json:"deleted"`
+	}
+	get := func(since string) (int, changes) {
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, httptest.NewRequest("GET", "/todos/changes?since="+url.QueryEscape(since), nil))
+		var got changes
+		if rec.Code == 200 {
+			if err := json.Unmarshal(rec.Body.Bytes(), &got); err != nil {
+				t.Fatal(err)
+			}
+		}
+		return rec.Code, got
+	}
+
+	status, got := get(since.Format(time.RFC3339))
+	if status != 200 {
+		t.Fatalf("status %d", status)
+	}
+	updated := map[uint64]bool{}
+	for _, td := range got.Updated {
+		updated[td.Id] = true
+	}
+	if len(updated) != 2 || !updated[created.Id] || !updated[completed.Id] || updated[untouched.Id] {
+		t.Errorf("updated %+v, want the created and completed todos", got.Updated)
+	}
+	if !reflect.DeepEqual(got.Deleted, []uint64{deleted.Id}) {
+		t.Errorf("deleted %v, want [%d]", got.Deleted, deleted.Id)
+	}
+	if !got.Now.Equal(clock.now) {
+		t.Errorf("now %v, want %v", got.Now, clock.now)
+	}
+
+	// nothing changed since the last sync
+	status, got = get(got.Now.Add(time.Second).Format(time.RFC3339))
+	if status != 200 || len(got.Updated) != 0 || len(got.Deleted) != 0 {
+		t.Errorf("later sync: status %d, changes %+v", status, got)
+	}
+
+	if status, _ := get("yesterday"); status != 400 {
+		t.Errorf("bad since: status %d, want 400", status)
+	}
+}
+
+func TestTemplatesFS(t *testing.T) {
+	for _, dir := range []string{"", filepath.Join(t.TempDir(), "missing"), "template"} {
+		fsys := templatesFS(dir)
+		if _, err := fs.Stat(fsys, "base.html"); err != nil {
+			t.Fatalf("templates from %q: %v", dir, err)
+		}
+		svc := newInMemTodoService(newTestClock())
+		mustCreate(t, svc, context.Background(), "Walk the dog")
+		cfg := defaultConfig()
+		cfg.CSRFAuthKey = strings.Repeat("k", 32)
+		h := newServer(fsys, "", svc).handler(cfg, true)
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, httptest.NewRequest("GET", "/todos/", nil))
+		if rec.Code != 200 || !strings.Contains(rec.Body.String(), "Walk the dog") {
+			t.Errorf("templates from %q: status %d, body:\n%s", dir, rec.Code, rec.Body)
+		}
+	}
+}
+
+func TestSnoozeHidesUntilDue(t *testing.T) {
+	clock := newTestClock()
+	svc := newInMemTodoService(clock)
+	td := mustCreate(t, svc, context.Background(), "Call the bank")
+	s, h := newTestHandler(svc)
+	s.clock = clock
+
+	listed := func(target string) bool {
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, httptest.NewRequest("GET", target, nil))
+		return strings.Contains(rec.Body.String(), "Call the bank")
+	}
+
+	req := newTestRequest(t, h, "POST", fmt.Sprintf("/todos/%d/snooze/", td.Id), url.Values{"until": {"hour"}})
+	req.Header.Set("HX-Request", "true")
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, req)
+	if rec.Code != 200 {
+		t.Fatalf("snoozing: status %d", rec.Code)
+	}
+	if strings.Contains(rec.Body.String(), "Call the bank") {
+		t.Error("snooze response still lists the todo")
+	}
+	if listed("/todos/") {
+		t.Error("snoozed todo listed")
+	}
+	if !listed("/todos/?snoozed=include") {
+		t.Error("snoozed todo not listed when including snoozed todos")
+	}
+
+	clock.advance(59 * time.Minute)
+	if listed("/todos/") {
+		t.Error("todo listed before its snooze ran out")
+	}
+	clock.advance(time.Minute)
+	if !listed("/todos/") {
+		t.Error("todo not listed once its snooze ran out")
+	}
+
+	rec = httptest.NewRecorder()
+	h.ServeHTTP(rec, newTestRequest(t, h, "POST", fmt.Sprintf("/todos/%d/snooze/", td.Id), url.Values{"until": {"someday"}}))
+	if rec.Code != 400 {
+		t.Errorf("bad snooze time: status %d, want 400", rec.Code)
+	}
+}
+
+func TestResolveSnooze(t *testing.T) {
+	now := time.Date(2024, 3, 1, 9, 30, 0, 0, time.UTC)
+	tests := []struct {
+		in   string
+		want time.Time
+	}{
+		{"hour", time.Date(2024, 3, 1, 10, 30, 0, 0, time.UTC)},
+		{"tomorrow", time.Date(2024, 3, 2, 0, 0, 0, 0, time.UTC)},
+		{"nextweek", time.Date(2024, 3, 8, 0, 0, 0, 0, time.UTC)},
+		{"2024-04-01T12:00:00Z", time.Date(2024, 4, 1, 12, 0, 0, 0, time.UTC)},
+	}
+	for _, tt := range tests {
+		got, err := resolveSnooze(tt.in, now)
+		if err != nil || !got.Equal(tt.want) {
+			t.Errorf("resolveSnooze(%q) = %v, %v, want %v", tt.in, got, err, tt.want)
+		}
+	}
+	if _, err := resolveSnooze("someday", now); err == nil {
+		t.Error("resolveSnooze accepted someday")
+	}
+}
+
+func TestPanickingTemplate(t *testing.T) {
+	svc := newInMemTodoService(newTestClock())
+	s, h := newTestHandler(svc)
+	name := "help-shortcuts.html"
+	s.templates[name] = template.Must(template.New(name).Funcs(template.FuncMap{
+		"boom": func() string { panic("boom") },
+	}).Parse(`<p>{{boom}}</p>`))
+
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest("GET", "/help/shortcuts", nil))
+	if rec.Code != 500 {
+		t.Errorf("status %d, want 500", rec.Code)
+	}
+	if strings.Contains(rec.Body.String(), "<p>") {
+		t.Errorf("partial render sent: %s", rec.Body)
+	}
+
+	rec = httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest("GET", "/todos/", nil))
+	if rec.Code != 200 {
+		t.Errorf("after the panic: status %d, want 200", rec.Code)
+	}
+}
+
+func TestWithRecover(t *testing.T) {
+	logs := captureLog(t)
+	h := withRecover(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		panic("boom")
+	}))
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest("GET", "/todos/", nil))
+	if rec.Code != 500 {
+		t.Errorf("status %d, want 500", rec.Code)
+	}
+	if !strings.Contains(logs.String(), "panic serving GET /todos/: boom") || !strings.Contains(logs.String(), "goroutine") {
+		t.Errorf("panic not logged with its stack:\n%s", logs)
+	}
+
+	// aborting a response is left to net/http
+	h = withRecover(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		panic(http.ErrAbortHandler)
+	}))
+	defer func() {
+		if err := recover(); err != http.ErrAbortHandler {
+			t.Errorf("recovered %v, want http.ErrAbortHandler", err)
+		}
+	}()
+	h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("GET", "/todos/", nil))
+	t.Error("http.ErrAbortHandler was swallowed")
+}
+
+func TestMutationsTriggerEvents(t *testing.T) {
+	svc := newInMemTodoService(newTestClock())
+	td := mustCreate(t, svc, context.Background(), "Walk the dog")
+	_, h := newTestHandler(svc)
+
+	tests := []struct {
+		name   string
+		method string
+		target string
+		form   url.Values
+		want   map[string]interface{}
+	}{
+		{"create", "POST", "/todos/", url.Values{"new-todo": {"Feed the cat"}},
+			map[string]interface{}{eventNewTodo: nil, eventTodoCreated: map[string]interface{}{"id": float64(td.Id + 1)}}},
+		{"edit", "PUT", fmt.Sprintf("/todos/%d/_text/", td.Id), url.Values{"text": {"Walk the cat"}},
+			map[string]interface{}{eventTodoUpdated: map[string]interface{}{"id": float64(td.Id)}}},
+		{"toggle", "POST", fmt.Sprintf("/todos/%d/toggle/", td.Id), nil,
+			map[string]interface{}{eventTodoUpdated: map[string]interface{}{"id": float64(td.Id)}}},
+		{"delete", "DELETE", fmt.Sprintf("/todos/%d/", td.Id), nil,
+			map[string]interface{}{eventTodoDeleted: map[string]interface{}{"id": float64(td.Id)}}},
+	}
+	for _, tt := range tests {
+		req := newTestRequest(t, h, tt.method, tt.target, tt.form)
+		req.Header.Set("HX-Request", "true")
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, req)
+		var got map[string]interface{}
+		if err := json.Unmarshal([]byte(rec.Result().Header.Get("HX-Trigger")), &got); err != nil {
+			t.Errorf("%s: HX-Trigger %q: %v", tt.name, rec.Result().Header.Get("HX-Trigger"), err)
+			continue
+		}
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s: HX-Trigger %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestSetHxTrigger(t *testing.T) {
+	tests := []struct {
+		existing string
+		want     string
+	}{
+		{"", `{"todoDeleted":{"id":7}}`},
+		{`{"showToast":{"message":"Saved"}}`, `{"showToast":{"message":"Saved"},"todoDeleted":{"id":7}}`},
+		{"newTodo, somethingElse", `{"newTodo":null,"somethingElse":null,"todoDeleted":{"id":7}}`},
+	}
+	for _, tt := range tests {
+		rec := httptest.NewRecorder()
+		if tt.existing != "" {
+			rec.Header().Set("HX-Trigger", tt.existing)
+		}
+		setHxTrigger(rec, eventTodoDeleted, todoEventPayload{7})
+		if got := rec.Header().Get("HX-Trigger"); got != tt.want {
+			t.Errorf("after %q: got %s, want %s", tt.existing, got, tt.want)
+		}
+	}
+}
+
+func TestReadOnly(t *testing.T) {
+	svc := newInMemTodoService(newTestClock())
+	td := mustCreate(t, svc, context.Background(), "Walk the dog")
+	s, h := newTestHandler(svc)
+	s.readOnly = true
+
+	for _, tt := range []struct {
+		method string
+		target string
+		form   url.Values
+	}{
+		{"POST", "/todos/", url.Values{"new-todo": {"Feed the cat"}}},
+		{"POST", fmt.Sprintf("/todos/%d/toggle/", td.Id), nil},
+		{"PUT", fmt.Sprintf("/todos/%d/_text/", td.Id), url.Values{"text": {"Walk the cat"}}},
+		{"DELETE", fmt.Sprintf("/todos/%d/", td.Id), nil},
+	} {
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, newTestRequest(t, h, tt.method, tt.target, tt.form))
+		if rec.Code != 403 {
+			t.Errorf("%s %s: status %d, want 403", tt.method, tt.target, rec.Code)
+		}
+	}
+	if n, _ := svc.countTodos(context.Background(), todoFilter{}); n != 1 {
+		t.Errorf("got %d todos, want 1", n)
+	}
+	if got, _ := svc.getTodoById(context.Background(), td.Id); got.Text != "Walk the dog" || got.Done {
+		t.Errorf("todo changed: %+v", got)
+	}
+
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest("GET", "/todos/", nil))
+	body := rec.Body.String()
+	if !strings.Contains(body, "Walk the dog") {
+		t.Errorf("read-only list doesn't show the todo:\n%s", body)
+	}
+	for _, control := range []string{`id="new-todo-form"`, "/toggle/", "hx-delete=", "/edit/"} {
+		if strings.Contains(body, control) {
+			t.Errorf("read-only list has %q", control)
+		}
+	}
+}
+
+func TestTodoDetail(t *testing.T) {
+	svc := newInMemTodoService(newTestClock())
+	td := mustCreate(t, svc, context.Background(), "Walk the dog")
+	gone := mustCreate(t, svc, context.Background(), "Feed the cat")
+	if err := svc.deleteTodo(context.Background(), gone.Id); err != nil {
+		t.Fatal(err)
+	}
+	_, h := newTestHandler(svc)
+
+	get := func(target string, htmx bool) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("GET", target, nil)
+		if htmx {
+			req.Header.Set("HX-Request", "true")
+		}
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, req)
+		return rec
+	}
+
+	target := fmt.Sprintf("/todos/%d/detail/", td.Id)
+	rec := get(target, false)
+	if rec.Code != 200 || !strings.Contains(rec.Body.String(), "Walk the dog") {
+		t.Fatalf("detail page: status %d, body:\n%s", rec.Code, rec.Body)
+	}
+	if !strings.Contains(rec.Body.String(), "<html") || !strings.Contains(rec.Body.String(), `href="/todos/"`) {
+		t.Error("detail page isn't a full page linking back to the list")
+	}
+	rec = get(target, true)
+	if rec.Code != 200 || !strings.Contains(rec.Body.String(), "Walk the dog") || strings.Contains(rec.Body.String(), "<html") {
+		t.Errorf("detail fragment: status %d, body:\n%s", rec.Code, rec.Body)
+	}
+
+	for _, target := range []string{
+		"/todos/999/detail/",
+		fmt.Sprintf("/todos/%d/detail/", gone.Id),
+		"/todos/dog/detail/",
+	} {
+		if rec := get(target, false); rec.Code != 404 {
+			t.Errorf("GET %s: status %d, want 404", target, rec.Code)
+		}
+	}
+
+	rec = httptest.NewRecorder()
+	h.ServeHTTP(rec, newTestRequest(t, h, "POST", target, nil))
+	if rec.Code != 405 {
+		t.Errorf("POST %s: status %d, want 405", target, rec.Code)
+	}
+}
+
+func TestJSONErrors(t *testing.T) {
+	svc := newInMemTodoService(newTestClock())
+	_, h := newTestHandler(svc)
+
+	tests := []struct {
+		name    string
+		req     func() *http.Request
+		lang    string
+		status  int
+		code    string
+		message string
+	}{
+		{"not found", func() *http.Request { return httptest.NewRequest("GET", "/todos/999/", nil) },
+			"", 404, "not_found", "Not Found"},
+		{"validation", func() *http.Request {
+			return newTestRequest(t, h, "POST", "/todos/", url.Values{"new-todo": {"  "}})
+		}, "", 422, "validation_failed", "Todo text is required."},
+		{"localized", func() *http.Request {
+			return newTestRequest(t, h, "POST", "/todos/", url.Values{"new-todo": {"  "}})
+		}, "fr", 422, "validation_failed", "Le texte de la tâche est obligatoire."},
+		{"method", func() *http.Request { return newTestRequest(t, h, "PATCH", "/todos/focus/", nil) },
+			"", 405, "method_not_allowed", "Method Not Allowed"},
+	}
+	for _, tt := range tests {
+		req := tt.req()
+		req.Header.Set("Accept", "application/json")
+		if tt.lang != "" {
+			req.AddCookie(&http.Cookie{Name: langCookieName, Value: tt.lang})
+		}
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, req)
+		if rec.Code != tt.status {
+			t.Errorf("%s: status %d, want %d", tt.name, rec.Code, tt.status)
+		}
+		if ct := rec.Result().Header.Get("Content-Type"); ct != "application/json" {
+			t.Errorf("%s: Content-Type %q", tt.name, ct)
+		}
+		var body struct {
+			Error struct {
+				Code    string `json:"code"`
+				Message string `json:"message"`
+			} `json:"error"`
+		}
+		if err := json.Unmarshal(rec.Body.Bytes(), &body); err != nil {
+			t.Errorf("%s: %v: %s", tt.name, err, rec.Body)
+			continue
+		}
+		if body.Error.Code != tt.code || body.Error.Message != tt.message {
+			t.Errorf("%s: error %+v, want %s %q", tt.name, body.Error, tt.code, tt.message)
+		}
+	}
+
+	// browsers still get plain errors
+	rec := httptest.NewRecorder()
+	req := httptest.NewRequest("GET", "/todos/999/", nil)
+	req.Header.Set("HX-Request", "true")
+	h.ServeHTTP(rec, req)
+	if rec.Code != 404 || strings.Contains(rec.Body.String(), `"error"`) {
+		t.Errorf("htmx not found: status %d, body %s", rec.Code, rec.Body)
+	}
+}
+
+func TestChainedFilters(t *testing.T) {
+	clock := newTestClock()
+	svc := newInMemTodoService(clock)
+	ctx := context.Background()
+	yes := true
+	for _, td := range []struct {
+		text                  string
+		overdue, pinned, done bool
+	}{
+		{"Pay the bills", true, true, false},
+		{"Pay the rent", true, false, false},
+		{"Pay the plumber", true, false, true},
+		{"Pay a visit", false, true, false},
+		{"Walk the dog", true, true, false},
+	} {
+		created := &todo{Text: td.text}
+		if td.overdue {
+			created.DueAt = clock.now.Add(-time.Hour)
+		}
+		if err := svc.createTodo(ctx, created); err != nil {
+			t.Fatal(err)
+		}
+		if td.pinned {
+			if _, err := svc.updateTodo(ctx, created.Id, todoUpdate{pinned: &yes}); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if td.done {
+			if _, err := svc.updateTodo(ctx, created.Id, todoUpdate{done: &yes}); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	s, h := newTestHandler(svc)
+	s.clock = clock
+
+	tests := []struct {
+		query string
+		want  []string
+	}{
+		{"filter=notdone&overdue=1", []string{"Pay the bills", "Pay the rent", "Walk the dog"}},
+		{"filter=notdone&q=pay", []string{"Pay a visit", "Pay the bills", "Pay the rent"}},
+		{"filter=notdone&overdue=1&q=pay", []string{"Pay the bills", "Pay the rent"}},
+		{"overdue=1&pinned=1&q=pay", []string{"Pay the bills"}},
+		{"filter=done&q=pay", []string{"Pay the plumber"}},
+		{"filter=done&overdue=1", nil},
+	}
+	for _, tt := range tests {
+		req := httptest.NewRequest("GET", "/todos/?"+tt.query, nil)
+		req.Header.Set("Accept", "application/json")
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, req)
+		var list []todoDTO
+		if err := json.Unmarshal(rec.Body.Bytes(), &list); err != nil {
+			t.Fatalf("%s: %v", tt.query, err)
+		}
+		var got []string
+		for _, td := range list {
+			got = append(got, td.Text)
+		}
+		sort.Strings(got)
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s: got %q, want %q", tt.query, got, tt.want)
+		}
+	}
+}
+
+func TestApplyFilterMarksTheCombination(t *testing.T) {
+	r := httptest.NewRequest("GET", "/todos/?filter=notdone&overdue=1&q=pay", nil)
+	filters := getParamFilters(message.NewPrinter(language.English))
+	var filter todoFilter
+	applyFilter(&filter, filters, r, time.Now(), "")
+	if filter.done == nil || *filter.done || !filter.overdue || filter.pinnedOnly || filter.query != "pay" {
+		t.Errorf("filter %+v, want remaining overdue todos matching pay", filter)
+	}
+	for _, f := range filters {
+		want := f.Value == "notdone" || f.Param == "overdue"
+		if f.Active != want {
+			t.Errorf("%s active = %v, want %v", f.Label, f.Active, want)
+		}
+	}
+	hrefs := map[string]string{}
+	for _, f := range filters {
+		hrefs[f.Label] = f.Href
+	}
+	for label, want := range map[string]string{
+		"Done":    "./?filter=done&overdue=1&q=pay",
+		"Overdue": "./?filter=notdone&q=pay",
+		"Pinned":  "./?filter=notdone&overdue=1&pinned=1&q=pay",
+	} {
+		if hrefs[label] != want {
+			t.Errorf("%s links to %q, want %q", label, hrefs[label], want)
+		}
+	}
+}
+
+func TestGroupedView(t *testing.T) {
+	clock := newTestClock()
+	svc := newInMemTodoService(clock)
+	ctx := context.Background()
+	mustCreate(t, svc, ctx, "Walk the dog")
+	clock.advance(24 * time.Hour)
+	mustCreate(t, svc, ctx, "Feed the cat")
+	mustCreate(t, svc, ctx, "Water the plants")
+	_, h := newTestHandler(svc)
+
+	get := func(target, lang string) string {
+		req := httptest.NewRequest("GET", target, nil)
+		if lang != "" {
+			req.AddCookie(&http.Cookie{Name: langCookieName, Value: lang})
+		}
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, req)
+		if rec.Code != 200 {
+			t.Fatalf("GET %s: status %d", target, rec.Code)
+		}
+		return rec.Body.String()
+	}
+
+	body := get("/todos/?view=grouped", "")
+	if n := strings.Count(body, "<h3"); n != 2 {
+		t.Fatalf("got %d day headers, want 2:\n%s", n, body)
+	}
+	first := strings.Index(body, `<time datetime="2024-03-01">Friday, March 1, 2024</time>`)
+	second := strings.Index(body, `<time datetime="2024-03-02">Saturday, March 2, 2024</time>`)
+	if first < 0 || second < first {
+		t.Fatalf("day headers missing or out of order:\n%s", body)
+	}
+	for text, want := range map[string][2]int{
+		"Walk the dog":     {first, second},
+		"Feed the cat":     {second, len(body)},
+		"Water the plants": {second, len(body)},
+	} {
+		if i := strings.Index(body, text); i < want[0] || i > want[1] {
+			t.Errorf("%s isn't under its day", text)
+		}
+	}
+
+	fr := get("/todos/?view=grouped", "fr")
+	header := formatDay(message.NewPrinter(language.French), time.Date(2024, 3, 1, 0, 0, 0, 0, time.UTC))
+	if header == "Friday, March 1, 2024" || !strings.Contains(fr, header) {
+		t.Errorf("no French day header %q:\n%s", header, fr)
+	}
+
+	// nothing is due, so everything lands in one undated group
+	byDue := get("/todos/?view=grouped&group=due", "")
+	if n := strings.Count(byDue, "<h3"); n != 1 || !strings.Contains(byDue, "No due date") {
+		t.Errorf("grouping by due date:\n%s", byDue)
+	}
+
+	// the flat view stays the default
+	if flat := get("/todos/", ""); strings.Contains(flat, "<h3") {
+		t.Error("flat view has day headers")
+	}
+
+	empty := newInMemTodoService(clock)
+	_, h = newTestHandler(empty)
+	if body := get("/todos/?view=grouped", ""); strings.Contains(body, "<h3") || !strings.Contains(body, "No todos") {
+		t.Errorf("empty grouped view:\n%s", body)
+	}
+}
+
+func TestGroupTodosByDay(t *testing.T) {
+	loc := time.FixedZone("UTC-5", -5*60*60)
+	item := func(created, due time.Time) todoListItem {
+		return todoListItem{Todo: &todo{CreatedAt: created, DueAt: due}}
+	}
+	day := func(d, h int) time.Time {
+		return time.Date(2024, 3, d, h, 0, 0, 0, time.UTC)
+	}
+	items := []todoListItem{
+		item(day(2, 3), time.Time{}),
+		item(day(2, 12), day(5, 12)),
+		item(day(1, 12), day(3, 12)),
+	}
+
+	// 03:00 UTC is still the day before five hours west
+	groups := groupTodosByDay(items, false, loc)
+	if len(groups) != 2 || len(groups[0].Todos) != 2 || len(groups[1].Todos) != 1 {
+		t.Fatalf("by creation: got %+v", groups)
+	}
+	if want := time.Date(2024, 3, 1, 0, 0, 0, 0, loc); !groups[0].Day.Equal(want) {
+		t.Errorf("first day %v, want %v", groups[0].Day, want)
+	}
+
+	groups = groupTodosByDay(items, true, loc)
+	if len(groups) != 3 || !groups[2].Day.IsZero() || groups[0].Todos[0] != items[2] {
+		t.Errorf("by due date: got %+v", groups)
+	}
+
+	if groups := groupTodosByDay(nil, false, loc); len(groups) != 0 {
+		t.Errorf("no todos: got %+v", groups)
+	}
+}
+
+func TestRenameWithPrompt(t *testing.T) {
+	tests := []struct {
+		name   string
+		prompt []string
+		form   url.Values
+		status int
+		want   string
+	}{
+		{"prompt only", []string{"  Walk the cat  "}, nil, 200, "Walk the cat"},
+		{"prompt wins", []string{"Walk the cat"}, url.Values{"text": {"Feed the cat"}}, 200, "Walk the cat"},
+		{"form fallback", nil, url.Values{"text": {"Feed the cat"}}, 200, "Feed the cat"},
+		{"blank prompt", []string{"   "}, url.Values{"text": {"Feed the cat"}}, 422, "Walk the dog"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			svc := newInMemTodoService(newTestClock())
+			td := mustCreate(t, svc, context.Background(), "Walk the dog")
+			_, h := newTestHandler(svc)
+			req := newTestRequest(t, h, "PUT", fmt.Sprintf("/todos/%d/_text/", td.Id), tt.form)
+			req.Header.Set("HX-Request", "true")
+			if tt.prompt != nil {
+				req.Header["Hx-Prompt"] = tt.prompt
+			}
+			rec := httptest.NewRecorder()
+			h.ServeHTTP(rec, req)
+			if rec.Code != tt.status {
+				t.Errorf("status %d, want %d", rec.Code, tt.status)
+			}
+			if got, _ := svc.getTodoById(context.Background(), td.Id); got.Text != tt.want {
+				t.Errorf("text %q, want %q", got.Text, tt.want)
+			}
+			if tt.status == 200 && !strings.Contains(rec.Body.String(), fmt.Sprintf(`<tr id="todo-%d"`, td.Id)) {
+				t.Errorf("response isn't the todo's row:\n%s", rec.Body)
+			}
+		})
+	}
+}
+
+func TestListenOnUnixSocket(t *testing.T) {
+	socket := filepath.Join(t.TempDir(), "todos.sock")
+	// a previous run that didn't shut down cleanly leaves its socket behind
+	stale, err := net.Listen("unix", socket)
+	if err != nil {
+		t.Fatal(err)
+	}
+	stale.(*net.UnixListener).SetUnlinkOnClose(false)
+	stale.Close()
+
+	ln, err := listen("", 0, socket)
+	if err != nil {
+		t.Fatalf("listening over a stale socket: %v", err)
+	}
+	svc := newInMemTodoService(newTestClock())
+	mustCreate(t, svc, context.Background(), "Walk the dog")
+	_, h := newTestHandler(svc)
+	srv := &http.Server{Handler: h}
+	go srv.Serve(ln)
+
+	client := &http.Client{Transport: &http.Transport{
+		DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+			var d net.Dialer
+			return d.DialContext(ctx, "unix", socket)
+		},
+	}}
+	resp, err := client.Get("http://todos/todos/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, err := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.StatusCode != 200 || !strings.Contains(string(body), "Walk the dog") {
+		t.Errorf("status %d, body:\n%s", resp.StatusCode, body)
+	}
+
+	if err := srv.Shutdown(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(socket); !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("socket left behind after shutdown: %v", err)
+	}
+
+	// anything else at the path is left alone
+	notSocket := filepath.Join(t.TempDir(), "todos.json")
+	if err := os.WriteFile(notSocket, []byte("[]"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if ln, err := listen("", 0, notSocket); err == nil {
+		ln.Close()
+		t.Error("listened over a regular file")
+	}
+	if _, err := os.Stat(notSocket); err != nil {
+		t.Errorf("regular file removed: %v", err)
+	}
+}
+
+func TestServeTLS(t *testing.T) {
+	cfg := defaultConfig()
+	cfg.CSRFAuthKey = strings.Repeat("k", 32)
+	cfg.TLSCert, cfg.TLSKey = "cert.pem", "key.pem"
+	s, err := newServerFromConfig(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := httptest.NewTLSServer(s.handler(cfg, false))
+	defer srv.Close()
+	client := srv.Client()
+
+	resp, err := client.Get(srv.URL + "/todos/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, err := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.StatusCode != 200 {
+		t.Fatalf("status %d over TLS", resp.StatusCode)
+	}
+	m := csrfTokenRe.FindStringSubmatch(string(body))
+	if m == nil {
+		t.Fatal("no CSRF token on the index page")
+	}
+
+	req, err := http.NewRequest("POST", srv.URL+"/theme/", strings.NewReader("theme=dark"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Referer", srv.URL+"/todos/")
+	req.Header.Set("X-CSRF-Token", jsUnescaper.Replace(m[1]))
+	for _, c := range resp.Cookies() {
+		req.AddCookie(c)
+	}
+	client.CheckRedirect = func(*http.Request, []*http.Request) error { return http.ErrUseLastResponse }
+	resp, err = client.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	var theme *http.Cookie
+	for _, c := range resp.Cookies() {
+		if c.Name == themeCookieName {
+			theme = c
+		}
+	}
+	if theme == nil || !theme.Secure {
+		t.Errorf("theme cookie %v, want it set and secure (status %d)", theme, resp.StatusCode)
+	}
+}
+
+func TestRedirectToHTTPS(t *testing.T) {
+	tests := []struct {
+		port   int
+		target string
+		want   string
+	}{
+		{443, "http://example.com/todos/?filter=done", "https://example.com/todos/?filter=done"},
+		{443, "http://example.com:8080/", "https://example.com/"},
+		{8443, "http://example.com:8080/todos/", "https://example.com:8443/todos/"},
+	}
+	for _, tt := range tests {
+		rec := httptest.NewRecorder()
+		redirectToHTTPS(tt.port).ServeHTTP(rec, httptest.NewRequest("GET", tt.target, nil))
+		if loc := rec.Result().Header.Get("Location"); rec.Code != 301 || loc != tt.want {
+			t.Errorf("%s on port %d: %d to %q, want 301 to %q", tt.target, tt.port, rec.Code, loc, tt.want)
+		}
+	}
+}
+
+func TestReminders(t *testing.T) {
+	clock := newTestClock()
+	svc := newInMemTodoService(clock)
+	ctx := context.Background()
+	yes := true
+	due := func(text string, in time.Duration) *todo {
+		td := &todo{Text: text, DueAt: clock.now.Add(in)}
+		if err := svc.createTodo(ctx, td); err != nil {
+			t.Fatal(err)
+		}
+		return td
+	}
+	due("in three hours", 3*time.Hour)
+	due("in an hour", time.Hour)
+	due("in thirty hours", 30*time.Hour)
+	due("an hour ago", -time.Hour)
+	done := due("done", 2*time.Hour)
+	if _, err := svc.updateTodo(ctx, done.Id, todoUpdate{done: &yes}); err != nil {
+		t.Fatal(err)
+	}
+	snoozed := due("snoozed", 2*time.Hour)
+	if _, err := svc.snoozeTodo(ctx, snoozed.Id, clock.now.Add(4*time.Hour)); err != nil {
+		t.Fatal(err)
+	}
+	deleted := due("deleted", 2*time.Hour)
+	if err := svc.deleteTodo(ctx, deleted.Id); err != nil {
+		t.Fatal(err)
+	}
+	mustCreate(t, svc, ctx, "not due")
+	s, h := newTestHandler(svc)
+	s.clock = clock
+
+	tests := []struct {
+		query  string
+		status int
+		want   []string
+	}{
+		{"", 200, []string{"in an hour", "in three hours"}},
+		{"?within=48h", 200, []string{"in an hour", "in three hours", "in thirty hours"}},
+		{"?within=2h", 200, []string{"in an hour"}},
+		{"?within=0s", 200, []string{}},
+		{"?within=soon", 400, nil},
+		{"?within=-1h", 400, nil},
+	}
+	for _, tt := range tests {
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, httptest.NewRequest("GET", "/todos/reminders"+tt.query, nil))
+		if rec.Code != tt.status {
+			t.Errorf("%q: status %d, want %d", tt.query, rec.Code, tt.status)
+			continue
+		}
+		if tt.status != 200 {
+			continue
+		}
+		var list []todoDTO
+		if err := json.Unmarshal(rec.Body.Bytes(), &list); err != nil {
+			t.Fatalf("%q: %v", tt.query, err)
+		}
+		got := []string{}
+		for _, td := range list {
+			got = append(got, td.Text)
+		}
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%q: got %q, want %q", tt.query, got, tt.want)
+		}
+	}
+}
+
+func TestEmptyStates(t *testing.T) {
+	const (
+		noData  = "No todos yet — add one below."
+		noMatch = "No todos match your filter."
+	)
+	tests := []struct {
+		name     string
+		todos    []string
+		target   string
+		readOnly bool
+		want     string
+	}{
+		{"no todos", nil, "/todos/", false, noData},
+		{"no todos read-only", nil, "/todos/", true, "No todos yet."},
+		{"no match", []string{"Walk the dog"}, "/todos/?q=cat", false, noMatch},
+		{"no done todos", []string{"Walk the dog"}, "/todos/?filter=done", false, noMatch},
+		{"some todos", []string{"Walk the dog"}, "/todos/", false, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			svc := newInMemTodoService(newTestClock())
+			for _, text := range tt.todos {
+				mustCreate(t, svc, context.Background(), text)
+			}
+			s, h := newTestHandler(svc)
+			s.readOnly = tt.readOnly
+			for _, htmx := range []bool{false, true} {
+				req := httptest.NewRequest("GET", tt.target, nil)
+				if htmx {
+					req.Header.Set("HX-Request", "true")
+				}
+				rec := httptest.NewRecorder()
+				h.ServeHTTP(rec, req)
+				body := rec.Body.String()
+				if tt.want == "" {
+					if strings.Contains(body, `id="todo-list-empty"`) {
+						t.Errorf("htmx %v: empty state shown with todos listed", htmx)
+					}
+					continue
+				}
+				for _, message := range []string{noData, noMatch} {
+					if got := strings.Contains(body, message); got != (message == tt.want) {
+						t.Errorf("htmx %v: has %q = %v", htmx, message, got)
+					}
+				}
+				if !strings.Contains(body, tt.want) || !strings.Contains(body, "Showing 0 todo items.") {
+					t.Errorf("htmx %v: want %q and a zero count:\n%s", htmx, tt.want, body)
+				}
+			}
+		})
+	}
+}
+
+func TestBatchDelete(t *testing.T) {
+	svc := newInMemTodoService(newTestClock())
+	ctx := context.Background()
+	var ids []string
+	for _, text := range []string{"Walk the dog", "Feed the cat", "Water the plants", "Call the bank"} {
+		ids = append(ids, fmt.Sprint(mustCreate(t, svc, ctx, text).Id))
+	}
+	_, h := newTestHandler(svc)
+	post := func(form url.Values) *httptest.ResponseRecorder {
+		req := newTestRequest(t, h, "POST", "/todos/batch-delete/", form)
+		req.Header.Set("HX-Request", "true")
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, req)
+		return rec
+	}
+	remaining := func() int {
+		n, err := svc.countTodos(ctx, todoFilter{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return n
+	}
+
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest("GET", "/todos/", nil))
+	if !strings.Contains(rec.Body.String(), `form="batch-delete-form"`) {
+		t.Error("list has no checkboxes for the batch delete form")
+	}
+
+	// nothing selected leaves the list be
+	rec = post(url.Values{})
+	if rec.Code != 200 || remaining() != 4 || rec.Result().Header.Get("HX-Trigger") != "" {
+		t.Errorf("no ids: status %d, %d todos left, HX-Trigger %q", rec.Code, remaining(), rec.Result().Header.Get("HX-Trigger"))
+	}
+
+	// one id that's gone fails the whole batch
+	rec = post(url.Values{"id": {ids[0], "999"}})
+	if rec.Code != 404 || remaining() != 4 {
+		t.Errorf("stale id: status %d, %d todos left", rec.Code, remaining())
+	}
+
+	rec = post(url.Values{"id": {ids[0], ids[2], ids[2]}})
+	if rec.Code != 200 {
+		t.Fatalf("status %d", rec.Code)
+	}
+	if n := remaining(); n != 2 {
+		t.Errorf("%d todos left, want 2", n)
+	}
+	body := rec.Body.String()
+	if strings.Contains(body, "Walk the dog") || strings.Contains(body, "Water the plants") || !strings.Contains(body, "Feed the cat") {
+		t.Errorf("list after the delete:\n%s", body)
+	}
+	if !strings.Contains(body, "Showing 2 todo items.") {
+		t.Errorf("count after the delete:\n%s", body)
+	}
+	var events map[string]toastPayload
+	if err := json.Unmarshal([]byte(rec.Result().Header.Get("HX-Trigger")), &events); err != nil {
+		t.Fatal(err)
+	}
+	if got := events[eventShowToast].Message; got != "Deleted 2 todos." {
+		t.Errorf("toast %q, want Deleted 2 todos.", got)
+	}
+
+	req := newTestRequest(t, h, "POST", "/todos/batch-delete/", url.Values{"id": {ids[1], ids[3]}})
+	req.Header.Set("Accept", "application/json")
+	rec = httptest.NewRecorder()
+	h.ServeHTTP(rec, req)
+	if got := strings.TrimSpace(rec.Body.String()); rec.Code != 200 || got != `{"deleted":2}` {
+		t.Errorf("json: status %d, body %s", rec.Code, got)
+	}
+	if n := remaining(); n != 0 {
+		t.Errorf("%d todos left, want none", n)
+	}
+
+	rec = post(url.Values{"id": {"dog"}})
+	if rec.Code != 400 {
+		t.Errorf("bad id: status %d, want 400", rec.Code)
+	}
+}
+
+func TestHTTPServerTimeouts(t *testing.T) {
+	srv := newHTTPServer(defaultConfig(), ":8080", http.NotFoundHandler())
+	for name, tt := range map[string]struct{ got, want time.Duration }{
+		"ReadHeaderTimeout": {srv.ReadHeaderTimeout, 5 * time.Second},
+		"ReadTimeout":       {srv.ReadTimeout, 15 * time.Second},
+		"WriteTimeout":      {srv.WriteTimeout, 45 * time.Second},
+		"IdleTimeout":       {srv.IdleTimeout, 2 * time.Minute},
+	} {
+		if tt.got != tt.want {
+			t.Errorf("default %s = %v, want %v", name, tt.got, tt.want)
+		}
+	}
+
+	cfg := defaultConfig()
+	flags := flag.NewFlagSet("htmx-go", flag.ContinueOnError)
+	cfg.registerFlags(flags)
+	if err := flags.Parse([]string{"-read-header-timeout", "1s", "-read-timeout", "2s", "-write-timeout", "3s", "-idle-timeout", "4s"}); err != nil {
+		t.Fatal(err)
+	}
+	srv = newHTTPServer(cfg, ":8080", http.NotFoundHandler())
+	if srv.ReadHeaderTimeout != time.Second || srv.ReadTimeout != 2*time.Second || srv.WriteTimeout != 3*time.Second || srv.IdleTimeout != 4*time.Second {
+		t.Errorf("timeouts from flags: %v %v %v %v", srv.ReadHeaderTimeout, srv.ReadTimeout, srv.WriteTimeout, srv.IdleTimeout)
+	}
+	if srv.Addr != ":8080" {
+		t.Errorf("addr %q", srv.Addr)
+	}
+}
+
+func TestToggleTwice(t *testing.T) {
+	clock := newTestClock()
+	svc := newInMemTodoService(clock)
+	td := mustCreate(t, svc, context.Background(), "Walk the dog")
+	_, h := newTestHandler(svc)
+	toggle := func(target string) *httptest.ResponseRecorder {
+		req := newTestRequest(t, h, "POST", target, nil)
+		req.Header.Set("HX-Request", "true")
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, req)
+		return rec
+	}
+	target := fmt.Sprintf("/todos/%d/toggle/", td.Id)
+
+	clock.advance(time.Hour)
+	rec := toggle(target)
+	if rec.Code != 200 || !strings.Contains(rec.Body.String(), `hx-swap-oob="outerHTML:#todo-number-items"`) {
+		t.Fatalf("first toggle: status %d, body:\n%s", rec.Code, rec.Body)
+	}
+	got, _ := svc.getTodoById(context.Background(), td.Id)
+	if !got.Done || !got.DoneAt.Equal(clock.now) {
+		t.Errorf("after one toggle: done %v at %v, want done at %v", got.Done, got.DoneAt, clock.now)
+	}
+
+	clock.advance(time.Hour)
+	if rec := toggle(target); rec.Code != 200 {
+		t.Fatalf("second toggle: status %d", rec.Code)
+	}
+	got, _ = svc.getTodoById(context.Background(), td.Id)
+	if got.Done || !got.DoneAt.IsZero() {
+		t.Errorf("after two toggles: done %v at %v, want not done", got.Done, got.DoneAt)
+	}
+
+	if rec := toggle("/todos/999/toggle/"); rec.Code != 404 {
+		t.Errorf("missing todo: status %d, want 404", rec.Code)
+	}
+	rec = httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest("GET", target, nil))
+	if rec.Code != 405 {
+		t.Errorf("GET: status %d, want 405", rec.Code)
+	}
+}
+
+// tracedCreates fails every create, remembering the trace id each one ran
+// under.
+type tracedCreates struct {
+	todoService
+	traceIDs []string
+}
+
+func (s *tracedCreates) createTodo(ctx context.Context, todo *todo) error {
+	s.traceIDs = append(s.traceIDs, traceIDFromContext(ctx))
+	return errors.New("store unavailable")
+}
+
+func TestTraceIDs(t *testing.T) {
+	const traceID = "4bf92f3577b34da6a3ce929d0e0e4736"
+	tests := []struct {
+		name   string
+		header string
+		value  string
+		want   string
+	}{
+		{"traceparent", "traceparent", "00-" + traceID + "-00f067aa0ba902b7-01", traceID},
+		{"trace id", traceIDHeaderName, "checkout-42", "checkout-42"},
+		{"bad traceparent", "traceparent", "00-xyz-01", ""},
+		{"bad trace id", traceIDHeaderName, "no spaces allowed", ""},
+		{"none", "", "", ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			logs := captureLog(t)
+			svc := &tracedCreates{todoService: newInMemTodoService(newTestClock())}
+			_, h := newTestHandler(svc)
+			req := newTestRequest(t, h, "POST", "/todos/", url.Values{"new-todo": {"Walk the dog"}})
+			if tt.header != "" {
+				req.Header.Set(tt.header, tt.value)
+			}
+			rec := httptest.NewRecorder()
+			h.ServeHTTP(rec, req)
+
+			got := rec.Result().Header.Get(traceIDHeaderName)
+			if tt.want != "" && got != tt.want {
+				t.Errorf("response trace id %q, want %q", got, tt.want)
+			}
+			if tt.want == "" && !regexp.MustCompile(`^[0-9a-f]{32}$`).MatchString(got) {
+				t.Errorf("generated trace id %q", got)
+			}
+			if len(svc.traceIDs) != 1 || svc.traceIDs[0] != got {
+				t.Errorf("service saw trace ids %q, want %q", svc.traceIDs, got)
+			}
+			if !strings.Contains(logs.String(), "["+got+"] creating todo: store unavailable") {
+				t.Errorf("failure not logged with the trace id:\n%s", logs)
+			}
+		})
+	}
+}
+
+func TestTrashView(t *testing.T) {
+	svc := newInMemTodoService(newTestClock())
+	ctx := context.Background()
+	mustCreate(t, svc, ctx, "Walk the dog")
+	trashed := mustCreate(t, svc, ctx, "Feed the cat")
+	if err := svc.deleteTodo(ctx, trashed.Id); err != nil {
+		t.Fatal(err)
+	}
+	_, h := newTestHandler(svc)
+	get := func(target string) string {
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, httptest.NewRequest("GET", target, nil))
+		if rec.Code != 200 {
+			t.Fatalf("GET %s: status %d", target, rec.Code)
+		}
+		return rec.Body.String()
+	}
+
+	trash := get("/todos/?filter=deleted")
+	if !strings.Contains(trash, "Feed the cat") || strings.Contains(trash, "Walk the dog") {
+		t.Errorf("trash should list only the deleted todo:\n%s", trash)
+	}
+	for _, action := range []string{
+		fmt.Sprintf(`hx-post="/todos/%d/restore/`, trashed.Id),
+		fmt.Sprintf(`hx-delete="/todos/%d/purge/`, trashed.Id),
+	} {
+		if !strings.Contains(trash, action) {
+			t.Errorf("trash has no %s", action)
+		}
+	}
+	if !strings.Contains(trash, `hx-get="./?filter=deleted"`) {
+		t.Error("no Trash tab")
+	}
+
+	for _, target := range []string{"/todos/", "/todos/?filter=all", "/todos/?filter=done", "/todos/?filter=notdone", "/todos/?q=cat"} {
+		if strings.Contains(get(target), "Feed the cat") {
+			t.Errorf("GET %s lists the deleted todo", target)
+		}
+	}
+
+	for _, tt := range []struct {
+		filter todoFilter
+		want   string
+	}{
+		{todoFilter{}, "Walk the dog"},
+		{todoFilter{deletedOnly: true}, "Feed the cat"},
+	} {
+		found, err := svc.findTodos(ctx, tt.filter)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(found) != 1 || found[0].Text != tt.want {
+			t.Errorf("deletedOnly %v: found %+v, want %s", tt.filter.deletedOnly, found, tt.want)
+		}
+	}
+}
+
+func TestDefaultAndRememberedFilter(t *testing.T) {
+	svc := newInMemTodoService(newTestClock())
+	ctx := context.Background()
+	done := mustCreate(t, svc, ctx, "Walk the dog")
+	if err := svc.setTodosDone(ctx, []uint64{done.Id}, true); err != nil {
+		t.Fatal(err)
+	}
+	mustCreate(t, svc, ctx, "Feed the cat")
+	s, h := newTestHandler(svc)
+	s.defaultFilter = "notdone"
+
+	tests := []struct {
+		name   string
+		query  string
+		cookie string
+		want   []string
+	}{
+		{"default", "", "", []string{"Feed the cat"}},
+		{"cookie over default", "", "done", []string{"Walk the dog"}},
+		{"query over cookie", "?filter=all", "done", []string{"Feed the cat", "Walk the dog"}},
+		{"query over default", "?filter=done", "", []string{"Walk the dog"}},
+		{"bad cookie", "", "bogus", []string{"Feed the cat"}},
+	}
+	for _, tt := range tests {
+		req := httptest.NewRequest("GET", "/todos/"+tt.query, nil)
+		req.Header.Set("Accept", "application/json")
+		if tt.cookie != "" {
+			req.AddCookie(&http.Cookie{Name: filterCookieName, Value: tt.cookie})
+		}
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, req)
+		var list []todoDTO
+		if err := json.Unmarshal(rec.Body.Bytes(), &list); err != nil {
+			t.Fatalf("%s: %v", tt.name, err)
+		}
+		var got []string
+		for _, td := range list {
+			got = append(got, td.Text)
+		}
+		sort.Strings(got)
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s: got %q, want %q", tt.name, got, tt.want)
+		}
+	}
+
+	// choosing a filter remembers it, other query parameters don't
+	for query, want := range map[string]string{"?filter=done": "done", "?q=dog": "", "?filter=bogus": ""} {
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, httptest.NewRequest("GET", "/todos/"+query, nil))
+		var got string
+		for _, c := range rec.Result().Cookies() {
+			if c.Name == filterCookieName {
+				got = c.Value
+			}
+		}
+		if got != want {
+			t.Errorf("%s remembered %q, want %q", query, got, want)
+		}
+	}
+}
+
+func TestLiveRegionAnnouncements(t *testing.T) {
+	messages := map[string][]string{
+		"en": {"Todo added", "Todo completed", "Todo reopened", "Todo updated", "Todo deleted"},
+		"fr": {"Tâche ajoutée", "Tâche terminée", "Tâche rouverte", "Tâche modifiée", "Tâche supprimée"},
+	}
+	for lang, want := range messages {
+		t.Run(lang, func(t *testing.T) {
+			svc := newInMemTodoService(newTestClock())
+			_, h := newTestHandler(svc)
+			steps := []struct {
+				method string
+				target string
+				form   url.Values
+			}{
+				{"POST", "/todos/", url.Values{"new-todo": {"Walk the dog"}}},
+				{"POST", "/todos/%d/toggle/", nil},
+				{"POST", "/todos/%d/toggle/", nil},
+				{"PUT", "/todos/%d/_text/", url.Values{"text": {"Walk the cat"}}},
+				{"DELETE", "/todos/%d/", nil},
+			}
+			var id uint64
+			for i, step := range steps {
+				if i > 0 {
+					step.target = fmt.Sprintf(step.target, id)
+				}
+				req := newTestRequest(t, h, step.method, step.target, step.form)
+				req.Header.Set("HX-Request", "true")
+				req.AddCookie(&http.Cookie{Name: langCookieName, Value: lang})
+				rec := httptest.NewRecorder()
+				h.ServeHTTP(rec, req)
+				// the create answers outside the table, the rows inside it
+				region := `<tr hx-swap-oob="innerHTML:#live-region"><td>` + want[i] + `</td></tr>`
+				if i == 0 {
+					region = `<div hx-swap-oob="innerHTML:#live-region">` + want[i] + `</div>`
+				}
+				if !strings.Contains(rec.Body.String(), region) {
+					t.Errorf("%s %s: status %d, no %s:\n%s", step.method, step.target, rec.Code, region, rec.Body)
+				}
+				if i == 0 {
+					found, err := svc.findTodos(context.Background(), todoFilter{})
+					if err != nil || len(found) != 1 {
+						t.Fatalf("created %d todos: %v", len(found), err)
+					}
+					id = found[0].Id
+				}
+			}
+		})
+	}
+
+	_, h := newTestHandler(newInMemTodoService(newTestClock()))
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest("GET", "/todos/", nil))
+	if !strings.Contains(rec.Body.String(), `<div id="live-region" class="sr-only" role="status" aria-live="polite"></div>`) {
+		t.Error("page has no live region")
+	}
+}
+
+func TestPreferenceCookieAttributes(t *testing.T) {
+	for _, tls := range []bool{false, true} {
+		t.Run(fmt.Sprintf("tls %v", tls), func(t *testing.T) {
+			cfg := defaultConfig()
+			cfg.CSRFAuthKey = strings.Repeat("k", 32)
+			cfg.CookieDomain = "example.com"
+			cfg.CookieSameSite = "strict"
+			cfg.CookieMaxAge = duration{24 * time.Hour}
+			if tls {
+				cfg.TLSCert, cfg.TLSKey = "cert.pem", "key.pem"
+			}
+			s, err := newServerFromConfig(cfg)
+			if err != nil {
+				t.Fatal(err)
+			}
+			h := s.handler(cfg, true)
+			for _, tt := range []struct {
+				target string
+				form   url.Values
+				cookie string
+			}{
+				{"/lang/", url.Values{"lang": {"fr"}}, langCookieName},
+				{"/theme/", url.Values{"theme": {"dark"}}, themeCookieName},
+			} {
+				rec := httptest.NewRecorder()
+				h.ServeHTTP(rec, newTestRequest(t, h, "POST", tt.target, tt.form))
+				var cookie *http.Cookie
+				for _, c := range rec.Result().Cookies() {
+					if c.Name == tt.cookie {
+						cookie = c
+					}
+				}
+				if cookie == nil {
+					t.Errorf("%s set no %s cookie", tt.target, tt.cookie)
+					continue
+				}
+				if cookie.Path != "/" || cookie.Domain != "example.com" || cookie.MaxAge != 86400 ||
+					cookie.SameSite != http.SameSiteStrictMode || !cookie.HttpOnly || cookie.Secure != tls {
+					t.Errorf("%s cookie %s", tt.cookie, cookie)
+				}
+			}
+		})
+	}
+}
+
+func TestFilterBarMarksActiveTab(t *testing.T) {
+	svc := newInMemTodoService(newTestClock())
+	s, h := newTestHandler(svc)
+	activeTab := regexp.MustCompile(`aria-label="Filter todos: ([^"]+)"\s+aria-current="true"`)
+
+	req := httptest.NewRequest("GET", "/todos/?filter=done", nil)
+	req.Header.Set("HX-Request", "true")
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, req)
+	body := rec.Body.String()
+	if !strings.Contains(body, `<tr
+	id="todo-filter-bar"`) {
+		t.Fatalf("no filter bar in the list fragment:\n%s", body)
+	}
+	var active []string
+	for _, m := range activeTab.FindAllStringSubmatch(body, -1) {
+		active = append(active, m[1])
+	}
+	if !reflect.DeepEqual(active, []string{"Done"}) {
+		t.Errorf("active tabs %q, want Done", active)
+	}
+	// the bar comes with the list it sits in, so it isn't swapped twice
+	if strings.Contains(body, `hx-swap-oob="outerHTML:#todo-filter-bar"`) {
+		t.Error("filter bar sent out of band as well")
+	}
+
+	// as an out-of-band fragment of its own
+	rec = httptest.NewRecorder()
+	withMessagePrinter(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		filters := getParamFilters(printer(r))
+		applyFilter(&todoFilter{}, filters, r, time.Now(), "")
+		data := todoListPage{Request: r, Filters: filters, UpdateNumber: true}
+		if err := renderOOB(s.templates, w, fragment{"todo-filter-bar.html", data}); err != nil {
+			t.Error(err)
+		}
+	})).ServeHTTP(rec, httptest.NewRequest("GET", "/todos/?filter=done", nil))
+	body = rec.Body.String()
+	if !strings.Contains(body, `hx-swap-oob="outerHTML:#todo-filter-bar"`) || !activeTab.MatchString(body) {
+		t.Errorf("out-of-band filter bar:\n%s", body)
+	}
+}
+
+func TestTemplateHelpers(t *testing.T) {
+	clock := newTestClock()
+	s := newServer(embeddedTemplates(), "", newInMemTodoService(clock))
+	s.clock = clock
+	helpers, err := s.templates["help-shortcuts.html"].Clone()
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = helpers.New("helpers").Parse(`{{formatDate .Request .Day}}|{{relativeTime .Request .Earlier}}|` +
+		`{{truncate "Walk the dog" 6}}|{{T .Request "Added %d todo(s)." 1}}|{{T .Request "Added %d todo(s)." 3}}|` +
+		`<input type="checkbox" {{checked true}}><input type="checkbox" {{checked false}}>`)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := map[string]string{
+		"en": `March 1, 2024|3 hours ago|Walk …|Added 1 todo.|Added 3 todos.|<input type="checkbox" checked><input type="checkbox" >`,
+		"fr": `1 mars 2024|il y a 3 heures|Walk …|1 tâche ajoutée.|3 tâches ajoutées.|<input type="checkbox" checked><input type="checkbox" >`,
+	}
+	for lang, want := range tests {
+		var b strings.Builder
+		h := withMessagePrinter(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			err := helpers.ExecuteTemplate(&b, "helpers", map[string]interface{}{
+				"Request": r,
+				"Day":     clock.now,
+				"Earlier": clock.now.Add(-3 * time.Hour),
+			})
+			if err != nil {
+				t.Error(err)
+			}
+		}))
+		req := httptest.NewRequest("GET", "/", nil)
+		req = req.WithContext(context.WithValue(req.Context(), locationKey, time.UTC))
+		req.AddCookie(&http.Cookie{Name: langCookieName, Value: lang})
+		h.ServeHTTP(httptest.NewRecorder(), req)
+		if got := b.String(); got != want {
+			t.Errorf("%s:\n got %s\nwant %s", lang, got, want)
+		}
+	}
+}
+
+func TestMethodOverride(t *testing.T) {
+	tests := []struct {
+		name    string
+		form    url.Values
+		header  string
+		deleted bool
+	}{
+		{"form field", url.Values{"_method": {"DELETE"}}, "", true},
+		{"lower case", url.Values{"_method": {"delete"}}, "", true},
+		{"header", nil, "DELETE", true},
+		{"not allowed", url.Values{"_method": {"GET"}}, "", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			svc := newInMemTodoService(newTestClock())
+			td := mustCreate(t, svc, context.Background(), "Walk the dog")
+			_, h := newTestHandler(svc)
+			req := newTestRequest(t, h, "POST", fmt.Sprintf("/todos/%d/", td.Id), tt.form)
+			if tt.header != "" {
+				req.Header.Set("X-HTTP-Method-Override", tt.header)
+			}
+			rec := httptest.NewRecorder()
+			h.ServeHTTP(rec, req)
+			got, err := svc.getTodoById(context.Background(), td.Id)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got.Deleted != tt.deleted {
+				t.Errorf("status %d, deleted %v, want %v", rec.Code, got.Deleted, tt.deleted)
+			}
+		})
+	}
+
+	// only a POST can be overridden
+	var method string
+	h := withMethodOverride(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) { method = r.Method }))
+	req := httptest.NewRequest("GET", "/todos/1/", nil)
+	req.Header.Set("X-HTTP-Method-Override", "DELETE")
+	h.ServeHTTP(httptest.NewRecorder(), req)
+	if method != "GET" {
+		t.Errorf("GET overridden to %s", method)
+	}
+}
+
+func TestPinning(t *testing.T) {
+	svc := newInMemTodoService(newTestClock())
+	ctx := context.Background()
+	mustCreate(t, svc, ctx, "Walk the dog")
+	cat := mustCreate(t, svc, ctx, "Feed the cat")
+	plants := mustCreate(t, svc, ctx, "Water the plants")
+	if err := svc.setTodosDone(ctx, []uint64{plants.Id}, true); err != nil {
+		t.Fatal(err)
+	}
+	_, h := newTestHandler(svc)
+	list := func(query string) []string {
+		req := httptest.NewRequest("GET", "/todos/"+query, nil)
+		req.Header.Set("Accept", "application/json")
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, req)
+		var list []todoDTO
+		if err := json.Unmarshal(rec.Body.Bytes(), &list); err != nil {
+			t.Fatal(err)
+		}
+		var texts []string
+		for _, td := range list {
+			texts = append(texts, td.Text)
+		}
+		return texts
+	}
+	pin := func(id uint64, form url.Values) int {
+		req := newTestRequest(t, h, "POST", fmt.Sprintf("/todos/%d/pin/", id), form)
+		req.Header.Set("HX-Request", "true")
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, req)
+		return rec.Code
+	}
+
+	// the done todo can be pinned too
+	for _, id := range []uint64{plants.Id, cat.Id} {
+		if status := pin(id, nil); status != 200 {
+			t.Fatalf("pinning %d: status %d", id, status)
+		}
+	}
+	if got, want := list(""), []string{"Feed the cat", "Water the plants", "Walk the dog"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("list %q, want pinned first %q", got, want)
+	}
+	if got, want := list("?pinned=1"), []string{"Feed the cat", "Water the plants"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("pinned only %q, want %q", got, want)
+	}
+
+	// the pin survives other changes
+	text := "Feed the cats"
+	if _, err := svc.updateTodo(ctx, cat.Id, todoUpdate{text: &text}); err != nil {
+		t.Fatal(err)
+	}
+	if got, _ := svc.getTodoById(ctx, cat.Id); !got.Pinned {
+		t.Error("editing the text unpinned the todo")
+	}
+
+	if status := pin(cat.Id, nil); status != 200 {
+		t.Fatalf("unpinning: status %d", status)
+	}
+	if status := pin(plants.Id, url.Values{"pinned": {"true"}}); status != 200 {
+		t.Fatalf("pinning explicitly: status %d", status)
+	}
+	if got, want := list("?pinned=1"), []string{"Water the plants"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("pinned only after unpinning %q, want %q", got, want)
+	}
+	if status := pin(plants.Id, url.Values{"pinned": {"maybe"}}); status != 400 {
+		t.Errorf("bad pinned value: status %d, want 400", status)
+	}
+	if status := pin(999, nil); status != 404 {
+		t.Errorf("missing todo: status %d, want 404", status)
+	}
+}
+
+// failingFinds fails to find any todos.
+type failingFinds struct {
+	todoService
+}
+
+func (s failingFinds) findTodos(ctx context.Context, filter todoFilter) ([]*todo, error) {
+	return nil, errors.New("store unavailable")
+}
+
+func TestErrorPages(t *testing.T) {
+	tests := []struct {
+		name     string
+		svc      todoService
+		target   string
+		accept   string
+		htmx     bool
+		lang     string
+		status   int
+		ctype    string
+		contains []string
+	}{
+		{"browser 404", nil, "/todos/nope/nope/", "text/html", false, "", 404, "text/html; charset=utf-8",
+			[]string{"<html", "<title>Not Found", "404", `href="/todos/"`}},
+		{"localized 404", nil, "/todos/nope/nope/", "text/html", false, "fr", 404, "text/html; charset=utf-8",
+			[]string{"<title>Introuvable", "Retour à la liste"}},
+		{"api 404", nil, "/todos/nope/nope/", "application/json", false, "", 404, "application/json",
+			[]string{`{"error":{"code":"not_found","message":"Not Found"}}`}},
+		{"htmx 404", nil, "/todos/nope/nope/", "", true, "", 404, "text/plain; charset=utf-8",
+			[]string{"Not Found"}},
+		{"browser 500", failingFinds{newInMemTodoService(newTestClock())}, "/todos/", "text/html", false, "fr", 500, "text/html; charset=utf-8",
+			[]string{"<html", "<title>Erreur interne du serveur"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			svc := tt.svc
+			if svc == nil {
+				svc = newInMemTodoService(newTestClock())
+			}
+			_, h := newTestHandler(svc)
+			req := httptest.NewRequest("GET", tt.target, nil)
+			if tt.accept != "" {
+				req.Header.Set("Accept", tt.accept)
+			}
+			if tt.htmx {
+				req.Header.Set("HX-Request", "true")
+			}
+			if tt.lang != "" {
+				req.AddCookie(&http.Cookie{Name: langCookieName, Value: tt.lang})
+			}
+			rec := httptest.NewRecorder()
+			h.ServeHTTP(rec, req)
+			if rec.Code != tt.status {
+				t.Errorf("status %d, want %d", rec.Code, tt.status)
+			}
+			if ct := rec.Result().Header.Get("Content-Type"); ct != tt.ctype {
+				t.Errorf("Content-Type %q, want %q", ct, tt.ctype)
+			}
+			for _, want := range tt.contains {
+				if !strings.Contains(rec.Body.String(), want) {
+					t.Errorf("no %q in:\n%s", want, rec.Body)
+				}
+			}
+		})
+	}
+
+	// plain text when the error page itself can't be rendered
+	s, h := newTestHandler(newInMemTodoService(newTestClock()))
+	delete(s.templates, "error.html")
+	req := httptest.NewRequest("GET", "/todos/nope/nope/", nil)
+	req.Header.Set("Accept", "text/html")
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, req)
+	if rec.Code != 404 || strings.TrimSpace(rec.Body.String()) != "Not Found" {
+		t.Errorf("without the error page: status %d, body %q", rec.Code, rec.Body)
+	}
+}
+
+func TestBatchStatus(t *testing.T) {
+	clock := newTestClock()
+	svc := newInMemTodoService(clock)
+	ctx := context.Background()
+	var ids []string
+	for _, text := range []string{"Walk the dog", "Feed the cat", "Water the plants"} {
+		ids = append(ids, fmt.Sprint(mustCreate(t, svc, ctx, text).Id))
+	}
+	_, h := newTestHandler(svc)
+	post := func(form url.Values) *httptest.ResponseRecorder {
+		req := newTestRequest(t, h, "POST", "/todos/batch-status/", form)
+		req.Header.Set("HX-Request", "true")
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, req)
+		return rec
+	}
+	doneCount := func() int {
+		yes := true
+		n, err := svc.countTodos(ctx, todoFilter{done: &yes})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return n
+	}
+
+	clock.advance(time.Hour)
+	rec := post(url.Values{"id": {ids[0], ids[2]}, "done": {"true"}})
+	if rec.Code != 200 {
+		t.Fatalf("status %d", rec.Code)
+	}
+	for i, id := range ids {
+		n, _ := strconv.ParseUint(id, 10, 64)
+		got, _ := svc.getTodoById(ctx, n)
+		wantDone := i != 1
+		if got.Done != wantDone || got.DoneAt.Equal(clock.now) != wantDone {
+			t.Errorf("%s: done %v at %v, want done %v", got.Text, got.Done, got.DoneAt, wantDone)
+		}
+	}
+	if !strings.Contains(rec.Body.String(), "2 of 3 done") {
+		t.Errorf("list after the update has no fresh progress:\n%s", rec.Body)
+	}
+	var events map[string]toastPayload
+	if err := json.Unmarshal([]byte(rec.Result().Header.Get("HX-Trigger")), &events); err != nil {
+		t.Fatal(err)
+	}
+	if got := events[eventShowToast].Message; got != "Marked 2 todos done." {
+		t.Errorf("toast %q", got)
+	}
+
+	// an id that's gone fails the whole batch
+	rec = post(url.Values{"id": {ids[1], "999"}, "done": {"true"}})
+	if rec.Code != 404 || doneCount() != 2 {
+		t.Errorf("invalid id: status %d, %d done, want 404 and 2 done", rec.Code, doneCount())
+	}
+
+	for name, form := range map[string]url.Values{
+		"no ids":   {"done": {"true"}},
+		"bad done": {"id": {ids[1]}, "done": {"maybe"}},
+		"no done":  {"id": {ids[1]}},
+		"bad id":   {"id": {"dog"}, "done": {"true"}},
+	} {
+		if rec := post(form); rec.Code != 400 {
+			t.Errorf("%s: status %d, want 400", name, rec.Code)
+		}
+	}
+	if n := doneCount(); n != 2 {
+		t.Errorf("%d done after the rejected batches, want 2", n)
+	}
+
+	rec = post(url.Values{"id": {ids[0], ids[2]}, "done": {"false"}})
+	if rec.Code != 200 || doneCount() != 0 {
+		t.Errorf("marking not done: status %d, %d done", rec.Code, doneCount())
+	}
+}
+
+func TestRestoreAllAndEmptyTrash(t *testing.T) {
+	svc := newInMemTodoService(newTestClock())
+	ctx := context.Background()
+	mustCreate(t, svc, ctx, "Walk the dog")
+	cat := mustCreate(t, svc, ctx, "Feed the cat")
+	plants := mustCreate(t, svc, ctx, "Water the plants")
+	trash := func() {
+		t.Helper()
+		if err := svc.deleteTodos(ctx, []uint64{cat.Id, plants.Id}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	_, h := newTestHandler(svc)
+	post := func(action string) *httptest.ResponseRecorder {
+		req := newTestRequest(t, h, "POST", "/todos/trash/"+action+"/?filter=deleted", nil)
+		req.Header.Set("HX-Request", "true")
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, req)
+		return rec
+	}
+	count := func(filter todoFilter) int {
+		n, err := svc.countTodos(ctx, filter)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return n
+	}
+
+	trash()
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest("GET", "/todos/?filter=deleted", nil))
+	if !regexp.MustCompile(`hx-post="/todos/trash/empty/[^"]*"\s+hx-confirm=`).MatchString(rec.Body.String()) {
+		t.Error("emptying the trash isn't confirmed")
+	}
+
+	rec = post("restore-all")
+	if rec.Code != 200 {
+		t.Fatalf("restore all: status %d", rec.Code)
+	}
+	if strings.Contains(rec.Body.String(), "Feed the cat") || !strings.Contains(rec.Body.String(), "No todos match your filter.") {
+		t.Errorf("trash after restoring all:\n%s", rec.Body)
+	}
+	if n := count(todoFilter{}); n != 3 {
+		t.Errorf("%d todos after restoring all, want 3", n)
+	}
+
+	trash()
+	rec = post("empty")
+	if rec.Code != 200 {
+		t.Fatalf("empty trash: status %d", rec.Code)
+	}
+	if strings.Contains(rec.Body.String(), "Feed the cat") {
+		t.Errorf("trash after emptying it:\n%s", rec.Body)
+	}
+	var events map[string]toastPayload
+	if err := json.Unmarshal([]byte(rec.Result().Header.Get("HX-Trigger")), &events); err != nil {
+		t.Fatal(err)
+	}
+	if got := events[eventShowToast].Message; got != "Deleted 2 todos forever." {
+		t.Errorf("toast %q", got)
+	}
+	if n := count(todoFilter{deletedOnly: true}); n != 0 {
+		t.Errorf("%d todos left in the trash", n)
+	}
+	if n := count(todoFilter{}); n != 1 {
+		t.Errorf("%d todos after emptying the trash, want 1", n)
+	}
+	if _, err := svc.getTodoById(ctx, cat.Id); !errors.Is(err, errTodoNotFound) {
+		t.Errorf("emptied todo still there: %v", err)
+	}
+
+	if rec := post("shred"); rec.Code != 404 {
+		t.Errorf("unknown trash action: status %d, want 404", rec.Code)
+	}
+}
+
+func TestLanguageQueryOverride(t *testing.T) {
+	_, h := newTestHandler(newInMemTodoService(newTestClock()))
+	tests := []struct {
+		query  string
+		accept string
+		lang   string
+		show   string
+	}{
+		{"?lang=fr", "", "fr", "Montrer:"},
+		{"?lang=fr", "en", "fr", "Montrer:"},
+		{"?lang=xx", "", "en", "Show:"},
+		{"", "fr", "en", "Show:"},
+	}
+	for _, tt := range tests {
+		req := httptest.NewRequest("GET", "/todos/"+tt.query, nil)
+		req.AddCookie(&http.Cookie{Name: langCookieName, Value: "en"})
+		if tt.accept != "" {
+			req.Header.Set("Accept-Language", tt.accept)
+		}
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, req)
+		body := rec.Body.String()
+		if !strings.Contains(body, `<html lang="`+tt.lang+`"`) || !strings.Contains(body, tt.show) {
+			t.Errorf("%q with an English cookie: want the page in %s", tt.query, tt.lang)
+		}
+		for _, c := range rec.Result().Cookies() {
+			if c.Name == langCookieName {
+				t.Errorf("%q set the language cookie to %q", tt.query, c.Value)
+			}
+		}
+	}
+}
+
+func TestBranding(t *testing.T) {
+	icon := filepath.Join(t.TempDir(), "icon.png")
+	png := []byte("\x89PNG\r\n\x1a\nnot really")
+	if err := os.WriteFile(icon, png, 0o600); err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name    string
+		appName string
+		// html/template escapes the name's plus sign
+		rendered string
+		favicon  string
+		icon     []byte
+		ctype    string
+	}{
+		{"default", defaultAppName, "htmx &#43; Go", "", defaultFavicon, "image/x-icon"},
+		{"configured", "Chores", "Chores", icon, png, "image/png"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := defaultConfig()
+			cfg.CSRFAuthKey = strings.Repeat("k", 32)
+			cfg.AppName = tt.appName
+			cfg.Favicon = tt.favicon
+			s, err := newServerFromConfig(cfg)
+			if err != nil {
+				t.Fatal(err)
+			}
+			h := s.handler(cfg, true)
+
+			rec := httptest.NewRecorder()
+			h.ServeHTTP(rec, httptest.NewRequest("GET", "/", nil))
+			body := rec.Body.String()
+			name := tt.rendered
+			if !strings.Contains(body, "<title>"+name+"</title>") || !strings.Contains(body, `<a href="/">`+name+"</a>") {
+				t.Errorf("index isn't branded %q:\n%s", tt.appName, body)
+			}
+
+			rec = httptest.NewRecorder()
+			h.ServeHTTP(rec, httptest.NewRequest("GET", "/favicon.ico", nil))
+			res := rec.Result()
+			if rec.Code != 200 || !bytes.Equal(rec.Body.Bytes(), tt.icon) {
+				t.Errorf("favicon: status %d, %d bytes", rec.Code, rec.Body.Len())
+			}
+			if ct := res.Header.Get("Content-Type"); ct != tt.ctype {
+				t.Errorf("favicon Content-Type %q, want %q", ct, tt.ctype)
+			}
+			if cc := res.Header.Get("Cache-Control"); cc != faviconCacheControl {
+				t.Errorf("favicon Cache-Control %q", cc)
+			}
+		})
+	}
+
+	cfg := defaultConfig()
+	cfg.Favicon = filepath.Join(t.TempDir(), "missing.ico")
+	if _, err := newServerFromConfig(cfg); err == nil {
+		t.Error("missing favicon accepted")
+	}
+}
+
+func TestHead(t *testing.T) {
+	svc := newInMemTodoService(newTestClock())
+	td := mustCreate(t, svc, context.Background(), "Walk the dog")
+	_, h := newTestHandler(svc)
+	srv := httptest.NewServer(h)
+	defer srv.Close()
+
+	for _, path := range []string{"/", fmt.Sprintf("/todos/%d/", td.Id), "/favicon.ico"} {
+		get, err := http.Get(srv.URL + path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		body, err := io.ReadAll(get.Body)
+		get.Body.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		head, err := http.Head(srv.URL + path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		headBody, err := io.ReadAll(head.Body)
+		head.Body.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if head.StatusCode != 200 || len(headBody) != 0 {
+			t.Errorf("HEAD %s: status %d, %d byte body", path, head.StatusCode, len(headBody))
+		}
+		if got, want := head.Header.Get("Content-Type"), get.Header.Get("Content-Type"); got != want || got == "" {
+			t.Errorf("HEAD %s: Content-Type %q, GET gave %q", path, got, want)
+		}
+		// the length can differ by the masking of the page's CSRF token
+		if get.Header.Get("Content-Length") != "" && head.Header.Get("Content-Length") == "" {
+			t.Errorf("HEAD %s: no Content-Length, GET sent %d bytes", path, len(body))
+		}
+	}
+
+	// HEAD stays read-only
+	req := httptest.NewRequest("HEAD", "/todos/", nil)
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, req)
+	if n, _ := svc.countTodos(context.Background(), todoFilter{}); rec.Code != 200 || n != 1 {
+		t.Errorf("HEAD /todos/: status %d, %d todos", rec.Code, n)
+	}
+}
+
+func TestInlineAutoSave(t *testing.T) {
+	svc := newInMemTodoService(newTestClock())
+	td := mustCreate(t, svc, context.Background(), "Walk the dog")
+	_, h := newTestHandler(svc)
+	save := func(text, lang string) *httptest.ResponseRecorder {
+		req := newTestRequest(t, h, "PUT", fmt.Sprintf("/todos/%d/_text/?inline=1", td.Id), url.Values{"text": {text}})
+		req.Header.Set("HX-Request", "true")
+		if lang != "" {
+			req.AddCookie(&http.Cookie{Name: langCookieName, Value: lang})
+		}
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, req)
+		return rec
+	}
+
+	rec := save("Walk the cat", "")
+	want := fmt.Sprintf(`<span id="todo-%d-saved" role="status" class="text-xs text-gray-500">Saved</span>`, td.Id)
+	if rec.Code != 200 || strings.TrimSpace(rec.Body.String()) != want {
+		t.Errorf("status %d, body %q, want the save indicator", rec.Code, rec.Body)
+	}
+	if got, _ := svc.getTodoById(context.Background(), td.Id); got.Text != "Walk the cat" {
+		t.Errorf("text %q, want the saved change", got.Text)
+	}
+
+	if rec := save("Walk the bird", "fr"); !strings.Contains(rec.Body.String(), ">Enregistré<") {
+		t.Errorf("French indicator: %s", rec.Body)
+	}
+
+	if rec := save("  ", ""); rec.Code != 422 {
+		t.Errorf("blank text: status %d, want 422", rec.Code)
+	}
+	if got, _ := svc.getTodoById(context.Background(), td.Id); got.Text != "Walk the bird" {
+		t.Errorf("text %q after a rejected save", got.Text)
+	}
+
+	// the edit form saves as you type
+	get := httptest.NewRequest("GET", fmt.Sprintf("/todos/%d/edit/", td.Id), nil)
+	get.Header.Set("HX-Request", "true")
+	rec = httptest.NewRecorder()
+	h.ServeHTTP(rec, get)
+	if !strings.Contains(rec.Body.String(), `hx-trigger="keyup changed delay:500ms"`) {
+		t.Error("edit form doesn't save as you type")
+	}
+}
+
+func TestTodoMove(t *testing.T) {
+	svc := newInMemTodoService(newTestClock())
+	ctx := context.Background()
+	mustCreate(t, svc, ctx, "Alpha")
+	middle := mustCreate(t, svc, ctx, "Bravo")
+	mustCreate(t, svc, ctx, "Charlie")
+	_, h := newTestHandler(svc)
+	move := func(to string) *httptest.ResponseRecorder {
+		req := newTestRequest(t, h, "POST", fmt.Sprintf("/todos/%d/move", middle.Id), url.Values{"to": {to}})
+		req.Header.Set("HX-Request", "true")
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, req)
+		return rec
+	}
+	order := func(body string) []string {
+		texts := []string{"Alpha", "Bravo", "Charlie"}
+		sort.Slice(texts, func(i, j int) bool {
+			return strings.Index(body, texts[i]) < strings.Index(body, texts[j])
+		})
+		return texts
+	}
+
+	tests := []struct {
+		to   string
+		want []string
+	}{
+		{"top", []string{"Bravo", "Alpha", "Charlie"}},
+		{"bottom", []string{"Alpha", "Charlie", "Bravo"}},
+	}
+	for _, tt := range tests {
+		rec := move(tt.to)
+		if rec.Code != 200 {
+			t.Fatalf("to=%s: status %d: %s", tt.to, rec.Code, rec.Body)
+		}
+		if got := order(rec.Body.String()); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("to=%s: list fragment order %v, want %v", tt.to, got, tt.want)
+		}
+		todos, err := svc.findTodos(ctx, todoFilter{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		var got []string
+		for _, td := range todos {
+			got = append(got, td.Text)
+		}
+		if !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("to=%s: stored order %v, want %v", tt.to, got, tt.want)
+		}
+	}
+
+	for _, to := range []string{"", "middle", "TOP"} {
+		if rec := move(to); rec.Code != 400 {
+			t.Errorf("to=%q: status %d, want 400", to, rec.Code)
+		}
+	}
+}
+
+func TestContainsFolded(t *testing.T) {
+	tests := []struct {
+		s, substr string
+		want      bool
+	}{
+		{"Call Élodie", "élodie", true},
+		{"call élodie", "ÉLODIE", true},
+		{"Appeler Élodie", "elodie", false},
+		{"Straße fegen", "STRASSE", true},
+		{"STRASSE FEGEN", "straße", true},
+		{"Crème brûlée", "CRÈME BRÛLÉE", true},
+		{"Œuvre complète", "œuvre", true},
+		{"ΣΟΦΙΑ", "σοφια", true},
+		{"café", "cafe", false},
+	}
+	for _, lang := range []language.Tag{language.English, language.French} {
+		for _, tt := range tests {
+			if got := containsFolded(lang, tt.s, tt.substr); got != tt.want {
+				t.Errorf("%s: containsFolded(%q, %q) = %v, want %v", lang, tt.s, tt.substr, got, tt.want)
+			}
+		}
+	}
+}
+
+func TestSearchIgnoresCase(t *testing.T) {
+	svc := newInMemTodoService(newTestClock())
+	ctx := context.Background()
+	mustCreate(t, svc, ctx, "Appeler Élodie")
+	mustCreate(t, svc, ctx, "Straße fegen")
+	mustCreate(t, svc, ctx, "Buy milk")
+	_, h := newTestHandler(svc)
+	for _, lang := range []string{"en", "fr"} {
+		for q, want := range map[string]string{
+			"élodie":  "Appeler Élodie",
+			"ÉLODIE":  "Appeler Élodie",
+			"strasse": "Straße fegen",
+			"MILK":    "Buy milk",
+		} {
+			req := httptest.NewRequest("GET", "/todos/?q="+url.QueryEscape(q), nil)
+			req.Header.Set("Accept", "application/json")
+			req.AddCookie(&http.Cookie{Name: langCookieName, Value: lang})
+			rec := httptest.NewRecorder()
+			h.ServeHTTP(rec, req)
+			var got []struct{ Text string }
+			if err := json.Unmarshal(rec.Body.Bytes(), &got); err != nil {
+				t.Fatalf("%s q=%q: %v: %s", lang, q, err, rec.Body)
+			}
+			if len(got) != 1 || got[0].Text != want {
+				t.Errorf("%s q=%q: found %v, want only %q", lang, q, got, want)
+			}
+		}
+	}
+}
+
+func TestMutationsWithoutHtmxRedirect(t *testing.T) {
+	tests := []struct {
+		method string
+		path   string
+		form   url.Values
+		to     string
+	}{
+		{"POST", "/todos/", url.Values{"new-todo": {"Buy milk"}}, "/todos/"},
+		{"PUT", "/todos/%[1]d/_text/", url.Values{"text": {"Buy oat milk"}}, "/todos/"},
+		{"PUT", "/todos/%[1]d/_done/", url.Values{"done": {"true"}}, "/todos/"},
+		{"DELETE", "/todos/%[1]d/", nil, "/todos/"},
+		{"POST", "/todos/%[1]d/toggle/", nil, "/todos/"},
+		{"POST", "/todos/%[1]d/pin/", url.Values{"pinned": {"true"}}, "/todos/"},
+		{"POST", "/todos/%[1]d/move", url.Values{"to": {"top"}}, "/todos/"},
+		{"POST", "/todos/%[1]d/snooze/", url.Values{"until": {"tomorrow"}}, "/todos/"},
+		{"POST", "/todos/batch-delete/", url.Values{"id": {"%d"}}, "/todos/"},
+		{"POST", "/todos/batch-status/", url.Values{"id": {"%d"}, "done": {"true"}}, "/todos/"},
+		{"POST", "/todos/%[2]d/restore/", nil, "/todos/?filter=deleted"},
+		{"DELETE", "/todos/%[2]d/purge/", nil, "/todos/?filter=deleted"},
+		{"POST", "/todos/trash/restore-all/", nil, "/todos/?filter=deleted"},
+		{"POST", "/todos/trash/empty/", nil, "/todos/?filter=deleted"},
+	}
+	for _, tt := range tests {
+		for _, htmx := range []bool{false, true} {
+			svc := newInMemTodoService(newTestClock())
+			ctx := context.Background()
+			open := mustCreate(t, svc, ctx, "Buy milk")
+			trashed := mustCreate(t, svc, ctx, "Buy bread")
+			if err := svc.deleteTodo(ctx, trashed.Id); err != nil {
+				t.Fatal(err)
+			}
+			_, h := newTestHandler(svc)
+			path := tt.path
+			if strings.Contains(path, "%") {
+				path = fmt.Sprintf(path, open.Id, trashed.Id)
+			}
+			form := url.Values{}
+			for k, vs := range tt.form {
+				for _, v := range vs {
+					if v == "%d" {
+						v = strconv.FormatUint(open.Id, 10)
+					}
+					form.Add(k, v)
+				}
+			}
+			req := newTestRequest(t, h, tt.method, path, form)
+			if htmx {
+				req.Header.Set("HX-Request", "true")
+			}
+			rec := httptest.NewRecorder()
+			h.ServeHTTP(rec, req)
+
+			name := fmt.Sprintf("%s %s", tt.method, tt.path)
+			if !htmx {
+				if rec.Code != 302 && rec.Code != 303 {
+					t.Errorf("%s without htmx: status %d, want a redirect: %s", name, rec.Code, rec.Body)
+				} else if loc := rec.Header().Get("Location"); loc != tt.to {
+					t.Errorf("%s without htmx: redirected to %q, want %q", name, loc, tt.to)
+				}
+				continue
+			}
+			body := rec.Body.String()
+			if rec.Code != 200 {
+				t.Errorf("%s with htmx: status %d, want 200: %s", name, rec.Code, body)
+			} else if rec.Header().Get("Location") != "" || strings.Contains(body, "<html") {
+				t.Errorf("%s with htmx: got a redirect or a whole page, want a fragment", name)
+			}
+		}
+	}
+}
+
+func TestTodoJSONShape(t *testing.T) {
+	svc := newInMemTodoService(newTestClock())
+	ctx := context.Background()
+	yes := true
+	open := mustCreate(t, svc, ctx, "Buy milk")
+	done := mustCreate(t, svc, ctx, "Walk the dog")
+	if _, err := svc.updateTodo(ctx, done.Id, todoUpdate{done: &yes}); err != nil {
+		t.Fatal(err)
+	}
+	trashed := mustCreate(t, svc, ctx, "Call mom")
+	if err := svc.deleteTodo(ctx, trashed.Id); err != nil {
+		t.Fatal(err)
+	}
+	_, h := newTestHandler(svc)
+	get := func(target string) []map[string]interface{} {
+		t.Helper()
+		req := newJSONRequest(t, h, "GET", target, "")
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, req)
+		var list []map[string]interface{}
+		if err := json.Unmarshal(rec.Body.Bytes(), &list); err != nil {
+			t.Fatalf("GET %s: %v: %s", target, err, rec.Body)
+		}
+		return list
+	}
+	keys := func(m map[string]interface{}) []string {
+		var keys []string
+		for k := range m {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		return keys
+	}
+	byId := map[float64]map[string]interface{}{}
+	for _, m := range append(get("/todos/?filter=all"), get("/todos/?filter=deleted")...) {
+		byId[m["id"].(float64)] = m
+	}
+
+	tests := []struct {
+		todo *todo
+		keys []string
+	}{
+		{open, []string{"created_at", "done", "id", "pinned", "slug", "text", "updated_at"}},
+		{done, []string{"created_at", "done", "done_at", "id", "pinned", "slug", "text", "updated_at"}},
+		{trashed, []string{"created_at", "deleted_at", "done", "id", "pinned", "slug", "text", "updated_at"}},
+	}
+	for _, tt := range tests {
+		m, ok := byId[float64(tt.todo.Id)]
+		if !ok {
+			t.Errorf("%q missing from the JSON lists", tt.todo.Text)
+			continue
+		}
+		if got := keys(m); !reflect.DeepEqual(got, tt.keys) {
+			t.Errorf("%q has keys %v, want %v", tt.todo.Text, got, tt.keys)
+		}
+		if m["text"] != tt.todo.Text {
+			t.Errorf("text = %v, want %q", m["text"], tt.todo.Text)
+		}
+		if m["created_at"] != "2024-03-01T09:00:00Z" {
+			t.Errorf("created_at = %v, want RFC 3339", m["created_at"])
+		}
+	}
+}
+
+func TestHxTargetVariesResponse(t *testing.T) {
+	tests := []struct {
+		target     string
+		wantCounts bool
+	}{
+		{"", true},
+		{"todo-list", true},
+		{"todo-%d", true},
+		{"todo-detail", false},
+		{"focus", false},
+	}
+	for _, tt := range tests {
+		for _, method := range []string{"POST", "DELETE"} {
+			svc := newInMemTodoService(newTestClock())
+			td := mustCreate(t, svc, context.Background(), "Buy milk")
+			_, h := newTestHandler(svc)
+			path := fmt.Sprintf("/todos/%d/", td.Id)
+			if method == "POST" {
+				path += "toggle/"
+			}
+			req := newTestRequest(t, h, method, path, nil)
+			req.Header.Set("HX-Request", "true")
+			target := tt.target
+			if strings.Contains(target, "%d") {
+				target = fmt.Sprintf(target, td.Id)
+			}
+			if target != "" {
+				req.Header.Set("HX-Target", target)
+			}
+			rec := httptest.NewRecorder()
+			h.ServeHTTP(rec, req)
+			if rec.Code != 200 {
+				t.Fatalf("%s %s, target %q: status %d", method, path, target, rec.Code)
+			}
+			body := rec.Body.String()
+			for _, id := range []string{`id="todo-number-items"`, `id="todo-progress"`} {
+				if got := strings.Contains(body, id); got != tt.wantCounts {
+					t.Errorf("%s %s, target %q: has %s = %v, want %v", method, path, target, id, got, tt.wantCounts)
+				}
+			}
+			if !strings.Contains(body, `hx-swap-oob="innerHTML:#live-region"`) {
+				t.Errorf("%s %s, target %q: no announcement", method, path, target)
+			}
+		}
+	}
+}
+
+func TestTodoCharCount(t *testing.T) {
+	tests := []struct {
+		text, lang string
+		want       string
+		warn, over bool
+	}{
+		{"日本語", "", "3/10 characters", false, false},
+		{"é", "", "1/10 character", false, false},
+		{"ééééééééé", "", "9/10 characters", true, false},
+		{"héllo wörld", "", "11/10 characters", true, true},
+		{"café", "fr", "4/10 caractères", false, false},
+		{"🙂", "fr", "1/10 caractère", false, false},
+	}
+	for _, tt := range tests {
+		svc := newInMemTodoService(newTestClock())
+		s, h := newTestHandler(svc)
+		s.maxTodoLength = 10
+		req := httptest.NewRequest("GET", "/todos/charcount?text="+url.QueryEscape(tt.text), nil)
+		req.Header.Set("HX-Request", "true")
+		if tt.lang != "" {
+			req.AddCookie(&http.Cookie{Name: langCookieName, Value: tt.lang})
+		}
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, req)
+		body := rec.Body.String()
+		if rec.Code != 200 || !strings.Contains(body, ">"+tt.want+"<") {
+			t.Errorf("%q: status %d, body %s, want %q", tt.text, rec.Code, body, tt.want)
+		}
+		if got := strings.Contains(body, "text-red-700"); got != tt.warn {
+			t.Errorf("%q: red = %v, want %v", tt.text, got, tt.warn)
+		}
+		if got := strings.Contains(body, "font-bold"); got != tt.over {
+			t.Errorf("%q: over the limit = %v, want %v", tt.text, got, tt.over)
+		}
+	}
+}
+
+func TestSkins(t *testing.T) {
+	dir := t.TempDir()
+	// writeSkin copies the embedded templates to dir, marking the layout
+	// with the skin's name and leaving out the templates in skip
+	writeSkin := func(dir, name string, skip ...string) {
+		err := fs.WalkDir(embeddedTemplates(), ".", func(p string, d fs.DirEntry, err error) error {
+			if err != nil || d.IsDir() {
+				return err
+			}
+			for _, s := range skip {
+				if p == s {
+					return nil
+				}
+			}
+			b, err := fs.ReadFile(embeddedTemplates(), p)
+			if err != nil {
+				return err
+			}
+			if p == "base.html" {
+				b = bytes.Replace(b, []byte("<body "), []byte(`<body data-skin="`+name+`" `), 1)
+			}
+			dst := filepath.Join(dir, filepath.FromSlash(p))
+			if err := os.MkdirAll(filepath.Dir(dst), 0o755); err != nil {
+				return err
+			}
+			return os.WriteFile(dst, b, 0o644)
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	writeSkin(dir, "default")
+	writeSkin(filepath.Join(dir, "skins", "compact"), "compact")
+	writeSkin(filepath.Join(dir, "skins", "broken"), "broken", "partial/todo-list.html")
+
+	for _, skin := range []string{"default", "compact"} {
+		cfg := defaultConfig()
+		cfg.CSRFAuthKey = strings.Repeat("k", 32)
+		cfg.Templates = dir
+		cfg.Skin = skin
+		s, err := newServerFromConfig(cfg)
+		if err != nil {
+			t.Fatalf("skin %q: %v", skin, err)
+		}
+		rec := httptest.NewRecorder()
+		s.handler(cfg, true).ServeHTTP(rec, httptest.NewRequest("GET", "/todos/", nil))
+		if rec.Code != 200 {
+			t.Fatalf("skin %q: status %d", skin, rec.Code)
+		}
+		if !strings.Contains(rec.Body.String(), `data-skin="`+skin+`"`) {
+			t.Errorf("skin %q: index isn't rendered from its templates", skin)
+		}
+	}
+
+	for skin, want := range map[string]string{
+		"broken":  "partial/todo-list.html",
+		"missing": `skin "missing" not found`,
+	} {
+		cfg := defaultConfig()
+		cfg.CSRFAuthKey = strings.Repeat("k", 32)
+		cfg.Templates = dir
+		cfg.Skin = skin
+		if _, err := newServerFromConfig(cfg); err == nil || !strings.Contains(err.Error(), want) {
+			t.Errorf("skin %q: error %v, want one mentioning %s", skin, err, want)
+		}
+	}
+}
+
+func TestTodoHistory(t *testing.T) {
+	clock := newTestClock()
+	svc := newInMemTodoService(clock)
+	td := mustCreate(t, svc, context.Background(), "Buy milk")
+	s, h := newTestHandler(svc)
+	s.clock = clock
+	steps := []struct {
+		method, path string
+		form         url.Values
+	}{
+		{"POST", "/todos/%d/toggle/", nil},
+		{"POST", "/todos/%d/toggle/", nil},
+		{"PUT", "/todos/%d/_text/", url.Values{"text": {"Buy oat milk"}}},
+		{"DELETE", "/todos/%d/", nil},
+		{"POST", "/todos/%d/restore/", nil},
+	}
+	for _, step := range steps {
+		clock.advance(time.Minute)
+		path := fmt.Sprintf(step.path, td.Id)
+		req := newTestRequest(t, h, step.method, path, step.form)
+		req.Header.Set("HX-Request", "true")
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, req)
+		if rec.Code != 200 {
+			t.Fatalf("%s %s: status %d: %s", step.method, path, rec.Code, rec.Body)
+		}
+	}
+
+	req := newJSONRequest(t, h, "GET", fmt.Sprintf("/todos/%d/history/", td.Id), "")
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, req)
+	var events []struct {
+		Kind string
+		At   time.Time
+	}
+	if err := json.Unmarshal(rec.Body.Bytes(), &events); err != nil {
+		t.Fatalf("%v: %s", err, rec.Body)
+	}
+	want := []string{"created", "done", "undone", "edited", "deleted", "restored"}
+	var kinds []string
+	for i, e := range events {
+		kinds = append(kinds, e.Kind)
+		if at := newTestClock().now.Add(time.Duration(i) * time.Minute); !e.At.Equal(at) {
+			t.Errorf("%s at %v, want %v", e.Kind, e.At, at)
+		}
+	}
+	if !reflect.DeepEqual(kinds, want) {
+		t.Errorf("history %v, want %v", kinds, want)
+	}
+
+	req = httptest.NewRequest("GET", fmt.Sprintf("/todos/%d/history/", td.Id), nil)
+	req.Header.Set("HX-Request", "true")
+	req.AddCookie(&http.Cookie{Name: langCookieName, Value: "fr"})
+	rec = httptest.NewRecorder()
+	h.ServeHTTP(rec, req)
+	body := rec.Body.String()
+	last := 0
+	for _, label := range []string{"Historique", "Marquée complétée", "Marquée inachevée", "Modifiée"} {
+		i := strings.Index(body, label)
+		if i < last {
+			t.Errorf("French timeline lacks %q in order: %s", label, body)
+			break
+		}
+		last = i
+	}
+
+	// only the latest events are kept
+	for i := 0; i < maxTodoEvents; i++ {
+		done := i%2 == 0
+		if _, err := svc.updateTodo(context.Background(), td.Id, todoUpdate{done: &done}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	got, err := svc.getTodoById(context.Background(), td.Id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(got.History) != maxTodoEvents || got.History[0].Kind == eventCreated {
+		t.Errorf("kept %d events starting with %s, want the latest %d", len(got.History), got.History[0].Kind, maxTodoEvents)
+	}
+}
+
+func TestShortcutsHelpInFrench(t *testing.T) {
+	_, h := newTestHandler(newInMemTodoService(newTestClock()))
+	req := httptest.NewRequest("GET", "/help/shortcuts", nil)
+	req.Header.Set("HX-Request", "true")
+	req.AddCookie(&http.Cookie{Name: langCookieName, Value: "fr"})
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, req)
+	body := rec.Body.String()
+	if rec.Code != 200 || !strings.HasPrefix(body, `<div id="shortcuts-help"`) {
+		t.Fatalf("status %d, want the help fragment: %s", rec.Code, body)
+	}
+	fr := message.NewPrinter(language.French)
+	want := []string{"Raccourcis clavier", "Fermer"}
+	for _, sc := range shortcuts {
+		translated := fr.Sprintf(sc.Description)
+		if translated == sc.Description {
+			t.Errorf("%q has no French translation", sc.Description)
+		}
+		want = append(want, sc.Key+"</kbd>", translated)
+	}
+	for _, w := range want {
+		if !strings.Contains(body, w) {
+			t.Errorf("help lacks %q", w)
+		}
+	}
+}
+
+func TestMarkingDoneLeavesFilteredList(t *testing.T) {
+	tests := []struct {
+		name    string
+		method  string
+		path    string
+		form    url.Values
+		removed bool
+		count   string
+	}{
+		{"done while remaining", "PUT", "/todos/%d/_done/", url.Values{"done": {"done"}, "filter": {"notdone"}}, true, "Showing 1 todo item."},
+		{"toggled while remaining", "POST", "/todos/%d/toggle/", url.Values{"filter": {"notdone"}}, true, "Showing 1 todo item."},
+		{"done while all", "PUT", "/todos/%d/_done/", url.Values{"done": {"done"}, "filter": {"all"}}, false, "Showing 2 todo items."},
+		{"undone while done", "PUT", "/todos/%d/_done/", url.Values{"done": {""}, "filter": {"done"}}, true, "Showing 0 todo items."},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			svc := newInMemTodoService(newTestClock())
+			ctx := context.Background()
+			mustCreate(t, svc, ctx, "Walk the dog")
+			td := mustCreate(t, svc, ctx, "Feed the cat")
+			if tt.form.Get("filter") == "done" {
+				yes := true
+				if _, err := svc.updateTodo(ctx, td.Id, todoUpdate{done: &yes}); err != nil {
+					t.Fatal(err)
+				}
+			}
+			_, h := newTestHandler(svc)
+			req := newTestRequest(t, h, tt.method, fmt.Sprintf(tt.path, td.Id), tt.form)
+			req.Header.Set("HX-Request", "true")
+			req.Header.Set("HX-Target", fmt.Sprintf("todo-%d", td.Id))
+			rec := httptest.NewRecorder()
+			h.ServeHTTP(rec, req)
+			if rec.Code != 200 {
+				t.Fatalf("status %d: %s", rec.Code, rec.Body)
+			}
+			body := rec.Body.String()
+			row := fmt.Sprintf(`<tr id="todo-%d"`, td.Id)
+			if tt.removed {
+				if rec.Header().Get("HX-Reswap") != "delete" || strings.Contains(body, row) {
+					t.Errorf("row not removed: HX-Reswap %q:\n%s", rec.Header().Get("HX-Reswap"), body)
+				}
+			} else if rec.Header().Get("HX-Reswap") != "" || !strings.Contains(body, row) {
+				t.Errorf("row not rendered in place:\n%s", body)
+			}
+			if !strings.Contains(body, tt.count) || !strings.Contains(body, `hx-swap-oob="outerHTML:#todo-number-items"`) {
+				t.Errorf("count isn't %q:\n%s", tt.count, body)
+			}
+		})
+	}
+}
+
+func TestLogLevel(t *testing.T) {
+	defer setLogLevel(logLevel(atomic.LoadInt32(&minLogLevel)))
+	_, h := newTestHandler(newInMemTodoService(newTestClock()))
+	tests := []struct {
+		level     string
+		wantDebug bool
+		wantWarn  bool
+	}{
+		{"debug", true, true},
+		{"info", false, true},
+		{"warn", false, true},
+		{"error", false, false},
+	}
+	for _, tt := range tests {
+		level, ok := parseLogLevel(tt.level)
+		if !ok {
+			t.Fatalf("level %q not recognized", tt.level)
+		}
+		setLogLevel(level)
+		out := captureLog(t)
+		req := httptest.NewRequest("GET", "/todos/", nil)
+		req.AddCookie(&http.Cookie{Name: langCookieName, Value: "fr"})
+		h.ServeHTTP(httptest.NewRecorder(), req)
+		warnf(context.Background(), "something odd")
+		if got := strings.Contains(out.String(), "user language: fr"); got != tt.wantDebug {
+			t.Errorf("%s: language debug line logged = %v, want %v:\n%s", tt.level, got, tt.wantDebug, out)
+		}
+		if got := strings.Contains(out.String(), "[WARN] something odd"); got != tt.wantWarn {
+			t.Errorf("%s: warning logged = %v, want %v", tt.level, got, tt.wantWarn)
+		}
+	}
+
+	cfg := defaultConfig()
+	cfg.CSRFAuthKey = strings.Repeat("k", 32)
+	cfg.LogLevel = "verbose"
+	if err := cfg.validate(); err == nil || !strings.Contains(err.Error(), `unknown log level "verbose"`) {
+		t.Errorf("invalid level: error %v", err)
+	}
+}
+
+func TestRelativeTime(t *testing.T) {
+	now := newTestClock().now
+	tests := []struct {
+		ago    time.Duration
+		en, fr string
+	}{
+		{0, "just now", "à l'instant"},
+		{59 * time.Second, "just now", "à l'instant"},
+		{time.Minute, "1 minute ago", "il y a 1 minute"},
+		{5*time.Minute + 30*time.Second, "5 minutes ago", "il y a 5 minutes"},
+		{time.Hour, "1 hour ago", "il y a 1 heure"},
+		{23 * time.Hour, "23 hours ago", "il y a 23 heures"},
+		{24 * time.Hour, "1 day ago", "il y a 1 jour"},
+		{6 * 24 * time.Hour, "6 days ago", "il y a 6 jours"},
+		{7 * 24 * time.Hour, "February 23, 2024", "23 février 2024"},
+		{-2 * time.Hour, "in 2 hours", "dans 2 heures"},
+		{-3 * 24 * time.Hour, "in 3 days", "dans 3 jours"},
+	}
+	en, fr := message.NewPrinter(language.English), message.NewPrinter(language.French)
+	for _, tt := range tests {
+		at := now.Add(-tt.ago)
+		if got := relativeTime(en, at, now); got != tt.en {
+			t.Errorf("%v ago in English = %q, want %q", tt.ago, got, tt.en)
+		}
+		if got := relativeTime(fr, at, now); got != tt.fr {
+			t.Errorf("%v ago in French = %q, want %q", tt.ago, got, tt.fr)
+		}
+	}
+}
+
+func TestTodoAgeRefreshes(t *testing.T) {
+	clock := newTestClock()
+	svc := newInMemTodoService(clock)
+	td := mustCreate(t, svc, context.Background(), "Buy milk")
+	s, h := newTestHandler(svc)
+	s.clock = clock
+	tests := []struct {
+		after   time.Duration
+		want    string
+		trigger string
+	}{
+		{5 * time.Minute, "créée il y a 5 minutes", `hx-trigger="every 60s"`},
+		{2 * time.Hour, "créée il y a 2 heures", `hx-trigger="every 3600s"`},
+		{8 * 24 * time.Hour, "créée 1 mars 2024", ""},
+	}
+	for _, tt := range tests {
+		clock.now = newTestClock().now.Add(tt.after)
+		req := httptest.NewRequest("GET", fmt.Sprintf("/todos/%d/age/", td.Id), nil)
+		req.Header.Set("HX-Request", "true")
+		req.AddCookie(&http.Cookie{Name: langCookieName, Value: "fr"})
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, req)
+		body := rec.Body.String()
+		if !strings.Contains(body, tt.want) {
+			t.Errorf("after %v: %s, want %q", tt.after, body, tt.want)
+		}
+		if tt.trigger == "" {
+			if strings.Contains(body, "hx-trigger") {
+				t.Errorf("after %v: still refreshing a date: %s", tt.after, body)
+			}
+		} else if !strings.Contains(body, tt.trigger) {
+			t.Errorf("after %v: %s, want %s", tt.after, body, tt.trigger)
+		}
+	}
+}
+
+func TestRobots(t *testing.T) {
+	custom := filepath.Join(t.TempDir(), "robots.txt")
+	if err := os.WriteFile(custom, []byte("User-agent: *\nAllow: /\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name      string
+		robotsTxt string
+		noIndex   bool
+		want      string
+	}{
+		{"default", "", false, defaultRobotsTxt},
+		{"custom", custom, false, "User-agent: *\nAllow: /\n"},
+		{"noindex", "", true, defaultRobotsTxt},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cfg := defaultConfig()
+			cfg.CSRFAuthKey = strings.Repeat("k", 32)
+			cfg.RobotsTxt = tt.robotsTxt
+			cfg.NoIndex = tt.noIndex
+			s, err := newServerFromConfig(cfg)
+			if err != nil {
+				t.Fatal(err)
+			}
+			h := s.handler(cfg, true)
+
+			rec := httptest.NewRecorder()
+			h.ServeHTTP(rec, httptest.NewRequest("GET", "/robots.txt", nil))
+			if rec.Code != 200 || rec.Body.String() != tt.want {
+				t.Errorf("robots.txt: status %d, %q, want %q", rec.Code, rec.Body, tt.want)
+			}
+			if ct := rec.Header().Get("Content-Type"); ct != "text/plain; charset=utf-8" {
+				t.Errorf("robots.txt Content-Type %q", ct)
+			}
+
+			for _, target := range []string{"/robots.txt", "/todos/"} {
+				rec := httptest.NewRecorder()
+				h.ServeHTTP(rec, httptest.NewRequest("GET", target, nil))
+				got := rec.Header().Get("X-Robots-Tag")
+				if tt.noIndex && got != "noindex" || !tt.noIndex && got != "" {
+					t.Errorf("%s: X-Robots-Tag %q with noindex %v", target, got, tt.noIndex)
+				}
+			}
+		})
+	}
+
+	cfg := defaultConfig()
+	cfg.CSRFAuthKey = strings.Repeat("k", 32)
+	cfg.RobotsTxt = filepath.Join(t.TempDir(), "missing.txt")
+	if _, err := newServerFromConfig(cfg); err == nil {
+		t.Error("a missing robots.txt file was accepted")
+	}
+}
+
+func TestNotifierOnDoneTransitions(t *testing.T) {
+	clock := newTestClock()
+	n := &recordingNotifier{}
+	svc := hookingTodoService{newInMemTodoService(clock), n}
+	ctx := context.Background()
+	td := &todo{Text: "Buy milk"}
+	if err := svc.createTodo(ctx, td); err != nil {
+		t.Fatal(err)
+	}
+	other := &todo{Text: "Walk the dog"}
+	if err := svc.createTodo(ctx, other); err != nil {
+		t.Fatal(err)
+	}
+	yes, no := true, false
+	text := "Buy oat milk"
+	steps := []struct {
+		name string
+		do   func() error
+		done []uint64
+	}{
+		{"done", func() error {
+			_, err := svc.updateTodo(ctx, td.Id, todoUpdate{done: &yes})
+			return err
+		}, []uint64{td.Id}},
+		{"done again", func() error {
+			_, err := svc.updateTodo(ctx, td.Id, todoUpdate{done: &yes})
+			return err
+		}, []uint64{td.Id}},
+		{"edited while done", func() error {
+			_, err := svc.updateTodo(ctx, td.Id, todoUpdate{text: &text})
+			return err
+		}, []uint64{td.Id}},
+		{"batch with one already done", func() error {
+			return svc.setTodosDone(ctx, []uint64{td.Id, other.Id}, true)
+		}, []uint64{td.Id, other.Id}},
+		{"reopened", func() error {
+			_, err := svc.updateTodo(ctx, td.Id, todoUpdate{done: &no})
+			return err
+		}, []uint64{td.Id, other.Id}},
+		{"done once more", func() error {
+			_, err := svc.updateTodo(ctx, td.Id, todoUpdate{done: &yes})
+			return err
+		}, []uint64{td.Id, other.Id, td.Id}},
+	}
+	for _, step := range steps {
+		clock.advance(time.Minute)
+		if err := step.do(); err != nil {
+			t.Fatalf("%s: %v", step.name, err)
+		}
+		if !reflect.DeepEqual(n.done, step.done) {
+			t.Errorf("%s: told of completions %v, want %v", step.name, n.done, step.done)
+		}
+	}
+	if want := []uint64{td.Id, other.Id}; !reflect.DeepEqual(n.created, want) {
+		t.Errorf("told of creations %v, want %v", n.created, want)
+	}
+}
+
+func TestWebhookNotifierRetries(t *testing.T) {
+	events := make(chan webhookEvent, 2)
+	var calls int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if atomic.AddInt32(&calls, 1) == 1 {
+			http.Error(w, "try again", 503)
+			return
+		}
+		var event webhookEvent
+		if err := json.NewDecoder(r.Body).Decode(&event); err != nil {
+			t.Error(err)
+		}
+		events <- event
+	}))
+	defer srv.Close()
+
+	n := newWebhookNotifier(srv.URL)
+	n.OnTodoDone(context.Background(), &todo{Id: 7, Text: "Buy milk", Done: true})
+	select {
+	case event := <-events:
+		if event.Event != "done" || event.Todo.Id != 7 || event.Todo.Text != "Buy milk" {
+			t.Errorf("delivered %+v", event)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("webhook not delivered")
+	}
+	if got := atomic.LoadInt32(&calls); got != 2 {
+		t.Errorf("%d attempts, want a retry after the failure", got)
+	}
+}
+
+func TestResetFilters(t *testing.T) {
+	svc := newInMemTodoService(newTestClock())
+	ctx := context.Background()
+	mustCreate(t, svc, ctx, "Buy milk")
+	done := mustCreate(t, svc, ctx, "Walk the dog")
+	yes := true
+	if _, err := svc.updateTodo(ctx, done.Id, todoUpdate{done: &yes}); err != nil {
+		t.Fatal(err)
+	}
+	_, h := newTestHandler(svc)
+	get := func(target string, htmx bool) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("GET", target, nil)
+		if htmx {
+			req.Header.Set("HX-Request", "true")
+			req.Header.Set("HX-Current-URL", "http://example.com/todos/?filter=done&q=milk")
+		}
+		req.AddCookie(&http.Cookie{Name: filterCookieName, Value: "done"})
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, req)
+		return rec
+	}
+
+	// the remembered filter alone is worth clearing
+	if body := get("/todos/", true).Body.String(); !strings.Contains(body, "Clear filters") || strings.Contains(body, "Buy milk") {
+		t.Errorf("filtered list lacks the clear button or isn't filtered:\n%s", body)
+	}
+
+	rec := get("/todos/?reset=1&filter=done&q=dog", true)
+	body := rec.Body.String()
+	if rec.Code != 200 {
+		t.Fatalf("status %d", rec.Code)
+	}
+	if !strings.Contains(body, "Buy milk") || !strings.Contains(body, "Walk the dog") {
+		t.Errorf("reset list isn't unfiltered:\n%s", body)
+	}
+	if strings.Contains(body, "Clear filters") {
+		t.Error("reset list still offers to clear filters")
+	}
+	if got := rec.Header().Get("HX-Push-Url"); got != "/todos/" {
+		t.Errorf("HX-Push-Url %q, want the clean list URL", got)
+	}
+	var cleared bool
+	for _, c := range rec.Result().Cookies() {
+		if c.Name == filterCookieName && c.MaxAge < 0 {
+			cleared = true
+		}
+	}
+	if !cleared {
+		t.Error("remembered filter not cleared")
+	}
+
+	rec = get("/todos/?reset=1&filter=done", false)
+	if rec.Code != 303 || rec.Header().Get("Location") != "/todos/" {
+		t.Errorf("without htmx: status %d to %q, want a redirect to the clean list", rec.Code, rec.Header().Get("Location"))
+	}
+}
+
+func TestQuickAddLines(t *testing.T) {
+	svc := newInMemTodoService(newTestClock())
+	svc.maxTextLength = 20
+	_, h := newTestHandler(svc)
+	text := "  Walk the dog \n\nWater every single plant in the house\n\tFeed the cat\n   \n"
+	post := func(text string, accept string) *httptest.ResponseRecorder {
+		req := newTestRequest(t, h, "POST", "/todos/", url.Values{"new-todo": {text}, "multi": {"1"}})
+		if accept == "" {
+			req.Header.Set("HX-Request", "true")
+		} else {
+			req.Header.Set("Accept", accept)
+		}
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, req)
+		return rec
+	}
+
+	rec := post(text, "application/json")
+	var body struct {
+		Created []todoDTO
+		Errors  []lineError
+	}
+	if err := json.Unmarshal(rec.Body.Bytes(), &body); err != nil {
+		t.Fatalf("%v: %s", err, rec.Body)
+	}
+	var created []string
+	for _, td := range body.Created {
+		created = append(created, td.Text)
+	}
+	if want := []string{"Walk the dog", "Feed the cat"}; rec.Code != 201 || !reflect.DeepEqual(created, want) {
+		t.Errorf("status %d, created %q, want %q", rec.Code, created, want)
+	}
+	if len(body.Errors) != 1 || body.Errors[0].Line != 3 || body.Errors[0].Code != "validation_failed" {
+		t.Errorf("errors %+v, want the long third line", body.Errors)
+	}
+
+	rec = post(text, "")
+	html := rec.Body.String()
+	for _, want := range []string{"Added 2 todos.", "Line 3: Todo text must be at most 20 characters.", ">Water every single plant in the house</textarea>"} {
+		if !strings.Contains(html, want) {
+			t.Errorf("htmx response lacks %q:\n%s", want, html)
+		}
+	}
+
+	if rec := post("Water every single plant in the house", "application/json"); rec.Code != 422 {
+		t.Errorf("only failing lines: status %d, want 422", rec.Code)
+	}
+	before, err := svc.findTodos(context.Background(), todoFilter{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if rec := post(strings.Repeat("todo\n", maxQuickAddLines+1), "application/json"); rec.Code != 422 {
+		t.Errorf("%d lines: status %d, want 422", maxQuickAddLines+1, rec.Code)
+	}
+	after, err := svc.findTodos(context.Background(), todoFilter{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(after) != len(before) {
+		t.Errorf("too many lines still added %d todos", len(after)-len(before))
+	}
+}
+
+func TestParseFormRejectsLargeBody(t *testing.T) {
+	tests := []struct {
+		name       string
+		body       string
+		wantStatus int
+	}{
+		{"too large", "new-todo=" + strings.Repeat("a", 100), 413},
+		{"malformed", "new-todo=%zz", 400},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rec := httptest.NewRecorder()
+			h := withMessagePrinter(withMaxBodyBytes(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				if parseForm(w, r) {
+					t.Error("parseForm accepted the body")
+				}
+			}), 64))
+			r := httptest.NewRequest("POST", "/todos/", strings.NewReader(tt.body))
+			r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+			r.Header.Set("Accept", "application/json")
+			h.ServeHTTP(rec, r)
+			if rec.Code != tt.wantStatus {
+				t.Errorf("status %d, want %d", rec.Code, tt.wantStatus)
+			}
+		})
+	}
+}
+
+func TestWebSocketCommandsRespectMaintenance(t *testing.T) {
+	tests := []struct {
+		name        string
+		mode        maintenanceMode
+		wantApplied bool
+	}{
+		{"off", maintenanceOff, true},
+		{"writes", maintenanceWrites, false},
+		{"all", maintenanceAll, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			svc := newInMemTodoService(newTestClock())
+			toggled := mustCreate(t, svc, context.Background(), "Walk the dog")
+			deleted := mustCreate(t, svc, context.Background(), "Feed the cat")
+			s, _ := newTestHandler(svc)
+			s.setMaintenanceMode(tt.mode)
+			r := httptest.NewRequest("GET", "/todos/ws", nil)
+			s.applyWebSocketCommand(nil, r, wsCommand{Command: "toggle", Id: fmt.Sprint(toggled.Id)})
+			s.applyWebSocketCommand(nil, r, wsCommand{Command: "delete", Id: fmt.Sprint(deleted.Id)})
+
+			got, err := svc.getTodoById(context.Background(), toggled.Id)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got.Done != tt.wantApplied {
+				t.Errorf("toggled: done %v, want %v", got.Done, tt.wantApplied)
+			}
+			got, err = svc.getTodoById(context.Background(), deleted.Id)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got.Deleted != tt.wantApplied {
+				t.Errorf("deleted: %v, want %v", got.Deleted, tt.wantApplied)
+			}
+		})
+	}
+}
+
+func TestChangeBroker(t *testing.T) {
+	b := newChangeBroker()
+	signalled := func(ch chan struct{}) bool {
+		select {
+		case <-ch:
+			return true
+		default:
+			return false
+		}
+	}
+
+	fast, slow := b.subscribe(), b.subscribe()
+	b.publish()
+	if !signalled(fast) || !signalled(slow) {
+		t.Fatal("a subscriber missed the publish")
+	}
+
+	// a subscriber that doesn't keep up gets one signal for the lot,
+	// without holding up publish
+	for i := 0; i < 3; i++ {
+		b.publish()
+	}
+	if !signalled(slow) {
+		t.Error("slow subscriber lost every signal")
+	}
+	if signalled(slow) {
+		t.Error("slow subscriber got more than one signal")
+	}
+	signalled(fast)
+
+	b.unsubscribe(slow)
+	b.publish()
+	if signalled(slow) {
+		t.Error("unsubscribed channel was signalled")
+	}
+	if !signalled(fast) {
+		t.Error("remaining subscriber missed the publish")
+	}
+}
+
+func TestNotifyingServicePublishesChanges(t *testing.T) {
+	b := newChangeBroker()
+	svc := notifyingTodoService{newInMemTodoService(newTestClock()), b}
+	ch := b.subscribe()
+	td := mustCreate(t, svc, context.Background(), "Walk the dog")
+	select {
+	case <-ch:
+	default:
+		t.Error("creating a todo published nothing")
+	}
+	if err := svc.deleteTodo(context.Background(), td.Id+100); err == nil {
+		t.Fatal("deleted a missing todo")
+	}
+	select {
+	case <-ch:
+		t.Error("a failed change was published")
+	default:
+	}
+}
+
+// dialTodos opens the todo list websocket of a server running h.
+func dialTodos(t *testing.T, h http.Handler) *websocket.Conn {
+	t.Helper()
+	srv := httptest.NewServer(h)
+	t.Cleanup(srv.Close)
+	conn, _, err := websocket.DefaultDialer.Dial("ws"+strings.TrimPrefix(srv.URL, "http")+"/todos/ws", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	return conn
+}
+
+func readFrame(t *testing.T, conn *websocket.Conn) string {
+	t.Helper()
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	_, msg, err := conn.ReadMessage()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(msg)
+}
+
+// newWebSocketServer wires up s the way the websocket config option does.
+func newWebSocketServer(svc todoService) (*server, http.Handler) {
+	s, h := newTestHandler(svc)
+	s.changes = newChangeBroker()
+	s.todoService = notifyingTodoService{s.todoService, s.changes}
+	return s, h
+}
+
+func TestWebSocketPushesCreatedTodos(t *testing.T) {
+	_, h := newWebSocketServer(newInMemTodoService(newTestClock()))
+	conn := dialTodos(t, h)
+
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, newTestRequest(t, h, "POST", "/todos/", url.Values{"new-todo": {"Walk the dog"}}))
+	if rec.Code >= 400 {
+		t.Fatalf("creating: status %d", rec.Code)
+	}
+	if frame := readFrame(t, conn); !strings.Contains(frame, "Walk the dog") {
+		t.Errorf("frame doesn't list the new todo:\n%s", frame)
+	}
+}
+
+func TestWebSocketDeleteWaitsOutUndoWindow(t *testing.T) {
+	svc := newInMemTodoService(newTestClock())
+	td := mustCreate(t, svc, context.Background(), "Walk the dog")
+	s, h := newWebSocketServer(svc)
+	s.pendingDeletes = newPendingDeletes(time.Minute)
+	conn := dialTodos(t, h)
+
+	if err := conn.WriteJSON(wsCommand{Command: "delete", Id: fmt.Sprint(td.Id)}); err != nil {
+		t.Fatal(err)
+	}
+	frame := readFrame(t, conn)
+	if !strings.Contains(frame, fmt.Sprintf(`id="todo-%d"`, td.Id)) || !strings.Contains(frame, "/undo/") {
+		t.Errorf("frame isn't the todo's undo row:\n%s", frame)
+	}
+	if ids := s.pendingDeletes.ids(); len(ids) != 1 || ids[0] != td.Id {
+		t.Errorf("pending deletes %v, want [%d]", ids, td.Id)
+	}
+	got, err := svc.getTodoById(context.Background(), td.Id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.Deleted {
+		t.Error("todo deleted before the undo window ran out")
+	}
+}
+
+func TestWebSocketDeleteNeedsConfirming(t *testing.T) {
+	svc := newInMemTodoService(newTestClock())
+	deleted := mustCreate(t, svc, context.Background(), "Walk the dog")
+	toggled := mustCreate(t, svc, context.Background(), "Feed the cat")
+	s, h := newWebSocketServer(svc)
+	s.deleteTokens = newDeleteTokens(time.Minute, 10)
+	conn := dialTodos(t, h)
+
+	// commands run in order, so once the toggle's list arrives the delete
+	// has been handled
+	for _, cmd := range []wsCommand{
+		{Command: "delete", Id: fmt.Sprint(deleted.Id)},
+		{Command: "toggle", Id: fmt.Sprint(toggled.Id)},
+	} {
+		if err := conn.WriteJSON(cmd); err != nil {
+			t.Fatal(err)
+		}
+	}
+	readFrame(t, conn)
+	got, err := svc.getTodoById(context.Background(), deleted.Id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.Deleted {
+		t.Error("websocket delete skipped the confirmation")
+	}
+}
+
+func TestFileStoreRoundTrip(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "todos.json")
+	svc, err := newFileTodoService(newInMemTodoService(newTestClock()), path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ctx := ownerContext("alice")
+	kept := mustCreate(t, svc, ctx, "Walk the dog")
+	done := mustCreate(t, svc, ctx, "Feed the cat")
+	trashed := mustCreate(t, svc, ctx, "Water the plants")
+	yes := true
+	if _, err := svc.updateTodo(ctx, done.Id, todoUpdate{done: &yes}); err != nil {
+		t.Fatal(err)
+	}
+	if err := svc.deleteTodo(ctx, trashed.Id); err != nil {
+		t.Fatal(err)
+	}
+
+	// every save renames its temporary file over the store
+	entries, err := os.ReadDir(filepath.Dir(path))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) != 1 || entries[0].Name() != "todos.json" {
+		var names []string
+		for _, e := range entries {
+			names = append(names, e.Name())
+		}
+		t.Errorf("store directory holds %v, want just todos.json", names)
+	}
+
+	reloaded, err := newFileTodoService(newInMemTodoService(newTestClock()), path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range []*todo{kept, done, trashed} {
+		got, err := reloaded.getTodoById(ctx, want.Id)
+		if err != nil {
+			t.Fatalf("todo %d: %v", want.Id, err)
+		}
+		if got.Text != want.Text || got.Owner != "alice" {
+			t.Errorf("todo %d reloaded as %+v", want.Id, got)
+		}
+	}
+	if got, _ := reloaded.getTodoById(ctx, done.Id); !got.Done {
+		t.Error("done todo reloaded as not done")
+	}
+	if got, _ := reloaded.getTodoById(ctx, trashed.Id); !got.Deleted {
+		t.Error("trashed todo reloaded out of the trash")
+	}
+	added := mustCreate(t, reloaded, ctx, "Call your mom")
+	for _, old := range []*todo{kept, done, trashed} {
+		if added.Id == old.Id {
+			t.Errorf("todo added after reloading reused id %d", old.Id)
+		}
+	}
+}
+
+func TestFileStoreStartsEmpty(t *testing.T) {
+	dir := t.TempDir()
+	empty := filepath.Join(dir, "empty.json")
+	if err := os.WriteFile(empty, nil, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	for _, path := range []string{filepath.Join(dir, "missing.json"), empty} {
+		svc, err := newFileTodoService(newInMemTodoService(newTestClock()), path)
+		if err != nil {
+			t.Fatalf("%s: %v", filepath.Base(path), err)
+		}
+		if n, _ := svc.countTodos(context.Background(), todoFilter{allOwners: true}); n != 0 {
+			t.Errorf("%s: %d todos, want none", filepath.Base(path), n)
+		}
+	}
+}
+
+func TestFileStoreRejectsCorruptFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "todos.json")
+	if err := os.WriteFile(path, []byte(`[{"id": 1, "text": "Walk the`), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := newFileTodoService(newInMemTodoService(newTestClock()), path); err == nil {
+		t.Error("loaded a corrupt store without an error")
+	}
+}
+
+func TestSlugify(t *testing.T) {
+	tests := []struct {
+		text string
+		want string
+	}{
+		{"Buy milk", "buy-milk"},
+		{"  Call   your mom!! ", "call-your-mom"},
+		{"Crème brûlée à la française", "creme-brulee-a-la-francaise"},
+		{"Über Straße", "uber-stra-e"},
+		{"R2-D2 & C-3PO", "r2-d2-c-3po"},
+		{"日本語", "todo"},
+		{"!!!", "todo"},
+		{strings.Repeat("a", 70), strings.Repeat("a", maxSlugLength)},
+		// cut where a hyphen would come next, which isn't kept
+		{strings.Repeat("a", maxSlugLength) + " b", strings.Repeat("a", maxSlugLength)},
+	}
+	for _, tt := range tests {
+		if got := slugify(tt.text); got != tt.want {
+			t.Errorf("slugify(%q) = %q, want %q", tt.text, got, tt.want)
+		}
+	}
+	long := slugify(strings.Repeat("word ", 30))
+	if len(long) > maxSlugLength || strings.HasSuffix(long, "-") {
+		t.Errorf("long slug %q is over %d bytes or ends in a hyphen", long, maxSlugLength)
+	}
+}
+
+func TestPermalinks(t *testing.T) {
+	svc := newInMemTodoService(newTestClock())
+	first := mustCreate(t, svc, context.Background(), "Buy milk")
+	second := mustCreate(t, svc, context.Background(), "Buy milk!")
+	s, h := newTestHandler(svc)
+	if first.Slug != second.Slug {
+		t.Fatalf("slugs %q and %q, want the same", first.Slug, second.Slug)
+	}
+	// the id keeps todos with the same slug apart
+	if s.permalink(first) == s.permalink(second) {
+		t.Fatalf("both todos have permalink %s", s.permalink(first))
+	}
+	for _, td := range []*todo{first, second} {
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, httptest.NewRequest("GET", s.permalink(td), nil))
+		if rec.Code != 200 || !strings.Contains(rec.Body.String(), td.Text) {
+			t.Errorf("%s: status %d, want todo %d's page", s.permalink(td), rec.Code, td.Id)
+		}
+	}
+
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest("GET", fmt.Sprintf("/todos/%d-old-text/", first.Id), nil))
+	if loc := rec.Result().Header.Get("Location"); rec.Code != 301 || loc != s.permalink(first) {
+		t.Errorf("stale slug: status %d to %q, want 301 to %s", rec.Code, loc, s.permalink(first))
+	}
+}
+
+func TestUpdateSlugs(t *testing.T) {
+	for _, update := range []bool{false, true} {
+		svc := newInMemTodoService(newTestClock())
+		svc.updateSlugs = update
+		td := mustCreate(t, svc, context.Background(), "Buy milk")
+		text := "Buy oat milk"
+		got, err := svc.updateTodo(context.Background(), td.Id, todoUpdate{text: &text})
+		if err != nil {
+			t.Fatal(err)
+		}
+		want := "buy-milk"
+		if update {
+			want = "buy-oat-milk"
+		}
+		if got.Slug != want {
+			t.Errorf("updateSlugs %v: slug %q, want %q", update, got.Slug, want)
+		}
+	}
+}
+
+func TestActionableBefore(t *testing.T) {
+	now := newTestClock().Now()
+	tests := []struct {
+		name string
+		a, b todo
+	}{
+		{"pinned first", todo{Pinned: true}, todo{DueAt: now}},
+		{"due before undated", todo{DueAt: now.AddDate(1, 0, 0)}, todo{CreatedAt: now.Add(-time.Hour)}},
+		{"sooner due first", todo{DueAt: now}, todo{DueAt: now.AddDate(0, 0, 1)}},
+		{"pinned by due date", todo{Pinned: true, DueAt: now}, todo{Pinned: true, DueAt: now.AddDate(0, 0, 1)}},
+		{"then oldest", todo{CreatedAt: now.Add(-time.Hour)}, todo{CreatedAt: now}},
+		{"same due, oldest", todo{DueAt: now, CreatedAt: now.Add(-time.Hour)}, todo{DueAt: now, CreatedAt: now}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if !actionableBefore(&tt.a, &tt.b) {
+				t.Error("a isn't before b")
+			}
+			if actionableBefore(&tt.b, &tt.a) {
+				t.Error("b is before a")
+			}
+		})
+	}
+}
+
+func TestFocusFlow(t *testing.T) {
+	clock := newTestClock()
+	svc := newInMemTodoService(clock)
+	ctx := context.Background()
+	day := func(d int) time.Time { return time.Date(2024, 3, d, 0, 0, 0, 0, time.UTC) }
+	undated := mustCreate(t, svc, ctx, "Tidy up")
+	clock.advance(time.Minute)
+	later := &todo{Text: "File taxes", DueAt: day(5)}
+	if err := svc.createTodo(ctx, later); err != nil {
+		t.Fatal(err)
+	}
+	sooner := &todo{Text: "Pay rent", DueAt: day(3)}
+	if err := svc.createTodo(ctx, sooner); err != nil {
+		t.Fatal(err)
+	}
+	pinned := mustCreate(t, svc, ctx, "Call your mom")
+	yes := true
+	if _, err := svc.updateTodo(ctx, pinned.Id, todoUpdate{pinned: &yes}); err != nil {
+		t.Fatal(err)
+	}
+	s, h := newTestHandler(svc)
+	s.clock = clock
+
+	focus := func(method, target string, form url.Values) *todoDTO {
+		t.Helper()
+		req := newTestRequest(t, h, method, target, form)
+		req.Header.Set("Accept", "application/json")
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, req)
+		if rec.Code != 200 {
+			t.Fatalf("%s %s: status %d, want 200", method, target, rec.Code)
+		}
+		var got *todoDTO
+		if err := json.NewDecoder(rec.Body).Decode(&got); err != nil {
+			t.Fatal(err)
+		}
+		return got
+	}
+	want := func(step string, got *todoDTO, want *todo) {
+		t.Helper()
+		if got == nil || got.Id != want.Id {
+			t.Fatalf("%s: focused on %+v, want %q", step, got, want.Text)
+		}
+	}
+	skipPinned := fmt.Sprint(pinned.Id)
+
+	want("start", focus("GET", "/todos/focus/", nil), pinned)
+	want("next", focus("GET", "/todos/focus/?skip="+skipPinned, nil), sooner)
+	want("done", focus("POST", "/todos/focus/", url.Values{"id": {fmt.Sprint(sooner.Id)}, "action": {"done"}, "skip": {skipPinned}}), later)
+	want("snooze", focus("POST", "/todos/focus/", url.Values{"id": {fmt.Sprint(later.Id)}, "action": {"snooze"}, "skip": {skipPinned}}), undated)
+
+	if got, _ := svc.getTodoById(ctx, sooner.Id); !got.Done {
+		t.Error("todo marked done in focus mode isn't done")
+	}
+	if got, _ := svc.getTodoById(ctx, later.Id); !got.SnoozedUntil.Equal(day(2)) {
+		t.Errorf("snoozed until %v, want %v", got.SnoozedUntil, day(2))
+	}
+
+	// without htmx the action redirects back, still passing over the
+	// skipped todos
+	req := newTestRequest(t, h, "POST", "/todos/focus/", url.Values{"id": {fmt.Sprint(undated.Id)}, "action": {"done"}, "skip": {skipPinned}})
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, req)
+	if loc := rec.Result().Header.Get("Location"); rec.Code != 303 || loc != "/todos/focus/?skip="+skipPinned {
+		t.Errorf("status %d to %q, want 303 to /todos/focus/?skip=%s", rec.Code, loc, skipPinned)
+	}
+}
+
+func TestBatch(t *testing.T) {
+	type result struct {
+		Ok    bool
+		Todo  *todoDTO
+		Error *batchError
+	}
+	run := func(t *testing.T, svc *inMemTodoService, target, body string) (int, []result) {
+		t.Helper()
+		_, h := newTestHandler(svc)
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, newJSONRequest(t, h, "POST", target, body))
+		var results []result
+		if err := json.NewDecoder(rec.Body).Decode(&results); err != nil {
+			t.Fatal(err)
+		}
+		return rec.Code, results
+	}
+	codes := func(results []result) string {
+		var codes []string
+		for _, r := range results {
+			if r.Ok {
+				codes = append(codes, "ok")
+			} else if r.Error != nil {
+				codes = append(codes, r.Error.Code)
+			} else {
+				codes = append(codes, "none")
+			}
+		}
+		return strings.Join(codes, " ")
+	}
+
+	t.Run("mixed", func(t *testing.T) {
+		svc := newInMemTodoService(newTestClock())
+		existing := mustCreate(t, svc, context.Background(), "Walk the dog")
+		body := fmt.Sprintf(`[
+			{"op": "create", "text": "Feed the cat", "due": "2024-03-04"},
+			{"op": "update", "id": 999999, "done": true},
+			{"op": "delete", "id": %d},
+			{"op": "create", "text": "  "},
+			{"op": "rename"}
+		]`, existing.Id)
+		status, results := run(t, svc, "/todos/batch", body)
+		if want := "ok not_found ok validation_failed validation_failed"; status != 200 || codes(results) != want {
+			t.Fatalf("status %d, results %s; want 200, %s", status, codes(results), want)
+		}
+		if results[0].Todo == nil || results[0].Todo.Text != "Feed the cat" {
+			t.Errorf("create result %+v", results[0].Todo)
+		}
+		if got, _ := svc.getTodoById(context.Background(), existing.Id); !got.Deleted {
+			t.Error("delete after a failed update wasn't applied")
+		}
+	})
+
+	t.Run("atomic, rejected", func(t *testing.T) {
+		svc := newInMemTodoService(newTestClock())
+		status, results := run(t, svc, "/todos/batch?atomic=true", `[
+			{"op": "create", "text": "Feed the cat"},
+			{"op": "delete", "id": 999999}
+		]`)
+		if want := "not_applied not_found"; status != 422 || codes(results) != want {
+			t.Errorf("status %d, results %s; want 422, %s", status, codes(results), want)
+		}
+		if n, _ := svc.countTodos(context.Background(), todoFilter{}); n != 0 {
+			t.Errorf("%d todos created by a rejected batch", n)
+		}
+	})
+
+	t.Run("atomic, applied", func(t *testing.T) {
+		svc := newInMemTodoService(newTestClock())
+		existing := mustCreate(t, svc, context.Background(), "Walk the dog")
+		status, results := run(t, svc, "/todos/batch?atomic=true", fmt.Sprintf(`[
+			{"op": "create", "text": "Feed the cat"},
+			{"op": "update", "id": %d, "done": true}
+		]`, existing.Id))
+		if status != 200 || codes(results) != "ok ok" {
+			t.Errorf("status %d, results %s; want 200, ok ok", status, codes(results))
+		}
+	})
+
+	// the checks can't foresee everything: a failure while applying stops
+	// the batch, keeping what was already applied
+	t.Run("atomic, failing while applied", func(t *testing.T) {
+		svc := newInMemTodoService(newTestClock())
+		svc.maxTodos = 1
+		status, results := run(t, svc, "/todos/batch?atomic=true", `[
+			{"op": "create", "text": "Feed the cat"},
+			{"op": "create", "text": "Walk the dog"},
+			{"op": "create", "text": "Call your mom"}
+		]`)
+		if want := "ok validation_failed not_applied"; status != 200 || codes(results) != want {
+			t.Errorf("status %d, results %s; want 200, %s", status, codes(results), want)
+		}
+		if n, _ := svc.countTodos(context.Background(), todoFilter{}); n != 1 {
+			t.Errorf("%d todos, want the first one", n)
+		}
+	})
+}
+
+func TestTodosExpire(t *testing.T) {
+	clock := newTestClock()
+	svc := newInMemTodoService(clock)
+	svc.ttl = time.Hour
+	svc.ttlKeepDone = true
+	ctx := context.Background()
+	old := mustCreate(t, svc, ctx, "Walk the dog")
+	done := mustCreate(t, svc, ctx, "Feed the cat")
+	yes := true
+	if _, err := svc.updateTodo(ctx, done.Id, todoUpdate{done: &yes}); err != nil {
+		t.Fatal(err)
+	}
+	clock.advance(30 * time.Minute)
+	young := mustCreate(t, svc, ctx, "Call your mom")
+	listed := func() string {
+		t.Helper()
+		todos, err := svc.findTodos(ctx, todoFilter{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		var texts []string
+		for _, td := range todos {
+			texts = append(texts, td.Text)
+		}
+		return strings.Join(texts, ", ")
+	}
+
+	clock.advance(30*time.Minute - time.Second)
+	if got, want := listed(), "Walk the dog, Feed the cat, Call your mom"; got != want {
+		t.Errorf("before the TTL: %s, want %s", got, want)
+	}
+	clock.advance(time.Second)
+	if got, want := listed(), "Feed the cat, Call your mom"; got != want {
+		t.Errorf("at the TTL: %s, want %s", got, want)
+	}
+
+	n, err := svc.expireTodos(ctx)
+	if err != nil || n != 1 {
+		t.Fatalf("expired %d todos (%v), want 1", n, err)
+	}
+	if got, _ := svc.getTodoById(ctx, old.Id); !got.Deleted || !got.DeletedAt.Equal(clock.Now()) {
+		t.Errorf("expired todo = %+v, want it in the trash", got)
+	}
+
+	// brought back, it gets a fresh TTL
+	if _, err := svc.restoreTodo(ctx, old.Id); err != nil {
+		t.Fatal(err)
+	}
+	clock.advance(30 * time.Minute)
+	if got, want := listed(), "Walk the dog, Feed the cat"; got != want {
+		t.Errorf("after restoring: %s, want %s", got, want)
+	}
+	if got, _ := svc.getTodoById(ctx, young.Id); got.Deleted {
+		t.Error("todo left out of the list went to the trash before a sweep")
+	}
+}
+
+func TestExpireSweeperStops(t *testing.T) {
+	s, _ := newTestHandler(newInMemTodoService(newTestClock()))
+	ctx, cancel := context.WithCancel(context.Background())
+	stopped := make(chan struct{})
+	go func() {
+		s.expireTodos(ctx, time.Millisecond)
+		close(stopped)
+	}()
+	cancel()
+	select {
+	case <-stopped:
+	case <-time.After(5 * time.Second):
+		t.Fatal("sweeper kept running after its context was done")
+	}
+}
+
+func TestTodoTextLimits(t *testing.T) {
+	tests := []struct {
+		name     string
+		text     string
+		collapse bool
+		want     string
+		wantErr  bool
+	}{
+		{"at the limit", "abcde", false, "abcde", false},
+		{"over the limit", "abcdef", false, "", true},
+		{"trimmed to the limit", "  abcde\n", false, "abcde", false},
+		{"multibyte at the limit", "héllö", false, "héllö", false},
+		{"emoji at the limit", "🙂🙂🙂🙂🙂", false, "🙂🙂🙂🙂🙂", false},
+		{"multibyte over the limit", "héllös", false, "", true},
+		{"blank", " \t ", false, "", true},
+		{"inner whitespace kept", "a   b", false, "a   b", false},
+		{"inner whitespace collapsed", "a  \t  b", true, "a b", false},
+		{"collapsed under the limit", "a    b  c", true, "a b c", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			svc := newInMemTodoService(newTestClock())
+			svc.maxTextLength = 5
+			svc.collapseWhitespace = tt.collapse
+			td := &todo{Text: tt.text}
+			err := svc.createTodo(context.Background(), td)
+			var verr *validationError
+			if tt.wantErr {
+				if !errors.As(err, &verr) {
+					t.Errorf("got %v, want a validation error", err)
+				}
+				return
+			}
+			if err != nil || td.Text != tt.want {
+				t.Errorf("got %q (%v), want %q", td.Text, err, tt.want)
+			}
+		})
+	}
+}
+
+func TestTodoTextLimitOnUpdate(t *testing.T) {
+	svc := newInMemTodoService(newTestClock())
+	svc.maxTextLength = 5
+	td := mustCreate(t, svc, context.Background(), "abc")
+	_, h := newTestHandler(svc)
+
+	req := newTestRequest(t, h, "PUT", fmt.Sprintf("/todos/%d/", td.Id), url.Values{"text": {"abcdef"}})
+	req.Header.Set("Accept-Language", "fr")
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, req)
+	if rec.Code != 422 || !strings.Contains(rec.Body.String(), "ne doit pas dépasser 5 caractères") {
+		t.Errorf("status %d, want 422 with the French message:\n%s", rec.Code, rec.Body)
+	}
+	if got, _ := svc.getTodoById(context.Background(), td.Id); got.Text != "abc" {
+		t.Errorf("text %q after a rejected update, want it unchanged", got.Text)
+	}
+}
+
+func TestTimezoneDecidesToday(t *testing.T) {
+	clock := newTestClock()
+	svc := newInMemTodoService(clock)
+	// 14:00 UTC is still March 1st in Los Angeles and already 23:00 in
+	// Tokyo
+	clock.now = time.Date(2024, 3, 1, 14, 0, 0, 0, time.UTC)
+	td := mustCreate(t, svc, context.Background(), "Walk the dog")
+	yes := true
+	if _, err := svc.updateTodo(context.Background(), td.Id, todoUpdate{done: &yes}); err != nil {
+		t.Fatal(err)
+	}
+	// by 23:30 UTC it's March 2nd in Tokyo
+	clock.now = time.Date(2024, 3, 1, 23, 30, 0, 0, time.UTC)
+	s, h := newTestHandler(svc)
+	s.clock = clock
+
+	for _, tt := range []struct {
+		tz    string
+		today bool
+	}{
+		{"UTC", true},
+		{"America/Los_Angeles", true},
+		{"Asia/Tokyo", false},
+	} {
+		t.Run(tt.tz, func(t *testing.T) {
+			loc, err := time.LoadLocation(tt.tz)
+			if err != nil {
+				t.Fatal(err)
+			}
+			stats, err := svc.stats(context.WithValue(context.Background(), locationKey, loc))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if created := stats.CreatedToday == 1; created != tt.today {
+				t.Errorf("created today: %v, want %v", created, tt.today)
+			}
+
+			req := httptest.NewRequest("GET", "/todos/?filter=donetoday", nil)
+			req.Header.Set("Accept", "application/json")
+			req.AddCookie(&http.Cookie{Name: timezoneCookieName, Value: tt.tz})
+			rec := httptest.NewRecorder()
+			h.ServeHTTP(rec, req)
+			if listed := strings.Contains(rec.Body.String(), "Walk the dog"); listed != tt.today {
+				t.Errorf("listed as done today: %v, want %v", listed, tt.today)
+			}
+		})
+	}
+}
+
+func TestTimezoneCookie(t *testing.T) {
+	_, h := newTestHandler(newInMemTodoService(newTestClock()))
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, newTestRequest(t, h, "POST", "/timezone/", url.Values{"tz": {"Mars/Olympus_Mons"}}))
+	if rec.Code != 400 {
+		t.Errorf("unknown zone: status %d, want 400", rec.Code)
+	}
+	rec = httptest.NewRecorder()
+	h.ServeHTTP(rec, newTestRequest(t, h, "POST", "/timezone/", url.Values{"tz": {"Europe/Paris"}}))
+	var tz *http.Cookie
+	for _, c := range rec.Result().Cookies() {
+		if c.Name == timezoneCookieName {
+			tz = c
+		}
+	}
+	if rec.Code >= 400 || tz == nil || tz.Value != "Europe/Paris" {
+		t.Errorf("status %d, cookie %v; want the zone kept in a cookie", rec.Code, tz)
+	}
+}
+
+// captureLog collects what is logged until the test ends.
+func captureLog(t *testing.T) *strings.Builder {
+	var b strings.Builder
+	log.SetOutput(&b)
+	t.Cleanup(func() { log.SetOutput(io.Discard) })
+	return &b
+}
+
+func TestDebugBodies(t *testing.T) {
+	for _, debug := range []bool{false, true} {
+		t.Run(fmt.Sprint(debug), func(t *testing.T) {
+			svc := newInMemTodoService(newTestClock())
+			s := newServer(embeddedTemplates(), "", svc)
+			cfg := defaultConfig()
+			cfg.CSRFAuthKey = strings.Repeat("k", 32)
+			cfg.DebugBodies = debug
+			h := s.handler(cfg, true)
+			form := url.Values{
+				"new-todo":           {"Walk the dog"},
+				"gorilla.csrf.Token": {"hunter2"},
+				"notes":              {strings.Repeat("x", 2*maxLoggedBody)},
+			}
+			req := newTestRequest(t, h, "POST", "/todos/", form)
+			logged := captureLog(t)
+			rec := httptest.NewRecorder()
+			h.ServeHTTP(rec, req)
+
+			// the handler still reads the whole body
+			if n, _ := svc.countTodos(context.Background(), todoFilter{}); rec.Code >= 400 || n != 1 {
+				t.Fatalf("status %d, %d todos; want the todo created", rec.Code, n)
+			}
+			out := logged.String()
+			if !debug {
+				if strings.Contains(out, "request body") {
+					t.Errorf("body logged without -debug-bodies:\n%s", out)
+				}
+				return
+			}
+			for _, want := range []string{"request body: ", "gorilla.csrf.Token=[redacted]", "new-todo=Walk+the+dog", "(truncated)", "responded 302 with"} {
+				if !strings.Contains(out, want) {
+					t.Errorf("log has no %q:\n%s", want, out)
+				}
+			}
+			if strings.Contains(out, "hunter2") {
+				t.Errorf("token logged:\n%s", out)
+			}
+			if strings.Contains(out, strings.Repeat("x", maxLoggedBody)) {
+				t.Errorf("logged more than %d bytes of the body", maxLoggedBody)
+			}
+		})
+	}
+}
+
+func TestRedactBody(t *testing.T) {
+	tests := []struct {
+		body string
+		want string
+	}{
+		{"password=hunter2&next=%2Ftodos%2F", "password=[redacted]&next=%2Ftodos%2F"},
+		{"new-todo=a&csrf_token=abc&x=1", "new-todo=a&csrf_token=[redacted]&x=1"},
+		{`{"text": "a", "api_token": "abc", "Secret" : "s"}`, `{"text": "a", "api_token": "[redacted]", "Secret" : "[redacted]"}`},
+		{"text=my+password+is+long", "text=my+password+is+long"},
+	}
+	for _, tt := range tests {
+		if got := string(redactBody([]byte(tt.body))); got != tt.want {
+			t.Errorf("redactBody(%q) = %q, want %q", tt.body, got, tt.want)
+		}
+	}
+}
+
+// parseICal unfolds an iCalendar document into its VTODOs' properties.
+func parseICal(t *testing.T, doc string) []map[string]string {
+	t.Helper()
+	if !strings.HasSuffix(doc, "\r\n") {
+		t.Fatal("document doesn't end with CRLF")
+	}
+	var todos []map[string]string
+	var cur map[string]string
+	for _, line := range strings.Split(strings.ReplaceAll(strings.TrimSuffix(doc, "\r\n"), "\r\n ", ""), "\r\n") {
+		parts := strings.SplitN(line, ":", 2)
+		switch {
+		case line == "BEGIN:VTODO":
+			cur = map[string]string{}
+		case line == "END:VTODO":
+			todos = append(todos, cur)
+			cur = nil
+		case cur != nil && len(parts) == 2:
+			cur[parts[0]] = parts[1]
+		}
+	}
+	return todos
+}
+
+func TestCalendarFeed(t *testing.T) {
+	svc := newInMemTodoService(newTestClock())
+	ctx := context.Background()
+	paris, err := time.LoadLocation("Europe/Paris")
+	if err != nil {
+		t.Fatal(err)
+	}
+	long := strings.TrimSpace(strings.Repeat("Réserver, le train; ", 6))
+	due := &todo{Text: long, DueAt: time.Date(2024, 3, 4, 0, 0, 0, 0, paris)}
+	pinned := &todo{Text: "Pay rent", DueAt: time.Date(2024, 3, 5, 0, 0, 0, 0, time.UTC), Pinned: true}
+	done := &todo{Text: "Walk the dog", DueAt: time.Date(2024, 3, 4, 0, 0, 0, 0, time.UTC)}
+	for _, td := range []*todo{due, pinned, done} {
+		if err := svc.createTodo(ctx, td); err != nil {
+			t.Fatal(err)
+		}
+	}
+	mustCreate(t, svc, ctx, "No due date")
+	yes := true
+	if _, err := svc.updateTodo(ctx, done.Id, todoUpdate{done: &yes}); err != nil {
+		t.Fatal(err)
+	}
+	_, h := newTestHandler(svc)
+
+	get := func(target string) string {
+		t.Helper()
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, httptest.NewRequest("GET", target, nil))
+		if ct := rec.Result().Header.Get("Content-Type"); rec.Code != 200 || ct != "text/calendar; charset=utf-8" {
+			t.Fatalf("status %d, Content-Type %q", rec.Code, ct)
+		}
+		return rec.Body.String()
+	}
+
+	doc := get("/todos.ics")
+	for _, line := range strings.Split(doc, "\r\n") {
+		if len(line) > 75 {
+			t.Errorf("line of %d octets: %q", len(line), line)
+		}
+		if !utf8.ValidString(line) {
+			t.Errorf("line splits a character: %q", line)
+		}
+	}
+	todos := parseICal(t, doc)
+	if len(todos) != 2 {
+		t.Fatalf("got %d VTODOs, want the 2 undone todos with a due date", len(todos))
+	}
+	var got map[string]string
+	for _, td := range todos {
+		if td["UID"] == fmt.Sprintf("todo-%d@example.com", due.Id) {
+			got = td
+		}
+	}
+	if got == nil {
+		t.Fatalf("no VTODO with todo %d's UID in %v", due.Id, todos)
+	}
+	if want := strings.NewReplacer(",", `\,`, ";", `\;`).Replace(long); got["SUMMARY"] != want {
+		t.Errorf("SUMMARY %q, want %q", got["SUMMARY"], want)
+	}
+	if got["DUE"] != "20240303T230000Z" {
+		t.Errorf("DUE %q, want midnight in Paris in UTC", got["DUE"])
+	}
+
+	todos = parseICal(t, get("/todos.ics?pinned=1"))
+	if len(todos) != 1 || todos[0]["SUMMARY"] != "Pay rent" {
+		t.Errorf("pinned filter gave %v, want just the pinned todo", todos)
+	}
+}
+
+func TestPlurals(t *testing.T) {
+	tests := []struct {
+		key  string
+		want map[string][4]string // for 0, 1, 2 and 5
+	}{
+		{"%d remaining", map[string][4]string{
+			"en": {"0 remaining", "1 remaining", "2 remaining", "5 remaining"},
+			"fr": {"0 restante", "1 restante", "2 restantes", "5 restantes"},
+		}},
+		{"Deleted %d todo(s).", map[string][4]string{
+			"en": {"Deleted 0 todos.", "Deleted 1 todo.", "Deleted 2 todos.", "Deleted 5 todos."},
+			"fr": {"0 tâches supprimées.", "1 tâche supprimée.", "2 tâches supprimées.", "5 tâches supprimées."},
+		}},
+		{"Marked %d todo(s) done.", map[string][4]string{
+			"en": {"Marked 0 todos done.", "Marked 1 todo done.", "Marked 2 todos done.", "Marked 5 todos done."},
+			"fr": {"0 tâche marquée terminée.", "1 tâche marquée terminée.", "2 tâches marquées terminées.", "5 tâches marquées terminées."},
+		}},
+		{"Showing %d todo item(s).", map[string][4]string{
+			"en": {"Showing 0 todo items.", "Showing 1 todo item.", "Showing 2 todo items.", "Showing 5 todo items."},
+			"fr": {"Affichage de 0 éléments à faire.", "Affichage de 1 élément à faire.", "Affichage de 2 éléments à faire.", "Affichage de 5 éléments à faire."},
+		}},
+	}
+	for _, tt := range tests {
+		for lang, want := range tt.want {
+			p := message.NewPrinter(language.MustParse(lang))
+			for i, n := range []int{0, 1, 2, 5} {
+				if got := p.Sprintf(tt.key, n); got != want[i] {
+					t.Errorf("%s %q with %d: %q, want %q", lang, tt.key, n, got, want[i])
+				}
+			}
+		}
+	}
+}
+
+func TestProgressFractionPlural(t *testing.T) {
+	p := message.NewPrinter(language.French)
+	if got, want := p.Sprintf("%d of %d done (%d%%)", 1, 4, 25), "1 sur 4 terminée (25 %)"; got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+	if got, want := p.Sprintf("%d of %d done (%d%%)", 3, 4, 75), "3 sur 4 terminées (75 %)"; got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
+
+func TestLocalizedDates(t *testing.T) {
+	day := time.Date(2024, 3, 1, 9, 0, 0, 0, time.UTC)
+	en, fr := message.NewPrinter(language.English), message.NewPrinter(language.French)
+	for _, tt := range []struct{ got, want string }{
+		{formatDay(en, day), "Friday, March 1, 2024"},
+		{formatDay(fr, day), "vendredi 1 mars 2024"},
+		{formatDate(en, day), "March 1, 2024"},
+		{formatDate(fr, day), "1 mars 2024"},
+	} {
+		if tt.got != tt.want {
+			t.Errorf("got %q, want %q", tt.got, tt.want)
+		}
+	}
+}
+
+func TestFilterLabelsAreTranslated(t *testing.T) {
+	var labels []string
+	for _, f := range getParamFilters(message.NewPrinter(language.French)) {
+		labels = append(labels, f.Label)
+	}
+	if got, want := strings.Join(labels, ", "), "Tout, Restant, Complété, Complété aujourd'hui, Corbeille, En retard, Épinglées"; got != want {
+		t.Errorf("labels %s, want %s", got, want)
+	}
+
+	svc := newInMemTodoService(newTestClock())
+	mustCreate(t, svc, context.Background(), "Walk the dog")
+	mustCreate(t, svc, context.Background(), "Feed the cat")
+	_, h := newTestHandler(svc)
+	req := httptest.NewRequest("GET", "/todos/", nil)
+	req.Header.Set("Accept-Language", "fr")
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, req)
+	for _, want := range []string{"2 restantes", `aria-label="Filtrer les tâches: Tout"`} {
+		if !strings.Contains(rec.Body.String(), want) {
+			t.Errorf("French list page has no %q", want)
+		}
+	}
+}
+
+// writeConfig writes a config file for parseConfig to read.
+func writeConfig(t *testing.T, body string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "config.json")
+	if err := os.WriteFile(path, []byte(body), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestConfigFile(t *testing.T) {
+	path := writeConfig(t, `{
+		"port": 9000,
+		"csrf": "`+strings.Repeat("k", 32)+`",
+		"timezone": "Europe/Paris",
+		"request_timeout": "5s",
+		"max_todos": 50
+	}`)
+
+	c, err := parseConfig("htmx-go", []string{"-config", path})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c.Port != 9000 || c.Timezone != "Europe/Paris" || c.RequestTimeout.Duration != 5*time.Second || c.MaxTodos != 50 {
+		t.Errorf("config = %+v, want the file's values", c)
+	}
+	if def := defaultConfig(); c.Host != def.Host || c.WriteTimeout != def.WriteTimeout {
+		t.Errorf("config = %+v, want defaults for what the file leaves out", c)
+	}
+
+	// flags given on the command line win, the others don't reset the file
+	c, err = parseConfig("htmx-go", []string{"-config", path, "-port", "9100", "-request-timeout", "1m"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c.Port != 9100 || c.RequestTimeout.Duration != time.Minute || c.Timezone != "Europe/Paris" || c.MaxTodos != 50 {
+		t.Errorf("config = %+v, want the flags over the file", c)
+	}
+}
+
+func TestConfigFileRejected(t *testing.T) {
+	key := strings.Repeat("k", 32)
+	tests := []struct {
+		name string
+		body string
+		want []string
+	}{
+		{"unknown field", `{"csrf": "` + key + `", "prot": 80}`, []string{`unknown field "prot"`}},
+		{"bad duration", `{"csrf": "` + key + `", "request_timeout": 30}`, []string{"duration must be a string"}},
+		{"not json", `port = 80`, []string{"decoding config"}},
+		{"out of range", `{"csrf": "` + key + `", "port": 70000, "max_todos": -1, "log_level": "loud"}`, []string{
+			"port 70000 out of range",
+			"max todos must not be negative",
+			`unknown log level "loud"`,
+		}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := parseConfig("htmx-go", []string{"-config", writeConfig(t, tt.body)})
+			if err == nil {
+				t.Fatal("config accepted")
+			}
+			for _, want := range tt.want {
+				if !strings.Contains(err.Error(), want) {
+					t.Errorf("error %q doesn't mention %q", err, want)
+				}
+			}
+		})
+	}
+}
+
+func TestPurgeExpired(t *testing.T) {
+	clock := newTestClock()
+	svc := newInMemTodoService(clock)
+	ctx := ownerContext("alice")
+	old := mustCreate(t, svc, ctx, "Walk the dog")
+	recent := mustCreate(t, svc, ctx, "Feed the cat")
+	kept := mustCreate(t, svc, ctx, "Call your mom")
+	// another owner's trash is purged too
+	bobs := mustCreate(t, svc, ownerContext("bob"), "Water the plants")
+	if err := svc.deleteTodo(ctx, old.Id); err != nil {
+		t.Fatal(err)
+	}
+	if err := svc.deleteTodo(ownerContext("bob"), bobs.Id); err != nil {
+		t.Fatal(err)
+	}
+	clock.advance(10 * 24 * time.Hour)
+	if err := svc.deleteTodo(ctx, recent.Id); err != nil {
+		t.Fatal(err)
+	}
+	clock.advance(24 * time.Hour)
+
+	n, err := svc.purgeExpired(context.Background(), clock.Now().Add(-5*24*time.Hour))
+	if err != nil || n != 2 {
+		t.Fatalf("purged %d todos (%v), want 2", n, err)
+	}
+	if _, err := svc.getTodoById(ctx, old.Id); !errors.Is(err, errTodoNotFound) {
+		t.Errorf("todo deleted 11 days ago: got %v, want it gone", err)
+	}
+	for _, td := range []*todo{recent, kept} {
+		if _, err := svc.getTodoById(ctx, td.Id); err != nil {
+			t.Errorf("%q: %v, want it kept", td.Text, err)
+		}
+	}
+}
+
+func TestPurgeTrashStops(t *testing.T) {
+	s, _ := newTestHandler(newInMemTodoService(newTestClock()))
+	ctx, cancel := context.WithCancel(context.Background())
+	stopped := make(chan struct{})
+	go func() {
+		s.purgeTrash(ctx, time.Hour, time.Millisecond)
+		close(stopped)
+	}()
+	cancel()
+	select {
+	case <-stopped:
+	case <-time.After(5 * time.Second):
+		t.Fatal("purge kept running after its context was done")
+	}
+}
+
+func TestResolveClientIP(t *testing.T) {
+	trusted, err := parseCIDRs("10.0.0.0/8, 192.0.2.1, 2001:db8::/32")
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name    string
+		remote  string
+		xff     []string
+		realIP  string
+		trusted []*net.IPNet
+		want    string
+	}{
+		{"no proxies trusted", "192.0.2.1:1234", []string{"203.0.113.7"}, "", nil, "192.0.2.1"},
+		{"untrusted peer", "198.51.100.9:1234", []string{"203.0.113.7"}, "203.0.113.8", trusted, "198.51.100.9"},
+		{"trusted proxy", "192.0.2.1:1234", []string{"203.0.113.7"}, "", trusted, "203.0.113.7"},
+		{"proxy chain", "10.0.0.1:1234", []string{"203.0.113.7, 10.0.0.2"}, "", trusted, "203.0.113.7"},
+		{"spoofed first hop", "10.0.0.1:1234", []string{"1.2.3.4, 203.0.113.7"}, "", trusted, "203.0.113.7"},
+		{"several headers", "10.0.0.1:1234", []string{"203.0.113.7", "10.0.0.2"}, "", trusted, "203.0.113.7"},
+		{"only proxies", "10.0.0.1:1234", []string{"10.0.0.3, 10.0.0.2"}, "", trusted, "10.0.0.3"},
+		{"garbage hop", "10.0.0.1:1234", []string{"not-an-ip"}, "203.0.113.8", trusted, "203.0.113.8"},
+		{"X-Real-IP", "192.0.2.1:1234", nil, "203.0.113.8", trusted, "203.0.113.8"},
+		{"nothing forwarded", "192.0.2.1:1234", nil, "", trusted, "192.0.2.1"},
+		{"IPv6 proxy", "[2001:db8::1]:1234", []string{"2001:470::9, 2001:db8::2"}, "", trusted, "2001:470::9"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest("GET", "/", nil)
+			r.RemoteAddr = tt.remote
+			for _, v := range tt.xff {
+				r.Header.Add("X-Forwarded-For", v)
+			}
+			if tt.realIP != "" {
+				r.Header.Set("X-Real-IP", tt.realIP)
+			}
+			var got string
+			withClientIP(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				got = clientIP(r)
+			}), tt.trusted).ServeHTTP(httptest.NewRecorder(), r)
+			if got != tt.want {
+				t.Errorf("client IP %s, want %s", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestParseCIDRs(t *testing.T) {
+	nets, err := parseCIDRs(" 10.0.0.0/8 ,192.0.2.1,, ::1 ")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got []string
+	for _, n := range nets {
+		got = append(got, n.String())
+	}
+	if want := "10.0.0.0/8 192.0.2.1/32 ::1/128"; strings.Join(got, " ") != want {
+		t.Errorf("got %v, want %s", got, want)
+	}
+	for _, bad := range []string{"10.0.0.0/33", "localhost"} {
+		if _, err := parseCIDRs(bad); err == nil {
+			t.Errorf("%q accepted", bad)
+		}
+	}
+}
+
+func TestDeleteTokensAreCapped(t *testing.T) {
+	clock := newTestClock()
+	tokens := newDeleteTokens(time.Minute, 3)
+	var issued []string
+	for id := uint64(1); id <= 5; id++ {
+		issued = append(issued, tokens.issue(id, clock.Now()))
+		clock.advance(time.Second)
+	}
+	if n := len(tokens.tokens); n != 3 {
+		t.Errorf("holding %d tokens, want the cap of 3", n)
+	}
+	for i, token := range issued {
+		id := uint64(i + 1)
+		want := id > 2
+		if got := tokens.consume(token, id, clock.Now()); got != want {
+			t.Errorf("token for todo %d: consumed %v, want %v", id, got, want)
+		}
+	}
+
+	tokens.issue(6, clock.Now())
+	clock.advance(time.Minute)
+	tokens.issue(7, clock.Now())
+	if n := len(tokens.tokens); n != 1 {
+		t.Errorf("holding %d tokens, want the expired one swept", n)
+	}
+}
+
+func TestIdempotencyKeysAreOwned(t *testing.T) {
+	store := newIdempotencyStore(time.Minute, 10)
+	now := newTestClock().Now()
+	next := uint64(0)
+	create := func() (uint64, error) {
+		next++
+		return next, nil
+	}
+	alice, _, _ := store.do("alice", "key", now, create)
+	bob, created, _ := store.do("bob", "key", now, create)
+	if !created || bob == alice {
+		t.Errorf("bob's create with alice's key returned todo %d (created %v), want a new todo", bob, created)
+	}
+	again, created, _ := store.do("alice", "key", now, create)
+	if created || again != alice {
+		t.Errorf("alice's retry returned todo %d (created %v), want her todo %d", again, created, alice)
+	}
+}
+
+func TestIdempotencyRetriesWaitForCreate(t *testing.T) {
+	store := newIdempotencyStore(time.Minute, 10)
+	now := newTestClock().Now()
+	release := make(chan struct{})
+	var calls int32
+	var mu sync.Mutex
+	slow := func() (uint64, error) {
+		mu.Lock()
+		calls++
+		mu.Unlock()
+		<-release
+		return 42, nil
+	}
+
+	var wg sync.WaitGroup
+	ids := make([]uint64, 8)
+	createdBy := make([]bool, 8)
+	for i := range ids {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			ids[i], createdBy[i], _ = store.do("alice", "slow", now, slow)
+		}(i)
+	}
+
+	// another key goes through while the slow create is in progress
+	other := make(chan uint64)
+	go func() {
+		id, _, _ := store.do("alice", "other", now, func() (uint64, error) { return 7, nil })
+		other <- id
+	}()
+	select {
+	case id := <-other:
+		if id != 7 {
+			t.Errorf("other key got todo %d, want 7", id)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("a create with another key waited for the slow one")
+	}
+
+	close(release)
+	wg.Wait()
+	if calls != 1 {
+		t.Errorf("create called %d times, want once", calls)
+	}
+	n := 0
+	for i, id := range ids {
+		if id != 42 {
+			t.Errorf("call %d got todo %d, want 42", i, id)
+		}
+		if createdBy[i] {
+			n++
+		}
+	}
+	if n != 1 {
+		t.Errorf("%d calls reported creating the todo, want 1", n)
+	}
+}
+
+func TestIdempotencyRetriesFailedCreate(t *testing.T) {
+	store := newIdempotencyStore(time.Minute, 10)
+	now := newTestClock().Now()
+	errFull := errors.New("full")
+	if _, _, err := store.do("alice", "key", now, func() (uint64, error) { return 0, errFull }); err != errFull {
+		t.Fatalf("got error %v, want the create's", err)
+	}
+	id, created, err := store.do("alice", "key", now, func() (uint64, error) { return 3, nil })
+	if err != nil || !created || id != 3 {
+		t.Errorf("retry after a failed create: todo %d, created %v, error %v; want a new todo 3", id, created, err)
+	}
+}
+
+// failingCreates fails the first fail creates.
+type failingCreates struct {
+	todoService
+	fail int
+}
+
+func (s *failingCreates) createTodo(ctx context.Context, todo *todo) error {
+	if s.fail > 0 {
+		s.fail--
+		return errors.New("store unavailable")
+	}
+	return s.todoService.createTodo(ctx, todo)
+}
+
+func TestIdempotentCreateOverHTTP(t *testing.T) {
+	svc := newInMemTodoService(newTestClock())
+	failing := &failingCreates{todoService: svc}
+	s := newServer(embeddedTemplates(), "", failing)
+	cfg := defaultConfig()
+	cfg.CSRFAuthKey = strings.Repeat("k", 32)
+	cfg.OwnerHeader = "X-Remote-User"
+	cfg.TrustedProxies = "192.0.2.0/24"
+	h := s.handler(cfg, true)
+
+	create := func(owner, key string) (int, uint64) {
+		t.Helper()
+		req := newTestRequest(t, h, "POST", "/todos/", url.Values{"new-todo": {"Walk the dog"}})
+		req.Header.Set("Accept", "application/json")
+		req.Header.Set("Idempotency-Key", key)
+		req.Header.Set("X-Remote-User", owner)
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, req)
+		var got todoDTO
+		if rec.Code == 201 {
+			if err := json.NewDecoder(rec.Body).Decode(&got); err != nil {
+				t.Fatal(err)
+			}
+		}
+		return rec.Code, got.Id
+	}
+	count := func(owner string) int {
+		t.Helper()
+		n, err := svc.countTodos(ownerContext(owner), todoFilter{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return n
+	}
+
+	code, first := create("alice", "key-1")
+	if code != 201 {
+		t.Fatalf("create: status %d, want 201", code)
+	}
+	if code, again := create("alice", "key-1"); code != 201 || again != first {
+		t.Errorf("replay: status %d, todo %d; want 201 and todo %d", code, again, first)
+	}
+	if n := count("alice"); n != 1 {
+		t.Errorf("alice has %d todos after a replay, want 1", n)
+	}
+
+	if code, bobs := create("bob", "key-1"); code != 201 || bobs == first {
+		t.Errorf("bob with alice's key: status %d, todo %d; want a todo of his own", code, bobs)
+	}
+	if n := count("bob"); n != 1 {
+		t.Errorf("bob has %d todos, want 1", n)
+	}
+
+	failing.fail = 1
+	if code, _ := create("alice", "key-2"); code != 500 {
+		t.Errorf("failed create: status %d, want 500", code)
+	}
+	if code, retried := create("alice", "key-2"); code != 201 || retried == first {
+		t.Errorf("retry after a failure: status %d, todo %d; want a new todo", code, retried)
+	}
+	if n := count("alice"); n != 2 {
+		t.Errorf("alice has %d todos, want 2", n)
+	}
+}
+
+func TestQuickAddReplaysCreatedTodos(t *testing.T) {
+	svc := newInMemTodoService(newTestClock())
+	_, h := newTestHandler(svc)
+	add := func() []uint64 {
+		t.Helper()
+		form := url.Values{"new-todo": {"Walk the dog\n\nFeed the cat"}, "multi": {"1"}}
+		req := newTestRequest(t, h, "POST", "/todos/", form)
+		req.Header.Set("Accept", "application/json")
+		req.Header.Set("Idempotency-Key", "paste-1")
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, req)
+		if rec.Code != 201 {
+			t.Fatalf("status %d, want 201", rec.Code)
+		}
+		var body struct {
+			Created []todoDTO `json:"created"`
+		}
+		if err := json.NewDecoder(rec.Body).Decode(&body); err != nil {
+			t.Fatal(err)
+		}
+		var ids []uint64
+		for _, td := range body.Created {
+			ids = append(ids, td.Id)
+		}
+		return ids
+	}
+
+	first := add()
+	if len(first) != 2 {
+		t.Fatalf("created %v, want two todos", first)
+	}
+	if again := add(); fmt.Sprint(again) != fmt.Sprint(first) {
+		t.Errorf("replay answered %v, want %v", again, first)
+	}
+	if n, err := svc.countTodos(context.Background(), todoFilter{}); err != nil || n != 2 {
+		t.Errorf("store has %d todos (%v), want 2", n, err)
+	}
+}
+
+func TestFailedLoginPage(t *testing.T) {
+	s, h := newTestHandler(newInMemTodoService(newTestClock()))
+	s.sessions = newSessions("secret", sessionTTL, maxSessions)
+	req := newTestRequest(t, h, "POST", "/login", url.Values{"password": {"wrong"}})
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, req)
+	if rec.Code != 401 {
+		t.Errorf("status %d, want 401", rec.Code)
+	}
+	// the headers as sent, not as set after the fact
+	header := rec.Result().Header
+	if ct := header.Get("Content-Type"); !strings.HasPrefix(ct, "text/html") {
+		t.Errorf("Content-Type %q, want text/html", ct)
+	}
+	if cl := header.Get("Content-Length"); cl != fmt.Sprint(rec.Body.Len()) {
+		t.Errorf("Content-Length %q, want %d", cl, rec.Body.Len())
+	}
+	if !strings.Contains(rec.Body.String(), `name="password"`) {
+		t.Errorf("body isn't the login page:\n%s", rec.Body)
+	}
+}
+
+func TestLoginFlow(t *testing.T) {
+	clock := newTestClock()
+	s := newServer(embeddedTemplates(), "", newInMemTodoService(clock))
+	s.clock = clock
+	s.sessions = newSessions("secret", sessionTTL, maxSessions)
+	cfg := defaultConfig()
+	cfg.CSRFAuthKey = strings.Repeat("k", 32)
+	h := s.handler(cfg, true)
+	get := func(session *http.Cookie, accept string) *httptest.ResponseRecorder {
+		t.Helper()
+		req := httptest.NewRequest("GET", "/todos/", nil)
+		if session != nil {
+			req.AddCookie(session)
+		}
+		if accept != "" {
+			req.Header.Set("Accept", accept)
+		}
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, req)
+		return rec
+	}
+	wantLogin := func(step string, rec *httptest.ResponseRecorder) {
+		t.Helper()
+		if loc := rec.Result().Header.Get("Location"); rec.Code != 303 || loc != "/login?next=%2Ftodos%2F" {
+			t.Errorf("%s: status %d to %q, want 303 to the login page", step, rec.Code, loc)
+		}
+	}
+
+	wantLogin("logged out", get(nil, ""))
+	if rec := get(nil, "application/json"); rec.Code != 401 {
+		t.Errorf("logged out API call: status %d, want 401", rec.Code)
+	}
+
+	req := newTestRequest(t, h, "POST", "/login", url.Values{"password": {"secret"}, "next": {"/todos/"}})
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, req)
+	if loc := rec.Result().Header.Get("Location"); rec.Code != 303 || loc != "/todos/" {
+		t.Fatalf("login: status %d to %q, want 303 to /todos/", rec.Code, loc)
+	}
+	var session *http.Cookie
+	for _, c := range rec.Result().Cookies() {
+		if c.Name == sessionCookieName {
+			session = c
+		}
+	}
+	if session == nil || session.Value == "" {
+		t.Fatal("login set no session cookie")
+	}
+
+	if rec := get(session, ""); rec.Code != 200 {
+		t.Errorf("logged in: status %d, want 200", rec.Code)
+	}
+
+	req = newTestRequest(t, h, "POST", "/logout", nil)
+	req.AddCookie(session)
+	rec = httptest.NewRecorder()
+	h.ServeHTTP(rec, req)
+	if rec.Code != 303 {
+		t.Errorf("logout: status %d, want 303", rec.Code)
+	}
+	for _, c := range rec.Result().Cookies() {
+		if c.Name == sessionCookieName && c.MaxAge >= 0 {
+			t.Errorf("logout kept the session cookie: %v", c)
+		}
+	}
+	wantLogin("after logout", get(session, ""))
+
+	// sessions also end on their own
+	id := s.sessions.start(clock.Now())
+	clock.advance(sessionTTL)
+	wantLogin("expired session", get(&http.Cookie{Name: sessionCookieName, Value: id}, ""))
+}
+
+func TestCacheControl(t *testing.T) {
+	_, h := newTestHandler(newInMemTodoService(newTestClock()))
+	tests := []struct {
+		name   string
+		method string
+		target string
+		htmx   bool
+		want   string
+	}{
+		{"index", "GET", "/", false, "private, max-age=300"},
+		{"index head", "HEAD", "/", false, "private, max-age=300"},
+		{"index fragment", "GET", "/", true, "no-store"},
+		{"list fragment", "GET", "/todos/", true, "no-store"},
+		{"list page", "GET", "/todos/", false, "no-store"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			req := httptest.NewRequest(tt.method, tt.target, nil)
+			if tt.htmx {
+				req.Header.Set("HX-Request", "true")
+			}
+			rec := httptest.NewRecorder()
+			h.ServeHTTP(rec, req)
+			res := rec.Result()
+			if got := res.Header.Get("Cache-Control"); got != tt.want {
+				t.Errorf("Cache-Control %q, want %q", got, tt.want)
+			}
+			if vary := strings.Join(res.Header.Values("Vary"), ", "); !strings.Contains(vary, "Accept-Language") {
+				t.Errorf("Vary %q doesn't name Accept-Language", vary)
+			}
+		})
+	}
+}
+
+func TestCacheControlFlags(t *testing.T) {
+	cfg := defaultConfig()
+	flags := flag.NewFlagSet("htmx-go", flag.ContinueOnError)
+	cfg.registerFlags(flags)
+	if err := flags.Parse([]string{"-index-cache-control", "public, max-age=60", "-cache-control", ""}); err != nil {
+		t.Fatal(err)
+	}
+	cfg.CSRFAuthKey = strings.Repeat("k", 32)
+	svc := newInMemTodoService(newTestClock())
+	h := newServer(embeddedTemplates(), "", svc).handler(cfg, true)
+
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest("GET", "/", nil))
+	if got := rec.Result().Header.Get("Cache-Control"); got != "public, max-age=60" {
+		t.Errorf("index Cache-Control %q, want the flag's", got)
+	}
+	req := httptest.NewRequest("GET", "/todos/", nil)
+	req.Header.Set("HX-Request", "true")
+	rec = httptest.NewRecorder()
+	h.ServeHTTP(rec, req)
+	if got, ok := rec.Result().Header["Cache-Control"]; ok {
+		t.Errorf("list fragment Cache-Control %q, want none", got)
+	}
+
+	// changes answer with fragments too, which mustn't be cached
+	_, h = newTestHandler(svc)
+	req = newTestRequest(t, h, "POST", "/todos/", url.Values{"new-todo": {"Walk the dog"}})
+	req.Header.Set("HX-Request", "true")
+	rec = httptest.NewRecorder()
+	h.ServeHTTP(rec, req)
+	if got := rec.Result().Header.Get("Cache-Control"); got != "no-store" {
+		t.Errorf("create fragment Cache-Control %q, want no-store", got)
+	}
+}
+
+func TestCORSOnlyForAPI(t *testing.T) {
+	const origin = "https://app.example.com"
+	h := withCORS(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}), []string{origin})
+	tests := []struct {
+		name      string
+		method    string
+		path      string
+		origin    string
+		accept    string
+		htmx      bool
+		wantAllow bool
+	}{
+		{"json", "GET", "/todos/", origin, "application/json", false, true},
+		{"json change", "DELETE", "/todos/1/", origin, "application/json", false, true},
+		{"calendar", "GET", "/todos.ics", origin, "text/calendar", false, true},
+		{"preflight", "OPTIONS", "/todos/1/", origin, "", false, true},
+		{"page", "GET", "/todos/", origin, "text/html", false, false},
+		{"no accept", "GET", "/todos/", origin, "", false, false},
+		{"htmx fragment", "GET", "/todos/", origin, "application/json", true, false},
+		{"other origin", "GET", "/todos/", "https://evil.example.com", "application/json", false, false},
+		{"outside the api", "GET", "/settings", origin, "application/json", false, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest(tt.method, tt.path, nil)
+			r.Header.Set("Origin", tt.origin)
+			if tt.accept != "" {
+				r.Header.Set("Accept", tt.accept)
+			}
+			if tt.htmx {
+				r.Header.Set("HX-Request", "true")
+			}
+			if tt.method == "OPTIONS" {
+				r.Header.Set("Access-Control-Request-Method", "DELETE")
+			}
+			rec := httptest.NewRecorder()
+			h.ServeHTTP(rec, r)
+			allow := rec.Header().Get("Access-Control-Allow-Origin")
+			if got := allow == origin; got != tt.wantAllow {
+				t.Errorf("Access-Control-Allow-Origin %q, want allowed %v", allow, tt.wantAllow)
+			}
+		})
+	}
+}
+
+func TestPutTodoKeepsOmittedFields(t *testing.T) {
+	svc := newInMemTodoService(newTestClock())
+	_, h := newTestHandler(svc)
+	id := uint64(minClientTodoId + 1)
+	put := func(form url.Values) (int, todoDTO) {
+		t.Helper()
+		req := newTestRequest(t, h, "PUT", fmt.Sprintf("/todos/%d/", id), form)
+		req.Header.Set("Accept", "application/json")
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, req)
+		var got todoDTO
+		if rec.Code/100 == 2 {
+			if err := json.Unmarshal(rec.Body.Bytes(), &got); err != nil {
+				t.Fatal(err)
+			}
+		}
+		return rec.Code, got
+	}
+
+	if code, _ := put(url.Values{"pinned": {"true"}}); code != 422 {
+		t.Errorf("creating without text: status %d, want 422", code)
+	}
+	code, got := put(url.Values{
+		"text":       {"Water the plants"},
+		"pinned":     {"true"},
+		"due":        {"2024-03-05"},
+		"recurrence": {"weekly"},
+	})
+	if code != 201 {
+		t.Fatalf("creating: status %d, want 201", code)
+	}
+	if got.Id != id || !got.Pinned || got.DueAt == nil || got.Recurrence != "weekly" {
+		t.Fatalf("created %+v, want it pinned, due and weekly", got)
+	}
+
+	code, got = put(url.Values{"text": {"Water the garden"}})
+	if code != 200 {
+		t.Fatalf("updating the text: status %d, want 200", code)
+	}
+	if got.Text != "Water the garden" || !got.Pinned || got.DueAt == nil || got.Recurrence != "weekly" {
+		t.Errorf("after updating the text: %+v, want the other fields kept", got)
+	}
+
+	code, got = put(url.Values{})
+	if code != 200 || got.Text != "Water the garden" || !got.Pinned {
+		t.Errorf("empty put: status %d, %+v, want nothing changed", code, got)
+	}
+
+	code, got = put(url.Values{"pinned": {"false"}, "due": {""}, "recurrence": {""}})
+	if code != 200 {
+		t.Fatalf("clearing: status %d, want 200", code)
+	}
+	if got.Pinned || got.DueAt != nil || got.Recurrence != "" || got.Text != "Water the garden" {
+		t.Errorf("after clearing: %+v, want it unpinned without due date or recurrence", got)
+	}
+
+	if code, _ := put(url.Values{"done": {"maybe"}}); code != 400 {
+		t.Errorf("bad done value: status %d, want 400", code)
+	}
+	id = 12345
+	if code, _ := put(url.Values{"text": {"outside the client range"}}); code != 404 {
+		t.Errorf("unknown id below the client range: status %d, want 404", code)
+	}
+}
+
+func TestCrossOriginAPIChanges(t *testing.T) {
+	const origin = "https://app.example.com"
+	tests := []struct {
+		name       string
+		origin     string
+		accept     string
+		wantStatus int
+	}{
+		{"allowed origin", origin, "application/json", 201},
+		{"allowed origin asking for html", origin, "text/html", 403},
+		{"other origin", "https://evil.example.com", "application/json", 403},
+		{"no origin", "", "application/json", 403},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			svc := newInMemTodoService(newTestClock())
+			s := newServer(embeddedTemplates(), "", svc)
+			cfg := defaultConfig()
+			cfg.CSRFAuthKey = strings.Repeat("k", 32)
+			cfg.CORSOrigins = origin
+			h := s.handler(cfg, false)
+
+			r := httptest.NewRequest("POST", "/todos/", strings.NewReader("new-todo=Walk+the+dog"))
+			r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+			r.Header.Set("Accept", tt.accept)
+			if tt.origin != "" {
+				r.Header.Set("Origin", tt.origin)
+			}
+			rec := httptest.NewRecorder()
+			h.ServeHTTP(rec, r)
+			if rec.Code != tt.wantStatus {
+				t.Fatalf("status %d, want %d: %s", rec.Code, tt.wantStatus, rec.Body)
+			}
+			n, _ := svc.countTodos(context.Background(), todoFilter{})
+			if created := n == 1; created != (tt.wantStatus == 201) {
+				t.Errorf("got %d todos after a %d", n, rec.Code)
+			}
+			if tt.wantStatus == 201 && rec.Header().Get("Access-Control-Allow-Origin") != origin {
+				t.Errorf("Access-Control-Allow-Origin %q, want %s", rec.Header().Get("Access-Control-Allow-Origin"), origin)
+			}
+		})
+	}
+}
+
+// blockingCounter is a service whose counts wait for release, recording
+// how often they ran and whether their context was done by then.
+type blockingCounter struct {
+	todoService
+	entered chan struct{}
+	release chan struct{}
+
+	mu        sync.Mutex
+	calls     int
+	cancelled bool
+}
+
+func newBlockingCounter() *blockingCounter {
+	return &blockingCounter{
+		todoService: newInMemTodoService(newTestClock()),
+		entered:     make(chan struct{}, 100),
+		release:     make(chan struct{}),
+	}
+}
+
+func (s *blockingCounter) countTodos(ctx context.Context, filter todoFilter) (int, error) {
+	s.entered <- struct{}{}
+	<-s.release
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.calls++
+	if ctx.Err() != nil {
+		s.cancelled = true
+		return 0, ctx.Err()
+	}
+	return 3, nil
+}
+
+func TestFilterKeyIgnoresExcludeOrder(t *testing.T) {
+	a := todoFilter{excludeIds: []uint64{3, 1, 2}}
+	b := todoFilter{excludeIds: []uint64{2, 3, 1}}
+	if a.key() != b.key() {
+		t.Errorf("keys differ: %q and %q", a.key(), b.key())
+	}
+	if a.excludeIds[0] != 3 {
+		t.Error("key() reordered the filter's ids")
+	}
+	if c := (todoFilter{excludeIds: []uint64{1, 2}}); c.key() == a.key() {
+		t.Error("different ids give the same key")
+	}
+}
+
+func TestCoalescingSharesCounts(t *testing.T) {
+	inner := newBlockingCounter()
+	svc := newCoalescingTodoService(inner)
+	const callers = 8
+	var started, finished sync.WaitGroup
+	counts := make([]int, callers)
+	errs := make([]error, callers)
+	for i := 0; i < callers; i++ {
+		started.Add(1)
+		finished.Add(1)
+		go func(i int) {
+			defer finished.Done()
+			started.Done()
+			counts[i], errs[i] = svc.countTodos(context.Background(), todoFilter{excludeIds: []uint64{uint64(i % 2), 5}})
+		}(i)
+	}
+	started.Wait()
+	<-inner.entered
+	// let the other callers reach the call in progress
+	time.Sleep(50 * time.Millisecond)
+	close(inner.release)
+	finished.Wait()
+
+	for i := range counts {
+		if errs[i] != nil || counts[i] != 3 {
+			t.Errorf("caller %d: %d, %v; want 3", i, counts[i], errs[i])
+		}
+	}
+	// the two sets of excluded ids make two distinct counts
+	if inner.calls > 2 {
+		t.Errorf("%d counts for %d callers, want them shared", inner.calls, callers)
+	}
+}
+
+func TestCoalescingCancelledCallerLeavesOthers(t *testing.T) {
+	inner := newBlockingCounter()
+	svc := newCoalescingTodoService(inner)
+	ctx, cancel := context.WithCancel(context.Background())
+	first := make(chan error, 1)
+	go func() {
+		_, err := svc.countTodos(ctx, todoFilter{})
+		first <- err
+	}()
+	<-inner.entered
+
+	second := make(chan int, 1)
+	go func() {
+		n, err := svc.countTodos(context.Background(), todoFilter{})
+		if err != nil {
+			t.Errorf("second caller: %v", err)
+		}
+		second <- n
+	}()
+	time.Sleep(20 * time.Millisecond)
+
+	cancel()
+	select {
+	case err := <-first:
+		if !errors.Is(err, context.Canceled) {
+			t.Errorf("cancelled caller got %v, want context.Canceled", err)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("the cancelled caller kept waiting for the shared count")
+	}
+
+	close(inner.release)
+	if n := <-second; n != 3 {
+		t.Errorf("second caller got %d, want 3", n)
+	}
+	if inner.cancelled {
+		t.Error("the shared count ran with the cancelled caller's context")
+	}
+}
+
+func TestTrashedTodosCantBeChanged(t *testing.T) {
+	svc := newInMemTodoService(newTestClock())
+	ctx := context.Background()
+	trashed := mustCreate(t, svc, ctx, "Walk the dog")
+	if err := svc.deleteTodo(ctx, trashed.Id); err != nil {
+		t.Fatal(err)
+	}
+	text := "changed"
+	changes := map[string]func() error{
+		"updateTodo": func() error {
+			_, err := svc.updateTodo(ctx, trashed.Id, todoUpdate{text: &text})
+			return err
+		},
+		"snoozeTodo": func() error {
+			_, err := svc.snoozeTodo(ctx, trashed.Id, time.Now().Add(time.Hour))
+			return err
+		},
+		"putTodo": func() error {
+			_, _, err := svc.putTodo(ctx, trashed.Id, todoUpdate{text: &text})
+			return err
+		},
+	}
+	for name, change := range changes {
+		if err := change(); !errors.Is(err, errTodoNotFound) {
+			t.Errorf("%s on a trashed todo: got %v, want errTodoNotFound", name, err)
+		}
+	}
+
+	_, h := newTestHandler(svc)
+	req := newTestRequest(t, h, "PUT", fmt.Sprintf("/todos/%d/", trashed.Id), url.Values{"text": {text}})
+	req.Header.Set("Accept", "application/json")
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, req)
+	if rec.Code != 404 {
+		t.Errorf("PUT to a trashed todo: status %d, want 404", rec.Code)
+	}
+
+	got, err := svc.getTodoById(ctx, trashed.Id)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.Text != "Walk the dog" || !got.SnoozedUntil.IsZero() || !got.Deleted {
+		t.Errorf("trashed todo changed: %+v", got)
+	}
+}
+
+func TestStatsAndMetricsCoverEveryOwner(t *testing.T) {
+	svc := newInMemTodoService(newTestClock())
+	alice, bob := ownerContext("alice"), ownerContext("bob")
+	mustCreate(t, svc, alice, "Walk the dog")
+	snoozed := mustCreate(t, svc, alice, "Call the dentist")
+	if _, err := svc.snoozeTodo(alice, snoozed.Id, svc.clock.Now().Add(time.Hour)); err != nil {
+		t.Fatal(err)
+	}
+	done := mustCreate(t, svc, bob, "Feed the cat")
+	yes := true
+	if _, err := svc.updateTodo(bob, done.Id, todoUpdate{done: &yes}); err != nil {
+		t.Fatal(err)
+	}
+
+	stats, err := svc.stats(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if stats.Total != 3 || stats.Done != 1 || stats.Remaining != 2 {
+		t.Errorf("stats = %+v, want 3 todos of both owners, 1 done", stats)
+	}
+
+	s, h := newTestHandler(svc)
+	s.metrics = newMetrics()
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest("GET", "/metrics", nil))
+	if !regexp.MustCompile(`(?m)^todos 3$`).MatchString(rec.Body.String()) {
+		t.Errorf("metrics don't count all 3 todos:\n%s", rec.Body)
+	}
+}
+
+func TestStats(t *testing.T) {
+	clock := newTestClock()
+	svc := newInMemTodoService(clock)
+	ctx := context.Background()
+	yes := true
+
+	// yesterday's todo, done a day later
+	clock.now = clock.now.AddDate(0, 0, -1)
+	old := mustCreate(t, svc, ctx, "Walk the dog")
+	clock.advance(24 * time.Hour)
+	if _, err := svc.updateTodo(ctx, old.Id, todoUpdate{done: &yes}); err != nil {
+		t.Fatal(err)
+	}
+	// today's, one done in two hours, one open and one deleted
+	quick := mustCreate(t, svc, ctx, "Feed the cat")
+	mustCreate(t, svc, ctx, "Call your mom")
+	trashed := mustCreate(t, svc, ctx, "Water the plants")
+	if err := svc.deleteTodo(ctx, trashed.Id); err != nil {
+		t.Fatal(err)
+	}
+	clock.advance(2 * time.Hour)
+	if _, err := svc.updateTodo(ctx, quick.Id, todoUpdate{done: &yes}); err != nil {
+		t.Fatal(err)
+	}
+
+	got, err := svc.stats(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := todoStats{
+		Total:             3,
+		Done:              2,
+		Remaining:         1,
+		Deleted:           1,
+		CreatedToday:      3,
+		AverageCompletion: 13 * time.Hour,
+	}
+	if got != want {
+		t.Errorf("stats = %+v, want %+v", got, want)
+	}
+}
+
+func TestAdminStatsNeedLogin(t *testing.T) {
+	svc := newInMemTodoService(newTestClock())
+	mustCreate(t, svc, context.Background(), "Walk the dog")
+	_, h := newTestHandler(svc)
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest("GET", "/admin/stats", nil))
+	if rec.Code != 404 {
+		t.Errorf("without a password: status %d, want 404", rec.Code)
+	}
+
+	s := newServer(embeddedTemplates(), "", svc)
+	s.sessions = newSessions("secret", sessionTTL, maxSessions)
+	cfg := defaultConfig()
+	cfg.CSRFAuthKey = strings.Repeat("k", 32)
+	h = s.handler(cfg, true)
+	req := httptest.NewRequest("GET", "/admin/stats", nil)
+	req.Header.Set("Accept", "application/json")
+	rec = httptest.NewRecorder()
+	h.ServeHTTP(rec, req)
+	if rec.Code != 401 {
+		t.Errorf("logged out: status %d, want 401", rec.Code)
+	}
+	req.AddCookie(&http.Cookie{Name: sessionCookieName, Value: s.sessions.start(s.clock.Now())})
+	rec = httptest.NewRecorder()
+	h.ServeHTTP(rec, req)
+	var stats todoStats
+	if err := json.NewDecoder(rec.Body).Decode(&stats); err != nil || rec.Code != 200 || stats.Total != 1 {
+		t.Errorf("logged in: status %d, stats %+v (%v); want 200 and 1 todo", rec.Code, stats, err)
+	}
+}
+
+func TestPprof(t *testing.T) {
+	_, app := newTestHandler(newInMemTodoService(newTestClock()))
+	tests := []struct {
+		name   string
+		h      http.Handler
+		target string
+		want   int
+	}{
+		{"on", pprofHandler(), "/debug/pprof/", 200},
+		{"on, a profile", pprofHandler(), "/debug/pprof/cmdline", 200},
+		{"on, outside the profiles", pprofHandler(), "/todos/", 404},
+		// the profiles are never served by the app itself
+		{"off", app, "/debug/pprof/", 404},
+		{"off, a profile", app, "/debug/pprof/cmdline", 404},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rec := httptest.NewRecorder()
+			tt.h.ServeHTTP(rec, httptest.NewRequest("GET", tt.target, nil))
+			if rec.Code != tt.want {
+				t.Errorf("status %d, want %d", rec.Code, tt.want)
+			}
+		})
+	}
+}
+
+func TestMetricsExposition(t *testing.T) {
+	m := newMetrics()
+	m.observe("GET", 200, 15625*time.Microsecond)
+	m.observe("POST", 303, 375*time.Millisecond)
+	m.observe("GET", 200, 3*time.Second)
+	m.observe("GET", 404, 3906250*time.Nanosecond)
+	var b strings.Builder
+	if err := m.writeTo(&b, 7); err != nil {
+		t.Fatal(err)
+	}
+	want := `# HELP http_requests_total Total number of HTTP requests.
+# TYPE http_requests_total counter
+http_requests_total{method="GET",status="200"} 2
+http_requests_total{method="GET",status="404"} 1
+http_requests_total{method="POST",status="303"} 1
+# HELP http_request_duration_seconds HTTP request latencies in seconds.
+# TYPE http_request_duration_seconds histogram
+http_request_duration_seconds_bucket{le="0.005"} 1
+http_request_duration_seconds_bucket{le="0.01"} 1
+http_request_duration_seconds_bucket{le="0.025"} 2
+http_request_duration_seconds_bucket{le="0.05"} 2
+http_request_duration_seconds_bucket{le="0.1"} 2
+http_request_duration_seconds_bucket{le="0.25"} 2
+http_request_duration_seconds_bucket{le="0.5"} 3
+http_request_duration_seconds_bucket{le="1"} 3
+http_request_duration_seconds_bucket{le="2.5"} 3
+http_request_duration_seconds_bucket{le="5"} 4
+http_request_duration_seconds_bucket{le="10"} 4
+http_request_duration_seconds_bucket{le="+Inf"} 4
+http_request_duration_seconds_sum 3.39453125
+http_request_duration_seconds_count 4
+# HELP todos Current number of todos, excluding deleted ones.
+# TYPE todos gauge
+todos 7
+`
+	if got := b.String(); got != want {
+		t.Errorf("got\n%s\nwant\n%s", got, want)
+	}
+}
+
+func TestMetricsHandler(t *testing.T) {
+	svc := newInMemTodoService(newTestClock())
+	mustCreate(t, svc, context.Background(), "Walk the dog")
+	trashed := mustCreate(t, svc, context.Background(), "Feed the cat")
+	if err := svc.deleteTodo(context.Background(), trashed.Id); err != nil {
+		t.Fatal(err)
+	}
+
+	s, h := newTestHandler(svc)
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest("GET", "/metrics", nil))
+	if rec.Code != 404 {
+		t.Errorf("turned off: status %d, want 404", rec.Code)
+	}
+
+	s.metrics = newMetrics()
+	s.metrics.observe("GET", 200, time.Millisecond)
+	rec = httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest("GET", "/metrics", nil))
+	if ct := rec.Result().Header.Get("Content-Type"); rec.Code != 200 || ct != "text/plain; version=0.0.4" {
+		t.Fatalf("status %d, Content-Type %q; want 200 and the text format", rec.Code, ct)
+	}
+	body := rec.Body.String()
+	for _, line := range []string{`http_requests_total{method="GET",status="200"} 1`, "todos 1"} {
+		if !regexp.MustCompile("(?m)^" + regexp.QuoteMeta(line) + "$").MatchString(body) {
+			t.Errorf("no %q line in:\n%s", line, body)
+		}
+	}
+}
+
+func TestTodoLimitIsPerOwner(t *testing.T) {
+	alice, bob := ownerContext("alice"), ownerContext("bob")
+	yes := true
+
+	t.Run("rejects", func(t *testing.T) {
+		svc := newInMemTodoService(newTestClock())
+		svc.maxTodos = 2
+		mustCreate(t, svc, alice, "one")
+		mustCreate(t, svc, alice, "two")
+		var verr *validationError
+		if err := svc.createTodo(alice, &todo{Text: "three"}); !errors.As(err, &verr) {
+			t.Errorf("alice's third todo: got %v, want the list to be full", err)
+		}
+		mustCreate(t, svc, bob, "bob's one")
+		mustCreate(t, svc, bob, "bob's two")
+	})
+
+	t.Run("evicts the owner's oldest done todo", func(t *testing.T) {
+		clock := newTestClock()
+		svc := newInMemTodoService(clock)
+		svc.maxTodos = 2
+		svc.evictDone = true
+		older := mustCreate(t, svc, alice, "older")
+		newer := mustCreate(t, svc, alice, "newer")
+		bobs := mustCreate(t, svc, bob, "bob's")
+		for _, c := range []struct {
+			ctx context.Context
+			id  uint64
+		}{{alice, older.Id}, {bob, bobs.Id}, {alice, newer.Id}} {
+			clock.advance(time.Minute)
+			if _, err := svc.updateTodo(c.ctx, c.id, todoUpdate{done: &yes}); err != nil {
+				t.Fatal(err)
+			}
+		}
+		mustCreate(t, svc, alice, "third")
+
+		for _, c := range []struct {
+			ctx         context.Context
+			id          uint64
+			wantDeleted bool
+		}{{alice, older.Id, true}, {alice, newer.Id, false}, {bob, bobs.Id, false}} {
+			got, err := svc.getTodoById(c.ctx, c.id)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got.Deleted != c.wantDeleted {
+				t.Errorf("%q deleted = %v, want %v", got.Text, got.Deleted, c.wantDeleted)
+			}
+		}
+	})
+
+	t.Run("ignores expired todos", func(t *testing.T) {
+		clock := newTestClock()
+		svc := newInMemTodoService(clock)
+		svc.maxTodos = 1
+		svc.ttl = time.Hour
+		mustCreate(t, svc, alice, "stale")
+		clock.advance(2 * time.Hour)
+		mustCreate(t, svc, alice, "fresh")
+	})
+}
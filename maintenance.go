@@ -0,0 +1,89 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+const maintenanceRetryAfter = 5 * time.Minute
+
+// maintenanceMode is what is turned away during maintenance.
+type maintenanceMode int32
+
+const (
+	maintenanceOff maintenanceMode = iota
+	// maintenanceWrites still serves reads
+	maintenanceWrites
+	maintenanceAll
+)
+
+func parseMaintenanceMode(v string) (maintenanceMode, bool) {
+	switch v {
+	case "off", "":
+		return maintenanceOff, true
+	case "writes":
+		return maintenanceWrites, true
+	case "all":
+		return maintenanceAll, true
+	}
+	return maintenanceOff, false
+}
+
+func (s *server) maintenanceMode() maintenanceMode {
+	return maintenanceMode(atomic.LoadInt32(&s.maintenance))
+}
+
+func (s *server) setMaintenanceMode(m maintenanceMode) {
+	atomic.StoreInt32(&s.maintenance, int32(m))
+}
+
+// withMaintenance answers 503 during maintenance, to changes only or to
+// everything depending on the mode. Logging in and switching maintenance
+// off again always get through.
+func (s *server) withMaintenance(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mode := s.maintenanceMode()
+		read := r.Method == "GET" || r.Method == "HEAD"
+		path := strings.TrimPrefix(r.URL.Path, s.basePath)
+		if mode == maintenanceOff || (mode == maintenanceWrites && read) ||
+			path == "/login" || path == "/logout" || path == "/maintenance" {
+			h.ServeHTTP(w, r)
+			return
+		}
+		r = r.WithContext(context.WithValue(r.Context(), templatesKey, s.templates))
+		w.Header().Set("Retry-After", strconv.Itoa(int(maintenanceRetryAfter.Seconds())))
+		respondErrorMessage(w, r, 503, "The site is under maintenance, please try again in a few minutes.")
+	})
+}
+
+// maintenanceHandler switches maintenance on or off at runtime. It is only
+// there for users who logged in with the password.
+func (s *server) maintenanceHandler(w http.ResponseWriter, r *http.Request) {
+	if s.sessions == nil {
+		respondError(w, r, 404)
+		return
+	}
+	if r.Method != "POST" {
+		respondError(w, r, 405)
+		return
+	}
+	if !s.loggedIn(r) {
+		respondError(w, r, 401)
+		return
+	}
+	if !parseForm(w, r) {
+		return
+	}
+	mode, ok := parseMaintenanceMode(r.PostForm.Get("mode"))
+	if !ok {
+		respondError(w, r, 400)
+		return
+	}
+	s.setMaintenanceMode(mode)
+	logf(r.Context(), "maintenance mode set to %q", r.PostForm.Get("mode"))
+	w.WriteHeader(204)
+}
@@ -0,0 +1,150 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"sort"
+	"sync"
+	"time"
+)
+
+var durationBuckets = []float64{0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10}
+
+type requestKey struct {
+	method string
+	status int
+}
+
+type metrics struct {
+	mu            sync.Mutex
+	requests      map[requestKey]uint64
+	bucketCounts  []uint64
+	durationSum   float64
+	durationCount uint64
+}
+
+func newMetrics() *metrics {
+	return &metrics{
+		requests:     make(map[requestKey]uint64),
+		bucketCounts: make([]uint64, len(durationBuckets)),
+	}
+}
+
+func (m *metrics) observe(method string, status int, d time.Duration) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.requests[requestKey{method, status}]++
+	secs := d.Seconds()
+	for i, upper := range durationBuckets {
+		if secs <= upper {
+			m.bucketCounts[i]++
+		}
+	}
+	m.durationSum += secs
+	m.durationCount++
+}
+
+func (m *metrics) writeTo(w io.Writer, todoCount int) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	keys := make([]requestKey, 0, len(m.requests))
+	for k := range m.requests {
+		keys = append(keys, k)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		if keys[i].method != keys[j].method {
+			return keys[i].method < keys[j].method
+		}
+		return keys[i].status < keys[j].status
+	})
+
+	var err error
+	printf := func(format string, a ...interface{}) {
+		if err == nil {
+			_, err = fmt.Fprintf(w, format, a...)
+		}
+	}
+	printf("# HELP http_requests_total Total number of HTTP requests.\n")
+	printf("# TYPE http_requests_total counter\n")
+	for _, k := range keys {
+		printf("http_requests_total{method=%q,status=\"%d\"} %d\n", k.method, k.status, m.requests[k])
+	}
+	printf("# HELP http_request_duration_seconds HTTP request latencies in seconds.\n")
+	printf("# TYPE http_request_duration_seconds histogram\n")
+	for i, upper := range durationBuckets {
+		printf("http_request_duration_seconds_bucket{le=\"%g\"} %d\n", upper, m.bucketCounts[i])
+	}
+	printf("http_request_duration_seconds_bucket{le=\"+Inf\"} %d\n", m.durationCount)
+	printf("http_request_duration_seconds_sum %g\n", m.durationSum)
+	printf("http_request_duration_seconds_count %d\n", m.durationCount)
+	printf("# HELP todos Current number of todos, excluding deleted ones.\n")
+	printf("# TYPE todos gauge\n")
+	printf("todos %d\n", todoCount)
+	return err
+}
+
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+	size   int
+}
+
+func (rec *statusRecorder) WriteHeader(status int) {
+	if rec.status == 0 {
+		rec.status = status
+	}
+	rec.ResponseWriter.WriteHeader(status)
+}
+
+func (rec *statusRecorder) Write(b []byte) (int, error) {
+	if rec.status == 0 {
+		rec.status = http.StatusOK
+	}
+	n, err := rec.ResponseWriter.Write(b)
+	rec.size += n
+	return n, err
+}
+
+func (rec *statusRecorder) Unwrap() http.ResponseWriter {
+	return rec.ResponseWriter
+}
+
+// Flush lets streamed responses through the recorder.
+func (rec *statusRecorder) Flush() {
+	if f, ok := rec.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// Hijack lets websocket upgrades through the recorder.
+func (rec *statusRecorder) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	h, ok := rec.ResponseWriter.(http.Hijacker)
+	if !ok {
+		return nil, nil, errors.New("hijacking not supported")
+	}
+	rec.status = http.StatusSwitchingProtocols
+	return h.Hijack()
+}
+
+func (s *server) metricsHandler(w http.ResponseWriter, r *http.Request) {
+	if s.metrics == nil {
+		http.Error(w, http.StatusText(http.StatusNotFound), http.StatusNotFound)
+		return
+	}
+	// the gauge is for the whole store, not the owner scraping it
+	n, err := s.todoService.countTodos(r.Context(), todoFilter{allOwners: true, includeSnoozed: true})
+	if err != nil {
+		logf(r.Context(), "counting todos: %v", err)
+		http.Error(w, http.StatusText(500), 500)
+		return
+	}
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	if err := s.metrics.writeTo(w, n); err != nil {
+		logf(r.Context(), "writing metrics: %v", err)
+	}
+}
@@ -0,0 +1,176 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"time"
+)
+
+// Notifier runs side effects when todos are created or completed. Its
+// methods are called after the change is stored and must not block the
+// request that made it.
+type Notifier interface {
+	OnTodoCreated(ctx context.Context, t *todo)
+	OnTodoDone(ctx context.Context, t *todo)
+}
+
+// hookingTodoService tells a Notifier about the todos created or completed
+// through the wrapped service. Without a notifier configured the service
+// isn't wrapped at all.
+type hookingTodoService struct {
+	todoService
+	notifier Notifier
+}
+
+// justDone reports whether the change that returned t is the one that
+// completed it: completing a todo stamps DoneAt and UpdatedAt with the same
+// time, while later changes, including marking it done again, only move
+// UpdatedAt.
+func justDone(t *todo) bool {
+	return t.Done && t.DoneAt.Equal(t.UpdatedAt)
+}
+
+func (s hookingTodoService) createTodo(ctx context.Context, todo *todo) error {
+	if err := s.todoService.createTodo(ctx, todo); err != nil {
+		return err
+	}
+	s.notifier.OnTodoCreated(ctx, todo.clone())
+	return nil
+}
+
+func (s hookingTodoService) updateTodo(ctx context.Context, id uint64, update todoUpdate) (*todo, error) {
+	t, err := s.todoService.updateTodo(ctx, id, update)
+	if err != nil {
+		return nil, err
+	}
+	if update.done != nil && justDone(t) {
+		s.notifier.OnTodoDone(ctx, t.clone())
+	}
+	return t, nil
+}
+
+func (s hookingTodoService) setTodosDone(ctx context.Context, ids []uint64, done bool) error {
+	if err := s.todoService.setTodosDone(ctx, ids, done); err != nil {
+		return err
+	}
+	if !done {
+		return nil
+	}
+	for _, id := range ids {
+		t, err := s.todoService.getTodoById(ctx, id)
+		if err != nil {
+			// deleted again since, nothing left to tell
+			continue
+		}
+		if justDone(t) {
+			s.notifier.OnTodoDone(ctx, t)
+		}
+	}
+	return nil
+}
+
+func (s hookingTodoService) putTodo(ctx context.Context, id uint64, update todoUpdate) (*todo, bool, error) {
+	t, created, err := s.todoService.putTodo(ctx, id, update)
+	if err != nil {
+		return nil, false, err
+	}
+	if created {
+		s.notifier.OnTodoCreated(ctx, t.clone())
+	}
+	if update.done != nil && justDone(t) {
+		s.notifier.OnTodoDone(ctx, t.clone())
+	}
+	return t, created, nil
+}
+
+const (
+	webhookTimeout  = 10 * time.Second
+	webhookAttempts = 3
+	// maxWebhookDeliveries bounds the deliveries in flight; events beyond
+	// it are dropped rather than queued
+	maxWebhookDeliveries = 16
+)
+
+// webhookEvent is the body POSTed to the webhook.
+type webhookEvent struct {
+	Event string   `json:"event"`
+	Todo  *todoDTO `json:"todo"`
+}
+
+// webhookNotifier POSTs each event as JSON to a URL in the background,
+// retrying failed deliveries a few times.
+type webhookNotifier struct {
+	url    string
+	client *http.Client
+	slots  chan struct{}
+}
+
+// isWebhookURL reports whether v is an absolute http or https URL.
+func isWebhookURL(v string) bool {
+	u, err := url.Parse(v)
+	return err == nil && (u.Scheme == "http" || u.Scheme == "https") && u.Host != ""
+}
+
+func newWebhookNotifier(u string) *webhookNotifier {
+	return &webhookNotifier{
+		url:    u,
+		client: &http.Client{Timeout: webhookTimeout},
+		slots:  make(chan struct{}, maxWebhookDeliveries),
+	}
+}
+
+func (n *webhookNotifier) OnTodoCreated(ctx context.Context, t *todo) {
+	n.send(ctx, webhookEvent{Event: "created", Todo: todoJSON(t)})
+}
+
+func (n *webhookNotifier) OnTodoDone(ctx context.Context, t *todo) {
+	n.send(ctx, webhookEvent{Event: "done", Todo: todoJSON(t)})
+}
+
+// send delivers event without waiting for it. The delivery outlives the
+// request, so only its trace id is kept for the logs.
+func (n *webhookNotifier) send(ctx context.Context, event webhookEvent) {
+	b, err := json.Marshal(event)
+	if err != nil {
+		logf(ctx, "encoding webhook event: %v", err)
+		return
+	}
+	select {
+	case n.slots <- struct{}{}:
+	default:
+		warnf(ctx, "dropping %s webhook for todo %d: too many deliveries in flight", event.Event, event.Todo.Id)
+		return
+	}
+	ctx = context.WithValue(context.Background(), traceIDKey, traceIDFromContext(ctx))
+	go func() {
+		defer func() { <-n.slots }()
+		for attempt := 1; ; attempt++ {
+			err := n.post(b)
+			if err == nil {
+				debugf(ctx, "delivered %s webhook for todo %d", event.Event, event.Todo.Id)
+				return
+			}
+			if attempt == webhookAttempts {
+				logf(ctx, "delivering %s webhook for todo %d: %v", event.Event, event.Todo.Id, err)
+				return
+			}
+			time.Sleep(time.Duration(attempt) * time.Second)
+		}
+	}()
+}
+
+func (n *webhookNotifier) post(body []byte) error {
+	resp, err := n.client.Post(n.url, "application/json", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("webhook answered %s", resp.Status)
+	}
+	return nil
+}
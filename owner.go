@@ -0,0 +1,40 @@
+package main
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"strings"
+)
+
+const ownerKey contextKey = 7
+
+// anonymousOwner owns the todos created by requests that carry no
+// identity, which is all of them until some authentication is set up.
+const anonymousOwner = "anonymous"
+
+// withOwner records who is making the request, for the todo service to
+// keep each owner's todos apart. For now the identity can only come from a
+// header set by an authenticating reverse proxy, so the header is only
+// believed from one of the trusted proxies.
+func withOwner(h http.Handler, header string, trusted []*net.IPNet) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		owner := anonymousOwner
+		if header != "" && isTrustedProxy(remoteHost(r.RemoteAddr), trusted) {
+			if v := strings.TrimSpace(r.Header.Get(header)); v != "" {
+				owner = v
+			}
+		}
+		ctx := context.WithValue(r.Context(), ownerKey, owner)
+		h.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
+
+// ownerFromContext returns the owner recorded by withOwner, or the
+// anonymous owner.
+func ownerFromContext(ctx context.Context) string {
+	if owner, ok := ctx.Value(ownerKey).(string); ok {
+		return owner
+	}
+	return anonymousOwner
+}
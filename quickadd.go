@@ -0,0 +1,112 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+)
+
+// maxQuickAddLines is how many todos can be added at once by pasting them
+// one per line.
+const maxQuickAddLines = 50
+
+// newTodoForm is the data of the new-todo form, which takes one todo or,
+// in multi mode, one per line.
+type newTodoForm struct {
+	Request *http.Request
+	Multi   bool
+	// Text and Errors hold the lines that could not be added
+	Text   string
+	Errors []string
+}
+
+type lineError struct {
+	Line int `json:"line"`
+	batchError
+}
+
+// newTodoFormHandler renders the new-todo form, switching it between one
+// todo and one per line.
+func (s *server) newTodoFormHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" {
+		respondError(w, r, 405)
+		return
+	}
+	handlePage(s.templates, "new-todo-form.html", w, newTodoForm{Request: r, Multi: r.FormValue("multi") != ""})
+}
+
+// createTodoLines adds a todo for each non-blank line of text, otherwise
+// like proto. Lines that fail are reported with their line number, without
+// keeping the others from being added.
+func (s *server) createTodoLines(w http.ResponseWriter, r *http.Request, text string, proto todo) {
+	var lines []string
+	var numbers []int
+	for i, line := range strings.Split(text, "\n") {
+		if line = strings.TrimSpace(line); line != "" {
+			lines = append(lines, line)
+			numbers = append(numbers, i+1)
+		}
+	}
+	if len(lines) > maxQuickAddLines {
+		respondServiceError(w, r, &validationError{key: "At most %d todos can be added at once.", args: []interface{}{maxQuickAddLines}})
+		return
+	}
+
+	created := []*todo{}
+	errs := []lineError{}
+	var failed []string
+	create := func() ([]uint64, error) {
+		var ids []uint64
+		for i, line := range lines {
+			t := proto
+			t.Text = line
+			if err := s.todoService.createTodo(r.Context(), &t); err != nil {
+				logf(r.Context(), "creating todo from line %d: %v", numbers[i], err)
+				errs = append(errs, lineError{numbers[i], *newBatchError(r, err)})
+				failed = append(failed, line)
+				continue
+			}
+			created = append(created, &t)
+			ids = append(ids, t.Id)
+		}
+		return ids, nil
+	}
+	if key := idempotencyKey(r); key != "" {
+		// a retry of lines already added adds nothing, and answers with
+		// the todos they added
+		ids, isNew, _ := s.idempotency.doMany(ownerFromContext(r.Context()), key, s.clock.Now(), create)
+		if !isNew {
+			for _, id := range ids {
+				t, err := s.todoService.getTodoById(r.Context(), id)
+				if err != nil {
+					logf(r.Context(), "getting todo by id: %v", err)
+					continue
+				}
+				created = append(created, t)
+			}
+		}
+	} else {
+		create()
+	}
+
+	switch negotiate(r) {
+	case formatJSON:
+		status := 201
+		if len(created) == 0 && len(errs) > 0 {
+			status = 422
+		}
+		handleJSON(w, status, map[string]interface{}{"created": todosJSON(created), "errors": errs})
+	case formatHTMLFragment:
+		if len(created) > 0 {
+			setHxTrigger(w, eventNewTodo, nil)
+		}
+		form := newTodoForm{Request: r, Multi: true, Text: strings.Join(failed, "\n")}
+		for _, e := range errs {
+			form.Errors = append(form.Errors, printer(r).Sprintf("Line %d: %s", e.Line, e.Message))
+		}
+		handleOOB(s.templates, w,
+			fragment{"new-todo-form.html", form},
+			fragment{"live-region.html", liveMessage{printer(r).Sprintf("Added %d todo(s).", len(created)), false}})
+	default:
+		http.Redirect(w, r, s.url("/todos/"), 303)
+	}
+}
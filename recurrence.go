@@ -0,0 +1,53 @@
+package main
+
+import "time"
+
+type recurrence string
+
+const (
+	recurNone    recurrence = ""
+	recurDaily   recurrence = "daily"
+	recurWeekly  recurrence = "weekly"
+	recurMonthly recurrence = "monthly"
+)
+
+func parseRecurrence(v string) (recurrence, error) {
+	switch r := recurrence(v); r {
+	case recurNone, recurDaily, recurWeekly, recurMonthly:
+		return r, nil
+	}
+	return recurNone, &validationError{key: "Unknown recurrence %q.", args: []interface{}{v}}
+}
+
+func (r recurrence) Label() string {
+	switch r {
+	case recurDaily:
+		return "Daily"
+	case recurWeekly:
+		return "Weekly"
+	case recurMonthly:
+		return "Monthly"
+	}
+	return ""
+}
+
+// next returns the first occurrence after t. Monthly recurrences keep the
+// day of the month where possible and otherwise clamp to the last day of
+// the following month, so Jan 31 is followed by Feb 28 (or 29).
+func (r recurrence) next(t time.Time) time.Time {
+	switch r {
+	case recurDaily:
+		return t.AddDate(0, 0, 1)
+	case recurWeekly:
+		return t.AddDate(0, 0, 7)
+	case recurMonthly:
+		y, m, d := t.Date()
+		lastDay := time.Date(y, m+2, 0, 0, 0, 0, 0, t.Location()).Day()
+		if d > lastDay {
+			d = lastDay
+		}
+		hh, mm, ss := t.Clock()
+		return time.Date(y, m+1, d, hh, mm, ss, t.Nanosecond(), t.Location())
+	}
+	return t
+}
@@ -0,0 +1,65 @@
+package main
+
+import (
+	"net/http"
+)
+
+// filtersActive reports whether r narrows the todo list down from what it
+// shows when nothing is chosen, so there is something to clear.
+func (s *server) filtersActive(r *http.Request) bool {
+	query := listQuery(r)
+	state := query.Get("filter")
+	query.Del("filter")
+	if state == "" {
+		state = s.defaultFilterValue(r)
+	}
+	return len(query) > 0 || state != s.defaultFilter
+}
+
+// resetListRequest returns a copy of r that selects the todo list as if no
+// filter was ever chosen: without the list parameters, the state parameter
+// packing them, or the remembered filter.
+func resetListRequest(r *http.Request) *http.Request {
+	reset := r.Clone(r.Context())
+	query := reset.URL.Query()
+	for _, key := range append(listQueryKeys, viewStateParam, "reset") {
+		query.Del(key)
+	}
+	reset.URL.RawQuery = query.Encode()
+	reset.Form, reset.PostForm = nil, nil
+	reset.Header.Del("Cookie")
+	for _, c := range r.Cookies() {
+		if c.Name != filterCookieName {
+			reset.AddCookie(c)
+		}
+	}
+	return reset
+}
+
+// resetFilters clears the todo list selection for GET /todos/?reset=1,
+// forgetting the remembered filter too. Browsers without htmx are sent to
+// the plain list.
+func (s *server) resetFilters(w http.ResponseWriter, r *http.Request) {
+	s.clearCookie(w, filterCookieName)
+	if negotiate(r) == formatHTML {
+		http.Redirect(w, r, s.url("/todos/"), 303)
+		return
+	}
+	r = resetListRequest(r)
+	data, err := s.getTodoListPage(r)
+	if err != nil {
+		logf(r.Context(), "getting todo list: %v", err)
+		respondError(w, r, 500)
+		return
+	}
+	if negotiate(r) == formatJSON {
+		list := make([]*todo, len(data.Todos))
+		for i, item := range data.Todos {
+			list[i] = item.Todo
+		}
+		handleJSON(w, 200, todosJSON(list))
+		return
+	}
+	w.Header().Set("HX-Push-Url", s.listPushURL(r))
+	handlePage(s.templates, "todo-list.html", w, data)
+}
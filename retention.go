@@ -0,0 +1,31 @@
+package main
+
+import (
+	"context"
+	"log"
+	"time"
+)
+
+// purgeTrash removes todos that have been in the trash for longer than
+// retention, checking every interval until ctx is done.
+func (s *server) purgeTrash(ctx context.Context, retention, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			n, err := s.todoService.purgeExpired(ctx, s.clock.Now().Add(-retention))
+			if err != nil {
+				if ctx.Err() == nil {
+					log.Printf("purging expired todos: %v", err)
+				}
+				continue
+			}
+			if n > 0 {
+				log.Printf("purged %d todo(s) from the trash", n)
+			}
+		}
+	}
+}
@@ -0,0 +1,30 @@
+package main
+
+import "net/http"
+
+// defaultRobotsTxt keeps crawlers away from the whole site, as fits a
+// personal todo list; public demos can serve their own with -robots-txt.
+const defaultRobotsTxt = "User-agent: *\nDisallow: /\n"
+
+func (s *server) robotsHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" && r.Method != "HEAD" {
+		respondError(w, r, 405)
+		return
+	}
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	if r.Method == "HEAD" {
+		return
+	}
+	if _, err := w.Write(s.robotsTxt); err != nil {
+		logf(r.Context(), "writing robots.txt: %v", err)
+	}
+}
+
+// withNoIndex asks search engines not to index any response, including
+// those of crawlers that ignore robots.txt or reach pages through links.
+func withNoIndex(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("X-Robots-Tag", "noindex")
+		h.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,58 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"math/rand"
+	"time"
+)
+
+var seedTexts = []string{
+	"Buy milk", "Call mom", "Fix the bike", "Write the report", "Read a book",
+	"Clean the garage", "Plan the trip", "Review the budget", "Book tickets", "Email the landlord",
+	"Water the plants", "Pay the rent", "Walk the dog", "Renew the passport", "Back up the laptop",
+}
+
+// seedClock is the service clock while seeding, set to each made up
+// moment in turn.
+type seedClock struct {
+	now time.Time
+}
+
+func (c *seedClock) Now() time.Time {
+	return c.now
+}
+
+// seedTodos fills svc with n made up todos for trying the app with a long
+// list: each created a while before the previous one, about a third of them
+// done and some with a due date. The same n always makes the same todos.
+func seedTodos(svc *inMemTodoService, n int) error {
+	ctx := context.Background()
+	saved := svc.clock
+	now := saved.Now()
+	clock := &seedClock{}
+	svc.clock = clock
+	defer func() { svc.clock = saved }()
+	rnd := rand.New(rand.NewSource(int64(n)))
+	for i := 0; i < n; i++ {
+		clock.now = now.Add(-time.Duration(i) * 37 * time.Minute)
+		t := todo{Text: fmt.Sprintf("%s #%d", seedTexts[i%len(seedTexts)], i+1)}
+		if rnd.Intn(5) == 0 {
+			t.DueAt = startOfDay(now).AddDate(0, 0, rnd.Intn(29)-14)
+		}
+		if err := svc.createTodo(ctx, &t); err != nil {
+			return err
+		}
+		if rnd.Intn(10) < 3 {
+			clock.now = clock.now.Add(time.Duration(rnd.Int63n(int64(72 * time.Hour))))
+			if clock.now.After(now) {
+				clock.now = now
+			}
+			done := true
+			if _, err := svc.updateTodo(ctx, t.Id, todoUpdate{done: &done}); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,67 @@
+package main
+
+import (
+	"fmt"
+	"io/fs"
+	"path"
+	"strings"
+)
+
+// defaultSkin is the layout at the root of the templates, other skins live
+// in skins/<name>/ next to it, each a complete set of templates.
+const defaultSkin = "default"
+
+// skinFS returns the templates of the named skin within templates, after
+// making sure none of them is missing.
+func skinFS(templates fs.FS, name string) (fs.FS, error) {
+	if name != defaultSkin {
+		dir := path.Join("skins", name)
+		if info, err := fs.Stat(templates, dir); err != nil || !info.IsDir() {
+			return nil, fmt.Errorf("skin %q not found", name)
+		}
+		sub, err := fs.Sub(templates, dir)
+		if err != nil {
+			return nil, err
+		}
+		templates = sub
+	}
+	if err := checkTemplates(templates); err != nil {
+		return nil, fmt.Errorf("skin %q: %w", name, err)
+	}
+	return templates, nil
+}
+
+// checkTemplates reports the templates that fsys lacks among those the
+// server renders, which are the ones embedded in the binary.
+func checkTemplates(fsys fs.FS) error {
+	var missing []string
+	err := fs.WalkDir(embeddedTemplates(), ".", func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if d.IsDir() {
+			if p == "skins" {
+				return fs.SkipDir
+			}
+			return nil
+		}
+		if path.Ext(p) != ".html" {
+			return nil
+		}
+		if _, err := fs.Stat(fsys, p); err != nil {
+			missing = append(missing, p)
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	if len(missing) > 0 {
+		return fmt.Errorf("missing templates %s", strings.Join(missing, ", "))
+	}
+	return nil
+}
+
+func isSkinName(name string) bool {
+	return name != "" && name != "." && name != ".." && !strings.ContainsAny(name, `/\`)
+}
@@ -0,0 +1,59 @@
+package main
+
+import (
+	"regexp"
+	"strings"
+	"unicode"
+
+	"golang.org/x/text/unicode/norm"
+)
+
+const maxSlugLength = 60
+
+var permalinkSlugRe = regexp.MustCompile(`^/todos/\d+-([^/]*)/$`)
+
+// slugify makes a readable URL path segment from a todo's text: lower case
+// ASCII letters and digits separated by single hyphens, with accents
+// dropped. The todo's id comes before the slug in links, so slugs don't
+// need to be unique.
+func slugify(text string) string {
+	var b strings.Builder
+	hyphen := false
+	for _, r := range norm.NFD.String(strings.ToLower(text)) {
+		switch {
+		case unicode.Is(unicode.Mn, r):
+			// the accent of a decomposed letter
+		case r < unicode.MaxASCII && (unicode.IsLetter(r) || unicode.IsDigit(r)):
+			if hyphen && b.Len() > 0 {
+				b.WriteByte('-')
+			}
+			hyphen = false
+			b.WriteRune(r)
+		default:
+			hyphen = true
+		}
+		if b.Len() >= maxSlugLength {
+			break
+		}
+	}
+	slug := b.String()
+	if len(slug) > maxSlugLength {
+		// a hyphen and the letter after it can go one past
+		slug = slug[:maxSlugLength]
+	}
+	slug = strings.TrimRight(slug, "-")
+	if slug == "" {
+		return "todo"
+	}
+	return slug
+}
+
+// permalinkSlug returns the slug part of a permalink path such as
+// /todos/12-buy-milk/.
+func permalinkSlug(path string) (string, bool) {
+	m := permalinkSlugRe.FindStringSubmatch(path)
+	if m == nil {
+		return "", false
+	}
+	return m[1], true
+}
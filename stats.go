@@ -0,0 +1,79 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"time"
+)
+
+// todoStats sums up the whole store, every owner's todos included.
+type todoStats struct {
+	Total        int `json:"total"`
+	Done         int `json:"done"`
+	Remaining    int `json:"remaining"`
+	Deleted      int `json:"deleted"`
+	CreatedToday int `json:"created_today"`
+	// AverageCompletion is the mean time from creating a todo to
+	// completing it, over the done todos, in nanoseconds in JSON
+	AverageCompletion time.Duration `json:"average_completion_ns"`
+}
+
+func (s *inMemTodoService) stats(ctx context.Context) (todoStats, error) {
+	var stats todoStats
+	if err := ctx.Err(); err != nil {
+		return stats, err
+	}
+	today := startOfDay(s.clock.Now().In(timeLocation(ctx)))
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	var completion time.Duration
+	for _, t := range s.todos {
+		if !t.CreatedAt.Before(today) {
+			stats.CreatedToday++
+		}
+		if t.Deleted {
+			stats.Deleted++
+			continue
+		}
+		stats.Total++
+		if t.Done {
+			stats.Done++
+			completion += t.DoneAt.Sub(t.CreatedAt)
+		} else {
+			stats.Remaining++
+		}
+	}
+	if stats.Done > 0 {
+		stats.AverageCompletion = completion / time.Duration(stats.Done)
+	}
+	return stats, nil
+}
+
+type adminStatsPage struct {
+	Request *http.Request
+	Stats   todoStats
+}
+
+// adminStatsHandler shows operators how the store is used. It is only
+// there for users who logged in with the password.
+func (s *server) adminStatsHandler(w http.ResponseWriter, r *http.Request) {
+	if s.sessions == nil {
+		respondError(w, r, 404)
+		return
+	}
+	if r.Method != "GET" {
+		respondError(w, r, 405)
+		return
+	}
+	stats, err := s.todoService.stats(r.Context())
+	if err != nil {
+		logf(r.Context(), "computing stats: %v", err)
+		respondError(w, r, 500)
+		return
+	}
+	if negotiate(r) == formatJSON {
+		handleJSON(w, 200, stats)
+		return
+	}
+	handlePage(s.templates, "admin_stats.html", w, adminStatsPage{Request: r, Stats: stats})
+}
@@ -0,0 +1,165 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+// fileTodoService keeps the todos in memory like inMemTodoService, and
+// writes all of them to a JSON file after every change so they survive a
+// restart.
+type fileTodoService struct {
+	*inMemTodoService
+	path string
+	// writeMu keeps the writes in order, so the file always ends up with
+	// the latest todos
+	writeMu sync.Mutex
+}
+
+// newFileTodoService loads the todos saved at path into svc. A missing or
+// empty file is an empty store.
+func newFileTodoService(svc *inMemTodoService, path string) (*fileTodoService, error) {
+	b, err := os.ReadFile(path)
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return nil, err
+	}
+	if len(b) > 0 {
+		var todos []*todo
+		if err := json.Unmarshal(b, &todos); err != nil {
+			return nil, fmt.Errorf("reading %s: %w", path, err)
+		}
+		svc.mu.Lock()
+		svc.todos = todos
+		svc.mu.Unlock()
+		for _, t := range todos {
+			if t.Id > latestTodoId && t.Id < minClientTodoId {
+				latestTodoId = t.Id
+			}
+		}
+	}
+	return &fileTodoService{inMemTodoService: svc, path: path}, nil
+}
+
+// save writes the todos to a temporary file next to the store and renames
+// it over the store, so a crash never leaves a half written file behind.
+func (s *fileTodoService) save() error {
+	s.writeMu.Lock()
+	defer s.writeMu.Unlock()
+	s.mu.RLock()
+	b, err := json.MarshalIndent(s.todos, "", "\t")
+	s.mu.RUnlock()
+	if err != nil {
+		return err
+	}
+	f, err := os.CreateTemp(filepath.Dir(s.path), filepath.Base(s.path)+".tmp*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+	if _, err := f.Write(b); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	return os.Rename(f.Name(), s.path)
+}
+
+func (s *fileTodoService) persist(err error) error {
+	if err != nil {
+		return err
+	}
+	if err := s.save(); err != nil {
+		return fmt.Errorf("saving todos: %w", err)
+	}
+	return nil
+}
+
+func (s *fileTodoService) createTodo(ctx context.Context, todo *todo) error {
+	return s.persist(s.inMemTodoService.createTodo(ctx, todo))
+}
+
+func (s *fileTodoService) updateTodo(ctx context.Context, id uint64, update todoUpdate) (*todo, error) {
+	t, err := s.inMemTodoService.updateTodo(ctx, id, update)
+	return t, s.persist(err)
+}
+
+func (s *fileTodoService) deleteTodo(ctx context.Context, id uint64) error {
+	return s.persist(s.inMemTodoService.deleteTodo(ctx, id))
+}
+
+func (s *fileTodoService) deleteTodos(ctx context.Context, ids []uint64) error {
+	return s.persist(s.inMemTodoService.deleteTodos(ctx, ids))
+}
+
+func (s *fileTodoService) setTodosDone(ctx context.Context, ids []uint64, done bool) error {
+	return s.persist(s.inMemTodoService.setTodosDone(ctx, ids, done))
+}
+
+func (s *fileTodoService) snoozeTodo(ctx context.Context, id uint64, until time.Time) (*todo, error) {
+	t, err := s.inMemTodoService.snoozeTodo(ctx, id, until)
+	return t, s.persist(err)
+}
+
+func (s *fileTodoService) restoreTodo(ctx context.Context, id uint64) (*todo, error) {
+	t, err := s.inMemTodoService.restoreTodo(ctx, id)
+	return t, s.persist(err)
+}
+
+func (s *fileTodoService) moveTodo(ctx context.Context, id uint64, toTop bool) (*todo, error) {
+	t, err := s.inMemTodoService.moveTodo(ctx, id, toTop)
+	return t, s.persist(err)
+}
+
+func (s *fileTodoService) putTodo(ctx context.Context, id uint64, update todoUpdate) (*todo, bool, error) {
+	t, created, err := s.inMemTodoService.putTodo(ctx, id, update)
+	return t, created, s.persist(err)
+}
+
+func (s *fileTodoService) purgeTodo(ctx context.Context, id uint64) error {
+	return s.persist(s.inMemTodoService.purgeTodo(ctx, id))
+}
+
+func (s *fileTodoService) purgeExpired(ctx context.Context, before time.Time) (int, error) {
+	n, err := s.inMemTodoService.purgeExpired(ctx, before)
+	if n > 0 {
+		err = s.persist(err)
+	}
+	return n, err
+}
+
+func (s *fileTodoService) expireTodos(ctx context.Context) (int, error) {
+	n, err := s.inMemTodoService.expireTodos(ctx)
+	if n > 0 {
+		err = s.persist(err)
+	}
+	return n, err
+}
+
+func (s *fileTodoService) restoreAll(ctx context.Context) (int, error) {
+	n, err := s.inMemTodoService.restoreAll(ctx)
+	if n > 0 {
+		err = s.persist(err)
+	}
+	return n, err
+}
+
+func (s *fileTodoService) emptyTrash(ctx context.Context) (int, error) {
+	n, err := s.inMemTodoService.emptyTrash(ctx)
+	if n > 0 {
+		err = s.persist(err)
+	}
+	return n, err
+}
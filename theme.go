@@ -0,0 +1,67 @@
+package main
+
+import (
+	"context"
+	"net/http"
+)
+
+type Theme struct {
+	Name  string
+	Label string
+}
+
+var supportedThemes = []Theme{
+	{"auto", "Auto"},
+	{"light", "Light"},
+	{"dark", "Dark"},
+}
+
+const (
+	themeKey        contextKey = 3
+	themeCookieName            = "theme"
+	defaultTheme               = "auto"
+)
+
+func isSupportedTheme(name string) bool {
+	for _, t := range supportedThemes {
+		if t.Name == name {
+			return true
+		}
+	}
+	return false
+}
+
+func withTheme(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		theme := defaultTheme
+		if c, err := r.Cookie(themeCookieName); err == nil && isSupportedTheme(c.Value) {
+			theme = c.Value
+		}
+		ctx := context.WithValue(r.Context(), themeKey, theme)
+		h.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
+
+func (s *server) themeHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(w, http.StatusText(405), 405)
+		return
+	}
+	if !parseForm(w, r) {
+		return
+	}
+	if theme := r.FormValue("theme"); theme != "" {
+		if !isSupportedTheme(theme) {
+			warnf(r.Context(), "unsupported theme %q", theme)
+			http.NotFound(w, r)
+			return
+		}
+
+		s.setCookie(w, themeCookieName, theme)
+		respondOrRedirect(w, r, s.url("/"), func() {
+			w.Header().Set("HX-Refresh", "true")
+		})
+	} else {
+		http.Error(w, http.StatusText(400), 400)
+	}
+}
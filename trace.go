@@ -0,0 +1,68 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"log"
+	"net/http"
+	"regexp"
+)
+
+const (
+	traceIDKey        contextKey = 4
+	traceIDHeaderName            = "X-Trace-Id"
+)
+
+var (
+	// version-traceid-parentid-flags, see https://www.w3.org/TR/trace-context/
+	traceparentRe = regexp.MustCompile(`^[0-9a-f]{2}-([0-9a-f]{32})-[0-9a-f]{16}-[0-9a-f]{2}$`)
+	traceIDRe     = regexp.MustCompile(`^[0-9A-Za-z-]{1,64}$`)
+)
+
+// withTrace tags each request with a trace id, taken from an incoming
+// traceparent or X-Trace-Id header or generated, and echoes it back in the
+// X-Trace-Id response header.
+func withTrace(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id := incomingTraceID(r)
+		if id == "" {
+			id = newTraceID()
+		}
+		w.Header().Set(traceIDHeaderName, id)
+		ctx := context.WithValue(r.Context(), traceIDKey, id)
+		h.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
+
+func incomingTraceID(r *http.Request) string {
+	if m := traceparentRe.FindStringSubmatch(r.Header.Get("traceparent")); m != nil {
+		return m[1]
+	}
+	if id := r.Header.Get(traceIDHeaderName); traceIDRe.MatchString(id) {
+		return id
+	}
+	return ""
+}
+
+func newTraceID() string {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		panic(err)
+	}
+	return hex.EncodeToString(b)
+}
+
+func traceIDFromContext(ctx context.Context) string {
+	id, _ := ctx.Value(traceIDKey).(string)
+	return id
+}
+
+// logf logs like log.Printf, prefixed with the trace id of the request ctx
+// belongs to, if any.
+func logf(ctx context.Context, format string, a ...interface{}) {
+	if id := traceIDFromContext(ctx); id != "" {
+		format = "[" + id + "] " + format
+	}
+	log.Printf(format, a...)
+}
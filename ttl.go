@@ -0,0 +1,82 @@
+package main
+
+import (
+	"context"
+	"log"
+	"time"
+)
+
+// expireSweepInterval is how often expired todos are moved to the trash;
+// until then they are already left out of the list.
+const expireSweepInterval = time.Minute
+
+// expiresAt returns when a todo outlives the service's TTL, or the zero
+// time if it never does. A todo brought back from the trash gets a fresh
+// TTL, so restoring an expired one keeps it.
+func (s *inMemTodoService) expiresAt(t *todo) time.Time {
+	if s.ttl <= 0 || t.Deleted || (s.ttlKeepDone && t.Done) {
+		return time.Time{}
+	}
+	start := t.CreatedAt
+	for i := len(t.History) - 1; i >= 0; i-- {
+		if t.History[i].Kind == eventRestored {
+			if t.History[i].At.After(start) {
+				start = t.History[i].At
+			}
+			break
+		}
+	}
+	return start.Add(s.ttl)
+}
+
+func (s *inMemTodoService) expired(t *todo, now time.Time) bool {
+	at := s.expiresAt(t)
+	return !at.IsZero() && !now.Before(at)
+}
+
+// expireTodos moves the todos past their TTL to the trash and reports how
+// many there were. Like purgeExpired it covers every owner.
+func (s *inMemTodoService) expireTodos(ctx context.Context) (int, error) {
+	if err := ctx.Err(); err != nil {
+		return 0, err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	now := s.clock.Now()
+	n := 0
+	for _, t := range s.todos {
+		if !s.expired(t, now) {
+			continue
+		}
+		t.Deleted = true
+		t.DeletedAt = now
+		t.UpdatedAt = now
+		t.record(eventExpired, now)
+		n++
+	}
+	return n, nil
+}
+
+// expireTodos moves todos past their TTL to the trash, checking every
+// interval until ctx is done.
+func (s *server) expireTodos(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			n, err := s.todoService.expireTodos(ctx)
+			if err != nil {
+				if ctx.Err() == nil {
+					log.Printf("expiring todos: %v", err)
+				}
+				continue
+			}
+			if n > 0 {
+				log.Printf("moved %d expired todo(s) to the trash", n)
+			}
+		}
+	}
+}
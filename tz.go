@@ -0,0 +1,77 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"time"
+	// time zone names chosen by users must load wherever the server runs
+	_ "time/tzdata"
+)
+
+const (
+	locationKey        contextKey = 8
+	timezoneCookieName            = "tz"
+)
+
+// withLocation records the time zone that decides where a user's days
+// start and end, and that dates are shown in: the one chosen with the tz
+// cookie, or else the server's.
+func withLocation(h http.Handler, def *time.Location) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		loc := def
+		if c, err := r.Cookie(timezoneCookieName); err == nil {
+			if l, err := loadLocation(c.Value); err == nil {
+				loc = l
+			}
+		}
+		ctx := context.WithValue(r.Context(), locationKey, loc)
+		h.ServeHTTP(w, r.WithContext(ctx))
+	})
+}
+
+// loadLocation loads an IANA time zone such as Europe/Paris. Unlike
+// time.LoadLocation, the empty name is not taken for UTC.
+func loadLocation(name string) (*time.Location, error) {
+	if name == "" {
+		return time.Local, nil
+	}
+	return time.LoadLocation(name)
+}
+
+// timeLocation returns the time zone recorded by withLocation, or the
+// server's.
+func timeLocation(ctx context.Context) *time.Location {
+	if loc, ok := ctx.Value(locationKey).(*time.Location); ok {
+		return loc
+	}
+	return time.Local
+}
+
+// now is the clock's time in the time zone of the user making r.
+func (s *server) now(r *http.Request) time.Time {
+	return s.clock.Now().In(timeLocation(r.Context()))
+}
+
+func (s *server) timezoneHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(w, http.StatusText(405), 405)
+		return
+	}
+	if !parseForm(w, r) {
+		return
+	}
+	if tz := r.FormValue("tz"); tz != "" {
+		if _, err := loadLocation(tz); err != nil {
+			warnf(r.Context(), "unknown time zone %q", tz)
+			respondError(w, r, 400)
+			return
+		}
+
+		s.setCookie(w, timezoneCookieName, tz)
+		respondOrRedirect(w, r, s.url("/"), func() {
+			w.Header().Set("HX-Refresh", "true")
+		})
+	} else {
+		http.Error(w, http.StatusText(400), 400)
+	}
+}
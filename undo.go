@@ -0,0 +1,160 @@
+package main
+
+import (
+	"context"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+)
+
+const undoSweepInterval = time.Second
+
+// pendingDeletes backs the optional undo window: a todo deleted from the
+// list is only hidden at first, and actually deleted by the sweep once its
+// window has passed without an undo.
+type pendingDeletes struct {
+	mu      sync.Mutex
+	ttl     time.Duration
+	pending map[uint64]pendingDelete
+}
+
+// pendingDelete remembers whose todo is to be deleted, for the sweep to
+// delete it on their behalf.
+type pendingDelete struct {
+	owner string
+	due   time.Time
+}
+
+func newPendingDeletes(ttl time.Duration) *pendingDeletes {
+	return &pendingDeletes{ttl: ttl, pending: make(map[uint64]pendingDelete)}
+}
+
+func (p *pendingDeletes) add(id uint64, owner string, now time.Time) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.pending[id] = pendingDelete{owner, now.Add(p.ttl)}
+}
+
+// cancel reports whether owner's delete of id was still pending, calling it
+// off.
+func (p *pendingDeletes) cancel(id uint64, owner string) bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	d, ok := p.pending[id]
+	if !ok || d.owner != owner {
+		return false
+	}
+	delete(p.pending, id)
+	return true
+}
+
+func (p *pendingDeletes) ids() []uint64 {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	ids := make([]uint64, 0, len(p.pending))
+	for id := range p.pending {
+		ids = append(ids, id)
+	}
+	return ids
+}
+
+// expired takes the deletes whose window has passed by now off the list
+// and returns them, by id. The zero time takes them all.
+func (p *pendingDeletes) expired(now time.Time) map[uint64]pendingDelete {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	taken := make(map[uint64]pendingDelete)
+	for id, d := range p.pending {
+		if now.IsZero() || !now.Before(d.due) {
+			taken[id] = d
+			delete(p.pending, id)
+		}
+	}
+	return taken
+}
+
+// pendingDeleteIds are the todos to leave out of the list while their
+// delete can still be undone.
+func (s *server) pendingDeleteIds() []uint64 {
+	if s.pendingDeletes == nil {
+		return nil
+	}
+	return s.pendingDeletes.ids()
+}
+
+// finalizeDeletes carries out the pending deletes whose undo window has
+// passed, checking every interval until ctx is done. The deletes still
+// pending then are carried out right away rather than lost.
+func (s *server) finalizeDeletes(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			s.deletePending(context.Background(), s.pendingDeletes.expired(time.Time{}))
+			return
+		case <-ticker.C:
+			s.deletePending(ctx, s.pendingDeletes.expired(s.clock.Now()))
+		}
+	}
+}
+
+func (s *server) deletePending(ctx context.Context, deletes map[uint64]pendingDelete) {
+	for id, d := range deletes {
+		ctx := context.WithValue(ctx, ownerKey, d.owner)
+		if err := s.todoService.deleteTodo(ctx, id); err != nil {
+			log.Printf("deleting todo %d after its undo window: %v", id, err)
+		}
+	}
+}
+
+// deleteWithUndo hides a todo and answers with a row offering to undo the
+// delete until the sweep carries it out.
+func (s *server) deleteWithUndo(w http.ResponseWriter, r *http.Request, id uint64) {
+	todo, err := s.todoService.getTodoById(r.Context(), id)
+	if err != nil || todo.Deleted {
+		respondError(w, r, 404)
+		return
+	}
+	s.pendingDeletes.add(id, ownerFromContext(r.Context()), s.clock.Now())
+	row := fragment{"todo-undo-item.html", todoListItem{Request: r, Todo: todo}}
+	s.respondRowRemoved(w, r, "Todo deleted", row)
+}
+
+// todoUndoHandler brings back a todo deleted from the list, whether its
+// delete is still pending or already went through.
+func (s *server) todoUndoHandler(w http.ResponseWriter, r *http.Request) {
+	if s.pendingDeletes == nil {
+		respondError(w, r, 404)
+		return
+	}
+	if r.Method != "POST" {
+		respondError(w, r, 405)
+		return
+	}
+	id, err := extractTodoId(r.URL.Path)
+	if err != nil {
+		logf(r.Context(), "extracting todo id: %v", err)
+		respondError(w, r, 500)
+		return
+	}
+	var todo *todo
+	if s.pendingDeletes.cancel(id, ownerFromContext(r.Context())) {
+		todo, err = s.todoService.getTodoById(r.Context(), id)
+	} else {
+		todo, err = s.todoService.restoreTodo(r.Context(), id)
+	}
+	if err != nil {
+		logf(r.Context(), "undoing delete: %v", err)
+		respondServiceError(w, r, err)
+		return
+	}
+	if negotiate(r) == formatJSON {
+		handleJSON(w, 200, todoJSON(todo))
+		return
+	}
+	respondOrRedirect(w, r, s.url("/todos/"), func() {
+		s.respondTodoRow(w, r, todo, "Todo restored")
+	})
+}
@@ -0,0 +1,147 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// minClientTodoId starts the range of ids clients may pick themselves when
+// creating a todo with PUT /todos/{id}/, such as an offline client that
+// needs a stable id before it can reach the server. Ids the server assigns
+// count up from 1 and never get this far, so the two never collide; a PUT
+// to an unknown id below the range is a 404 like any other request. The
+// range ends at 1<<53, past which JavaScript clients can't hold an id
+// exactly.
+const (
+	minClientTodoId = 1 << 52
+	maxClientTodoId = 1<<53 - 1
+)
+
+func isClientTodoId(id uint64) bool {
+	return id >= minClientTodoId && id <= maxClientTodoId
+}
+
+// putTodo applies update to the todo with id, or creates the todo from it
+// if the id is unused and in the client range. Like updateTodo it leaves the
+// fields the update doesn't set as they are, or empty on a new todo, which
+// needs at least its text. Repeating a put changes nothing more.
+func (s *inMemTodoService) putTodo(ctx context.Context, id uint64, update todoUpdate) (*todo, bool, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, false, err
+	}
+	if update.text != nil {
+		text, err := s.cleanText(*update.text)
+		if err != nil {
+			return nil, false, err
+		}
+		update.text = &text
+	}
+	owner := ownerFromContext(ctx)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, t := range s.todos {
+		if t.Id != id {
+			continue
+		}
+		if t.Owner != owner || t.Deleted {
+			// another owner's todo is as good as missing, and so is one in
+			// the trash until it's restored
+			return nil, false, fmt.Errorf("todo %d: %w", id, errTodoNotFound)
+		}
+		s.applyUpdate(t, update)
+		return t.clone(), false, nil
+	}
+	if !isClientTodoId(id) {
+		return nil, false, fmt.Errorf("todo %d: %w", id, errTodoNotFound)
+	}
+	if update.text == nil {
+		return nil, false, &validationError{key: "Todo text is required."}
+	}
+	if err := s.makeRoom(owner); err != nil {
+		return nil, false, err
+	}
+	s.addTodo(&todo{Id: id, Text: *update.text, Owner: owner})
+	t := s.todos[len(s.todos)-1]
+	// the rest goes in as an update, so that a todo created done gets its
+	// DoneAt and history
+	update.text = nil
+	s.applyUpdate(t, update)
+	return t.clone(), true, nil
+}
+
+// todoPutHandler creates or updates the todo at PUT /todos/{id}/, answering
+// 201 when it was created and 200 when it was updated. Only the fields in
+// the form change: text, done, recurrence, due and pinned, where an empty
+// due or recurrence clears it.
+func (s *server) todoPutHandler(w http.ResponseWriter, r *http.Request, id uint64) {
+	var update todoUpdate
+	if _, ok := r.Form["text"]; ok {
+		text := r.FormValue("text")
+		update.text = &text
+	}
+	if v := r.FormValue("done"); v != "" {
+		done, err := strconv.ParseBool(v)
+		if err != nil {
+			logf(r.Context(), "parsing done: %v", err)
+			respondError(w, r, 400)
+			return
+		}
+		update.done = &done
+	}
+	if v := r.FormValue("pinned"); v != "" {
+		pinned, err := strconv.ParseBool(v)
+		if err != nil {
+			logf(r.Context(), "parsing pinned: %v", err)
+			respondError(w, r, 400)
+			return
+		}
+		update.pinned = &pinned
+	}
+	if _, ok := r.Form["recurrence"]; ok {
+		recur, err := parseRecurrence(r.FormValue("recurrence"))
+		if err != nil {
+			logf(r.Context(), "parsing recurrence: %v", err)
+			respondServiceError(w, r, err)
+			return
+		}
+		update.recurrence = &recur
+	}
+	if _, ok := r.Form["due"]; ok {
+		var due time.Time
+		if v := r.FormValue("due"); v != "" {
+			var err error
+			if due, err = parseDue(v, timeLocation(r.Context())); err != nil {
+				logf(r.Context(), "parsing due date: %v", err)
+				respondServiceError(w, r, err)
+				return
+			}
+		}
+		update.due = &due
+	}
+	t, created, err := s.todoService.putTodo(r.Context(), id, update)
+	if err != nil {
+		logf(r.Context(), "putting todo: %v", err)
+		respondServiceError(w, r, err)
+		return
+	}
+	if negotiate(r) == formatJSON {
+		status := 200
+		if created {
+			status = 201
+		}
+		handleJSON(w, status, todoJSON(t))
+		return
+	}
+	respondOrRedirect(w, r, s.url("/todos/"), func() {
+		if created {
+			setHxTrigger(w, eventNewTodo, nil)
+			s.respondTodoRow(w, r, t, "Todo added")
+			return
+		}
+		setHxTrigger(w, eventTodoUpdated, todoEventPayload{t.Id})
+		s.respondTodoRow(w, r, t, "Todo updated")
+	})
+}
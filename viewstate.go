@@ -0,0 +1,68 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+	"net/url"
+)
+
+// viewStateParam carries the whole todo list selection, the listQueryKeys
+// parameters, in one compact value so a view can be shared as a short
+// link. ("view" already picks between the list and grouped pages.)
+const viewStateParam = "state"
+
+// encodeViewState packs the list parameters of query into a URL-safe
+// string, or returns "" when there are none.
+func encodeViewState(query url.Values) string {
+	state := map[string]string{}
+	for _, key := range listQueryKeys {
+		if v := query.Get(key); v != "" {
+			state[key] = v
+		}
+	}
+	if len(state) == 0 {
+		return ""
+	}
+	b, err := json.Marshal(state)
+	if err != nil {
+		// a map of strings always marshals
+		panic(err)
+	}
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+// decodeViewState unpacks a string made by encodeViewState, dropping any
+// parameters that don't select the list.
+func decodeViewState(v string) (url.Values, error) {
+	b, err := base64.RawURLEncoding.DecodeString(v)
+	if err != nil {
+		return nil, err
+	}
+	var state map[string]string
+	if err := json.Unmarshal(b, &state); err != nil {
+		return nil, err
+	}
+	query := url.Values{}
+	for _, key := range listQueryKeys {
+		if v := state[key]; v != "" {
+			query.Set(key, v)
+		}
+	}
+	return query, nil
+}
+
+// viewState returns the list parameters packed in r's state parameter, or
+// none if it is missing or malformed.
+func viewState(r *http.Request) url.Values {
+	v := r.FormValue(viewStateParam)
+	if v == "" {
+		return url.Values{}
+	}
+	query, err := decodeViewState(v)
+	if err != nil {
+		warnf(r.Context(), "invalid %s value %q: %v", viewStateParam, v, err)
+		return url.Values{}
+	}
+	return query
+}
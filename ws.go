@@ -0,0 +1,194 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gorilla/websocket"
+)
+
+const (
+	wsWriteWait    = 10 * time.Second
+	wsPongWait     = 60 * time.Second
+	wsPingInterval = wsPongWait * 9 / 10
+)
+
+// The default origin check only accepts same-host connections, which keeps
+// other sites from sending commands with the user's cookies.
+var wsUpgrader = websocket.Upgrader{
+	ReadBufferSize:  1024,
+	WriteBufferSize: 4096,
+}
+
+// wsCommand is what htmx's ws-send posts: the triggering element's form
+// values as JSON.
+type wsCommand struct {
+	Command string `json:"command"`
+	Id      string `json:"id"`
+}
+
+// detachedContext keeps a request's values but not its cancellation, for
+// work that outlives the request, such as a websocket outliving the request
+// timeout.
+type detachedContext struct {
+	context.Context
+}
+
+func (detachedContext) Deadline() (time.Time, bool) { return time.Time{}, false }
+func (detachedContext) Done() <-chan struct{}       { return nil }
+func (detachedContext) Err() error                  { return nil }
+
+// todoWebSocketHandler pushes the re-rendered todo list, with the filters
+// from the connection URL, whenever a todo changes, for htmx's ws extension
+// to swap in by id. It also accepts toggle and delete commands.
+func (s *server) todoWebSocketHandler(w http.ResponseWriter, r *http.Request) {
+	if s.changes == nil {
+		respondError(w, r, 404)
+		return
+	}
+	// subscribing first, so no change made once the client has the
+	// connection goes unsent
+	changed := s.changes.subscribe()
+	defer s.changes.unsubscribe(changed)
+	conn, err := wsUpgrader.Upgrade(w, r, nil)
+	if err != nil {
+		// the upgrader has already responded
+		logf(r.Context(), "upgrading to websocket: %v", err)
+		return
+	}
+	defer conn.Close()
+	r = r.WithContext(detachedContext{r.Context()})
+
+	commands := make(chan wsCommand)
+	readerDone := make(chan struct{})
+	quit := make(chan struct{})
+	defer close(quit)
+	go func() {
+		defer close(readerDone)
+		conn.SetReadLimit(4096)
+		conn.SetReadDeadline(time.Now().Add(wsPongWait))
+		conn.SetPongHandler(func(string) error {
+			return conn.SetReadDeadline(time.Now().Add(wsPongWait))
+		})
+		for {
+			var cmd wsCommand
+			if err := conn.ReadJSON(&cmd); err != nil {
+				if !websocket.IsCloseError(err, websocket.CloseNormalClosure, websocket.CloseGoingAway) {
+					logf(r.Context(), "reading websocket: %v", err)
+				}
+				return
+			}
+			select {
+			case commands <- cmd:
+			case <-quit:
+				return
+			}
+		}
+	}()
+
+	ping := time.NewTicker(wsPingInterval)
+	defer ping.Stop()
+	for {
+		select {
+		case <-readerDone:
+			return
+		case cmd := <-commands:
+			if err := s.applyWebSocketCommand(conn, r, cmd); err != nil {
+				logf(r.Context(), "writing websocket: %v", err)
+				return
+			}
+		case <-changed:
+			if err := s.writeTodoList(conn, r); err != nil {
+				logf(r.Context(), "writing websocket: %v", err)
+				return
+			}
+		case <-ping.C:
+			conn.SetWriteDeadline(time.Now().Add(wsWriteWait))
+			if err := conn.WriteMessage(websocket.PingMessage, nil); err != nil {
+				return
+			}
+		}
+	}
+}
+
+// applyWebSocketCommand carries out a command unless changes are turned
+// away, like withMaintenance does for the HTTP requests making them: a
+// websocket opened before maintenance started stays open. Deletes go
+// through the same confirmation and undo window as over HTTP. The error is
+// from writing to conn; failed commands are only logged.
+func (s *server) applyWebSocketCommand(conn *websocket.Conn, r *http.Request, cmd wsCommand) error {
+	if s.readOnly {
+		return nil
+	}
+	if s.maintenanceMode() != maintenanceOff {
+		logf(r.Context(), "ignoring websocket %s command during maintenance", cmd.Command)
+		return nil
+	}
+	id, err := strconv.ParseUint(cmd.Id, 10, 64)
+	if err != nil {
+		logf(r.Context(), "parsing websocket command id %q: %v", cmd.Id, err)
+		return nil
+	}
+	switch cmd.Command {
+	case "toggle":
+		t, err := s.todoService.getTodoById(r.Context(), id)
+		if err != nil {
+			logf(r.Context(), "getting todo by id: %v", err)
+			return nil
+		}
+		done := !t.Done
+		_, err = s.todoService.updateTodo(r.Context(), id, todoUpdate{done: &done})
+		if err != nil {
+			logf(r.Context(), "updating todo: %v", err)
+		}
+	case "delete":
+		switch {
+		case s.deleteTokens != nil:
+			// confirming takes the HTTP round trip through the confirm page
+			logf(r.Context(), "ignoring websocket delete of todo %d: deletes need confirming", id)
+		case s.pendingDeletes != nil:
+			return s.writeUndoRow(conn, r, id)
+		default:
+			if err := s.todoService.deleteTodo(r.Context(), id); err != nil {
+				logf(r.Context(), "deleting todo: %v", err)
+			}
+		}
+	default:
+		logf(r.Context(), "unknown websocket command %q", cmd.Command)
+	}
+	return nil
+}
+
+// writeUndoRow starts the undo window for a delete, like deleteWithUndo,
+// and sends the undo row in place of the todo's.
+func (s *server) writeUndoRow(conn *websocket.Conn, r *http.Request, id uint64) error {
+	todo, err := s.todoService.getTodoById(r.Context(), id)
+	if err != nil || todo.Deleted {
+		logf(r.Context(), "deleting todo %d: %v", id, errTodoNotFound)
+		return nil
+	}
+	s.pendingDeletes.add(id, ownerFromContext(r.Context()), s.clock.Now())
+	var b bytes.Buffer
+	item := todoListItem{Request: r, Todo: todo}
+	if err := s.templates["todo-undo-item.html"].ExecuteTemplate(&b, "todo-undo-item.html", item); err != nil {
+		return err
+	}
+	conn.SetWriteDeadline(time.Now().Add(wsWriteWait))
+	return conn.WriteMessage(websocket.TextMessage, b.Bytes())
+}
+
+func (s *server) writeTodoList(conn *websocket.Conn, r *http.Request) error {
+	data, err := s.getTodoListPage(r)
+	if err != nil {
+		return err
+	}
+	var b bytes.Buffer
+	if err := s.templates["todo-list.html"].ExecuteTemplate(&b, "todo-list.html", data); err != nil {
+		return err
+	}
+	conn.SetWriteDeadline(time.Now().Add(wsWriteWait))
+	return conn.WriteMessage(websocket.TextMessage, b.Bytes())
+}